@@ -0,0 +1,50 @@
+package api
+
+// BatchRequest is the body of POST /v2/batch: one function, built once and
+// run with each of Inputs as its standard input.
+type BatchRequest struct {
+	FnName       string `json:"fnName"`
+	DockerFile   string `json:"dockerFile"`
+	BuildContext Bytes  `json:"buildContext"`
+	// Inputs are passed to the function as standard input, one per run
+	Inputs []Bytes `json:"inputs"`
+	// TimeoutSeconds is how long each run may take before it's killed
+	TimeoutSeconds float64 `json:"timeoutSeconds"`
+	// Parallelism is how many inputs may run at once. It defaults to (and
+	// can't exceed) the number of slots.
+	Parallelism int `json:"parallelism,omitempty"`
+	// Env is set in the function's environment for every run
+	Env []EnvVar `json:"env,omitempty"`
+	// SecurityProfile names one of the server's security profiles, which
+	// makes the function's containers more restricted
+	SecurityProfile string `json:"securityProfile,omitempty"`
+	// Network is "none", "isolated", or one of the server's allowed
+	// networks. If it's empty, the server's default is used.
+	Network string `json:"network,omitempty"`
+}
+
+// BatchResult is the outcome of running one input. As with ExecResponse,
+// ExitCode is null if the function didn't finish.
+type BatchResult struct {
+	ExitCode   *int    `json:"exitCode"`
+	Stdout     Bytes   `json:"stdout"`
+	Stderr     Bytes   `json:"stderr"`
+	RunSeconds float64 `json:"runSeconds"`
+	Usage      Usage   `json:"usage"`
+	Errors     []Error `json:"errors"`
+}
+
+// BatchResponse is the body of every /v2/batch response. Results has one
+// entry per input, in the same order, unless the function couldn't be
+// built; Errors only describes the build and cleanup.
+type BatchResponse struct {
+	RequestID    string        `json:"requestId"`
+	Image        string        `json:"image"`
+	Build        BuildOutput   `json:"build"`
+	BuildSeconds float64       `json:"buildSeconds"`
+	Results      []BatchResult `json:"results"`
+	// Usage is the total for every input
+	Usage   Usage   `json:"usage"`
+	Cleanup Bytes   `json:"cleanup"`
+	Errors  []Error `json:"errors"`
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// Bytes is binary data (e.g. stdout), which is always encoded in JSON as a
+// base64 string. Unlike []byte, an empty or nil value encodes as "" rather
+// than null.
+type Bytes []byte
+
+// MarshalJSON implements json.Marshaler.
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.StdEncoding.EncodeToString(b))
+}
+
+// UnmarshalJSON implements json.Unmarshaler. null decodes as empty.
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*b = Bytes{}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
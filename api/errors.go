@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Phase is the stage of an invocation in which an error happened.
+type Phase string
+
+const (
+	// PhaseDecode covers reading and validating the request.
+	PhaseDecode Phase = "decode"
+	// PhaseAdmission covers quotas and other checks made before any work.
+	PhaseAdmission Phase = "admission"
+	// PhaseUnpack covers preparing the build context.
+	PhaseUnpack Phase = "unpack"
+	// PhaseBuild covers `docker build`.
+	PhaseBuild Phase = "build"
+	// PhaseRun covers running the function's container.
+	PhaseRun Phase = "run"
+	// PhaseCleanup covers removing the image and build context.
+	PhaseCleanup Phase = "cleanup"
+	// PhaseServer covers problems with Functron itself.
+	PhaseServer Phase = "server"
+)
+
+// ErrorCode is a machine-readable description of what went wrong.
+type ErrorCode string
+
+const (
+	ErrMethodNotAllowed ErrorCode = "method_not_allowed"
+	ErrNotFound         ErrorCode = "not_found"
+	ErrInvalidRequest   ErrorCode = "invalid_request"
+	ErrConflict         ErrorCode = "conflict"
+	ErrBodyMissing      ErrorCode = "body_missing"
+	ErrInvalidJSON      ErrorCode = "invalid_json"
+	ErrInvalidTimeout   ErrorCode = "invalid_timeout"
+	ErrPolicyViolation  ErrorCode = "policy_violation"
+	ErrQuotaExceeded    ErrorCode = "quota_exceeded"
+	ErrContextTooLarge  ErrorCode = "build_context_too_large"
+	ErrWorkspace        ErrorCode = "workspace_unavailable"
+	ErrInvalidContext   ErrorCode = "invalid_build_context"
+	ErrBuildFailed      ErrorCode = "build_failed"
+	ErrRunFailed        ErrorCode = "run_failed"
+	ErrTimeout          ErrorCode = "timeout"
+	ErrNonZeroExit      ErrorCode = "nonzero_exit"
+	ErrCleanupFailed    ErrorCode = "cleanup_failed"
+	ErrInternal         ErrorCode = "internal"
+)
+
+// phases groups each ErrorCode under the Phase it can happen in.
+var phases = map[ErrorCode]Phase{
+	ErrMethodNotAllowed: PhaseDecode,
+	ErrNotFound:         PhaseDecode,
+	ErrInvalidRequest:   PhaseDecode,
+	ErrConflict:         PhaseDecode,
+	ErrBodyMissing:      PhaseDecode,
+	ErrInvalidJSON:      PhaseDecode,
+	ErrInvalidTimeout:   PhaseDecode,
+	ErrPolicyViolation:  PhaseDecode,
+	ErrQuotaExceeded:    PhaseAdmission,
+	ErrContextTooLarge:  PhaseAdmission,
+	ErrWorkspace:        PhaseUnpack,
+	ErrInvalidContext:   PhaseUnpack,
+	ErrBuildFailed:      PhaseBuild,
+	ErrRunFailed:        PhaseRun,
+	ErrTimeout:          PhaseRun,
+	ErrNonZeroExit:      PhaseRun,
+	ErrCleanupFailed:    PhaseCleanup,
+	ErrInternal:         PhaseServer,
+}
+
+// Phase returns the phase which c belongs to.
+func (c ErrorCode) Phase() Phase {
+	if p, ok := phases[c]; ok {
+		return p
+	}
+	return PhaseServer
+}
+
+// PolicyViolation is a way in which a Dockerfile broke the server's policy.
+type PolicyViolation struct {
+	Line        int    `json:"line"`
+	Instruction string `json:"instruction,omitempty"`
+	Rule        string `json:"rule"`
+	Message     string `json:"message"`
+}
+
+// Error describes one thing which went wrong with a request.
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Phase   Phase     `json:"phase"`
+	Message string    `json:"message"`
+
+	// PolicyViolations is set for ErrPolicyViolation
+	PolicyViolations []PolicyViolation `json:"policyViolations,omitempty"`
+	// Limit and RetryAfterSeconds are set for ErrQuotaExceeded
+	Limit             string `json:"limit,omitempty"`
+	RetryAfterSeconds int    `json:"retryAfterSeconds,omitempty"`
+}
+
+// NewError creates an Error, filling in its phase from code.
+func NewError(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Phase: code.Phase(), Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Phase, e.Code, e.Message)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. As well as objects, it accepts
+// the plain strings which v1 endpoints (and authentication) report, which
+// become an Error with only a Message.
+func (e *Error) UnmarshalJSON(data []byte) error {
+	var message string
+	if err := json.Unmarshal(data, &message); err == nil {
+		*e = Error{Message: message}
+		return nil
+	}
+	type plain Error
+	return json.Unmarshal(data, (*plain)(e))
+}
+
+// ErrorResponse is the body of an error response from any v2 endpoint
+// other than exec, which always responds with an ExecResponse.
+type ErrorResponse struct {
+	Errors []Error `json:"errors"`
+}
@@ -0,0 +1,65 @@
+// Package api defines the typed requests and responses of Functron's v2
+// HTTP API, which are shared by the server and its Go client.
+package api
+
+// ExecRequest is the body of POST /v2/exec.
+type ExecRequest struct {
+	// FnName identifies the function, e.g. in metrics and image names
+	FnName string `json:"fnName"`
+	// DockerFile is the text of the Dockerfile to build
+	DockerFile string `json:"dockerFile"`
+	// BuildContext is a tar file, unpacked at /data inside the container
+	BuildContext Bytes `json:"buildContext"`
+	// Stdin is passed to the function as standard input
+	Stdin Bytes `json:"stdin"`
+	// TimeoutSeconds is how long the function may run before it's killed
+	TimeoutSeconds float64 `json:"timeoutSeconds"`
+	// Env is set in the function's environment
+	Env []EnvVar `json:"env,omitempty"`
+	// SecurityProfile names one of the server's security profiles, which
+	// makes the function's container more restricted
+	SecurityProfile string `json:"securityProfile,omitempty"`
+	// Network is "none", "isolated", or one of the server's allowed
+	// networks. If it's empty, the server's default is used.
+	Network string `json:"network,omitempty"`
+}
+
+// BuildOutput is what `docker build` printed.
+type BuildOutput struct {
+	Stdout Bytes `json:"stdout"`
+	Stderr Bytes `json:"stderr"`
+}
+
+// Timings reports how long each phase took.
+type Timings struct {
+	BuildSeconds float64 `json:"buildSeconds"`
+	RunSeconds   float64 `json:"runSeconds"`
+}
+
+// Usage reports what a function's containers used. It's sampled while
+// they run, so a container which only runs briefly may report less than it
+// used.
+type Usage struct {
+	CPUSeconds      float64 `json:"cpuSeconds"`
+	MemoryPeakBytes int64   `json:"memoryPeakBytes"`
+	BlockReadBytes  int64   `json:"blockReadBytes"`
+	BlockWriteBytes int64   `json:"blockWriteBytes"`
+	NetworkRxBytes  int64   `json:"networkRxBytes"`
+	NetworkTxBytes  int64   `json:"networkTxBytes"`
+}
+
+// ExecResponse is the body of every /v2/exec response. Fields are always
+// present: binary data is base64-encoded ("" if empty), Errors is [] if
+// nothing went wrong, and ExitCode is null if the function didn't finish.
+type ExecResponse struct {
+	RequestID string      `json:"requestId"`
+	Image     string      `json:"image"`
+	ExitCode  *int        `json:"exitCode"`
+	Stdout    Bytes       `json:"stdout"`
+	Stderr    Bytes       `json:"stderr"`
+	Build     BuildOutput `json:"build"`
+	Cleanup   Bytes       `json:"cleanup"`
+	Timings   Timings     `json:"timings"`
+	Usage     Usage       `json:"usage"`
+	Errors    []Error     `json:"errors"`
+}
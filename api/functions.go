@@ -0,0 +1,54 @@
+package api
+
+import "time"
+
+// RegisterFunctionRequest is the body of POST /v2/functions.
+type RegisterFunctionRequest struct {
+	// Name must be lowercase letters, digits, '.', '_' and '-'
+	Name         string `json:"name"`
+	DockerFile   string `json:"dockerFile"`
+	BuildContext Bytes  `json:"buildContext"`
+	// TimeoutSeconds is used when an invocation doesn't specify one
+	TimeoutSeconds float64 `json:"timeoutSeconds"`
+	// Weight is the function's share of its tenant's slots, relative to
+	// the tenant's other functions, when they're contended. 1 by default.
+	Weight float64 `json:"weight,omitempty"`
+	// Env is set in the function's environment whenever it's invoked
+	Env []EnvVar `json:"env,omitempty"`
+	// SecurityProfile names one of the server's security profiles, which
+	// makes the function's containers more restricted
+	SecurityProfile string `json:"securityProfile,omitempty"`
+	// Network is "none", "isolated", or one of the server's allowed
+	// networks. If it's empty, the server's default is used.
+	Network string `json:"network,omitempty"`
+}
+
+// Function describes a registered function.
+type Function struct {
+	Name              string    `json:"name"`
+	DockerFile        string    `json:"dockerFile"`
+	BuildContextBytes int       `json:"buildContextBytes"`
+	TimeoutSeconds    float64   `json:"timeoutSeconds"`
+	Weight            float64   `json:"weight"`
+	Env               []EnvVar  `json:"env"`
+	SecurityProfile   string    `json:"securityProfile,omitempty"`
+	Network           string    `json:"network,omitempty"`
+	Created           time.Time `json:"created"`
+	Updated           time.Time `json:"updated"`
+}
+
+// FunctionList is the body of GET /v2/functions.
+type FunctionList struct {
+	Functions []Function `json:"functions"`
+}
+
+// InvokeRequest is the body of POST /v2/functions/{name}/invoke, which
+// responds with an ExecResponse.
+type InvokeRequest struct {
+	Stdin Bytes `json:"stdin"`
+	// TimeoutSeconds overrides the function's timeout, if set
+	TimeoutSeconds float64 `json:"timeoutSeconds,omitempty"`
+	// Env is added to the function's environment, replacing any variables
+	// it declares with the same names
+	Env []EnvVar `json:"env,omitempty"`
+}
@@ -0,0 +1,80 @@
+package api
+
+import "time"
+
+// Image describes an image which Functron keeps between invocations.
+type Image struct {
+	Name             string     `json:"name"`
+	Status           string     `json:"status"`
+	Created          time.Time  `json:"created"`
+	Finished         *time.Time `json:"finished"`
+	ScheduledRemoval *time.Time `json:"scheduledRemoval"`
+	// Pinned images are never removed automatically
+	Pinned bool `json:"pinned"`
+}
+
+// ImageChange describes a change made to an image through the API.
+type ImageChange struct {
+	Change   string    `json:"change"`
+	Detail   string    `json:"detail,omitempty"`
+	APIKeyId *int64    `json:"apiKeyId,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// ImageDetail is the body of GET and PATCH /v2/images/{name}.
+type ImageDetail struct {
+	Image
+	// Changes made to the image, oldest first
+	Changes []ImageChange `json:"changes"`
+}
+
+// ImageTransition is a change to an image's status. From is empty for the
+// image's first status.
+type ImageTransition struct {
+	From    string    `json:"from,omitempty"`
+	To      string    `json:"to"`
+	Message string    `json:"message,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// ImageTimeline is the body of GET /v2/images/{name}/history.
+type ImageTimeline struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Transitions lists every change to the image's status, oldest first
+	Transitions []ImageTransition `json:"transitions"`
+}
+
+// UpdateImageRequest is the body of PATCH /v2/images/{name}. Fields which
+// are left out aren't changed.
+type UpdateImageRequest struct {
+	Pinned *bool `json:"pinned"`
+	// ScheduledRemoval has to be in the future. DELETE the image to remove
+	// it now.
+	ScheduledRemoval *time.Time `json:"scheduledRemoval"`
+}
+
+// ImageList is the body of GET /v2/images.
+type ImageList struct {
+	Images []Image `json:"images"`
+}
+
+// EvictedImage describes an image which was evicted to keep within the
+// disk budget.
+type EvictedImage struct {
+	Name      string    `json:"name"`
+	SizeBytes int64     `json:"sizeBytes"`
+	LastUsed  time.Time `json:"lastUsed"`
+	Reason    string    `json:"reason"`
+}
+
+// GCResult is the body of POST /v2/images/gc.
+type GCResult struct {
+	// Removed lists the images which were removed
+	Removed []string `json:"removed"`
+	// Evicted lists the images which were evicted to keep within the disk
+	// budget
+	Evicted []EvictedImage `json:"evicted"`
+	// Errors describes images which couldn't be removed
+	Errors []Error `json:"errors"`
+}
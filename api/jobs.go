@@ -0,0 +1,89 @@
+package api
+
+import "time"
+
+// JobRequest is the body of POST /v2/jobs. It either names a registered
+// Function, or describes a one-off function with Exec.
+type JobRequest struct {
+	Function       string  `json:"function,omitempty"`
+	Stdin          Bytes   `json:"stdin"`
+	TimeoutSeconds float64 `json:"timeoutSeconds,omitempty"`
+
+	Exec *ExecRequest `json:"exec,omitempty"`
+
+	// Env is added to the environment of Function or Exec, replacing any
+	// variables they declare with the same names
+	Env []EnvVar `json:"env,omitempty"`
+
+	// Jobs with a higher Priority are run first. Jobs with the same
+	// priority run in the order they were submitted.
+	Priority int `json:"priority,omitempty"`
+
+	// CallbackURL, if set, is sent a signed WebhookPayload when the job
+	// finishes
+	CallbackURL string `json:"callbackUrl,omitempty"`
+}
+
+// JobStatus is how far a job has got.
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	// JobDead jobs ran out of attempts. They won't change any further
+	// unless they're requeued.
+	JobDead JobStatus = "dead"
+)
+
+// Finished returns true if the job won't change any further.
+func (s JobStatus) Finished() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobDead
+}
+
+// Job is an asynchronous invocation, as returned by POST /v2/jobs and
+// GET /v2/jobs/{id}.
+type Job struct {
+	ID          string     `json:"id"`
+	Function    string     `json:"function"`
+	Status      JobStatus  `json:"status"`
+	Created     time.Time  `json:"created"`
+	Started     *time.Time `json:"started"`
+	Finished    *time.Time `json:"finished"`
+	CallbackURL string     `json:"callbackUrl,omitempty"`
+	Priority    int        `json:"priority"`
+	// Attempts counts the times the job has been started. Jobs which fail
+	// because of a problem with the server, rather than the function, are
+	// attempted again until they reach MaxAttempts, and are then dead.
+	Attempts    int    `json:"attempts"`
+	MaxAttempts int    `json:"maxAttempts"`
+	LastError   string `json:"lastError,omitempty"`
+	// Result is set once the job has finished
+	Result *ExecResponse `json:"result"`
+}
+
+// JobList is the body of GET /v2/jobs.
+type JobList struct {
+	Jobs []Job `json:"jobs"`
+}
+
+// Kinds of StreamEvent.
+const (
+	EventStatus = "status"
+	EventStdout = "stdout"
+	EventStderr = "stderr"
+	EventResult = "result"
+)
+
+// StreamEvent is one line of GET /v2/jobs/{id}/stream, which sends each
+// event as a line of JSON. The stream ends after the result event.
+type StreamEvent struct {
+	Type string `json:"type"`
+	// Status is set for status events
+	Status JobStatus `json:"status,omitempty"`
+	// Data is set for stdout and stderr events
+	Data Bytes `json:"data,omitempty"`
+	// Result is set for the result event
+	Result *ExecResponse `json:"result,omitempty"`
+}
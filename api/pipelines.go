@@ -0,0 +1,35 @@
+package api
+
+// PipelineRequest is the body of POST /v2/pipelines: registered functions
+// which run one after another, each reading the previous one's output.
+type PipelineRequest struct {
+	// Functions are the names of the stages, in order
+	Functions []string `json:"functions"`
+	// Stdin is passed to the first stage as standard input
+	Stdin Bytes `json:"stdin"`
+	// TimeoutSeconds overrides each stage's timeout, if set
+	TimeoutSeconds float64 `json:"timeoutSeconds,omitempty"`
+}
+
+// PipelineStage describes how one stage of a pipeline went. A stage's
+// standard output isn't included, since it's the next stage's input.
+type PipelineStage struct {
+	Function    string  `json:"function"`
+	ExitCode    *int    `json:"exitCode"`
+	StdoutBytes int     `json:"stdoutBytes"`
+	Stderr      Bytes   `json:"stderr"`
+	Timings     Timings `json:"timings"`
+	Errors      []Error `json:"errors"`
+}
+
+// PipelineResponse is the body of every /v2/pipelines response. Stages has
+// an entry for each stage which ran. If one failed, FailedStage is its
+// index, the pipeline stopped there, and its errors are repeated in Errors.
+// Stdout is the last stage's output.
+type PipelineResponse struct {
+	RequestID   string          `json:"requestId"`
+	Stdout      Bytes           `json:"stdout"`
+	Stages      []PipelineStage `json:"stages"`
+	FailedStage *int            `json:"failedStage"`
+	Errors      []Error         `json:"errors"`
+}
@@ -0,0 +1,42 @@
+package api
+
+import "time"
+
+// ScheduleRequest is the body of POST /v2/schedules.
+type ScheduleRequest struct {
+	// Name must be lowercase letters, digits, '.', '_' and '-'
+	Name string `json:"name"`
+	// Cron is a five-field cron expression, such as "0 2 * * *", or a
+	// macro such as "@daily", in the server's time zone
+	Cron     string `json:"cron"`
+	Function string `json:"function"`
+	Stdin    Bytes  `json:"stdin"`
+	// TimeoutSeconds overrides the function's timeout, if set
+	TimeoutSeconds float64 `json:"timeoutSeconds,omitempty"`
+	// Enabled defaults to true
+	Enabled *bool `json:"enabled,omitempty"`
+	// SkipOverlapping stops a run starting while the last one's still
+	// going
+	SkipOverlapping bool `json:"skipOverlapping,omitempty"`
+}
+
+// Schedule describes a schedule. NextRun is null if it's disabled, or its
+// expression never matches.
+type Schedule struct {
+	Name            string     `json:"name"`
+	Cron            string     `json:"cron"`
+	Function        string     `json:"function"`
+	Stdin           Bytes      `json:"stdin"`
+	TimeoutSeconds  float64    `json:"timeoutSeconds"`
+	Enabled         bool       `json:"enabled"`
+	SkipOverlapping bool       `json:"skipOverlapping"`
+	Created         time.Time  `json:"created"`
+	Updated         time.Time  `json:"updated"`
+	LastRun         *time.Time `json:"lastRun"`
+	NextRun         *time.Time `json:"nextRun"`
+}
+
+// ScheduleList is the body of GET /v2/schedules.
+type ScheduleList struct {
+	Schedules []Schedule `json:"schedules"`
+}
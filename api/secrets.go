@@ -0,0 +1,29 @@
+package api
+
+import "time"
+
+// EnvVar is an environment variable for a function. It's set either to
+// Value, or to the value of the stored secret named by Secret, which is
+// redacted from the function's output.
+type EnvVar struct {
+	Name   string `json:"name"`
+	Value  string `json:"value,omitempty"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// PutSecretRequest is the body of PUT /v2/secrets/{name}.
+type PutSecretRequest struct {
+	Value string `json:"value"`
+}
+
+// Secret describes a stored secret. Its value can't be read back.
+type Secret struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// SecretList is the body of GET /v2/secrets.
+type SecretList struct {
+	Secrets []Secret `json:"secrets"`
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers sent with each webhook delivery.
+const (
+	// WebhookSignatureHeader is "sha256=" and the hex HMAC-SHA256, keyed
+	// with the API key's webhook secret, of the timestamp, a '.' and the
+	// body
+	WebhookSignatureHeader = "X-Functron-Signature"
+	// WebhookTimestampHeader is when the delivery was signed, in seconds
+	// since the Unix epoch
+	WebhookTimestampHeader = "X-Functron-Timestamp"
+	// WebhookDeliveryHeader identifies the delivery, which is the same for
+	// each attempt at it
+	WebhookDeliveryHeader = "X-Functron-Delivery"
+)
+
+// EventJobFinished is the Event of the payload delivered when a job
+// finishes.
+const EventJobFinished = "job.finished"
+
+// WebhookPayload is the body POSTed to a job's callback URL.
+type WebhookPayload struct {
+	Event string `json:"event"`
+	Job   Job    `json:"job"`
+}
+
+// WebhookSecret is the body of /v2/webhooks/secret: the secret which signs
+// deliveries for the calling key's jobs.
+type WebhookSecret struct {
+	Secret  string    `json:"secret"`
+	Created time.Time `json:"created"`
+}
+
+// WebhookAttempt is one try at a delivery. StatusCode is null if there was
+// no response.
+type WebhookAttempt struct {
+	Attempt         int       `json:"attempt"`
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	StatusCode      *int      `json:"statusCode"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// WebhookDelivery describes the delivery of a job's result to its
+// callback URL. Status is "pending", "delivered" or "failed".
+type WebhookDelivery struct {
+	ID          int64            `json:"id"`
+	URL         string           `json:"url"`
+	Status      string           `json:"status"`
+	NextAttempt *time.Time       `json:"nextAttempt"`
+	Created     time.Time        `json:"created"`
+	Finished    *time.Time       `json:"finished"`
+	Attempts    []WebhookAttempt `json:"attempts"`
+}
+
+// WebhookDeliveryList is the body of GET /v2/jobs/{id}/deliveries.
+type WebhookDeliveryList struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+// SignWebhook returns the signature of body at timestamp.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ErrBadWebhookSignature is returned by VerifyWebhook for deliveries which
+// weren't signed with the secret, or were signed too long ago.
+var ErrBadWebhookSignature = errors.New("functron: the webhook's signature is invalid")
+
+// VerifyWebhook checks that a delivery's body was signed with secret, no
+// more than tolerance ago (or in the future), to stop old deliveries being
+// replayed.
+func VerifyWebhook(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	timestamp, err := strconv.ParseInt(header.Get(WebhookTimestampHeader), 10, 64)
+	if err != nil {
+		return ErrBadWebhookSignature
+	}
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrBadWebhookSignature
+	}
+	expected := SignWebhook(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(header.Get(WebhookSignatureHeader))) {
+		return ErrBadWebhookSignature
+	}
+	return nil
+}
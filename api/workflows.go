@@ -0,0 +1,61 @@
+package api
+
+import "time"
+
+// WorkflowNode is one step of a workflow: a registered function which runs
+// once the nodes it comes After have succeeded. Its input is their
+// outputs, concatenated in order, or the workflow's Stdin if it has none.
+type WorkflowNode struct {
+	ID       string   `json:"id"`
+	Function string   `json:"function"`
+	After    []string `json:"after,omitempty"`
+	// Map runs the function once for each line of the input, and
+	// concatenates the outputs in order
+	Map bool `json:"map,omitempty"`
+}
+
+// WorkflowDefinition describes a workflow's nodes, which must form a
+// directed acyclic graph.
+type WorkflowDefinition struct {
+	Nodes []WorkflowNode `json:"nodes"`
+}
+
+// WorkflowRequest is the body of POST /v2/workflows.
+type WorkflowRequest struct {
+	WorkflowDefinition
+	Stdin Bytes `json:"stdin"`
+}
+
+// WorkflowStatus is how far a workflow, node or task has got.
+type WorkflowStatus string
+
+const (
+	WorkflowPending   WorkflowStatus = "pending"
+	WorkflowRunning   WorkflowStatus = "running"
+	WorkflowSucceeded WorkflowStatus = "succeeded"
+	WorkflowFailed    WorkflowStatus = "failed"
+	// WorkflowSkipped nodes never ran, because a node before them failed
+	WorkflowSkipped WorkflowStatus = "skipped"
+)
+
+// NodeState describes how a workflow node is getting on.
+type NodeState struct {
+	WorkflowNode
+	Status   WorkflowStatus `json:"status"`
+	Started  *time.Time     `json:"started"`
+	Finished *time.Time     `json:"finished"`
+	// Tasks counts the node's runs (one per line of input for map nodes)
+	// by status
+	Tasks  map[WorkflowStatus]int `json:"tasks"`
+	Output Bytes                  `json:"output"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+// Workflow is the body of GET /v2/workflows/{id}.
+type Workflow struct {
+	ID       string         `json:"id"`
+	Status   WorkflowStatus `json:"status"`
+	Created  time.Time      `json:"created"`
+	Finished *time.Time     `json:"finished"`
+	Nodes    []NodeState    `json:"nodes"`
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type memoryKeyStore struct {
+	keys    map[string]*models.APIKey
+	touched []int64
+}
+
+func (m *memoryKeyStore) RetrieveAPIKeyByHash(hash string) (*models.APIKey, error) {
+	if key, ok := m.keys[hash]; ok {
+		return key, nil
+	}
+	return nil, interfaces.NoMatchingAPIKey
+}
+
+func (m *memoryKeyStore) TouchAPIKey(id int64) error {
+	m.touched = append(m.touched, id)
+	return nil
+}
+
+func TestGenerateKey(t *testing.T) {
+	Convey("Generated keys should be distinct, prefixed and hash stably", t, func() {
+		a, err := GenerateKey()
+		So(err, ShouldBeNil)
+		b, err := GenerateKey()
+		So(err, ShouldBeNil)
+		So(a, ShouldNotEqual, b)
+		So(strings.HasPrefix(a, keyPrefix), ShouldBeTrue)
+		So(HashKey(a), ShouldEqual, HashKey(a))
+		So(HashKey(a), ShouldNotEqual, HashKey(b))
+		So(DisplayPrefix(a), ShouldHaveLength, displayLength)
+	})
+}
+
+func TestRequire(t *testing.T) {
+	Convey("Given a store with an exec-only key...", t, func() {
+		plaintext, _ := GenerateKey()
+		key := &models.APIKey{Id: 7, Scopes: models.Scopes{models.ScopeExec}}
+		store := &memoryKeyStore{keys: map[string]*models.APIKey{HashKey(plaintext): key}}
+		a := CreateAuthenticator(store)
+
+		var seen *models.APIKey
+		handler := func(w http.ResponseWriter, req *http.Request) {
+			seen = KeyFromContext(req.Context())
+		}
+
+		call := func(scope models.Scope, header, value string) int {
+			req := httptest.NewRequest("POST", "/v1/exec", nil)
+			if header != "" {
+				req.Header.Set(header, value)
+			}
+			w := httptest.NewRecorder()
+			a.Require(scope, handler)(w, req)
+			return w.Code
+		}
+
+		Convey("Requests without a key should get 401", func() {
+			So(call(models.ScopeExec, "", ""), ShouldEqual, http.StatusUnauthorized)
+			So(seen, ShouldBeNil)
+		})
+
+		Convey("Requests with an unknown key should get 401", func() {
+			So(call(models.ScopeExec, "Authorization", "Bearer fn_nope"), ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Requests with the key should reach the handler", func() {
+			So(call(models.ScopeExec, "Authorization", "Bearer "+plaintext), ShouldEqual, http.StatusOK)
+			So(seen, ShouldEqual, key)
+			So(store.touched, ShouldResemble, []int64{7})
+		})
+
+		Convey("The key can also be sent in X-API-Key", func() {
+			So(call(models.ScopeExec, APIKeyHeader, plaintext), ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Requests needing another scope should get 403", func() {
+			So(call(models.ScopeAdmin, APIKeyHeader, plaintext), ShouldEqual, http.StatusForbidden)
+			So(seen, ShouldBeNil)
+		})
+
+		Convey("The key can be sent in the URL only where that's allowed", func() {
+			var query string
+			handler := func(w http.ResponseWriter, req *http.Request) {
+				seen, query = KeyFromContext(req.Context()), req.URL.RawQuery
+			}
+			target := "/fn/hook?x=1&" + APIKeyParameter + "=" + plaintext
+
+			w := httptest.NewRecorder()
+			a.Require(models.ScopeExec, handler)(w, httptest.NewRequest("POST", target, nil))
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+
+			w = httptest.NewRecorder()
+			a.RequireAllowingURLKey(models.ScopeExec, handler)(w, httptest.NewRequest("POST", target, nil))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(seen, ShouldEqual, key)
+			So(query, ShouldEqual, "x=1")
+		})
+
+		Convey("Keys in URLs should be redacted for logging", func() {
+			u, _ := url.Parse("/fn/hook?x=1&" + APIKeyParameter + "=" + plaintext)
+			So(RedactURL(u), ShouldNotContainSubstring, plaintext)
+			So(RedactURL(u), ShouldContainSubstring, "x=1")
+		})
+	})
+}
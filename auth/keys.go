@@ -0,0 +1,66 @@
+// Package auth implements API key authentication for Functron's HTTP API.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/Sentimentron/functron/models"
+)
+
+// keyPrefix marks a string as a Functron API key.
+const keyPrefix = "fn_"
+
+// displayLength is how many characters of a key are kept (in the clear) so
+// that administrators can tell keys apart.
+const displayLength = len(keyPrefix) + 8
+
+// GenerateKey returns a new random API key.
+func GenerateKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return keyPrefix + hex.EncodeToString(b), nil
+}
+
+// HashKey returns the hash stored in place of a key. Keys are long and
+// random, so a plain SHA-256 is enough (a slow password hash isn't needed).
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// DisplayPrefix returns the part of a key which is safe to show.
+func DisplayPrefix(key string) string {
+	if len(key) < displayLength {
+		return key
+	}
+	return key[:displayLength]
+}
+
+// KeyIssuer persists newly-issued keys (e.g. database.Store).
+type KeyIssuer interface {
+	CreateAPIKey(key *models.APIKey) (*models.APIKey, error)
+}
+
+// IssueKey generates a key carrying scopes, optionally under a tenant, and
+// stores its hash. The returned plaintext can't be recovered later.
+func IssueKey(store KeyIssuer, name string, scopes models.Scopes, tenantId *int64) (string, *models.APIKey, error) {
+	plaintext, err := GenerateKey()
+	if err != nil {
+		return "", nil, err
+	}
+	key, err := store.CreateAPIKey(&models.APIKey{
+		Name:     name,
+		Prefix:   DisplayPrefix(plaintext),
+		Hash:     HashKey(plaintext),
+		Scopes:   scopes,
+		TenantId: tenantId,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return plaintext, key, nil
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/models"
+)
+
+// APIKeyHeader can be used instead of "Authorization: Bearer ...".
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyParameter carries the key in the URL's query string, for the
+// endpoints wrapped by RequireAllowingURLKey.
+const APIKeyParameter = "functron_key"
+
+var (
+	ErrNoKey             = errors.New("auth: no API key provided")
+	ErrInvalidKey        = errors.New("auth: invalid API key")
+	ErrInsufficientScope = errors.New("auth: API key lacks the required scope")
+)
+
+type contextKey int
+
+const apiKeyContextKey contextKey = 0
+
+// Authenticator checks the API keys presented with each request.
+type Authenticator struct {
+	store interfaces.KeyStore
+}
+
+// CreateAuthenticator returns an Authenticator which looks keys up in store.
+func CreateAuthenticator(store interfaces.KeyStore) *Authenticator {
+	return &Authenticator{store}
+}
+
+// keyFromRequest extracts the presented key from the request headers.
+func keyFromRequest(req *http.Request) string {
+	if key := req.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+	header := req.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	return ""
+}
+
+// Authenticate returns the unrevoked key presented with req.
+func (a *Authenticator) Authenticate(req *http.Request) (*models.APIKey, error) {
+	return a.authenticate(keyFromRequest(req))
+}
+
+// authenticate returns the unrevoked key matching presented.
+func (a *Authenticator) authenticate(presented string) (*models.APIKey, error) {
+	if presented == "" {
+		return nil, ErrNoKey
+	}
+
+	key, err := a.store.RetrieveAPIKeyByHash(HashKey(presented))
+	if err == interfaces.NoMatchingAPIKey {
+		return nil, ErrInvalidKey
+	} else if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Require wraps next so that it only runs for requests which present a
+// valid key carrying scope. Requests without a valid key get 401, and
+// requests whose key lacks the scope get 403. The key is available to next
+// via KeyFromContext.
+func (a *Authenticator) Require(scope models.Scope, next http.HandlerFunc) http.HandlerFunc {
+	return a.require(scope, next, false)
+}
+
+// RequireAllowingURLKey is like Require, but the key can also be sent as
+// the APIKeyParameter query parameter, for callers which can't set
+// headers. The parameter is removed from the request before next sees it.
+func (a *Authenticator) RequireAllowingURLKey(scope models.Scope, next http.HandlerFunc) http.HandlerFunc {
+	return a.require(scope, next, true)
+}
+
+func (a *Authenticator) require(scope models.Scope, next http.HandlerFunc, urlKey bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		logger := logging.FromContext(req.Context())
+
+		presented := keyFromRequest(req)
+		if urlKey {
+			var fromURL string
+			req, fromURL = withoutURLKey(req)
+			if presented == "" {
+				presented = fromURL
+			}
+		}
+		key, err := a.authenticate(presented)
+		switch err {
+		case nil:
+		case ErrNoKey, ErrInvalidKey:
+			logger.WithField("error", err).Warnf("Authentication failed")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="functron"`)
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		default:
+			logger.WithField("error", err).Errorf("Could not look up API key")
+			writeError(w, http.StatusInternalServerError, "AuthenticationUnavailable")
+			return
+		}
+
+		logger = logger.WithField("api_key_id", key.Id)
+		if !key.Scopes.Has(scope) {
+			logger.WithField("scope", scope).Warnf("API key lacks the required scope")
+			writeError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+
+		if err := a.store.TouchAPIKey(key.Id); err != nil {
+			logger.WithField("error", err).Warnf("Could not record API key use")
+		}
+
+		ctx := ContextWithKey(req.Context(), key)
+		ctx = logging.NewContext(ctx, logger)
+		next(w, req.WithContext(ctx))
+	}
+}
+
+// withoutURLKey returns a copy of req without the APIKeyParameter query
+// parameter, and the parameter's value.
+func withoutURLKey(req *http.Request) (*http.Request, string) {
+	query := req.URL.Query()
+	if _, ok := query[APIKeyParameter]; !ok {
+		return req, ""
+	}
+	presented := query.Get(APIKeyParameter)
+	query.Del(APIKeyParameter)
+
+	u := *req.URL
+	u.RawQuery = query.Encode()
+	ret := req.WithContext(req.Context())
+	ret.URL = &u
+	ret.RequestURI = u.RequestURI()
+	return ret, presented
+}
+
+// RedactURL returns u as a string, with the value of any APIKeyParameter
+// replaced, so that it can be logged.
+func RedactURL(u *url.URL) string {
+	query := u.Query()
+	if _, ok := query[APIKeyParameter]; !ok {
+		return u.String()
+	}
+	query.Set(APIKeyParameter, "[REDACTED]")
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// ContextWithKey returns a copy of ctx which carries key, e.g. so that work
+// done after a request has finished is still attributed to its key.
+func ContextWithKey(ctx context.Context, key *models.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey, key)
+}
+
+// KeyFromContext returns the API key which authenticated the request, or
+// nil if the request wasn't authenticated.
+func KeyFromContext(ctx context.Context) *models.APIKey {
+	if key, ok := ctx.Value(apiKeyContextKey).(*models.APIKey); ok {
+		return key
+	}
+	return nil
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Errors": []string{message},
+	})
+}
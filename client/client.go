@@ -0,0 +1,225 @@
+// Package client calls Functron's HTTP API from Go.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/auth"
+)
+
+// Error is returned when Functron responds with an unsuccessful status code.
+type Error struct {
+	StatusCode int
+	Errors     []api.Error
+}
+
+func (e *Error) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("functron: %s", http.StatusText(e.StatusCode))
+	}
+	messages := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		if err.Code == "" {
+			messages = append(messages, err.Message)
+		} else {
+			messages = append(messages, fmt.Sprintf("%s: %s", err.Code, err.Message))
+		}
+	}
+	return fmt.Sprintf("functron: %d: %s", e.StatusCode, strings.Join(messages, "; "))
+}
+
+// Has returns true if Functron reported code.
+func (e *Error) Has(code api.ErrorCode) bool {
+	for _, err := range e.Errors {
+		if err.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Client calls a Functron server.
+type Client struct {
+	// BaseURL is where Functron is, e.g. "http://localhost:8081"
+	BaseURL string
+	// APIKey is sent with every request
+	APIKey string
+	// HTTPClient makes the requests (http.DefaultClient by default)
+	HTTPClient *http.Client
+
+	// Retries is how many more times to try a request which Functron asks
+	// to be retried (429 or 503), or a GET or DELETE which fails to connect
+	Retries int
+	// RetryWait is how long to wait before the first retry. It doubles with
+	// each retry, unless Functron says how long to wait.
+	RetryWait time.Duration
+}
+
+// CreateClient returns a Client for the server at baseURL, which retries
+// twice.
+func CreateClient(baseURL, apiKey string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		APIKey:     apiKey,
+		HTTPClient: http.DefaultClient,
+		Retries:    2,
+		RetryWait:  500 * time.Millisecond,
+	}
+}
+
+// Ping checks that Functron is reachable.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.call(ctx, "GET", "/v1/ping", nil, nil)
+}
+
+// send makes a request, retrying if it should, and returns the response.
+// body is encoded as JSON if it isn't nil. The caller must close the
+// response's body.
+func (c *Client) send(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var encoded []byte
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	idempotent := method == "GET" || method == "DELETE"
+
+	wait := c.RetryWait
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, c.BaseURL+path, bytes.NewReader(encoded))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.APIKey != "" {
+			req.Header.Set(auth.APIKeyHeader, c.APIKey)
+		}
+
+		resp, err := c.httpClient().Do(req)
+		retry := false
+		switch {
+		case err != nil:
+			retry = idempotent && ctx.Err() == nil
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+			retry = true
+			if seconds, parseErr := strconv.Atoi(resp.Header.Get("Retry-After")); parseErr == nil && seconds > 0 {
+				wait = time.Duration(seconds) * time.Second
+			}
+		}
+		if !retry || attempt >= c.Retries {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// call makes a request, decoding a successful response into out (if it
+// isn't nil), or returning an *Error.
+func (c *Client) call(ctx context.Context, method, path string, body, out interface{}) error {
+	resp, err := c.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// decodeError describes an unsuccessful response.
+func decodeError(resp *http.Response) error {
+	var body api.ErrorResponse
+	json.NewDecoder(resp.Body).Decode(&body)
+	return &Error{StatusCode: resp.StatusCode, Errors: body.Errors}
+}
+
+// callReporting makes a POST request whose response describes what went
+// wrong as well as what went right, decoding it into out even if there was
+// an error. errors returns the errors which out reports. The returned bool
+// says whether out was decoded.
+func (c *Client) callReporting(ctx context.Context, path string, body, out interface{}, errors func() []api.Error) (bool, error) {
+	resp, err := c.send(ctx, "POST", path, body)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		if resp.StatusCode >= 300 {
+			return false, &Error{StatusCode: resp.StatusCode}
+		}
+		return false, err
+	}
+	if resp.StatusCode >= 300 {
+		return true, &Error{StatusCode: resp.StatusCode, Errors: errors()}
+	}
+	return true, nil
+}
+
+// callExec makes a request which responds with an api.ExecResponse. The
+// response is returned even if there was an error (e.g. a failed build),
+// since it describes what went wrong.
+func (c *Client) callExec(ctx context.Context, path string, body interface{}) (*api.ExecResponse, error) {
+	var out api.ExecResponse
+	decoded, err := c.callReporting(ctx, path, body, &out, func() []api.Error { return out.Errors })
+	if !decoded {
+		return nil, err
+	}
+	return &out, err
+}
+
+// Exec builds and runs a one-off function. If the function ran but exited
+// with a non-zero status, there's no error, but the response's Errors say
+// so.
+func (c *Client) Exec(ctx context.Context, req *api.ExecRequest) (*api.ExecResponse, error) {
+	return c.callExec(ctx, "/v2/exec", req)
+}
+
+// Batch builds a function once and runs it with each of req's inputs. The
+// response has one result per input, in order; inputs which fail don't
+// make Batch return an error. As with Exec, the response is returned
+// alongside an error if it describes what went wrong.
+func (c *Client) Batch(ctx context.Context, req *api.BatchRequest) (*api.BatchResponse, error) {
+	var out api.BatchResponse
+	decoded, err := c.callReporting(ctx, "/v2/batch", req, &out, func() []api.Error { return out.Errors })
+	if !decoded {
+		return nil, err
+	}
+	return &out, err
+}
@@ -0,0 +1,489 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/auth"
+	"github.com/Sentimentron/functron/configuration"
+	"github.com/Sentimentron/functron/database"
+	"github.com/Sentimentron/functron/docker/dockertest"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/models"
+	"github.com/Sentimentron/functron/server"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// createTestServer starts a Functron server backed by runtime, and returns
+// a client which can use it.
+func createTestServer(runtime *dockertest.FakeRuntime) (*httptest.Server, *Client) {
+	tmpFile, err := ioutil.TempFile("", "functronclient")
+	So(err, ShouldBeNil)
+	os.Remove(tmpFile.Name())
+	store, err := database.CreateStore(tmpFile.Name())
+	So(err, ShouldBeNil)
+
+	key, _, err := auth.IssueKey(store, "tests", models.AllScopes, nil)
+	So(err, ShouldBeNil)
+
+	c := &configuration.Configuration{
+		DockerfilePolicy: &configuration.DefaultDockerfilePolicy,
+		SecretsKey:       base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)),
+		// Callbacks are sent to receivers on the loopback interface
+		Webhooks: configuration.WebhookConfig{AllowPrivateAddresses: true},
+	}
+	srv := server.CreateServer(c, store, runtime)
+	go srv.RunQueue(context.Background())
+	ts := httptest.NewServer(srv.Handler())
+	return ts, CreateClient(ts.URL, key)
+}
+
+// writeFunction writes a Dockerfile and a script into a new directory,
+// returning the Dockerfile's path.
+func writeFunction() string {
+	dir, err := ioutil.TempDir("", "functronfn")
+	So(err, ShouldBeNil)
+	So(ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM alpine\nCMD sh /data/main.sh\n"), 0644), ShouldBeNil)
+	So(os.Mkdir(filepath.Join(dir, "lib"), 0755), ShouldBeNil)
+	So(ioutil.WriteFile(filepath.Join(dir, "lib", "main.sh"), []byte("cat\n"), 0644), ShouldBeNil)
+	return filepath.Join(dir, "Dockerfile")
+}
+
+func TestPackDirectory(t *testing.T) {
+	Convey("Packing a directory should produce a tar file with relative paths", t, func() {
+		path := writeFunction()
+		packed, err := PackDirectory(filepath.Dir(path))
+		So(err, ShouldBeNil)
+
+		names := make([]string, 0)
+		tr := tar.NewReader(bytes.NewReader(packed))
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			So(err, ShouldBeNil)
+			names = append(names, header.Name)
+		}
+		So(names, ShouldResemble, []string{"Dockerfile", "lib/", "lib/main.sh"})
+	})
+}
+
+func TestClient(t *testing.T) {
+	Convey("Given a server with a fake runtime...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		ts, c := createTestServer(runtime)
+		defer ts.Close()
+		ctx := context.Background()
+
+		req, err := RequestFromDockerfile(writeFunction(), "echo", 5*time.Second)
+		So(err, ShouldBeNil)
+		req.Stdin = []byte("hello")
+
+		Convey("Should be able to ping the server...", func() {
+			So(c.Ping(ctx), ShouldBeNil)
+		})
+
+		Convey("Exec should return the function's output...", func() {
+			out, err := c.Exec(ctx, req)
+			So(err, ShouldBeNil)
+			So(string(out.Stdout), ShouldEqual, "hello")
+			So(runtime.Dockerfiles[out.Image], ShouldEqual, req.DockerFile)
+		})
+
+		Convey("A failed build should return both the response and an error...", func() {
+			runtime.FailBuild = true
+			out, err := c.Exec(ctx, req)
+			So(err, ShouldHaveSameTypeAs, &Error{})
+			So(err.(*Error).StatusCode, ShouldEqual, http.StatusUnprocessableEntity)
+			So(err.(*Error).Has(api.ErrBuildFailed), ShouldBeTrue)
+			So(string(out.Build.Stderr), ShouldEqual, "build failed\n")
+		})
+
+		Convey("An invalid key should be reported...", func() {
+			c.APIKey = "fn_nope"
+			_, err := c.Exec(ctx, req)
+			So(err.(*Error).StatusCode, ShouldEqual, http.StatusUnauthorized)
+			So(err.Error(), ShouldContainSubstring, "Unauthorized")
+		})
+
+		Convey("Cancelling the context should stop the call...", func() {
+			runtime.RunFunc = dockertest.Sleep
+			ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer cancel()
+			_, err := c.Exec(ctx, req)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Jobs which keep failing to run should be dead until they're requeued...", func() {
+			var down int32 = 1
+			runtime.RunFunc = func(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+				if atomic.LoadInt32(&down) == 1 {
+					return -1, errors.New("the runtime is down")
+				}
+				return dockertest.Cat(ctx, spec)
+			}
+			waitForJob := func(id string) *api.Job {
+				for i := 0; i < 100; i++ {
+					job, err := c.Job(ctx, id)
+					So(err, ShouldBeNil)
+					if job.Status.Finished() {
+						return job
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				return nil
+			}
+
+			job, err := c.SubmitJob(ctx, &api.JobRequest{Exec: req})
+			So(err, ShouldBeNil)
+			job = waitForJob(job.ID)
+			So(job.Status, ShouldEqual, api.JobDead)
+			So(job.Attempts, ShouldEqual, 3)
+			So(job.LastError, ShouldContainSubstring, "the runtime is down")
+
+			dead, err := c.Jobs(ctx, api.JobDead)
+			So(err, ShouldBeNil)
+			So(dead, ShouldHaveLength, 1)
+			So(dead[0].ID, ShouldEqual, job.ID)
+
+			atomic.StoreInt32(&down, 0)
+			requeued, err := c.RequeueJob(ctx, job.ID)
+			So(err, ShouldBeNil)
+			So(requeued.Status, ShouldNotEqual, api.JobDead)
+			job = waitForJob(job.ID)
+			So(job.Status, ShouldEqual, api.JobSucceeded)
+			So(string(job.Result.Stdout), ShouldEqual, "hello")
+
+			_, err = c.RequeueJob(ctx, job.ID)
+			So(err.(*Error).StatusCode, ShouldEqual, http.StatusBadRequest)
+			dead, err = c.Jobs(ctx, api.JobDead)
+			So(err, ShouldBeNil)
+			So(dead, ShouldBeEmpty)
+		})
+
+		Convey("Secrets should be given to functions, and redacted from their output...", func() {
+			secret, err := c.PutSecret(ctx, "token", "hunter2")
+			So(err, ShouldBeNil)
+			So(secret.Name, ShouldEqual, "token")
+
+			runtime.RunFunc = func(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+				fmt.Fprint(spec.Stdout, strings.Join(spec.Env, ","))
+				return 0, nil
+			}
+			_, err = c.RegisterFunction(ctx, &api.RegisterFunctionRequest{
+				Name:           "env",
+				DockerFile:     req.DockerFile,
+				BuildContext:   req.BuildContext,
+				TimeoutSeconds: 5,
+				Env:            []api.EnvVar{{Name: "TOKEN", Secret: "token"}, {Name: "MODE", Value: "test"}},
+			})
+			So(err, ShouldBeNil)
+			out, err := c.Invoke(ctx, "env", nil)
+			So(err, ShouldBeNil)
+			So(string(out.Stdout), ShouldEqual, "TOKEN=[REDACTED],MODE=test")
+
+			secrets, err := c.Secrets(ctx)
+			So(err, ShouldBeNil)
+			So(secrets, ShouldHaveLength, 1)
+
+			So(c.DeleteSecret(ctx, "token"), ShouldBeNil)
+			_, err = c.Invoke(ctx, "env", nil)
+			So(err.(*Error).StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Should be able to list images and collect garbage...", func() {
+			images, err := c.Images(ctx)
+			So(err, ShouldBeNil)
+			So(images, ShouldHaveLength, 0)
+			result, err := c.CollectGarbage(ctx)
+			So(err, ShouldBeNil)
+			So(result.Removed, ShouldHaveLength, 0)
+			So(result.Errors, ShouldHaveLength, 0)
+		})
+
+		Convey("Should be able to register a function...", func() {
+			fn, err := c.RegisterFunction(ctx, &api.RegisterFunctionRequest{
+				Name:           "echo",
+				DockerFile:     req.DockerFile,
+				BuildContext:   req.BuildContext,
+				TimeoutSeconds: 5,
+			})
+			So(err, ShouldBeNil)
+			So(fn.BuildContextBytes, ShouldEqual, len(req.BuildContext))
+
+			Convey("It should be listed...", func() {
+				functions, err := c.Functions(ctx)
+				So(err, ShouldBeNil)
+				So(functions, ShouldHaveLength, 1)
+				So(functions[0].Name, ShouldEqual, "echo")
+			})
+
+			Convey("It should be invokable...", func() {
+				out, err := c.Invoke(ctx, "echo", &api.InvokeRequest{Stdin: []byte("hi")})
+				So(err, ShouldBeNil)
+				So(string(out.Stdout), ShouldEqual, "hi")
+			})
+
+			Convey("It should run as a job, whose output can be streamed...", func() {
+				job, err := c.SubmitJob(ctx, &api.JobRequest{Function: "echo", Stdin: []byte("streamed")})
+				So(err, ShouldBeNil)
+				So(job.ID, ShouldNotEqual, "")
+
+				var stdout bytes.Buffer
+				result, err := c.StreamJob(ctx, job.ID, func(e api.StreamEvent) error {
+					if e.Type == api.EventStdout {
+						stdout.Write(e.Data)
+					}
+					return nil
+				})
+				So(err, ShouldBeNil)
+				So(stdout.String(), ShouldEqual, "streamed")
+				So(string(result.Stdout), ShouldEqual, "streamed")
+
+				job, err = c.Job(ctx, job.ID)
+				So(err, ShouldBeNil)
+				So(job.Status, ShouldEqual, api.JobSucceeded)
+			})
+
+			Convey("A job's result should be delivered to its callback URL, signed...", func() {
+				secret, err := c.WebhookSecret(ctx)
+				So(err, ShouldBeNil)
+				So(secret.Secret, ShouldStartWith, "whsec_")
+
+				received := make(chan api.WebhookPayload, 1)
+				receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					body, _ := ioutil.ReadAll(r.Body)
+					if api.VerifyWebhook(secret.Secret, r.Header, body, time.Minute) != nil {
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					var payload api.WebhookPayload
+					json.Unmarshal(body, &payload)
+					received <- payload
+				}))
+				defer receiver.Close()
+
+				job, err := c.SubmitJob(ctx, &api.JobRequest{Function: "echo", Stdin: []byte("called back"), CallbackURL: receiver.URL})
+				So(err, ShouldBeNil)
+				So(job.CallbackURL, ShouldEqual, receiver.URL)
+
+				var payload api.WebhookPayload
+				select {
+				case payload = <-received:
+				case <-time.After(5 * time.Second):
+				}
+				So(payload.Event, ShouldEqual, api.EventJobFinished)
+				So(payload.Job.ID, ShouldEqual, job.ID)
+				So(string(payload.Job.Result.Stdout), ShouldEqual, "called back")
+
+				Convey("The delivery should be listed with its attempts...", func() {
+					var deliveries []api.WebhookDelivery
+					for i := 0; i < 50; i++ {
+						deliveries, err = c.JobDeliveries(ctx, job.ID)
+						So(err, ShouldBeNil)
+						if len(deliveries) == 1 && deliveries[0].Status == models.WebhookDelivered {
+							break
+						}
+						time.Sleep(10 * time.Millisecond)
+					}
+					So(deliveries, ShouldHaveLength, 1)
+					So(deliveries[0].Status, ShouldEqual, models.WebhookDelivered)
+					So(deliveries[0].Attempts, ShouldHaveLength, 1)
+				})
+
+				Convey("Rotating the secret should replace it...", func() {
+					rotated, err := c.RotateWebhookSecret(ctx)
+					So(err, ShouldBeNil)
+					So(rotated.Secret, ShouldNotEqual, secret.Secret)
+					current, err := c.WebhookSecret(ctx)
+					So(err, ShouldBeNil)
+					So(current.Secret, ShouldEqual, rotated.Secret)
+				})
+			})
+
+			Convey("A job with an invalid callback URL should be refused...", func() {
+				_, err := c.SubmitJob(ctx, &api.JobRequest{Function: "echo", CallbackURL: "ftp://example.com"})
+				So(err, ShouldNotBeNil)
+				So(err.(*Error).StatusCode, ShouldEqual, http.StatusBadRequest)
+			})
+
+			Convey("It should be usable in pipelines and workflows...", func() {
+				runtime.RunFunc = func(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+					stdin, _ := ioutil.ReadAll(spec.Stdin)
+					switch {
+					case strings.HasPrefix(spec.Image, "functron-upper-"):
+						spec.Stdout.Write(bytes.ToUpper(stdin))
+					case strings.HasPrefix(spec.Image, "functron-fail-"):
+						spec.Stderr.Write([]byte("no"))
+						return 3, nil
+					default:
+						spec.Stdout.Write(stdin)
+					}
+					return 0, nil
+				}
+				for _, name := range []string{"upper", "fail"} {
+					_, err := c.RegisterFunction(ctx, &api.RegisterFunctionRequest{
+						Name:           name,
+						DockerFile:     req.DockerFile,
+						TimeoutSeconds: 5,
+					})
+					So(err, ShouldBeNil)
+				}
+
+				Convey("Each stage should read the previous one's output...", func() {
+					out, err := c.Pipeline(ctx, &api.PipelineRequest{
+						Functions: []string{"echo", "upper", "echo"},
+						Stdin:     []byte("piped"),
+					})
+					So(err, ShouldBeNil)
+					So(string(out.Stdout), ShouldEqual, "PIPED")
+					So(out.Stages, ShouldHaveLength, 3)
+					So(out.Stages[1].Function, ShouldEqual, "upper")
+					So(out.Stages[1].StdoutBytes, ShouldEqual, 5)
+					So(out.FailedStage, ShouldBeNil)
+				})
+
+				Convey("A failed stage should stop the pipeline...", func() {
+					out, err := c.Pipeline(ctx, &api.PipelineRequest{
+						Functions: []string{"upper", "fail", "echo"},
+						Stdin:     []byte("piped"),
+					})
+					So(err, ShouldBeNil)
+					So(out.Stages, ShouldHaveLength, 2)
+					So(*out.FailedStage, ShouldEqual, 1)
+					So(string(out.Stages[1].Stderr), ShouldEqual, "no")
+					So(out.Errors[0].Code, ShouldEqual, api.ErrNonZeroExit)
+					So(out.Stdout, ShouldBeEmpty)
+				})
+
+				Convey("A missing function should be reported before anything runs...", func() {
+					_, err := c.Pipeline(ctx, &api.PipelineRequest{Functions: []string{"echo", "nope"}})
+					So(err.(*Error).StatusCode, ShouldEqual, http.StatusNotFound)
+					So(runtime.RunCount(), ShouldEqual, 0)
+				})
+
+				Convey("A workflow should map a function over each line...", func() {
+					wf, err := c.SubmitWorkflow(ctx, &api.WorkflowRequest{
+						WorkflowDefinition: api.WorkflowDefinition{Nodes: []api.WorkflowNode{
+							{ID: "in", Function: "echo"},
+							{ID: "up", Function: "upper", After: []string{"in"}, Map: true},
+							{ID: "out", Function: "echo", After: []string{"up"}},
+						}},
+						Stdin: []byte("a\nb\n"),
+					})
+					So(err, ShouldBeNil)
+					So(wf.Nodes, ShouldHaveLength, 3)
+
+					for wf.Finished == nil {
+						time.Sleep(10 * time.Millisecond)
+						wf, err = c.Workflow(ctx, wf.ID)
+						So(err, ShouldBeNil)
+					}
+					So(wf.Status, ShouldEqual, api.WorkflowSucceeded)
+					So(wf.Nodes[1].Tasks[api.WorkflowSucceeded], ShouldEqual, 2)
+					So(string(wf.Nodes[2].Output), ShouldEqual, "A\nB\n")
+				})
+
+				Convey("A workflow with a cycle, or a missing function, should be refused...", func() {
+					_, err := c.SubmitWorkflow(ctx, &api.WorkflowRequest{
+						WorkflowDefinition: api.WorkflowDefinition{Nodes: []api.WorkflowNode{
+							{ID: "a", Function: "echo", After: []string{"b"}},
+							{ID: "b", Function: "echo", After: []string{"a"}},
+						}},
+					})
+					So(err.(*Error).StatusCode, ShouldEqual, http.StatusBadRequest)
+
+					_, err = c.SubmitWorkflow(ctx, &api.WorkflowRequest{
+						WorkflowDefinition: api.WorkflowDefinition{Nodes: []api.WorkflowNode{{ID: "a", Function: "nope"}}},
+					})
+					So(err.(*Error).StatusCode, ShouldEqual, http.StatusNotFound)
+
+					_, err = c.Workflow(ctx, "nope")
+					So(err.(*Error).StatusCode, ShouldEqual, http.StatusNotFound)
+				})
+			})
+
+			Convey("It should be schedulable...", func() {
+				sc, err := c.SaveSchedule(ctx, &api.ScheduleRequest{
+					Name:     "nightly",
+					Cron:     "@nightly",
+					Function: "echo",
+					Stdin:    []byte("report"),
+				})
+				So(err, ShouldBeNil)
+				So(sc.Enabled, ShouldBeTrue)
+				So(sc.NextRun, ShouldNotBeNil)
+				So(sc.NextRun.Hour(), ShouldEqual, 0)
+
+				disabled := false
+				sc, err = c.SaveSchedule(ctx, &api.ScheduleRequest{Name: "nightly", Cron: "0 3 * * *", Function: "echo", Enabled: &disabled})
+				So(err, ShouldBeNil)
+				So(sc.Enabled, ShouldBeFalse)
+				So(sc.NextRun, ShouldBeNil)
+
+				schedules, err := c.Schedules(ctx)
+				So(err, ShouldBeNil)
+				So(schedules, ShouldHaveLength, 1)
+				So(schedules[0].Cron, ShouldEqual, "0 3 * * *")
+
+				_, err = c.SaveSchedule(ctx, &api.ScheduleRequest{Name: "bad", Cron: "* * *", Function: "echo"})
+				So(err.(*Error).StatusCode, ShouldEqual, http.StatusBadRequest)
+
+				So(c.DeleteSchedule(ctx, "nightly"), ShouldBeNil)
+				_, err = c.Schedule(ctx, "nightly")
+				So(err.(*Error).StatusCode, ShouldEqual, http.StatusNotFound)
+			})
+
+			Convey("Once deleted, it should be gone...", func() {
+				So(c.DeleteFunction(ctx, "echo"), ShouldBeNil)
+				_, err := c.Invoke(ctx, "echo", nil)
+				So(err.(*Error).StatusCode, ShouldEqual, http.StatusNotFound)
+				So(err.(*Error).Has(api.ErrNotFound), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestRetries(t *testing.T) {
+	Convey("Given a server which is unavailable twice...", t, func() {
+		attempts := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			attempts++
+			if attempts <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer ts.Close()
+		c := CreateClient(ts.URL, "")
+		c.RetryWait = time.Millisecond
+
+		Convey("The client should retry until it succeeds...", func() {
+			So(c.Ping(context.Background()), ShouldBeNil)
+			So(attempts, ShouldEqual, 3)
+		})
+
+		Convey("But give up after Retries...", func() {
+			c.Retries = 1
+			err := c.Ping(context.Background())
+			So(err.(*Error).StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+			So(attempts, ShouldEqual, 2)
+		})
+	})
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/Sentimentron/functron/api"
+)
+
+// RegisterFunction registers a function, replacing any with the same name.
+// It needs a key with the register-functions scope.
+func (c *Client) RegisterFunction(ctx context.Context, req *api.RegisterFunctionRequest) (*api.Function, error) {
+	var out api.Function
+	if err := c.call(ctx, "POST", "/v2/functions", req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Functions lists registered functions.
+func (c *Client) Functions(ctx context.Context) ([]api.Function, error) {
+	var out api.FunctionList
+	if err := c.call(ctx, "GET", "/v2/functions", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Functions, nil
+}
+
+// Function describes a registered function.
+func (c *Client) Function(ctx context.Context, name string) (*api.Function, error) {
+	var out api.Function
+	if err := c.call(ctx, "GET", "/v2/functions/"+url.PathEscape(name), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteFunction removes a registered function. It needs a key with the
+// register-functions scope.
+func (c *Client) DeleteFunction(ctx context.Context, name string) error {
+	return c.call(ctx, "DELETE", "/v2/functions/"+url.PathEscape(name), nil, nil)
+}
+
+// Invoke runs a registered function. As with Exec, a non-zero exit isn't
+// an error.
+func (c *Client) Invoke(ctx context.Context, name string, req *api.InvokeRequest) (*api.ExecResponse, error) {
+	if req == nil {
+		req = &api.InvokeRequest{}
+	}
+	return c.callExec(ctx, "/v2/functions/"+url.PathEscape(name)+"/invoke", req)
+}
+
+// Pipeline runs registered functions one after another, each reading the
+// previous one's output. As with Exec, a stage which exits with a non-zero
+// status isn't an error, but the response's FailedStage says which it was.
+func (c *Client) Pipeline(ctx context.Context, req *api.PipelineRequest) (*api.PipelineResponse, error) {
+	var out api.PipelineResponse
+	decoded, err := c.callReporting(ctx, "/v2/pipelines", req, &out, func() []api.Error { return out.Errors })
+	if !decoded {
+		return nil, err
+	}
+	return &out, err
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/Sentimentron/functron/api"
+)
+
+// Images lists the images Functron keeps between invocations. It needs a
+// key with the admin scope.
+func (c *Client) Images(ctx context.Context) ([]api.Image, error) {
+	var out api.ImageList
+	if err := c.call(ctx, "GET", "/v2/images", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Images, nil
+}
+
+// CollectGarbage removes every image which is past its scheduled removal.
+// It needs a key with the admin scope.
+func (c *Client) CollectGarbage(ctx context.Context) (*api.GCResult, error) {
+	var out api.GCResult
+	if err := c.call(ctx, "POST", "/v2/images/gc", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Image describes an image, and the changes made to it. It needs a key
+// with the admin scope.
+func (c *Client) Image(ctx context.Context, name string) (*api.ImageDetail, error) {
+	var out api.ImageDetail
+	if err := c.call(ctx, "GET", "/v2/images/"+url.PathEscape(name), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UpdateImage pins or unpins an image, or changes when it's removed. It
+// needs a key with the admin scope.
+func (c *Client) UpdateImage(ctx context.Context, name string, req *api.UpdateImageRequest) (*api.ImageDetail, error) {
+	var out api.ImageDetail
+	if err := c.call(ctx, "PATCH", "/v2/images/"+url.PathEscape(name), req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RemoveImage removes an image now, or as soon as nothing's using it. It
+// needs a key with the admin scope.
+func (c *Client) RemoveImage(ctx context.Context, name string) error {
+	return c.call(ctx, "DELETE", "/v2/images/"+url.PathEscape(name), nil, nil)
+}
+
+// ImageHistory describes every change to an image's status. It needs a key
+// with the admin scope.
+func (c *Client) ImageHistory(ctx context.Context, name string) (*api.ImageTimeline, error) {
+	var out api.ImageTimeline
+	if err := c.call(ctx, "GET", "/v2/images/"+url.PathEscape(name)+"/history", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+
+	"github.com/Sentimentron/functron/api"
+)
+
+// ErrStreamEnded is returned by StreamJob if the stream ends before the
+// job's result.
+var ErrStreamEnded = errors.New("functron: the job's stream ended early")
+
+// SubmitJob adds a job to the queue, to run in the background.
+func (c *Client) SubmitJob(ctx context.Context, req *api.JobRequest) (*api.Job, error) {
+	var out api.Job
+	if err := c.call(ctx, "POST", "/v2/jobs", req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Job describes a job, including its result once it's finished.
+func (c *Client) Job(ctx context.Context, id string) (*api.Job, error) {
+	var out api.Job
+	if err := c.call(ctx, "GET", "/v2/jobs/"+url.PathEscape(id), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Jobs describes the client's jobs, newest first. If status isn't empty,
+// only jobs with that status are included: api.JobDead picks out the jobs
+// which ran out of attempts.
+func (c *Client) Jobs(ctx context.Context, status api.JobStatus) ([]api.Job, error) {
+	path := "/v2/jobs"
+	if status != "" {
+		path += "?status=" + url.QueryEscape(string(status))
+	}
+	var out api.JobList
+	if err := c.call(ctx, "GET", path, nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Jobs, nil
+}
+
+// RequeueJob queues a dead job again, with all of its attempts.
+func (c *Client) RequeueJob(ctx context.Context, id string) (*api.Job, error) {
+	var out api.Job
+	if err := c.call(ctx, "POST", "/v2/jobs/"+url.PathEscape(id)+"/requeue", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// JobDeliveries describes each delivery of a job's result to its callback
+// URL, and every attempt at it.
+func (c *Client) JobDeliveries(ctx context.Context, id string) ([]api.WebhookDelivery, error) {
+	var out api.WebhookDeliveryList
+	if err := c.call(ctx, "GET", "/v2/jobs/"+url.PathEscape(id)+"/deliveries", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Deliveries, nil
+}
+
+// WebhookSecret returns the secret which signs deliveries for the client's
+// key's jobs, which api.VerifyWebhook checks them with.
+func (c *Client) WebhookSecret(ctx context.Context) (*api.WebhookSecret, error) {
+	var out api.WebhookSecret
+	if err := c.call(ctx, "GET", "/v2/webhooks/secret", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RotateWebhookSecret replaces the client's key's webhook secret with a
+// new one, and returns it.
+func (c *Client) RotateWebhookSecret(ctx context.Context) (*api.WebhookSecret, error) {
+	var out api.WebhookSecret
+	if err := c.call(ctx, "POST", "/v2/webhooks/secret", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// StreamJob calls handle with each of a job's events as they happen,
+// starting from the beginning, until the job finishes, ctx is cancelled or
+// handle returns an error. It returns the job's result.
+func (c *Client) StreamJob(ctx context.Context, id string, handle func(api.StreamEvent) error) (*api.ExecResponse, error) {
+	resp, err := c.send(ctx, "GET", "/v2/jobs/"+url.PathEscape(id)+"/stream", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, decodeError(resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var e api.StreamEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		if handle != nil {
+			if err := handle(e); err != nil {
+				return nil, err
+			}
+		}
+		if e.Type == api.EventResult {
+			return e.Result, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrStreamEnded
+}
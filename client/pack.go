@@ -0,0 +1,93 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+)
+
+// PackDirectory returns a tar file holding everything under dir, which can
+// be used as a build context. Paths in the tar file are relative to dir.
+// Only regular files and directories are included.
+func PackDirectory(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// RequestFromDockerfile returns an ExecRequest which builds the Dockerfile
+// at path, with the directory it's in as the build context. fnName
+// defaults to the directory's name.
+func RequestFromDockerfile(path, fnName string, timeout time.Duration) (*api.ExecRequest, error) {
+	dockerfile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(path)
+	buildContext, err := PackDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+	if fnName == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		fnName = strings.ToLower(filepath.Base(abs))
+	}
+	return &api.ExecRequest{
+		FnName:         fnName,
+		DockerFile:     string(dockerfile),
+		BuildContext:   buildContext,
+		TimeoutSeconds: timeout.Seconds(),
+	}, nil
+}
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/Sentimentron/functron/api"
+)
+
+// SaveSchedule saves a schedule, replacing any with the same name. It
+// needs a key with the register-functions scope, and the schedule's runs
+// are made by that key.
+func (c *Client) SaveSchedule(ctx context.Context, req *api.ScheduleRequest) (*api.Schedule, error) {
+	var out api.Schedule
+	if err := c.call(ctx, "POST", "/v2/schedules", req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Schedules lists schedules.
+func (c *Client) Schedules(ctx context.Context) ([]api.Schedule, error) {
+	var out api.ScheduleList
+	if err := c.call(ctx, "GET", "/v2/schedules", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Schedules, nil
+}
+
+// Schedule describes a schedule, including when it last ran and will next.
+func (c *Client) Schedule(ctx context.Context, name string) (*api.Schedule, error) {
+	var out api.Schedule
+	if err := c.call(ctx, "GET", "/v2/schedules/"+url.PathEscape(name), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteSchedule removes a schedule. It needs a key with the
+// register-functions scope.
+func (c *Client) DeleteSchedule(ctx context.Context, name string) error {
+	return c.call(ctx, "DELETE", "/v2/schedules/"+url.PathEscape(name), nil, nil)
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/Sentimentron/functron/api"
+)
+
+// PutSecret stores a secret, replacing any with the same name. Functions
+// and requests can then refer to it by name in their environment. It needs
+// a key with the manage-secrets scope.
+func (c *Client) PutSecret(ctx context.Context, name, value string) (*api.Secret, error) {
+	var out api.Secret
+	req := api.PutSecretRequest{Value: value}
+	if err := c.call(ctx, "PUT", "/v2/secrets/"+url.PathEscape(name), &req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Secrets lists the stored secrets. Their values can't be read back.
+func (c *Client) Secrets(ctx context.Context) ([]api.Secret, error) {
+	var out api.SecretList
+	if err := c.call(ctx, "GET", "/v2/secrets", nil, &out); err != nil {
+		return nil, err
+	}
+	return out.Secrets, nil
+}
+
+// DeleteSecret removes a secret. It needs a key with the manage-secrets
+// scope.
+func (c *Client) DeleteSecret(ctx context.Context, name string) error {
+	return c.call(ctx, "DELETE", "/v2/secrets/"+url.PathEscape(name), nil, nil)
+}
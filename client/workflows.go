@@ -0,0 +1,26 @@
+package client
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/Sentimentron/functron/api"
+)
+
+// SubmitWorkflow starts a workflow in the background.
+func (c *Client) SubmitWorkflow(ctx context.Context, req *api.WorkflowRequest) (*api.Workflow, error) {
+	var out api.Workflow
+	if err := c.call(ctx, "POST", "/v2/workflows", req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Workflow describes a workflow and each of its nodes.
+func (c *Client) Workflow(ctx context.Context, id string) (*api.Workflow, error) {
+	var out api.Workflow
+	if err := c.call(ctx, "GET", "/v2/workflows/"+url.PathEscape(id), nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
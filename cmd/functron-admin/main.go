@@ -0,0 +1,207 @@
+// functron-admin manages a Functron server's database directly, e.g. to
+// issue the first admin API key.
+//
+// Usage:
+//
+//	functron-admin [-db functron.db] keys create -name NAME -scopes exec,admin [-tenant ID]
+//	functron-admin [-db functron.db] keys list
+//	functron-admin [-db functron.db] keys revoke -id ID
+//	functron-admin [-db functron.db] keys assign -id ID -tenant ID
+//	functron-admin [-db functron.db] tenants create -name NAME [limits]
+//	functron-admin [-db functron.db] tenants list
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Sentimentron/functron/auth"
+	"github.com/Sentimentron/functron/database"
+	"github.com/Sentimentron/functron/models"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: functron-admin [-db path] keys create|list|revoke|assign [flags]")
+	fmt.Fprintln(os.Stderr, "       functron-admin [-db path] tenants create|list [flags]")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "functron-admin: %s\n", err)
+	os.Exit(1)
+}
+
+func main() {
+	dbPath := flag.String("db", "functron.db", "path to Functron's database")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+	}
+
+	store, err := database.CreateStore(*dbPath)
+	if err != nil {
+		fail(err)
+	}
+	defer store.Close()
+
+	switch args[0] + " " + args[1] {
+	case "keys create":
+		createKey(store, args[2:])
+	case "keys list":
+		listKeys(store)
+	case "keys revoke":
+		revokeKey(store, args[2:])
+	case "keys assign":
+		assignKey(store, args[2:])
+	case "tenants create":
+		createTenant(store, args[2:])
+	case "tenants list":
+		listTenants(store)
+	default:
+		usage()
+	}
+}
+
+// optionalId turns an unset (zero) -tenant flag into nil.
+func optionalId(id int64) *int64 {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
+
+func createKey(store *database.Store, args []string) {
+	fs := flag.NewFlagSet("keys create", flag.ExitOnError)
+	name := fs.String("name", "", "a name for the key's owner")
+	scopeList := fs.String("scopes", string(models.ScopeExec), "comma-separated scopes (exec, register-functions, admin)")
+	tenant := fs.Int64("tenant", 0, "the tenant whose quotas apply to the key")
+	fs.Parse(args)
+	if *name == "" {
+		fail(fmt.Errorf("-name is required"))
+	}
+
+	scopes := models.Scopes{}
+	for _, s := range strings.Split(*scopeList, ",") {
+		scope, err := models.ParseScope(strings.TrimSpace(s))
+		if err != nil {
+			fail(err)
+		}
+		scopes = append(scopes, scope)
+	}
+
+	plaintext, key, err := auth.IssueKey(store, *name, scopes, optionalId(*tenant))
+	if err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "Created key %d. It won't be shown again:\n", key.Id)
+	fmt.Println(plaintext)
+}
+
+func listKeys(store *database.Store) {
+	keys, err := store.RetrieveAPIKeys()
+	if err != nil {
+		fail(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tPREFIX\tSCOPES\tTENANT\tLAST USED\tREVOKED")
+	for _, k := range keys {
+		scopes, _ := k.Scopes.Value()
+		tenant, lastUsed, revoked := "-", "-", "-"
+		if k.TenantId != nil {
+			tenant = fmt.Sprintf("%d", *k.TenantId)
+		}
+		if k.LastUsed != nil {
+			lastUsed = k.LastUsed.Format("2006-01-02 15:04")
+		}
+		if k.Revoked != nil {
+			revoked = k.Revoked.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", k.Id, k.Name, k.Prefix, scopes, tenant, lastUsed, revoked)
+	}
+	w.Flush()
+}
+
+func revokeKey(store *database.Store, args []string) {
+	fs := flag.NewFlagSet("keys revoke", flag.ExitOnError)
+	id := fs.Int64("id", 0, "the key to revoke")
+	fs.Parse(args)
+	if *id == 0 {
+		fail(fmt.Errorf("-id is required"))
+	}
+	if err := store.RevokeAPIKey(*id); err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "Revoked key %d\n", *id)
+}
+
+func assignKey(store *database.Store, args []string) {
+	fs := flag.NewFlagSet("keys assign", flag.ExitOnError)
+	id := fs.Int64("id", 0, "the key to assign")
+	tenant := fs.Int64("tenant", 0, "the tenant to assign it to (0 for none)")
+	fs.Parse(args)
+	if *id == 0 {
+		fail(fmt.Errorf("-id is required"))
+	}
+	if *tenant != 0 {
+		if _, err := store.RetrieveTenantById(*tenant); err != nil {
+			fail(err)
+		}
+	}
+	if err := store.AssignAPIKeyToTenant(*id, optionalId(*tenant)); err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "Assigned key %d\n", *id)
+}
+
+func createTenant(store *database.Store, args []string) {
+	fs := flag.NewFlagSet("tenants create", flag.ExitOnError)
+	name := fs.String("name", "", "the tenant's name")
+	concurrent := fs.Int("concurrent", 0, "maximum concurrent executions (0 for no limit)")
+	perMinute := fs.Int("per-minute", 0, "maximum invocations per minute (0 for no limit)")
+	cpuPerDay := fs.Float64("cpu-per-day", 0, "maximum CPU-seconds per day (0 for no limit)")
+	contextBytes := fs.Int64("context-bytes", 0, "maximum build context size in bytes (0 for no limit)")
+	weight := fs.Float64("weight", 1, "the tenant's share of the slots, relative to other tenants")
+	fs.Parse(args)
+	if *name == "" {
+		fail(fmt.Errorf("-name is required"))
+	}
+	if *weight < 0 {
+		fail(fmt.Errorf("-weight can't be negative"))
+	}
+
+	tenant, err := store.CreateTenant(&models.Tenant{
+		Name:                 *name,
+		MaxConcurrent:        *concurrent,
+		InvocationsPerMinute: *perMinute,
+		CPUSecondsPerDay:     *cpuPerDay,
+		MaxBuildContextBytes: *contextBytes,
+		Weight:               *weight,
+	})
+	if err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "Created tenant %d\n", tenant.Id)
+}
+
+func listTenants(store *database.Store) {
+	tenants, err := store.RetrieveTenants()
+	if err != nil {
+		fail(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tCONCURRENT\tPER MINUTE\tCPU-SECONDS/DAY\tCONTEXT BYTES\tWEIGHT")
+	for _, t := range tenants {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%g\t%d\t%g\n", t.Id, t.Name, t.MaxConcurrent,
+			t.InvocationsPerMinute, t.CPUSecondsPerDay, t.MaxBuildContextBytes, t.Weight)
+	}
+	w.Flush()
+}
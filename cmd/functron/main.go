@@ -0,0 +1,359 @@
+// functron calls a Functron server from the command line.
+//
+// Usage:
+//
+//	functron [-url URL] [-key KEY] [-json] exec [-dockerfile PATH] [-name NAME] [-timeout 5s] DIR < stdin
+//	functron [-url URL] [-key KEY] [-json] functions register [-dockerfile PATH] [-timeout 5s] NAME DIR
+//	functron [-url URL] [-key KEY] [-json] functions list
+//	functron [-url URL] [-key KEY] [-json] functions invoke [-timeout 5s] NAME < stdin
+//	functron [-url URL] [-key KEY] [-json] functions delete NAME
+//	functron [-url URL] [-key KEY] [-json] images list|gc
+//	functron [-url URL] [-key KEY] [-json] jobs tail ID
+//	functron [-url URL] [-key KEY] ping
+//
+// The server's URL and API key default to $FUNCTRON_URL and $FUNCTRON_KEY.
+// Output is human-readable unless -json is given.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/client"
+)
+
+// jsonOutput is set by -json, which every subcommand also accepts.
+var jsonOutput bool
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: functron [-url URL] [-key KEY] [-json] exec [flags] DIR")
+	fmt.Fprintln(os.Stderr, "       functron [-url URL] [-key KEY] [-json] functions register|list|invoke|delete [flags]")
+	fmt.Fprintln(os.Stderr, "       functron [-url URL] [-key KEY] [-json] images list|gc")
+	fmt.Fprintln(os.Stderr, "       functron [-url URL] [-key KEY] [-json] jobs tail ID")
+	fmt.Fprintln(os.Stderr, "       functron [-url URL] [-key KEY] ping")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "functron: %s\n", err)
+	os.Exit(1)
+}
+
+// envOr returns the environment variable key, or fallback if it's unset.
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func main() {
+	url := flag.String("url", envOr("FUNCTRON_URL", "http://localhost:8081"), "the Functron server")
+	key := flag.String("key", os.Getenv("FUNCTRON_KEY"), "the API key to use")
+	flag.BoolVar(&jsonOutput, "json", false, "print JSON rather than tables")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		usage()
+	}
+
+	c := client.CreateClient(*url, *key)
+	ctx := context.Background()
+
+	command := args[0]
+	if len(args) > 1 && command != "exec" && command != "ping" {
+		command += " " + args[1]
+		args = args[1:]
+	}
+
+	switch command {
+	case "exec":
+		execDirectory(ctx, c, args[1:])
+	case "functions register":
+		registerFunction(ctx, c, args[1:])
+	case "functions list":
+		listFunctions(ctx, c, args[1:])
+	case "functions invoke":
+		invokeFunction(ctx, c, args[1:])
+	case "functions delete":
+		deleteFunction(ctx, c, args[1:])
+	case "images list":
+		listImages(ctx, c, args[1:])
+	case "images gc":
+		collectGarbage(ctx, c, args[1:])
+	case "jobs tail":
+		tailJob(ctx, c, args[1:])
+	case "ping":
+		if err := c.Ping(ctx); err != nil {
+			fail(err)
+		}
+		fmt.Println("OK")
+	default:
+		usage()
+	}
+}
+
+// newFlagSet returns a FlagSet for a subcommand, which also accepts -json.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.BoolVar(&jsonOutput, "json", jsonOutput, "print JSON rather than tables")
+	return fs
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fail(err)
+	}
+}
+
+// readStdin returns whatever's piped into stdin, or nothing if it's a
+// terminal.
+func readStdin() []byte {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice != 0 {
+		return nil
+	}
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fail(err)
+	}
+	return stdin
+}
+
+// printResult shows what a function did: its output goes to stdout and
+// stderr, and functron exits with its exit code. Failures which aren't the
+// function's fault are reported by err.
+func printResult(out *api.ExecResponse, err error) {
+	if out == nil {
+		fail(err)
+	}
+	if jsonOutput {
+		printJSON(out)
+	} else {
+		os.Stdout.Write(out.Stdout)
+		os.Stderr.Write(out.Stderr)
+		for _, e := range out.Errors {
+			fmt.Fprintf(os.Stderr, "functron: %s: %s\n", e.Code, e.Message)
+		}
+		if len(out.Build.Stderr) > 0 && out.ExitCode == nil {
+			os.Stderr.Write(out.Build.Stderr)
+		}
+	}
+
+	switch {
+	case out.ExitCode != nil:
+		os.Exit(*out.ExitCode)
+	case len(out.Errors) > 0:
+		os.Exit(1)
+	}
+}
+
+func execDirectory(ctx context.Context, c *client.Client, args []string) {
+	fs := newFlagSet("exec")
+	dockerfile := fs.String("dockerfile", "", "the Dockerfile to build (DIR/Dockerfile by default)")
+	name := fs.String("name", "", "the function's name (DIR's name by default)")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long the function may run")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fail(fmt.Errorf("exec needs a directory"))
+	}
+	dir := fs.Arg(0)
+	if *dockerfile == "" {
+		*dockerfile = filepath.Join(dir, "Dockerfile")
+	}
+
+	req, err := client.RequestFromDockerfile(*dockerfile, *name, *timeout)
+	if err != nil {
+		fail(err)
+	}
+	if filepath.Dir(*dockerfile) != filepath.Clean(dir) {
+		if req.BuildContext, err = client.PackDirectory(dir); err != nil {
+			fail(err)
+		}
+	}
+	req.Stdin = readStdin()
+	printResult(c.Exec(ctx, req))
+}
+
+func registerFunction(ctx context.Context, c *client.Client, args []string) {
+	fs := newFlagSet("functions register")
+	dockerfile := fs.String("dockerfile", "", "the Dockerfile to build (DIR/Dockerfile by default)")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long the function may run, by default")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fail(fmt.Errorf("functions register needs a name and a directory"))
+	}
+	name, dir := fs.Arg(0), fs.Arg(1)
+	if *dockerfile == "" {
+		*dockerfile = filepath.Join(dir, "Dockerfile")
+	}
+
+	contents, err := ioutil.ReadFile(*dockerfile)
+	if err != nil {
+		fail(err)
+	}
+	buildContext, err := client.PackDirectory(dir)
+	if err != nil {
+		fail(err)
+	}
+	fn, err := c.RegisterFunction(ctx, &api.RegisterFunctionRequest{
+		Name:           name,
+		DockerFile:     string(contents),
+		BuildContext:   buildContext,
+		TimeoutSeconds: timeout.Seconds(),
+	})
+	if err != nil {
+		fail(err)
+	}
+	if jsonOutput {
+		printJSON(fn)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Registered %s\n", fn.Name)
+}
+
+func listFunctions(ctx context.Context, c *client.Client, args []string) {
+	newFlagSet("functions list").Parse(args)
+	functions, err := c.Functions(ctx)
+	if err != nil {
+		fail(err)
+	}
+	if jsonOutput {
+		printJSON(functions)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCONTEXT BYTES\tTIMEOUT\tUPDATED")
+	for _, f := range functions {
+		fmt.Fprintf(w, "%s\t%d\t%gs\t%s\n", f.Name, f.BuildContextBytes, f.TimeoutSeconds,
+			f.Updated.Format("2006-01-02 15:04"))
+	}
+	w.Flush()
+}
+
+func invokeFunction(ctx context.Context, c *client.Client, args []string) {
+	fs := newFlagSet("functions invoke")
+	timeout := fs.Duration("timeout", 0, "how long the function may run (its own timeout by default)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fail(fmt.Errorf("functions invoke needs a name"))
+	}
+	printResult(c.Invoke(ctx, fs.Arg(0), &api.InvokeRequest{
+		Stdin:          readStdin(),
+		TimeoutSeconds: timeout.Seconds(),
+	}))
+}
+
+func deleteFunction(ctx context.Context, c *client.Client, args []string) {
+	fs := newFlagSet("functions delete")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fail(fmt.Errorf("functions delete needs a name"))
+	}
+	if err := c.DeleteFunction(ctx, fs.Arg(0)); err != nil {
+		fail(err)
+	}
+	fmt.Fprintf(os.Stderr, "Deleted %s\n", fs.Arg(0))
+}
+
+func listImages(ctx context.Context, c *client.Client, args []string) {
+	newFlagSet("images list").Parse(args)
+	images, err := c.Images(ctx)
+	if err != nil {
+		fail(err)
+	}
+	if jsonOutput {
+		printJSON(images)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATUS\tCREATED\tREMOVAL")
+	for _, img := range images {
+		removal := "-"
+		if img.ScheduledRemoval != nil {
+			removal = img.ScheduledRemoval.Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", img.Name, img.Status, img.Created.Format("2006-01-02 15:04"), removal)
+	}
+	w.Flush()
+}
+
+func collectGarbage(ctx context.Context, c *client.Client, args []string) {
+	newFlagSet("images gc").Parse(args)
+	result, err := c.CollectGarbage(ctx)
+	if err != nil {
+		fail(err)
+	}
+	if jsonOutput {
+		printJSON(result)
+	} else {
+		for _, name := range result.Removed {
+			fmt.Printf("Removed %s\n", name)
+		}
+		for _, e := range result.Evicted {
+			fmt.Printf("Evicted %s (%d bytes): %s\n", e.Name, e.SizeBytes, e.Reason)
+		}
+		for _, e := range result.Errors {
+			fmt.Fprintf(os.Stderr, "functron: %s\n", e.Message)
+		}
+	}
+	if len(result.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+func tailJob(ctx context.Context, c *client.Client, args []string) {
+	fs := newFlagSet("jobs tail")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fail(fmt.Errorf("jobs tail needs a job ID"))
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	result, err := c.StreamJob(ctx, fs.Arg(0), func(e api.StreamEvent) error {
+		if jsonOutput {
+			return enc.Encode(e)
+		}
+		switch e.Type {
+		case api.EventStdout:
+			os.Stdout.Write(e.Data)
+		case api.EventStderr:
+			os.Stderr.Write(e.Data)
+		case api.EventStatus:
+			fmt.Fprintf(os.Stderr, "functron: job is %s\n", e.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		fail(err)
+	}
+
+	// The output has already been shown, so only report the errors
+	if !jsonOutput {
+		for _, e := range result.Errors {
+			fmt.Fprintf(os.Stderr, "functron: %s: %s\n", e.Code, e.Message)
+		}
+	}
+	switch {
+	case result.ExitCode != nil:
+		os.Exit(*result.ExitCode)
+	case len(result.Errors) > 0:
+		os.Exit(1)
+	}
+}
@@ -2,6 +2,7 @@ package configuration
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 )
 
@@ -17,6 +18,194 @@ type SlotConfig struct {
 	CmdPrefix string
 }
 
+// DockerfilePolicy describes which Dockerfiles Functron will build.
+type DockerfilePolicy struct {
+	// Instructions which can't appear at all, e.g. ADD
+	ForbiddenInstructions []string
+	// Whether the function must be specified with CMD or ENTRYPOINT
+	RequireCommand bool
+	// If non-empty, the only base images which can be used. Entries are
+	// either a repository (any tag, e.g. "python") or a repository and a
+	// tag, which may contain globs (e.g. "python:3.*").
+	AllowedBaseImages []string
+	// Whether base images must be pinned with a digest (image@sha256:...)
+	RequireDigest bool
+	// The maximum number of RUN instructions (0 for no limit)
+	MaxRunInstructions int
+}
+
+// DefaultDockerfilePolicy enforces the rules in the README: no ADD (or
+// COPY, since the build context is mounted at /data instead) and a CMD.
+var DefaultDockerfilePolicy = DockerfilePolicy{
+	ForbiddenInstructions: []string{"ADD", "COPY"},
+	RequireCommand:        true,
+}
+
+// WarmPoolConfig describes how many containers to keep ready to run each
+// registered function.
+type WarmPoolConfig struct {
+	// The most containers to keep ready for one function
+	MaxContainers int
+	// How many containers to keep ready for a function, even when it's idle
+	MinContainers int
+	// How often (in seconds) each function's pool is resized to match its
+	// demand since the last resize. Functions which weren't invoked shrink
+	// to MinContainers. 60 by default.
+	IdleSeconds int
+}
+
+// WebhookConfig describes how job results are delivered to callback URLs.
+// Each field is defaulted if it's zero.
+type WebhookConfig struct {
+	// How many times to try each delivery before giving up. 8 by default.
+	MaxAttempts int
+	// How long to wait before the first retry, doubling after each one.
+	// 10 by default.
+	InitialDelaySeconds float64
+	// The longest to wait between retries. 3600 by default.
+	MaxDelaySeconds float64
+	// How long to wait for the receiver to respond. 10 by default.
+	TimeoutSeconds float64
+	// Hosts which callbacks can be sent to, e.g. "hooks.example.com", or
+	// "*.example.com" for any of its subdomains. Any host which isn't
+	// denied, by default.
+	AllowedHosts []string
+	// Hosts which callbacks can't be sent to, written as AllowedHosts are
+	DeniedHosts []string
+	// Whether callbacks can be sent to loopback, private and link-local
+	// addresses, such as other services on Functron's network. False by
+	// default.
+	AllowPrivateAddresses bool
+}
+
+// QueueConfig describes how jobs are taken from the queue. Each field is
+// defaulted if it's zero.
+type QueueConfig struct {
+	// How many jobs to run at once. The number of slots by default.
+	Workers int
+	// How many times to try a job which keeps failing in ways that might
+	// not happen again (e.g. the workspace was unavailable) before it's
+	// dead. 3 by default.
+	MaxAttempts int
+	// How long a worker's lease on a job lasts. Leases are renewed while
+	// the job runs, so this is how long a job is stuck for if its worker
+	// stops. 60 by default.
+	LeaseSeconds float64
+	// How often idle workers look for jobs which weren't submitted to
+	// this server. 1 by default.
+	PollSeconds float64
+}
+
+// ImageGCConfig describes when built images are evicted to save disk, and
+// when references to them are reported as leaks. Each field but
+// DiskBudgetBytes is defaulted if it's zero.
+type ImageGCConfig struct {
+	// How much disk Functron's images can use before the least recently
+	// used are evicted. Nothing's evicted if it's zero.
+	DiskBudgetBytes int64
+	// How often (in seconds) to check. 300 by default.
+	IntervalSeconds float64
+	// How long (in seconds) an image has to go unused before it can be
+	// evicted. 600 by default.
+	MinIdleSeconds float64
+	// How long (in seconds) a reference to an image can be held before
+	// it's logged as a possible leak. 3600 by default.
+	LeakSeconds float64
+}
+
+// SecurityProfile describes how function containers are confined. The
+// zero value leaves Docker's defaults.
+type SecurityProfile struct {
+	// The user and group to run as, instead of the image's (often root).
+	// GID can only be set with UID.
+	UID *int
+	GID *int
+	// Whether the container's root filesystem is read-only. A tmpfs is
+	// mounted at /tmp, so functions still have somewhere to write.
+	ReadOnlyRootfs bool
+	// Size of the tmpfs at /tmp, e.g. "64m" (the default)
+	TmpfsSize string
+	// Capabilities to drop, e.g. ["ALL"] or ["NET_RAW"]
+	DropCapabilities []string
+	// Whether processes are stopped from gaining privileges, e.g. through
+	// setuid binaries
+	NoNewPrivileges bool
+	// Path to a seccomp profile on the server, instead of Docker's default
+	SeccompProfile string
+	// Name of an OCI runtime to use instead of Docker's default, e.g. runsc
+	Runtime string
+}
+
+// validate checks that p makes sense.
+func (p SecurityProfile) validate() error {
+	if p.GID != nil && p.UID == nil {
+		return fmt.Errorf("a GID can only be set with a UID")
+	}
+	if (p.UID != nil && *p.UID < 0) || (p.GID != nil && *p.GID < 0) {
+		return fmt.Errorf("UIDs and GIDs can't be negative")
+	}
+	return nil
+}
+
+// Network modes, besides the names of Docker networks.
+const (
+	// NetworkNone gives containers no network at all
+	NetworkNone = "none"
+	// NetworkIsolated puts each container on an internal bridge network of
+	// its own, where it can't reach anything else
+	NetworkIsolated = "isolated"
+	// NetworkBridge is Docker's default network
+	NetworkBridge = "bridge"
+)
+
+// DefaultIsolatedNetwork starts the names of the networks for
+// NetworkIsolated, if the configuration doesn't name them.
+const DefaultIsolatedNetwork = "functron-isolated"
+
+// NetworkConfig decides which networks function containers can join.
+type NetworkConfig struct {
+	// Mode for functions which don't choose one: "none", "isolated", or
+	// the name of a Docker network. If empty, Docker's default bridge is
+	// used.
+	Default string
+	// Docker networks which functions can choose, besides the default,
+	// "none" and "isolated"
+	Allowed []string
+	// Prefix of the internal networks created for each "isolated"
+	// container (functron-isolated by default)
+	IsolatedNetwork string
+}
+
+// DefaultMode returns the mode for functions which don't choose one.
+func (n NetworkConfig) DefaultMode() string {
+	if n.Default == "" {
+		return NetworkBridge
+	}
+	return n.Default
+}
+
+// Allows reports whether functions can choose mode.
+func (n NetworkConfig) Allows(mode string) bool {
+	if mode == NetworkNone || mode == NetworkIsolated || mode == n.DefaultMode() {
+		return true
+	}
+	for _, allowed := range n.Allowed {
+		if mode == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// IsolatedNetworkPrefix returns the prefix of the networks created for
+// "isolated" containers.
+func (n NetworkConfig) IsolatedNetworkPrefix() string {
+	if n.IsolatedNetwork == "" {
+		return DefaultIsolatedNetwork
+	}
+	return n.IsolatedNetwork
+}
+
 // Configuration describes the configuration for this instance of Functron.
 // Configuration covers
 type Configuration struct {
@@ -24,9 +213,44 @@ type Configuration struct {
 	Port int
 	// BaseURL of a Repositron server, where output's streamed.
 	RepositronURL string
+	// Path to the SQLite database which stores images etc.
+	DatabasePath string
+	// Minimum level of log lines to write: debug, info, warn or error.
+	LogLevel string
+	// Rules which submitted Dockerfiles must follow. If absent,
+	// DefaultDockerfilePolicy is used.
+	DockerfilePolicy *DockerfilePolicy
+	// If set, registered functions keep containers ready to run
+	WarmPool *WarmPoolConfig
+	// Registered functions are served as plain HTTP endpoints at
+	// /fn/{name}, or /{HTTPPrefix}/fn/{name} if this is set
+	HTTPPrefix string
+	// How job results are delivered to callback URLs
+	Webhooks WebhookConfig
+	// How jobs are taken from the queue
+	Queue QueueConfig
+	// When built images are evicted to save disk
+	ImageGC ImageGCConfig
+	// The master key which encrypts secrets in the database: 32 random
+	// bytes, base64-encoded (e.g. `openssl rand -base64 32`). Secrets
+	// can't be used without one.
+	SecretsKey string
+
+	// How every function's containers are confined. Functions can choose
+	// one of SecurityProfiles, which can make this stricter, but never
+	// weaker.
+	Security SecurityProfile
+	// Named profiles which functions can choose
+	SecurityProfiles map[string]SecurityProfile
+	// Which networks function containers can join
+	Network NetworkConfig
 
 	// Information about the resources on this machine
 	Slots []SlotConfig
+	// How many slots are reserved for interactive requests (exec, invoke,
+	// pipelines and HTTP endpoints), which jobs, batches, workflows and
+	// schedules can't use. At least one slot's always left for them.
+	InteractiveSlots int
 }
 
 // ReadConfiguration opens and parses Functron's configuration file.
@@ -44,5 +268,27 @@ func ReadConfiguration(path string) (*Configuration, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	// Fill in defaults
+	if c.DatabasePath == "" {
+		c.DatabasePath = "functron.db"
+	}
+	if c.DockerfilePolicy == nil {
+		p := DefaultDockerfilePolicy
+		c.DockerfilePolicy = &p
+	}
+	if c.WarmPool != nil && c.WarmPool.IdleSeconds == 0 {
+		c.WarmPool.IdleSeconds = 60
+	}
+
+	// Check the security profiles
+	if err := c.Security.validate(); err != nil {
+		return nil, fmt.Errorf("security: %v", err)
+	}
+	for name, p := range c.SecurityProfiles {
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("securityProfiles: %s: %v", name, err)
+		}
+	}
 	return &c, nil
 }
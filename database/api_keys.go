@@ -0,0 +1,107 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/models"
+)
+
+// CreateAPIKey saves a new API key. The caller is responsible for hashing it.
+func (s *Store) CreateAPIKey(key *models.APIKey) (*models.APIKey, error) {
+	ret := *key
+	ret.Created = time.Now()
+	ret.LastUsed = nil
+	ret.Revoked = nil
+
+	sql := `
+		INSERT INTO api_keys (name, prefix, hash, scopes, tenant_id, created)
+		VALUES (:name, :prefix, :hash, :scopes, :tenant_id, :created)`
+
+	result, err := s.handle.NamedExec(sql, ret)
+	if err != nil {
+		return nil, err
+	}
+
+	newId, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.RetrieveAPIKeyById(newId)
+}
+
+func (s *Store) retrieveAPIKey(where string, arg interface{}) (*models.APIKey, error) {
+	ret := make([]models.APIKey, 0)
+	err := s.handle.Select(&ret, "SELECT id, name, prefix, hash, scopes, tenant_id, created, last_used, revoked FROM api_keys WHERE "+where, arg)
+	if err != nil {
+		return nil, fmt.Errorf("retrieveAPIKey: %v", err)
+	}
+	if len(ret) == 0 {
+		return nil, interfaces.NoMatchingAPIKey
+	}
+	if len(ret) > 1 {
+		return nil, fmt.Errorf("integrity error: %d row(s) returned (should be 1)", len(ret))
+	}
+	return &ret[0], nil
+}
+
+// RetrieveAPIKeyById returns a key by its identifier, including revoked keys.
+func (s *Store) RetrieveAPIKeyById(id int64) (*models.APIKey, error) {
+	return s.retrieveAPIKey("id = $1", id)
+}
+
+// RetrieveAPIKeyByHash returns an unrevoked key by the hash of its value.
+func (s *Store) RetrieveAPIKeyByHash(hash string) (*models.APIKey, error) {
+	return s.retrieveAPIKey("hash = $1 AND revoked IS NULL", hash)
+}
+
+// RetrieveAPIKeys returns every key, including revoked ones.
+func (s *Store) RetrieveAPIKeys() ([]models.APIKey, error) {
+	ret := make([]models.APIKey, 0)
+	err := s.handle.Select(&ret, "SELECT id, name, prefix, hash, scopes, tenant_id, created, last_used, revoked FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// RevokeAPIKey stops a key from being used again.
+func (s *Store) RevokeAPIKey(id int64) error {
+	result, err := s.handle.Exec("UPDATE api_keys SET revoked = $1 WHERE id = $2 AND revoked IS NULL", time.Now(), id)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return interfaces.NoMatchingAPIKey
+	}
+	return nil
+}
+
+// AssignAPIKeyToTenant moves a key under a tenant's limits. A nil tenant
+// removes the key from any tenant.
+func (s *Store) AssignAPIKeyToTenant(id int64, tenantId *int64) error {
+	result, err := s.handle.Exec("UPDATE api_keys SET tenant_id = $1 WHERE id = $2", tenantId, id)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return interfaces.NoMatchingAPIKey
+	}
+	return nil
+}
+
+// TouchAPIKey records that a key has just been used.
+func (s *Store) TouchAPIKey(id int64) error {
+	_, err := s.handle.Exec("UPDATE api_keys SET last_used = $1 WHERE id = $2", time.Now(), id)
+	return err
+}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/models"
+)
+
+const functionColumns = "id, name, docker_file, build_context, timeout_seconds, weight, env, security_profile, network, created, updated"
+
+// SaveFunction registers a function, replacing any existing function with
+// the same name.
+func (s *Store) SaveFunction(function *models.Function) (*models.Function, error) {
+	ret := *function
+	ret.Created = time.Now()
+	ret.Updated = ret.Created
+	if ret.BuildContext == nil {
+		ret.BuildContext = []byte{}
+	}
+	if ret.Weight == 0 {
+		ret.Weight = 1
+	}
+
+	sql := `
+		INSERT INTO functions (name, docker_file, build_context, timeout_seconds, weight, env, security_profile, network, created, updated)
+		VALUES (:name, :docker_file, :build_context, :timeout_seconds, :weight, :env, :security_profile, :network, :created, :updated)
+		ON CONFLICT (name) DO UPDATE SET
+			docker_file = excluded.docker_file,
+			build_context = excluded.build_context,
+			timeout_seconds = excluded.timeout_seconds,
+			weight = excluded.weight,
+			env = excluded.env,
+			security_profile = excluded.security_profile,
+			network = excluded.network,
+			updated = excluded.updated`
+
+	_, err := s.handle.NamedExec(sql, ret)
+	if err != nil {
+		return nil, err
+	}
+	return s.RetrieveFunctionByName(ret.Name)
+}
+
+// RetrieveFunctionByName returns a function, or NoMatchingFunction.
+func (s *Store) RetrieveFunctionByName(name string) (*models.Function, error) {
+	ret := make([]models.Function, 0)
+	err := s.handle.Select(&ret, "SELECT "+functionColumns+" FROM functions WHERE name = $1", name)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveFunctionByName: %v", err)
+	}
+	if len(ret) == 0 {
+		return nil, interfaces.NoMatchingFunction
+	}
+	return &ret[0], nil
+}
+
+// RetrieveFunctions returns every registered function, ordered by name.
+func (s *Store) RetrieveFunctions() ([]models.Function, error) {
+	ret := make([]models.Function, 0)
+	err := s.handle.Select(&ret, "SELECT "+functionColumns+" FROM functions ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// DeleteFunction removes a registered function, or returns NoMatchingFunction.
+func (s *Store) DeleteFunction(name string) error {
+	result, err := s.handle.Exec("DELETE FROM functions WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return interfaces.NoMatchingFunction
+	}
+	return nil
+}
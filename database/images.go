@@ -0,0 +1,243 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/models"
+	"github.com/jmoiron/sqlx"
+)
+
+const imageChangeColumns = "id, image_id, change, detail, api_key_id, created"
+
+const imageTransitionColumns = "id, image_id, from_status, to_status, message, created"
+
+// Store provides the ImageStore interface.
+var _ interfaces.ImageStore = (*Store)(nil)
+
+// ImageRetention is how long images are kept after they're built, or last
+// used, before they're scheduled for removal.
+const ImageRetention = 24 * time.Hour
+
+// PinImage pins or unpins an image, as long as its status hasn't changed,
+// and records who did it.
+func (s *Store) PinImage(image *models.FunctronImage, pinned bool, apiKeyId *int64) (*models.FunctronImage, error) {
+	change := models.ImageChange{Change: models.ImageChangeUnpinned, APIKeyId: apiKeyId}
+	if pinned {
+		change.Change = models.ImageChangePinned
+	}
+	return s.changeImage(image, change, "pinned = $1", pinned)
+}
+
+// RescheduleImageRemoval changes when an image is removed, as long as its
+// status hasn't changed, and records who did it.
+func (s *Store) RescheduleImageRemoval(image *models.FunctronImage, when time.Time, detail string, apiKeyId *int64) (*models.FunctronImage, error) {
+	change := models.ImageChange{Change: models.ImageChangeRescheduled, Detail: detail, APIKeyId: apiKeyId}
+	return s.changeImage(image, change, "scheduled_removal = $1", when)
+}
+
+// RecordImageRemoval marks an image which has been removed early, as long
+// as its status hasn't changed, and records who removed it.
+func (s *Store) RecordImageRemoval(image *models.FunctronImage, apiKeyId *int64) (*models.FunctronImage, error) {
+	tx, err := s.handle.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	err = transitionImage(tx, image, models.ImageStatusCleanedUp, "removed early through the API")
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = recordImageChange(tx, image.Id, models.ImageChange{Change: models.ImageChangeRemoved, APIKeyId: apiKeyId})
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.RetrieveImageById(image.Id)
+}
+
+// RescheduleImageBuild schedules an image which failed, was built or was
+// removed to be built again, as long as nothing else has changed its
+// status, and schedules its removal a day from now. image is updated in
+// place.
+func (s *Store) RescheduleImageBuild(image *models.FunctronImage, message string) error {
+	tx, err := s.handle.Beginx()
+	if err != nil {
+		return err
+	}
+	err = transitionImage(tx, image, models.ImageStatusScheduledForBuild, message)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	now := time.Now()
+	removal := now.Add(ImageRetention)
+	_, err = tx.Exec("UPDATE images SET scheduled_build = $1, finished = NULL, scheduled_removal = $2 WHERE id = $3", now, removal, image.Id)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("RescheduleImageBuild: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	image.Status, image.ScheduledForBuild, image.Committed, image.ScheduledForRemoval = models.ImageStatusScheduledForBuild, now, nil, &removal
+	return nil
+}
+
+// Store provides the ImageUsageStore interface.
+var _ interfaces.ImageUsageStore = (*Store)(nil)
+
+// RetrieveImageUsage returns when each image was last used, and how big it
+// is, as of the last SaveImageUsage.
+func (s *Store) RetrieveImageUsage() ([]models.ImageUsage, error) {
+	ret := make([]models.ImageUsage, 0)
+	err := s.handle.Select(&ret, `SELECT name, last_used, size_bytes FROM images
+		WHERE last_used IS NOT NULL AND size_bytes IS NOT NULL ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveImageUsage: %v", err)
+	}
+	return ret, nil
+}
+
+// SaveImageUsage records when each image was last used, and how big it
+// is. Images which were acquired are kept for ImageRetention after they
+// were last used: if they're scheduled for removal sooner, they're
+// rescheduled. Images which aren't in the store are ignored.
+func (s *Store) SaveImageUsage(usage []models.ImageUsage) error {
+	tx, err := s.handle.Beginx()
+	if err != nil {
+		return err
+	}
+	for _, u := range usage {
+		keep := time.Time{}
+		if u.Acquired {
+			keep = u.LastUsed.Add(ImageRetention)
+		}
+		_, err := tx.Exec(`UPDATE images SET last_used = $1, size_bytes = $2,
+			scheduled_removal = CASE WHEN scheduled_removal < $3 THEN $3 ELSE scheduled_removal END
+			WHERE name = $4`, u.LastUsed, u.SizeBytes, keep, u.Name)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("SaveImageUsage: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// changeImage sets one column of image to value and records change, or
+// returns ImageChanged if the image's status isn't what it was when image
+// was retrieved.
+func (s *Store) changeImage(image *models.FunctronImage, change models.ImageChange, set string, value interface{}) (*models.FunctronImage, error) {
+	tx, err := s.handle.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	result, err := tx.Exec("UPDATE images SET "+set+" WHERE id = $2 AND status = $3", value, image.Id, image.Status)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("changeImage: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if affected == 0 {
+		tx.Rollback()
+		return nil, interfaces.ImageChanged
+	}
+
+	if err := recordImageChange(tx, image.Id, change); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.RetrieveImageById(image.Id)
+}
+
+// recordImageChange saves a change made to an image.
+func recordImageChange(tx *sqlx.Tx, imageId int64, change models.ImageChange) error {
+	change.ImageId = imageId
+	change.Created = time.Now()
+	_, err := tx.NamedExec(`
+		INSERT INTO image_changes (image_id, change, detail, api_key_id, created)
+		VALUES (:image_id, :change, :detail, :api_key_id, :created)`, change)
+	if err != nil {
+		return fmt.Errorf("recordImageChange: %v", err)
+	}
+	return nil
+}
+
+// transitionImage changes an image's status from image.Status to
+// newStatus, as long as the change is legal and nothing else has changed
+// it, and records the change. Images which are completed are marked as
+// finished.
+func transitionImage(tx *sqlx.Tx, image *models.FunctronImage, newStatus models.ImageStatus, message string) error {
+	if !image.Status.CanTransitionTo(newStatus) {
+		return interfaces.InvalidImageTransition
+	}
+	var finished *time.Time
+	if newStatus == models.ImageStatusCompleted {
+		now := time.Now()
+		finished = &now
+	} else {
+		finished = image.Committed
+	}
+	result, err := tx.Exec("UPDATE images SET status = $1, finished = $2 WHERE id = $3 AND status = $4", newStatus, finished, image.Id, image.Status)
+	if err != nil {
+		return fmt.Errorf("transitionImage: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return interfaces.ImageChanged
+	}
+	return recordImageTransition(tx, image.Id, image.Status, newStatus, message)
+}
+
+// recordImageTransition saves a change to an image's status in its
+// history.
+func recordImageTransition(tx *sqlx.Tx, imageId int64, from, to models.ImageStatus, message string) error {
+	_, err := tx.NamedExec(`
+		INSERT INTO image_status_history (image_id, from_status, to_status, message, created)
+		VALUES (:image_id, :from_status, :to_status, :message, :created)`, models.ImageStatusTransition{
+		ImageId: imageId,
+		From:    from,
+		To:      to,
+		Message: message,
+		Created: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("recordImageTransition: %v", err)
+	}
+	return nil
+}
+
+// RetrieveImageStatusHistory returns every change to an image's status,
+// oldest first.
+func (s *Store) RetrieveImageStatusHistory(imageId int64) ([]models.ImageStatusTransition, error) {
+	ret := make([]models.ImageStatusTransition, 0)
+	err := s.handle.Select(&ret, "SELECT "+imageTransitionColumns+" FROM image_status_history WHERE image_id = $1 ORDER BY id", imageId)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveImageStatusHistory: %v", err)
+	}
+	return ret, nil
+}
+
+// RetrieveImageChanges returns the changes made to an image, oldest first.
+func (s *Store) RetrieveImageChanges(imageId int64) ([]models.ImageChange, error) {
+	ret := make([]models.ImageChange, 0)
+	err := s.handle.Select(&ret, "SELECT "+imageChangeColumns+" FROM image_changes WHERE image_id = $1 ORDER BY id", imageId)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveImageChanges: %v", err)
+	}
+	return ret, nil
+}
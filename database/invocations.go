@@ -0,0 +1,54 @@
+package database
+
+import (
+	"time"
+
+	"github.com/Sentimentron/functron/models"
+)
+
+// PersistInvocation records the start of an invocation.
+func (s *Store) PersistInvocation(inv *models.Invocation) (*models.Invocation, error) {
+	ret := *inv
+	ret.Started = time.Now()
+	ret.Finished = nil
+	ret.Outcome = models.InvocationRunning
+
+	sql := `
+		INSERT INTO invocations (request_id, function_name, api_key_id, tenant_id, started, outcome, network)
+		VALUES (:request_id, :function_name, :api_key_id, :tenant_id, :started, :outcome, :network)`
+
+	result, err := s.handle.NamedExec(sql, ret)
+	if err != nil {
+		return nil, err
+	}
+
+	ret.Id, err = result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// FinishInvocation records the outcome of an invocation, and what its
+// containers used.
+func (s *Store) FinishInvocation(id int64, outcome string, usage models.Usage) error {
+	sql := `
+		UPDATE invocations SET finished = $1, outcome = $2, cpu_seconds = $3, memory_peak_bytes = $4,
+			block_read_bytes = $5, block_write_bytes = $6, network_rx_bytes = $7, network_tx_bytes = $8
+		WHERE id = $9`
+	_, err := s.handle.Exec(sql, time.Now(), outcome, usage.CPUSeconds, usage.MemoryPeakBytes,
+		usage.BlockReadBytes, usage.BlockWriteBytes, usage.NetworkRxBytes, usage.NetworkTxBytes, id)
+	return err
+}
+
+// RetrieveInvocations returns the most recent invocations, newest first.
+func (s *Store) RetrieveInvocations(limit int) ([]models.Invocation, error) {
+	ret := make([]models.Invocation, 0)
+	err := s.handle.Select(&ret, `SELECT id, request_id, function_name, api_key_id, tenant_id, started, finished, outcome, network,
+			cpu_seconds, memory_peak_bytes, block_read_bytes, block_write_bytes, network_rx_bytes, network_tx_bytes
+		FROM invocations ORDER BY started DESC, id DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,189 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/models"
+)
+
+const jobColumns = `seq, id, function_name, request, priority, status, api_key_id, callback_url, attempts,
+	max_attempts, lease_owner, lease_expires, enqueued, started, finished, result, last_error`
+
+// EnqueueJob saves a new job, ready to be claimed.
+func (s *Store) EnqueueJob(job *models.Job) (*models.Job, error) {
+	ret := *job
+	ret.Status = models.JobQueued
+	ret.Enqueued = time.Now()
+	ret.Attempts = 0
+	ret.LeaseOwner, ret.LeaseExpires = "", nil
+	ret.Started, ret.Finished = nil, nil
+
+	result, err := s.handle.NamedExec(`
+		INSERT INTO jobs (id, function_name, request, priority, status, api_key_id, callback_url, attempts, max_attempts, enqueued)
+		VALUES (:id, :function_name, :request, :priority, :status, :api_key_id, :callback_url, :attempts, :max_attempts, :enqueued)`, ret)
+	if err != nil {
+		return nil, fmt.Errorf("EnqueueJob: %v", err)
+	}
+	ret.Seq, err = result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// ClaimJob leases the queued job with the highest priority (the oldest,
+// if there's a tie) to owner until leaseExpires, counting an attempt at
+// it. It returns nil if nothing's queued.
+func (s *Store) ClaimJob(owner string, leaseExpires time.Time) (*models.Job, error) {
+	for {
+		candidates := make([]models.Job, 0)
+		err := s.handle.Select(&candidates, "SELECT "+jobColumns+" FROM jobs WHERE status = $1 ORDER BY priority DESC, seq LIMIT 1", models.JobQueued)
+		if err != nil {
+			return nil, fmt.Errorf("ClaimJob: %v", err)
+		}
+		if len(candidates) == 0 {
+			return nil, nil
+		}
+		claimed, err := s.claim(&candidates[0], owner, leaseExpires)
+		if err != nil || claimed != nil {
+			return claimed, err
+		}
+		// Another worker got there first
+	}
+}
+
+// claim leases job to owner, as long as it's still queued. It returns nil
+// if it isn't.
+func (s *Store) claim(job *models.Job, owner string, leaseExpires time.Time) (*models.Job, error) {
+	now := time.Now()
+	result, err := s.handle.Exec(`UPDATE jobs SET status = $1, attempts = attempts + 1, lease_owner = $2, lease_expires = $3,
+		started = COALESCE(started, $4) WHERE seq = $5 AND status = $6`,
+		models.JobRunning, owner, leaseExpires, now, job.Seq, models.JobQueued)
+	if err != nil {
+		return nil, fmt.Errorf("ClaimJob: %v", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+	ret := *job
+	ret.Status = models.JobRunning
+	ret.Attempts++
+	ret.LeaseOwner, ret.LeaseExpires = owner, &leaseExpires
+	if ret.Started == nil {
+		ret.Started = &now
+	}
+	return &ret, nil
+}
+
+// RenewJobLease extends owner's lease on a running job. It returns
+// NoMatchingJob if owner doesn't hold the lease any more.
+func (s *Store) RenewJobLease(id, owner string, leaseExpires time.Time) error {
+	result, err := s.handle.Exec("UPDATE jobs SET lease_expires = $1 WHERE id = $2 AND lease_owner = $3 AND status = $4",
+		leaseExpires, id, owner, models.JobRunning)
+	if err != nil {
+		return fmt.Errorf("RenewJobLease: %v", err)
+	}
+	return expectRow(result)
+}
+
+// SettleJob records the outcome of owner's attempt at a running job, and
+// releases its lease. status is JobQueued if the job should be attempted
+// again. It returns NoMatchingJob if owner doesn't hold the lease any more.
+func (s *Store) SettleJob(id, owner, status string, result []byte, lastError string) error {
+	var finished *time.Time
+	if status != models.JobQueued {
+		now := time.Now()
+		finished = &now
+	}
+	res, err := s.handle.Exec(`UPDATE jobs SET status = $1, result = $2, last_error = $3, finished = $4, lease_owner = '',
+		lease_expires = NULL WHERE id = $5 AND lease_owner = $6 AND status = $7`,
+		status, result, lastError, finished, id, owner, models.JobRunning)
+	if err != nil {
+		return fmt.Errorf("SettleJob: %v", err)
+	}
+	return expectRow(res)
+}
+
+// RequeueExpiredJobs releases the lease on every running job whose lease
+// expired before now. Jobs with attempts left are queued again, and the
+// rest become dead. It returns the jobs it released, with their new
+// statuses.
+func (s *Store) RequeueExpiredJobs(now time.Time) ([]models.Job, error) {
+	running := make([]models.Job, 0)
+	err := s.handle.Select(&running, "SELECT "+jobColumns+" FROM jobs WHERE status = $1 ORDER BY seq", models.JobRunning)
+	if err != nil {
+		return nil, fmt.Errorf("RequeueExpiredJobs: %v", err)
+	}
+
+	ret := make([]models.Job, 0)
+	for _, job := range running {
+		if job.LeaseExpires != nil && job.LeaseExpires.After(now) {
+			continue
+		}
+		status := models.JobQueued
+		if job.Attempts >= job.MaxAttempts {
+			status = models.JobDead
+		}
+		lastError := "the worker running the job stopped renewing its lease"
+		err := s.SettleJob(job.Id, job.LeaseOwner, status, job.Result, lastError)
+		if err == interfaces.NoMatchingJob {
+			// It finished, or was released, in the meantime
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		job.Status, job.LastError, job.LeaseOwner, job.LeaseExpires = status, lastError, "", nil
+		ret = append(ret, job)
+	}
+	return ret, nil
+}
+
+// RequeueJob queues a dead job again, with all of its attempts. It
+// returns NoMatchingJob if there's no dead job with the ID.
+func (s *Store) RequeueJob(id string) error {
+	result, err := s.handle.Exec("UPDATE jobs SET status = $1, attempts = 0, finished = NULL WHERE id = $2 AND status = $3",
+		models.JobQueued, id, models.JobDead)
+	if err != nil {
+		return fmt.Errorf("RequeueJob: %v", err)
+	}
+	return expectRow(result)
+}
+
+// RetrieveJob returns the job with the given ID, or NoMatchingJob.
+func (s *Store) RetrieveJob(id string) (*models.Job, error) {
+	ret := make([]models.Job, 0)
+	err := s.handle.Select(&ret, "SELECT "+jobColumns+" FROM jobs WHERE id = $1", id)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveJob: %v", err)
+	}
+	if len(ret) == 0 {
+		return nil, interfaces.NoMatchingJob
+	}
+	return &ret[0], nil
+}
+
+// RetrieveJobs returns every job with the given status (or every job, if
+// it's empty), newest first.
+func (s *Store) RetrieveJobs(status string) ([]models.Job, error) {
+	ret := make([]models.Job, 0)
+	err := s.handle.Select(&ret, "SELECT "+jobColumns+" FROM jobs WHERE $1 = '' OR status = $1 ORDER BY seq DESC", status)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveJobs: %v", err)
+	}
+	return ret, nil
+}
+
+// expectRow returns NoMatchingJob unless result changed a row.
+func expectRow(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return interfaces.NoMatchingJob
+	}
+	return nil
+}
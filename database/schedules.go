@@ -0,0 +1,88 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/models"
+)
+
+const scheduleColumns = "id, name, cron, function_name, stdin, timeout_seconds, enabled, skip_overlapping, api_key_id, created, updated, last_run, next_run"
+
+// SaveSchedule saves a schedule, replacing any existing schedule with the
+// same name. A replaced schedule keeps its ID and when it last ran.
+func (s *Store) SaveSchedule(schedule *models.Schedule) (*models.Schedule, error) {
+	ret := *schedule
+	ret.Created = time.Now()
+	ret.Updated = ret.Created
+	if ret.Stdin == nil {
+		ret.Stdin = []byte{}
+	}
+
+	sql := `
+		INSERT INTO schedules (name, cron, function_name, stdin, timeout_seconds, enabled, skip_overlapping, api_key_id, created, updated, next_run)
+		VALUES (:name, :cron, :function_name, :stdin, :timeout_seconds, :enabled, :skip_overlapping, :api_key_id, :created, :updated, :next_run)
+		ON CONFLICT (name) DO UPDATE SET
+			cron = excluded.cron,
+			function_name = excluded.function_name,
+			stdin = excluded.stdin,
+			timeout_seconds = excluded.timeout_seconds,
+			enabled = excluded.enabled,
+			skip_overlapping = excluded.skip_overlapping,
+			api_key_id = excluded.api_key_id,
+			updated = excluded.updated,
+			next_run = excluded.next_run`
+
+	_, err := s.handle.NamedExec(sql, ret)
+	if err != nil {
+		return nil, err
+	}
+	return s.RetrieveScheduleByName(ret.Name)
+}
+
+// RetrieveScheduleByName returns a schedule, or NoMatchingSchedule.
+func (s *Store) RetrieveScheduleByName(name string) (*models.Schedule, error) {
+	ret := make([]models.Schedule, 0)
+	err := s.handle.Select(&ret, "SELECT "+scheduleColumns+" FROM schedules WHERE name = $1", name)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveScheduleByName: %v", err)
+	}
+	if len(ret) == 0 {
+		return nil, interfaces.NoMatchingSchedule
+	}
+	return &ret[0], nil
+}
+
+// RetrieveSchedules returns every schedule, ordered by name.
+func (s *Store) RetrieveSchedules() ([]models.Schedule, error) {
+	ret := make([]models.Schedule, 0)
+	err := s.handle.Select(&ret, "SELECT "+scheduleColumns+" FROM schedules ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveSchedules: %v", err)
+	}
+	return ret, nil
+}
+
+// UpdateScheduleRun records when a schedule was last triggered, and when
+// it should be next. nextRun is nil if it never will be.
+func (s *Store) UpdateScheduleRun(id int64, lastRun time.Time, nextRun *time.Time) error {
+	_, err := s.handle.Exec("UPDATE schedules SET last_run = $1, next_run = $2 WHERE id = $3", lastRun, nextRun, id)
+	return err
+}
+
+// DeleteSchedule removes a schedule, or returns NoMatchingSchedule.
+func (s *Store) DeleteSchedule(name string) error {
+	result, err := s.handle.Exec("DELETE FROM schedules WHERE name = $1", name)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return interfaces.NoMatchingSchedule
+	}
+	return nil
+}
@@ -2,8 +2,9 @@ package database
 
 import (
 "errors"
+"fmt"
 "github.com/jmoiron/sqlx"
-"log"
+"github.com/Sentimentron/functron/logging"
 "os"
 )
 
@@ -13,6 +14,25 @@ type DatabaseSchemaVersion int
 const (
 	DbSchemaInvalid DatabaseSchemaVersion = 0
 	DbSchemaV1      DatabaseSchemaVersion = 1
+	DbSchemaV2      DatabaseSchemaVersion = 2
+	DbSchemaV3      DatabaseSchemaVersion = 3
+	DbSchemaV4      DatabaseSchemaVersion = 4
+	DbSchemaV5      DatabaseSchemaVersion = 5
+	DbSchemaV6      DatabaseSchemaVersion = 6
+	DbSchemaV7      DatabaseSchemaVersion = 7
+	DbSchemaV8      DatabaseSchemaVersion = 8
+	DbSchemaV9      DatabaseSchemaVersion = 9
+	DbSchemaV10     DatabaseSchemaVersion = 10
+	DbSchemaV11     DatabaseSchemaVersion = 11
+	DbSchemaV12     DatabaseSchemaVersion = 12
+	DbSchemaV13     DatabaseSchemaVersion = 13
+	DbSchemaV14     DatabaseSchemaVersion = 14
+	DbSchemaV15     DatabaseSchemaVersion = 15
+	DbSchemaV16     DatabaseSchemaVersion = 16
+	DbSchemaV17     DatabaseSchemaVersion = 17
+
+	// DbSchemaLatest is the version CreateStore upgrades databases to.
+	DbSchemaLatest = DbSchemaV17
 )
 
 var SchemaUnknownVersionError = errors.New("unable to find the version key")
@@ -40,6 +60,294 @@ CREATE TABLE images (
 CREATE INDEX name_index ON images(name);
 `
 
+// V2Migration adds API keys, and a history of invocations which records
+// the key that made each one.
+const V2Migration = `
+CREATE TABLE api_keys (
+	id INTEGER NOT NULL PRIMARY KEY,
+	name TEXT NOT NULL,
+	prefix TEXT NOT NULL,
+	hash TEXT NOT NULL UNIQUE,
+	scopes TEXT NOT NULL,
+	created DATETIME NOT NULL,
+	last_used DATETIME,
+	revoked DATETIME
+);
+
+CREATE TABLE invocations (
+	id INTEGER NOT NULL PRIMARY KEY,
+	request_id TEXT NOT NULL,
+	function_name TEXT NOT NULL,
+	api_key_id INTEGER REFERENCES api_keys(id),
+	started DATETIME NOT NULL,
+	finished DATETIME,
+	outcome TEXT NOT NULL
+);
+
+CREATE INDEX invocations_started_index ON invocations(started);
+`
+
+// V3Migration adds tenants, which group API keys under shared limits, and
+// the usage counters those limits are checked against.
+const V3Migration = `
+CREATE TABLE tenants (
+	id INTEGER NOT NULL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	created DATETIME NOT NULL,
+	max_concurrent INTEGER NOT NULL DEFAULT 0,
+	invocations_per_minute INTEGER NOT NULL DEFAULT 0,
+	cpu_seconds_per_day REAL NOT NULL DEFAULT 0,
+	max_build_context_bytes INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE tenant_usage (
+	tenant_id INTEGER NOT NULL REFERENCES tenants(id),
+	metric TEXT NOT NULL,
+	window_start DATETIME NOT NULL,
+	value REAL NOT NULL,
+	PRIMARY KEY (tenant_id, metric, window_start)
+);
+
+ALTER TABLE api_keys ADD COLUMN tenant_id INTEGER REFERENCES tenants(id);
+ALTER TABLE invocations ADD COLUMN tenant_id INTEGER REFERENCES tenants(id);
+`
+
+// V4Migration adds registered functions.
+const V4Migration = `
+CREATE TABLE functions (
+	id INTEGER NOT NULL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	docker_file TEXT NOT NULL,
+	build_context BLOB NOT NULL,
+	timeout_seconds REAL NOT NULL,
+	created DATETIME NOT NULL,
+	updated DATETIME NOT NULL
+);
+`
+
+// V5Migration adds workflows, and the state of each of their nodes and
+// tasks.
+const V5Migration = `
+CREATE TABLE workflows (
+	id TEXT NOT NULL PRIMARY KEY,
+	definition TEXT NOT NULL,
+	stdin BLOB NOT NULL,
+	status TEXT NOT NULL,
+	api_key_id INTEGER REFERENCES api_keys(id),
+	created DATETIME NOT NULL,
+	finished DATETIME
+);
+
+CREATE TABLE workflow_nodes (
+	workflow_id TEXT NOT NULL REFERENCES workflows(id),
+	node_id TEXT NOT NULL,
+	status TEXT NOT NULL,
+	output BLOB,
+	error TEXT NOT NULL DEFAULT '',
+	started DATETIME,
+	finished DATETIME,
+	PRIMARY KEY (workflow_id, node_id)
+);
+
+CREATE TABLE workflow_tasks (
+	workflow_id TEXT NOT NULL REFERENCES workflows(id),
+	node_id TEXT NOT NULL,
+	idx INTEGER NOT NULL,
+	input BLOB NOT NULL,
+	status TEXT NOT NULL,
+	output BLOB,
+	stderr BLOB,
+	exit_code INTEGER,
+	error TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (workflow_id, node_id, idx)
+);
+
+CREATE INDEX workflows_status_index ON workflows(status);
+`
+
+// V6Migration adds schedules.
+const V6Migration = `
+CREATE TABLE schedules (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	cron TEXT NOT NULL,
+	function_name TEXT NOT NULL,
+	stdin BLOB NOT NULL,
+	timeout_seconds REAL NOT NULL DEFAULT 0,
+	enabled BOOLEAN NOT NULL,
+	skip_overlapping BOOLEAN NOT NULL,
+	api_key_id INTEGER REFERENCES api_keys(id),
+	created DATETIME NOT NULL,
+	updated DATETIME NOT NULL,
+	last_run DATETIME,
+	next_run DATETIME
+);
+`
+
+// V7Migration adds webhook secrets, and the deliveries of job results to
+// callback URLs along with each attempt at them.
+const V7Migration = `
+CREATE TABLE webhook_secrets (
+	api_key_id INTEGER NOT NULL PRIMARY KEY REFERENCES api_keys(id),
+	secret TEXT NOT NULL,
+	created DATETIME NOT NULL
+);
+
+CREATE TABLE webhook_deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	job_id TEXT NOT NULL,
+	api_key_id INTEGER NOT NULL REFERENCES api_keys(id),
+	url TEXT NOT NULL,
+	payload BLOB NOT NULL,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt DATETIME,
+	created DATETIME NOT NULL,
+	finished DATETIME
+);
+
+CREATE INDEX webhook_deliveries_job_index ON webhook_deliveries(job_id);
+CREATE INDEX webhook_deliveries_status_index ON webhook_deliveries(status);
+
+CREATE TABLE webhook_attempts (
+	delivery_id INTEGER NOT NULL REFERENCES webhook_deliveries(id),
+	attempt INTEGER NOT NULL,
+	started DATETIME NOT NULL,
+	duration_seconds REAL NOT NULL,
+	status_code INTEGER,
+	error TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (delivery_id, attempt)
+);
+`
+
+// V8Migration adds the durable job queue.
+const V8Migration = `
+CREATE TABLE jobs (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	id TEXT NOT NULL UNIQUE,
+	function_name TEXT NOT NULL,
+	request BLOB NOT NULL,
+	priority INTEGER NOT NULL DEFAULT 0,
+	status TEXT NOT NULL,
+	api_key_id INTEGER REFERENCES api_keys(id),
+	callback_url TEXT NOT NULL DEFAULT '',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	max_attempts INTEGER NOT NULL,
+	lease_owner TEXT NOT NULL DEFAULT '',
+	lease_expires DATETIME,
+	enqueued DATETIME NOT NULL,
+	started DATETIME,
+	finished DATETIME,
+	result BLOB,
+	last_error TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX jobs_queue_index ON jobs(status, priority, seq);
+`
+
+// V9Migration adds the weights which share slots out between tenants and
+// functions.
+const V9Migration = `
+ALTER TABLE tenants ADD COLUMN weight REAL NOT NULL DEFAULT 1;
+ALTER TABLE functions ADD COLUMN weight REAL NOT NULL DEFAULT 1;
+`
+
+// V10Migration adds encrypted secrets, and environment variables for functions.
+const V10Migration = `
+CREATE TABLE secrets (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	sealed BLOB NOT NULL,
+	created DATETIME NOT NULL,
+	updated DATETIME NOT NULL
+);
+
+ALTER TABLE functions ADD COLUMN env TEXT NOT NULL DEFAULT '[]';
+`
+
+// V11Migration adds the security profiles functions can choose.
+const V11Migration = `
+ALTER TABLE functions ADD COLUMN security_profile TEXT NOT NULL DEFAULT '';
+`
+
+// V12Migration records the network mode of functions and invocations.
+const V12Migration = `
+ALTER TABLE functions ADD COLUMN network TEXT NOT NULL DEFAULT '';
+ALTER TABLE invocations ADD COLUMN network TEXT NOT NULL DEFAULT '';
+`
+
+// V13Migration records what each invocation's containers used.
+const V13Migration = `
+ALTER TABLE invocations ADD COLUMN cpu_seconds REAL NOT NULL DEFAULT 0;
+ALTER TABLE invocations ADD COLUMN memory_peak_bytes INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE invocations ADD COLUMN block_read_bytes INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE invocations ADD COLUMN block_write_bytes INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE invocations ADD COLUMN network_rx_bytes INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE invocations ADD COLUMN network_tx_bytes INTEGER NOT NULL DEFAULT 0;
+`
+
+// V14Migration lets images be pinned, so the garbage collector never
+// evicts them.
+const V14Migration = `
+ALTER TABLE images ADD COLUMN pinned INTEGER NOT NULL DEFAULT 0;
+`
+
+// V15Migration records the changes made to images through the API.
+const V15Migration = `
+CREATE TABLE image_changes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	image_id INTEGER NOT NULL REFERENCES images(id),
+	change TEXT NOT NULL,
+	detail TEXT NOT NULL DEFAULT '',
+	api_key_id INTEGER REFERENCES api_keys(id),
+	created DATETIME NOT NULL
+);
+
+CREATE INDEX image_changes_image_index ON image_changes(image_id);
+`
+
+// V16Migration records each change to an image's status.
+const V16Migration = `
+CREATE TABLE image_status_history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	image_id INTEGER NOT NULL REFERENCES images(id),
+	from_status TEXT NOT NULL,
+	to_status TEXT NOT NULL,
+	message TEXT NOT NULL DEFAULT '',
+	created DATETIME NOT NULL
+);
+
+CREATE INDEX image_status_history_image_index ON image_status_history(image_id);
+`
+
+// V17Migration records when each image was last used, and how big it is,
+// so the garbage collector remembers them across restarts.
+const V17Migration = `
+ALTER TABLE images ADD COLUMN last_used DATETIME;
+ALTER TABLE images ADD COLUMN size_bytes INTEGER;
+`
+
+// migrations maps each schema version onto the SQL which upgrades the
+// previous version to it.
+var migrations = map[DatabaseSchemaVersion]string{
+	DbSchemaV2:  V2Migration,
+	DbSchemaV3:  V3Migration,
+	DbSchemaV4:  V4Migration,
+	DbSchemaV5:  V5Migration,
+	DbSchemaV6:  V6Migration,
+	DbSchemaV7:  V7Migration,
+	DbSchemaV8:  V8Migration,
+	DbSchemaV9:  V9Migration,
+	DbSchemaV10: V10Migration,
+	DbSchemaV11: V11Migration,
+	DbSchemaV12: V12Migration,
+	DbSchemaV13: V13Migration,
+	DbSchemaV14: V14Migration,
+	DbSchemaV15: V15Migration,
+	DbSchemaV16: V16Migration,
+	DbSchemaV17: V17Migration,
+}
+
 type KeyValueConfig struct {
 	Key   string `db_name:"key"`
 	Value string `db_name:"value"`
@@ -51,7 +359,7 @@ func CreateDatabaseIfNotExists(path string) error {
 	// If the database already exists, there's nothing to do.
 	_, err := os.Stat(path)
 	if os.IsNotExist(err) {
-		log.Printf("Creating a database at... %s", path)
+		logging.Default().Infof("Creating a database at... %s", path)
 		// Otherwise, open a connection to the database and create the schema
 		db, err := sqlx.Open("sqlite3", path)
 		if err != nil {
@@ -61,7 +369,7 @@ func CreateDatabaseIfNotExists(path string) error {
 
 		db.MustExec(V1Schema)
 	} else {
-		log.Printf("Using existing database at... %s", path)
+		logging.Default().Infof("Using existing database at... %s", path)
 	}
 	return nil
 }
@@ -80,15 +388,58 @@ func GetDatabaseSchemaVersion(path string) (DatabaseSchemaVersion, error) {
 	}
 	for _, c := range configValues {
 		if c.Key == "db_schema" {
-			if c.Value == "v1" {
-				return DbSchemaV1, nil
+			var version DatabaseSchemaVersion
+			_, err := fmt.Sscanf(c.Value, "v%d", &version)
+			if err != nil || version < DbSchemaV1 || version > DbSchemaLatest {
+				return DbSchemaInvalid, SchemaUnsupportedVersionError
 			}
+			return version, nil
 		}
 	}
 
 	return DbSchemaInvalid, SchemaUnknownVersionError
 }
 
+// UpgradeDatabase applies each migration needed to bring the database at
+// path up to DbSchemaLatest. Each migration runs in its own transaction.
+func UpgradeDatabase(path string) error {
+	version, err := GetDatabaseSchemaVersion(path)
+	if err != nil {
+		return err
+	}
+
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for version < DbSchemaLatest {
+		version++
+		logging.Default().Infof("Upgrading database at %s to v%d...", path, version)
+
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(migrations[version])
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("UpgradeDatabase: v%d: %v", version, err)
+		}
+		_, err = tx.Exec(`UPDATE configuration SET value = $1 WHERE key = "db_schema"`, fmt.Sprintf("v%d", version))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func GetConfigurationValues(db *sqlx.DB) ([]KeyValueConfig, error) {
 	ret := []KeyValueConfig{}
 	err := db.Select(&ret, "SELECT key, value FROM configuration")
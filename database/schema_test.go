@@ -29,3 +29,22 @@ func TestCreateDatabaseIfNotExists(t *testing.T) {
 	})
 }
 
+func TestUpgradeDatabase(t *testing.T) {
+	Convey("Given a new v1 database...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "repo")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		So(CreateDatabaseIfNotExists(tmpFile.Name()), ShouldBeNil)
+
+		Convey("It should upgrade to the latest version", func() {
+			So(UpgradeDatabase(tmpFile.Name()), ShouldBeNil)
+			version, err := GetDatabaseSchemaVersion(tmpFile.Name())
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, DbSchemaLatest)
+
+			Convey("And upgrading again should do nothing", func() {
+				So(UpgradeDatabase(tmpFile.Name()), ShouldBeNil)
+			})
+		})
+	})
+}
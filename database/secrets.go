@@ -0,0 +1,71 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/models"
+)
+
+const secretColumns = "id, name, sealed, created, updated"
+
+// SaveSecret stores a sealed secret, replacing any existing secret with
+// the same name.
+func (s *Store) SaveSecret(secret *models.Secret) (*models.Secret, error) {
+	ret := *secret
+	ret.Created = time.Now()
+	ret.Updated = ret.Created
+
+	sql := `
+		INSERT INTO secrets (name, sealed, created, updated)
+		VALUES (:name, :sealed, :created, :updated)
+		ON CONFLICT (name) DO UPDATE SET
+			sealed = excluded.sealed,
+			updated = excluded.updated`
+
+	_, err := s.handle.NamedExec(sql, ret)
+	if err != nil {
+		return nil, fmt.Errorf("SaveSecret: %v", err)
+	}
+	return s.RetrieveSecretByName(ret.Name)
+}
+
+// RetrieveSecretByName returns a secret, or NoMatchingSecret.
+func (s *Store) RetrieveSecretByName(name string) (*models.Secret, error) {
+	ret := make([]models.Secret, 0)
+	err := s.handle.Select(&ret, "SELECT "+secretColumns+" FROM secrets WHERE name = $1", name)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveSecretByName: %v", err)
+	}
+	if len(ret) == 0 {
+		return nil, interfaces.NoMatchingSecret
+	}
+	return &ret[0], nil
+}
+
+// RetrieveSecrets returns every secret, ordered by name.
+func (s *Store) RetrieveSecrets() ([]models.Secret, error) {
+	ret := make([]models.Secret, 0)
+	err := s.handle.Select(&ret, "SELECT "+secretColumns+" FROM secrets ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveSecrets: %v", err)
+	}
+	return ret, nil
+}
+
+// DeleteSecret removes a secret, or returns NoMatchingSecret.
+func (s *Store) DeleteSecret(name string) error {
+	result, err := s.handle.Exec("DELETE FROM secrets WHERE name = $1", name)
+	if err != nil {
+		return fmt.Errorf("DeleteSecret: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return interfaces.NoMatchingSecret
+	}
+	return nil
+}
@@ -9,6 +9,8 @@ _ "github.com/mattn/go-sqlite3"
 	"github.com/Sentimentron/functron/interfaces"
 )
 
+const imageColumns = "id, name, docker_file, pre_commit_script, created, scheduled_build, finished, scheduled_removal, status, pinned"
+
 type Store struct {
 	path   string
 	handle *sqlx.DB
@@ -23,11 +25,20 @@ func CreateStore(path string) (*Store, error) {
 		return nil, err
 	}
 
+	// Bring it up to date.
+	err = UpgradeDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+
 	// Check that it's in the right format.
-	_, err = GetDatabaseSchemaVersion(path)
+	version, err := GetDatabaseSchemaVersion(path)
 	if err != nil {
 		return nil, err
 	}
+	if version != DbSchemaLatest {
+		return nil, SchemaUnsupportedVersionError
+	}
 
 	// Open the store for real this time
 	db, err := sqlx.Open("sqlite3", path)
@@ -51,24 +62,41 @@ func (s *Store) PersistImageForBuild(img *models.FunctronImage) (*models.Functro
 
 	// Update some key fields
 	ret.Created = time.Now()
-	ret.ScheduledForBuild = &ret.Created
+	ret.ScheduledForBuild = ret.Created
 	if ret.ScheduledForRemoval == nil {
-		cleanupTime := time.Now().Add(24*time.Hour)
+		cleanupTime := time.Now().Add(ImageRetention)
 		ret.ScheduledForRemoval = &cleanupTime
 	}
 	ret.Status = models.ImageStatusScheduledForBuild
 
 	// Build the query
 	sql := `
-		INSERT INTO images (name, docker_file, pre_commit_script, created, scheduled_build, finished, scheduled_removal, status) 
-		VALUES (:name, :docker_file, :pre_commit_script, :created, :scheduled_build, :finished, :scheduled_removal, :status)`
+		INSERT INTO images (name, docker_file, pre_commit_script, created, scheduled_build, finished, scheduled_removal, status, pinned) 
+		VALUES (:name, :docker_file, :pre_commit_script, :created, :scheduled_build, :finished, :scheduled_removal, :status, :pinned)`
 
-	result, err := s.handle.NamedExec(sql, ret)
+	tx, err := s.handle.Beginx()
 	if err != nil {
 		return nil, err
 	}
+	result, err := tx.NamedExec(sql, ret)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 
 	newId, err := result.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// Start the image's history
+	err = recordImageTransition(tx, newId, "", ret.Status, "scheduled for build")
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
 	if err != nil {
 		return nil, err
 	}
@@ -78,7 +106,7 @@ func (s *Store) PersistImageForBuild(img *models.FunctronImage) (*models.Functro
 
 func (s *Store) RetrieveImageById(id int64) (*models.FunctronImage, error) {
 	ret := make([]models.FunctronImage, 0)
-	err := s.handle.Select(&ret, "SELECT id, name, docker_file, pre_commit_script, created, scheduled_build, finished, scheduled_removal, status FROM images WHERE id = :id", id)
+	err := s.handle.Select(&ret, "SELECT "+imageColumns+" FROM images WHERE id = :id", id)
 	if err != nil {
 		return nil, fmt.Errorf("RetrieveBlobsById: %v", err)
 	}
@@ -93,7 +121,7 @@ func (s *Store) RetrieveImageById(id int64) (*models.FunctronImage, error) {
 
 func (s *Store) RetrieveImageByName(name string) (*models.FunctronImage, error) {
 	ret := make([]models.FunctronImage, 0)
-	err := s.handle.Select(&ret, "SELECT id, name, docker_file, pre_commit_script, created, scheduled_build, scheduled_removal, finished, status FROM images WHERE name = $1", name)
+	err := s.handle.Select(&ret, "SELECT "+imageColumns+" FROM images WHERE name = $1", name)
 	if err != nil {
 		return nil, fmt.Errorf("RetrieveBlobsById: %v", err)
 	}
@@ -115,46 +143,68 @@ func (s *Store) RetrieveImages() ([]string, error) {
 	return ret, nil
 }
 
-
-func (s *Store) UpdateStatus (image *models.FunctronImage, newStatus models.ImageStatus) (*models.FunctronImage, error) {
-
-	sql := `UPDATE images SET status = $1 WHERE id = $2`
-	tx, err := s.handle.Begin()
+// RetrievePinnedImages returns the names of the images which are pinned.
+func (s *Store) RetrievePinnedImages() ([]string, error) {
+	ret := make([]string, 0)
+	err := s.handle.Select(&ret, "SELECT name FROM images WHERE pinned = 1 ORDER BY name")
 	if err != nil {
 		return nil, err
 	}
-	_, err = tx.Exec(sql, newStatus, image.Id)
+	return ret, nil
+}
+
+// RetrieveAllImages returns every image, newest first.
+func (s *Store) RetrieveAllImages() ([]models.FunctronImage, error) {
+	ret := make([]models.FunctronImage, 0)
+	err := s.handle.Select(&ret, "SELECT "+imageColumns+" FROM images ORDER BY created DESC")
 	if err != nil {
 		return nil, err
 	}
+	return ret, nil
+}
+
+// UpdateStatus changes an image's status, as long as the change is legal
+// and nothing else has changed it since image was retrieved, and records
+// the change with message. image is updated in place.
+func (s *Store) UpdateStatus(image *models.FunctronImage, newStatus models.ImageStatus, message string) error {
+	tx, err := s.handle.Beginx()
+	if err != nil {
+		return err
+	}
+	err = transitionImage(tx, image, newStatus, message)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 	err = tx.Commit()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	ret := *image
-	ret.Status = newStatus
-
-	return s.RetrieveImageById(image.Id)
-
+	if newStatus == models.ImageStatusCompleted {
+		now := time.Now()
+		image.Committed = &now
+	}
+	image.Status = newStatus
+	return nil
 }
 
 func (s *Store) RetrieveBuildPlan() (*models.BuildPlan, error) {
 
-	// TODO: test me
 	var ret models.BuildPlan
 
 	// Return a list of images which need cleanup
 	imagesNeedingCleanup := make([]models.FunctronImage, 0)
-	err := s.handle.Select(&imagesNeedingCleanup, `SELECT * FROM images 
+	err := s.handle.Select(&imagesNeedingCleanup, `SELECT `+imageColumns+` FROM images 
 														  WHERE scheduled_removal < $1 
-														  AND status != $2`, time.Now(), models.ImageStatusCleanedUp)
+														  AND status != $2
+														  AND pinned = 0`, time.Now(), models.ImageStatusCleanedUp)
 	if err != nil {
 		return nil, err
 	}
 
 	// Build a list of images which need building
 	imagesNeedingBuild := make([]models.FunctronImage, 0)
-	err = s.handle.Select(&imagesNeedingBuild, `SELECT * FROM images 
+	err = s.handle.Select(&imagesNeedingBuild, `SELECT `+imageColumns+` FROM images 
 														  WHERE scheduled_build < $1 
 														  AND status == $2`, time.Now(), models.ImageStatusScheduledForBuild)
 	if err != nil {
@@ -174,4 +224,24 @@ func (s *Store) RetrieveBuildPlan() (*models.BuildPlan, error) {
 	ret.ImagesNeedingBuild = imagesNeedingBuild
 	ret.ImagesNeedingCleanup = imagesNeedingCleanup
 	ret.NextTick = minimumDate
+
+	return &ret, nil
+}
+
+// CountImagesByStatus returns how many images are in each status.
+func (s *Store) CountImagesByStatus() (map[models.ImageStatus]int, error) {
+	rows := []struct {
+		Status models.ImageStatus `db:"status"`
+		Count  int                `db:"count"`
+	}{}
+	err := s.handle.Select(&rows, "SELECT status, COUNT(*) AS count FROM images GROUP BY status")
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[models.ImageStatus]int)
+	for _, r := range rows {
+		ret[r.Status] = r.Count
+	}
+	return ret, nil
 }
\ No newline at end of file
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"testing"
+	"github.com/Sentimentron/functron/interfaces"
 	"github.com/Sentimentron/functron/models"
 	"time"
 )
@@ -74,6 +75,13 @@ func TestStore_PersistImageForBuild(t *testing.T) {
 					So(newImage.Name, ShouldBeIn, images)
 				})
 
+				Convey("The new image should appear in RetrieveAllImages...", func(){
+					images, err := handle.RetrieveAllImages()
+					So(err, ShouldBeNil)
+					So(images, ShouldHaveLength, 1)
+					So(images[0].Name, ShouldEqual, newImage.Name)
+				})
+
 				Convey("The new image should be retrievable via ID...", func(){
 					image, err := handle.RetrieveImageById(newImage.Id)
 					So(err, ShouldBeNil)
@@ -87,23 +95,661 @@ func TestStore_PersistImageForBuild(t *testing.T) {
 				})
 
 				Convey("Should be able to update the status...", func(){
-					newestImage, err := handle.UpdateStatus(newImage, models.ImageStatusFailedCommit)
+					err := handle.UpdateStatus(newImage, models.ImageStatusPreparingForBuild, "preparing")
 					So(err, ShouldBeNil)
-					So(newestImage, ShouldNotBeNil)
-					So(newestImage.Status, ShouldEqual, models.ImageStatusFailedCommit)
+					So(newImage.Status, ShouldEqual, models.ImageStatusPreparingForBuild)
 
 					Convey("And that should be persisted...", func(){
 						newImage, err := handle.RetrieveImageById(newImage.Id)
 						So(err, ShouldBeNil)
-						So(newImage.Status,ShouldEqual,models.ImageStatusFailedCommit)
+						So(newImage.Status,ShouldEqual,models.ImageStatusPreparingForBuild)
+					})
+
+					Convey("And recorded in its history...", func(){
+						history, err := handle.RetrieveImageStatusHistory(newImage.Id)
+						So(err, ShouldBeNil)
+						So(history, ShouldHaveLength, 2)
+						So(history[0].From, ShouldBeEmpty)
+						So(history[0].To, ShouldEqual, models.ImageStatusScheduledForBuild)
+						So(history[1].From, ShouldEqual, models.ImageStatusScheduledForBuild)
+						So(history[1].To, ShouldEqual, models.ImageStatusPreparingForBuild)
+						So(history[1].Message, ShouldEqual, "preparing")
 					})
 
 				})
 
+				Convey("Illegal changes of status should be refused...", func(){
+					err := handle.UpdateStatus(newImage, models.ImageStatusCompleted, "")
+					So(err, ShouldEqual, interfaces.InvalidImageTransition)
+					So(newImage.Status, ShouldEqual, models.ImageStatusScheduledForBuild)
+				})
+
+				Convey("Changes of status should only be made by one of two racing builders...", func(){
+					stale := *newImage
+					So(handle.UpdateStatus(newImage, models.ImageStatusPreparingForBuild, "first"), ShouldBeNil)
+					So(handle.UpdateStatus(&stale, models.ImageStatusPreparingForBuild, "second"), ShouldEqual, interfaces.ImageChanged)
+					history, err := handle.RetrieveImageStatusHistory(newImage.Id)
+					So(err, ShouldBeNil)
+					So(history, ShouldHaveLength, 2)
+				})
+
+				Convey("Pinned images should be listed...", func(){
+					pinned, err := handle.RetrievePinnedImages()
+					So(err, ShouldBeNil)
+					So(pinned, ShouldBeEmpty)
+
+					image.Name = "__pinned-image"
+					image.Pinned = true
+					pinnedImage, err := handle.PersistImageForBuild(&image)
+					So(err, ShouldBeNil)
+					So(pinnedImage.Pinned, ShouldBeTrue)
+					pinned, err = handle.RetrievePinnedImages()
+					So(err, ShouldBeNil)
+					So(pinned, ShouldResemble, []string{"__pinned-image"})
+				})
+
+				Convey("The new image should be counted by status...", func(){
+					counts, err := handle.CountImagesByStatus()
+					So(err, ShouldBeNil)
+					So(counts[models.ImageStatusScheduledForBuild], ShouldEqual, 1)
+					So(counts[models.ImageStatusCompleted], ShouldEqual, 0)
+				})
+
+
+			})
+
+
+		})
+	})
+}
+
+func TestStore_APIKeys(t *testing.T) {
+	Convey("Given a new store...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "functronkeys")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		handle, err := CreateStore(tmpFile.Name())
+		So(err, ShouldBeNil)
+
+		Convey("Should be able to create an API key...", func() {
+			key, err := handle.CreateAPIKey(&models.APIKey{
+				Name:   "tests",
+				Prefix: "fn_abcd",
+				Hash:   "deadbeef",
+				Scopes: models.Scopes{models.ScopeExec, models.ScopeAdmin},
+			})
+			So(err, ShouldBeNil)
+			So(key.Id, ShouldBeGreaterThan, 0)
+			So(key.Scopes, ShouldResemble, models.Scopes{models.ScopeExec, models.ScopeAdmin})
+
+			Convey("It should be retrievable by hash...", func() {
+				found, err := handle.RetrieveAPIKeyByHash("deadbeef")
+				So(err, ShouldBeNil)
+				So(found.Id, ShouldEqual, key.Id)
+			})
+
+			Convey("Invocations should record which key made them...", func() {
+				inv, err := handle.PersistInvocation(&models.Invocation{
+					RequestID:    "req",
+					FunctionName: "fn",
+					APIKeyId:     &key.Id,
+					Network:      "none",
+				})
+				So(err, ShouldBeNil)
+				So(handle.FinishInvocation(inv.Id, "success", models.Usage{CPUSeconds: 1.5, MemoryPeakBytes: 1024}), ShouldBeNil)
+
+				invocations, err := handle.RetrieveInvocations(10)
+				So(err, ShouldBeNil)
+				So(invocations, ShouldHaveLength, 1)
+				So(*invocations[0].APIKeyId, ShouldEqual, key.Id)
+				So(invocations[0].Outcome, ShouldEqual, "success")
+				So(invocations[0].Network, ShouldEqual, "none")
+				So(invocations[0].Usage, ShouldResemble, models.Usage{CPUSeconds: 1.5, MemoryPeakBytes: 1024})
+			})
+
+			Convey("Once revoked, it shouldn't be retrievable by hash...", func() {
+				So(handle.RevokeAPIKey(key.Id), ShouldBeNil)
+				_, err := handle.RetrieveAPIKeyByHash("deadbeef")
+				So(err, ShouldEqual, interfaces.NoMatchingAPIKey)
+			})
+		})
+	})
+}
+
+func TestStore_Tenants(t *testing.T) {
+	Convey("Given a new store...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "functrontenants")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		handle, err := CreateStore(tmpFile.Name())
+		So(err, ShouldBeNil)
+
+		Convey("Should be able to create a tenant...", func() {
+			tenant, err := handle.CreateTenant(&models.Tenant{Name: "team-a", MaxConcurrent: 2})
+			So(err, ShouldBeNil)
+			So(tenant.Id, ShouldBeGreaterThan, 0)
+			So(tenant.MaxConcurrent, ShouldEqual, 2)
+			So(tenant.Weight, ShouldEqual, 1)
+
+			Convey("Usage should accumulate within a window...", func() {
+				window := time.Now().Truncate(time.Minute)
+				So(handle.AddUsage(tenant.Id, models.UsageInvocations, window, 1), ShouldBeNil)
+				So(handle.AddUsage(tenant.Id, models.UsageInvocations, window, 2), ShouldBeNil)
+
+				used, err := handle.RetrieveUsage(tenant.Id, models.UsageInvocations, window)
+				So(err, ShouldBeNil)
+				So(used, ShouldEqual, 3)
+
+				Convey("And be pruned once it's old...", func() {
+					So(handle.PruneUsage(window.Add(time.Minute)), ShouldBeNil)
+					used, err := handle.RetrieveUsage(tenant.Id, models.UsageInvocations, window)
+					So(err, ShouldBeNil)
+					So(used, ShouldEqual, 0)
+				})
+			})
+
+			Convey("Limits should be updatable...", func() {
+				tenant.InvocationsPerMinute = 60
+				tenant.Weight = 2.5
+				So(handle.UpdateTenantLimits(tenant), ShouldBeNil)
+				updated, err := handle.RetrieveTenantById(tenant.Id)
+				So(err, ShouldBeNil)
+				So(updated.InvocationsPerMinute, ShouldEqual, 60)
+				So(updated.Weight, ShouldEqual, 2.5)
+			})
+		})
+	})
+}
+
+func TestStore_Functions(t *testing.T) {
+	Convey("Given a new store...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "functronfunctions")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		handle, err := CreateStore(tmpFile.Name())
+		So(err, ShouldBeNil)
+
+		Convey("Should be able to register a function...", func() {
+			fn, err := handle.SaveFunction(&models.Function{
+				Name:            "echo",
+				Dockerfile:      "FROM alpine\nCMD cat",
+				BuildContext:    []byte("tar"),
+				TimeoutSeconds:  5,
+				Env:             models.EnvVars{{Name: "GREETING", Value: "hi"}, {Name: "TOKEN", Secret: "token"}},
+				SecurityProfile: "strict",
+				Network:         "none",
+			})
+			So(err, ShouldBeNil)
+			So(fn.Id, ShouldBeGreaterThan, 0)
+			So(fn.SecurityProfile, ShouldEqual, "strict")
+			So(fn.Network, ShouldEqual, "none")
+			So(fn.BuildContext, ShouldResemble, []byte("tar"))
+			So(fn.Env, ShouldResemble, models.EnvVars{{Name: "GREETING", Value: "hi"}, {Name: "TOKEN", Secret: "token"}})
+
+			Convey("Registering it again should replace it...", func() {
+				updated, err := handle.SaveFunction(&models.Function{
+					Name:           "echo",
+					Dockerfile:     "FROM alpine\nCMD cat -n",
+					TimeoutSeconds: 10,
+				})
+				So(err, ShouldBeNil)
+				So(updated.Id, ShouldEqual, fn.Id)
+				So(updated.Dockerfile, ShouldEqual, "FROM alpine\nCMD cat -n")
+				So(updated.Env, ShouldResemble, models.EnvVars{})
+				So(updated.SecurityProfile, ShouldEqual, "")
+
+				functions, err := handle.RetrieveFunctions()
+				So(err, ShouldBeNil)
+				So(functions, ShouldHaveLength, 1)
+			})
+
+			Convey("It should be deletable...", func() {
+				So(handle.DeleteFunction("echo"), ShouldBeNil)
+				_, err := handle.RetrieveFunctionByName("echo")
+				So(err, ShouldEqual, interfaces.NoMatchingFunction)
+				So(handle.DeleteFunction("echo"), ShouldEqual, interfaces.NoMatchingFunction)
+			})
+		})
+	})
+}
+
+func TestStore_Secrets(t *testing.T) {
+	Convey("Given a new store...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "functronsecrets")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		handle, err := CreateStore(tmpFile.Name())
+		So(err, ShouldBeNil)
+
+		Convey("Should be able to save a secret...", func() {
+			secret, err := handle.SaveSecret(&models.Secret{Name: "token", Sealed: []byte("sealed")})
+			So(err, ShouldBeNil)
+			So(secret.Id, ShouldBeGreaterThan, 0)
+
+			Convey("Saving it again should replace it...", func() {
+				_, err := handle.SaveSecret(&models.Secret{Name: "token", Sealed: []byte("resealed")})
+				So(err, ShouldBeNil)
+				secrets, err := handle.RetrieveSecrets()
+				So(err, ShouldBeNil)
+				So(secrets, ShouldHaveLength, 1)
+				So(secrets[0].Sealed, ShouldResemble, []byte("resealed"))
+			})
+
+			Convey("It should be deletable...", func() {
+				So(handle.DeleteSecret("token"), ShouldBeNil)
+				_, err := handle.RetrieveSecretByName("token")
+				So(err, ShouldEqual, interfaces.NoMatchingSecret)
+				So(handle.DeleteSecret("token"), ShouldEqual, interfaces.NoMatchingSecret)
+			})
+		})
+	})
+}
+
+func TestStore_ImageChanges(t *testing.T) {
+	Convey("Given a store with an image past its scheduled removal...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "functronimagechanges")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		handle, err := CreateStore(tmpFile.Name())
+		So(err, ShouldBeNil)
+
+		past := time.Now().Add(-time.Hour)
+		image, err := handle.PersistImageForBuild(&models.FunctronImage{Name: "expired", ScheduledForRemoval: &past})
+		So(err, ShouldBeNil)
+		keyId := int64(7)
+
+		cleanup := func() []models.FunctronImage {
+			plan, err := handle.RetrieveBuildPlan()
+			So(err, ShouldBeNil)
+			return plan.ImagesNeedingCleanup
+		}
+		So(cleanup(), ShouldHaveLength, 1)
+
+		Convey("Pinning it should keep it out of the build plan, and be recorded...", func() {
+			pinned, err := handle.PinImage(image, true, &keyId)
+			So(err, ShouldBeNil)
+			So(pinned.Pinned, ShouldBeTrue)
+			So(cleanup(), ShouldBeEmpty)
+
+			changes, err := handle.RetrieveImageChanges(image.Id)
+			So(err, ShouldBeNil)
+			So(changes, ShouldHaveLength, 1)
+			So(changes[0].Change, ShouldEqual, models.ImageChangePinned)
+			So(*changes[0].APIKeyId, ShouldEqual, keyId)
+		})
+
+		Convey("Rescheduling it should keep it out of the build plan until then...", func() {
+			later := time.Now().Add(time.Hour)
+			rescheduled, err := handle.RescheduleImageRemoval(image, later, "later", nil)
+			So(err, ShouldBeNil)
+			So(rescheduled.ScheduledForRemoval.Equal(later), ShouldBeTrue)
+			So(cleanup(), ShouldBeEmpty)
+		})
+
+		Convey("Changes should fail if its status has changed since it was retrieved...", func() {
+			stale := *image
+			So(handle.UpdateStatus(image, models.ImageStatusPreparingForBuild, ""), ShouldBeNil)
+			_, err = handle.RecordImageRemoval(&stale, nil)
+			So(err, ShouldEqual, interfaces.ImageChanged)
+			changes, err := handle.RetrieveImageChanges(image.Id)
+			So(err, ShouldBeNil)
+			So(changes, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestStore_ImageUsage(t *testing.T) {
+	Convey("Given a store with an image...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "functronimageusage")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		handle, err := CreateStore(tmpFile.Name())
+		So(err, ShouldBeNil)
+		_, err = handle.PersistImageForBuild(&models.FunctronImage{Name: "kept"})
+		So(err, ShouldBeNil)
+
+		Convey("Its usage should be saved, and images which aren't stored ignored...", func() {
+			usage, err := handle.RetrieveImageUsage()
+			So(err, ShouldBeNil)
+			So(usage, ShouldBeEmpty)
+
+			lastUsed := time.Now().Add(-time.Hour).Truncate(time.Second)
+			So(handle.SaveImageUsage([]models.ImageUsage{
+				{Name: "kept", LastUsed: lastUsed, SizeBytes: 100},
+				{Name: "unknown", LastUsed: lastUsed, SizeBytes: 200},
+			}), ShouldBeNil)
+			usage, err = handle.RetrieveImageUsage()
+			So(err, ShouldBeNil)
+			So(usage, ShouldHaveLength, 1)
+			So(usage[0].Name, ShouldEqual, "kept")
+			So(usage[0].LastUsed.Equal(lastUsed), ShouldBeTrue)
+			So(usage[0].SizeBytes, ShouldEqual, 100)
+		})
+	})
+}
+
+func TestStore_UsageReport(t *testing.T) {
+	Convey("Given a store with some finished invocations...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "functronusage")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		handle, err := CreateStore(tmpFile.Name())
+		So(err, ShouldBeNil)
+
+		tenant, err := handle.CreateTenant(&models.Tenant{Name: "acme"})
+		So(err, ShouldBeNil)
+		invoke := func(function string, tenantId *int64, usage models.Usage) *models.Invocation {
+			inv, err := handle.PersistInvocation(&models.Invocation{RequestID: "req", FunctionName: function, TenantId: tenantId})
+			So(err, ShouldBeNil)
+			So(handle.FinishInvocation(inv.Id, "success", usage), ShouldBeNil)
+			return inv
+		}
+		invoke("echo", &tenant.Id, models.Usage{CPUSeconds: 1, MemoryPeakBytes: 100, NetworkTxBytes: 10})
+		invoke("echo", &tenant.Id, models.Usage{CPUSeconds: 2, MemoryPeakBytes: 300, NetworkTxBytes: 20})
+		invoke("echo", nil, models.Usage{CPUSeconds: 4})
+		old := invoke("echo", &tenant.Id, models.Usage{CPUSeconds: 8})
+		yesterday := time.Now().UTC().AddDate(0, 0, -1)
+		_, err = handle.handle.Exec("UPDATE invocations SET started = $1 WHERE id = $2", yesterday, old.Id)
+		So(err, ShouldBeNil)
+		today := time.Now().UTC().Format("2006-01-02")
+
+		Convey("Usage should be totalled by day, function and tenant...", func() {
+			report, err := handle.RetrieveUsageReport(models.UsageFilter{})
+			So(err, ShouldBeNil)
+			So(report, ShouldHaveLength, 3)
+			So(report[0].Day, ShouldEqual, yesterday.Format("2006-01-02"))
+			So(report[0].CPUSeconds, ShouldEqual, 8)
+
+			So(report[1].Day, ShouldEqual, today)
+			So(report[1].TenantId, ShouldBeNil)
+			So(report[1].CPUSeconds, ShouldEqual, 4)
+
+			So(report[2].Day, ShouldEqual, today)
+			So(*report[2].TenantId, ShouldEqual, tenant.Id)
+			So(report[2].TenantName, ShouldEqual, "acme")
+			So(report[2].Invocations, ShouldEqual, 2)
+			So(report[2].Usage, ShouldResemble, models.Usage{CPUSeconds: 3, MemoryPeakBytes: 300, NetworkTxBytes: 30})
+		})
+
+		Convey("The report should be filterable...", func() {
+			report, err := handle.RetrieveUsageReport(models.UsageFilter{From: today, To: today, TenantId: &tenant.Id})
+			So(err, ShouldBeNil)
+			So(report, ShouldHaveLength, 1)
+			So(report[0].Invocations, ShouldEqual, 2)
+
+			report, err = handle.RetrieveUsageReport(models.UsageFilter{FunctionName: "cat"})
+			So(err, ShouldBeNil)
+			So(report, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestStore_Workflows(t *testing.T) {
+	Convey("Given a new store...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "functronworkflows")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		handle, err := CreateStore(tmpFile.Name())
+		So(err, ShouldBeNil)
+
+		Convey("Should be able to create a workflow, with a pending row for each node...", func() {
+			wf, err := handle.CreateWorkflow(&models.Workflow{
+				Id:         "wf",
+				Definition: "{}",
+				Status:     models.WorkflowRunning,
+			}, []string{"a", "b"})
+			So(err, ShouldBeNil)
+			So(wf.Stdin, ShouldResemble, []byte{})
+
+			nodes, err := handle.RetrieveWorkflowNodes("wf")
+			So(err, ShouldBeNil)
+			So(nodes, ShouldHaveLength, 2)
+			So(nodes[0].Status, ShouldEqual, models.WorkflowPending)
+
+			Convey("Its tasks should be counted by status...", func() {
+				So(handle.CreateWorkflowTasks([]models.WorkflowTask{
+					{WorkflowId: "wf", NodeId: "a", Index: 0, Input: []byte("x"), Status: models.WorkflowPending},
+					{WorkflowId: "wf", NodeId: "a", Index: 1, Input: []byte("y"), Status: models.WorkflowPending},
+				}), ShouldBeNil)
+				So(handle.UpdateWorkflowTask(&models.WorkflowTask{
+					WorkflowId: "wf", NodeId: "a", Index: 1, Status: models.WorkflowSucceeded, Output: []byte("Y"),
+				}), ShouldBeNil)
+
+				tasks, err := handle.RetrieveWorkflowTasks("wf", "a")
+				So(err, ShouldBeNil)
+				So(tasks, ShouldHaveLength, 2)
+				So(string(tasks[1].Output), ShouldEqual, "Y")
+				counts, err := handle.CountWorkflowTasks("wf")
+				So(err, ShouldBeNil)
+				So(counts, ShouldHaveLength, 2)
+			})
+
+			Convey("Once finished, it shouldn't be resumed...", func() {
+				unfinished, err := handle.RetrieveUnfinishedWorkflows()
+				So(err, ShouldBeNil)
+				So(unfinished, ShouldHaveLength, 1)
+
+				So(handle.FinishWorkflow("wf", models.WorkflowSucceeded), ShouldBeNil)
+				unfinished, err = handle.RetrieveUnfinishedWorkflows()
+				So(err, ShouldBeNil)
+				So(unfinished, ShouldHaveLength, 0)
+				wf, err := handle.RetrieveWorkflow("wf")
+				So(err, ShouldBeNil)
+				So(wf.Finished, ShouldNotBeNil)
+			})
+		})
+
+		Convey("Missing workflows should be reported...", func() {
+			_, err := handle.RetrieveWorkflow("nope")
+			So(err, ShouldEqual, interfaces.NoMatchingWorkflow)
+		})
+	})
+}
+
+func TestStore_Schedules(t *testing.T) {
+	Convey("Given a new store...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "functronschedules")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		handle, err := CreateStore(tmpFile.Name())
+		So(err, ShouldBeNil)
+
+		Convey("Should be able to save a schedule...", func() {
+			next := time.Now().Add(time.Hour)
+			sc, err := handle.SaveSchedule(&models.Schedule{
+				Name:     "nightly",
+				Cron:     "@nightly",
+				Function: "report",
+				Enabled:  true,
+				NextRun:  &next,
+			})
+			So(err, ShouldBeNil)
+			So(sc.Id, ShouldBeGreaterThan, 0)
+			So(sc.Stdin, ShouldResemble, []byte{})
+
+			Convey("Recording a run should move it on...", func() {
+				now := time.Now()
+				So(handle.UpdateScheduleRun(sc.Id, now, nil), ShouldBeNil)
+				updated, err := handle.RetrieveScheduleByName("nightly")
+				So(err, ShouldBeNil)
+				So(updated.LastRun, ShouldNotBeNil)
+				So(updated.NextRun, ShouldBeNil)
+
+				Convey("Saving it again should replace it, keeping its ID and last run...", func() {
+					replaced, err := handle.SaveSchedule(&models.Schedule{Name: "nightly", Cron: "@hourly", Function: "report"})
+					So(err, ShouldBeNil)
+					So(replaced.Id, ShouldEqual, sc.Id)
+					So(replaced.Cron, ShouldEqual, "@hourly")
+					So(replaced.Enabled, ShouldBeFalse)
+					So(replaced.LastRun, ShouldNotBeNil)
+				})
+			})
+
+			Convey("It should be deletable...", func() {
+				So(handle.DeleteSchedule("nightly"), ShouldBeNil)
+				_, err := handle.RetrieveScheduleByName("nightly")
+				So(err, ShouldEqual, interfaces.NoMatchingSchedule)
+				So(handle.DeleteSchedule("nightly"), ShouldEqual, interfaces.NoMatchingSchedule)
+			})
+		})
+	})
+}
 
+func TestStore_Webhooks(t *testing.T) {
+	Convey("Given a new store with a key...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "functronwebhooks")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		handle, err := CreateStore(tmpFile.Name())
+		So(err, ShouldBeNil)
+		key, err := handle.CreateAPIKey(&models.APIKey{Name: "hooks", Prefix: "fn_x", Hash: "x"})
+		So(err, ShouldBeNil)
+
+		Convey("A key's secret should be replaced when it's saved again...", func() {
+			_, err := handle.RetrieveWebhookSecret(key.Id)
+			So(err, ShouldEqual, interfaces.NoMatchingWebhookSecret)
+			_, err = handle.SaveWebhookSecret(key.Id, "first")
+			So(err, ShouldBeNil)
+			_, err = handle.SaveWebhookSecret(key.Id, "second")
+			So(err, ShouldBeNil)
+			secret, err := handle.RetrieveWebhookSecret(key.Id)
+			So(err, ShouldBeNil)
+			So(secret.Secret, ShouldEqual, "second")
+		})
+
+		Convey("Should be able to record attempts at a delivery...", func() {
+			delivery, err := handle.CreateWebhookDelivery(&models.WebhookDelivery{
+				JobId: "job", APIKeyId: key.Id, URL: "http://example.com", Payload: []byte("{}"),
 			})
+			So(err, ShouldBeNil)
+			So(delivery.Status, ShouldEqual, models.WebhookPending)
 
+			next := time.Now().Add(time.Minute)
+			So(handle.RecordWebhookAttempt(&models.WebhookAttempt{
+				DeliveryId: delivery.Id, Attempt: 1, Started: time.Now(), Error: "refused",
+			}, models.WebhookPending, &next), ShouldBeNil)
+			pending, err := handle.RetrievePendingWebhookDeliveries()
+			So(err, ShouldBeNil)
+			So(pending, ShouldHaveLength, 1)
+			So(pending[0].Attempts, ShouldEqual, 1)
+			So(pending[0].NextAttempt, ShouldNotBeNil)
 
+			code := 200
+			So(handle.RecordWebhookAttempt(&models.WebhookAttempt{
+				DeliveryId: delivery.Id, Attempt: 2, Started: time.Now(), StatusCode: &code,
+			}, models.WebhookDelivered, nil), ShouldBeNil)
+			pending, err = handle.RetrievePendingWebhookDeliveries()
+			So(err, ShouldBeNil)
+			So(pending, ShouldBeEmpty)
+
+			deliveries, err := handle.RetrieveWebhookDeliveries("job")
+			So(err, ShouldBeNil)
+			So(deliveries, ShouldHaveLength, 1)
+			So(deliveries[0].Status, ShouldEqual, models.WebhookDelivered)
+			So(deliveries[0].Finished, ShouldNotBeNil)
+			attempts, err := handle.RetrieveWebhookAttempts(delivery.Id)
+			So(err, ShouldBeNil)
+			So(attempts, ShouldHaveLength, 2)
+			So(attempts[0].Error, ShouldEqual, "refused")
+			So(*attempts[1].StatusCode, ShouldEqual, 200)
 		})
 	})
-}
\ No newline at end of file
+}
+
+func TestStore_Jobs(t *testing.T) {
+	Convey("Given a store with some queued jobs...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "functronjobs")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		handle, err := CreateStore(tmpFile.Name())
+		So(err, ShouldBeNil)
+
+		for _, job := range []models.Job{
+			{Id: "low", Function: "f", Request: []byte("{}"), Priority: -1, MaxAttempts: 1},
+			{Id: "first", Function: "f", Request: []byte("{}"), MaxAttempts: 1},
+			{Id: "second", Function: "f", Request: []byte("{}"), MaxAttempts: 2},
+			{Id: "urgent", Function: "f", Request: []byte("{}"), Priority: 10, MaxAttempts: 1},
+		} {
+			queued, err := handle.EnqueueJob(&job)
+			So(err, ShouldBeNil)
+			So(queued.Status, ShouldEqual, models.JobQueued)
+		}
+		lease := time.Now().Add(time.Minute)
+
+		Convey("Jobs should be claimed by priority, then in order...", func() {
+			order := make([]string, 0)
+			for {
+				job, err := handle.ClaimJob("worker", lease)
+				So(err, ShouldBeNil)
+				if job == nil {
+					break
+				}
+				So(job.Status, ShouldEqual, models.JobRunning)
+				So(job.Attempts, ShouldEqual, 1)
+				order = append(order, job.Id)
+			}
+			So(order, ShouldResemble, []string{"urgent", "first", "second", "low"})
+
+			running, err := handle.RetrieveJobs(models.JobRunning)
+			So(err, ShouldBeNil)
+			So(running, ShouldHaveLength, 4)
+		})
+
+		Convey("Only the lease's owner should be able to settle a job...", func() {
+			job, err := handle.ClaimJob("worker", lease)
+			So(err, ShouldBeNil)
+			So(handle.RenewJobLease(job.Id, "other", lease), ShouldEqual, interfaces.NoMatchingJob)
+			So(handle.SettleJob(job.Id, "other", models.JobSucceeded, nil, ""), ShouldEqual, interfaces.NoMatchingJob)
+			So(handle.RenewJobLease(job.Id, "worker", lease), ShouldBeNil)
+			So(handle.SettleJob(job.Id, "worker", models.JobSucceeded, []byte("result"), ""), ShouldBeNil)
+
+			settled, err := handle.RetrieveJob(job.Id)
+			So(err, ShouldBeNil)
+			So(settled.Status, ShouldEqual, models.JobSucceeded)
+			So(settled.Result, ShouldResemble, []byte("result"))
+			So(settled.Finished, ShouldNotBeNil)
+			So(settled.LeaseOwner, ShouldEqual, "")
+		})
+
+		Convey("Jobs with expired leases should be queued again, or be dead...", func() {
+			expired := time.Now().Add(-time.Second)
+			for i := 0; i < 3; i++ {
+				_, err := handle.ClaimJob("gone", expired)
+				So(err, ShouldBeNil)
+			}
+			released, err := handle.RequeueExpiredJobs(time.Now())
+			So(err, ShouldBeNil)
+			So(released, ShouldHaveLength, 3)
+			statuses := make(map[string]string)
+			for _, job := range released {
+				statuses[job.Id] = job.Status
+			}
+			So(statuses, ShouldResemble, map[string]string{
+				"urgent": models.JobDead, "first": models.JobDead, "second": models.JobQueued,
+			})
+
+			dead, err := handle.RetrieveJobs(models.JobDead)
+			So(err, ShouldBeNil)
+			So(dead, ShouldHaveLength, 2)
+			So(dead[0].LastError, ShouldContainSubstring, "lease")
+
+			Convey("Dead jobs can be requeued, with all their attempts...", func() {
+				So(handle.RequeueJob("urgent"), ShouldBeNil)
+				So(handle.RequeueJob("second"), ShouldEqual, interfaces.NoMatchingJob)
+				job, err := handle.ClaimJob("worker", lease)
+				So(err, ShouldBeNil)
+				So(job.Id, ShouldEqual, "urgent")
+				So(job.Attempts, ShouldEqual, 1)
+			})
+		})
+
+		Convey("Unknown jobs should be reported...", func() {
+			_, err := handle.RetrieveJob("nope")
+			So(err, ShouldEqual, interfaces.NoMatchingJob)
+			all, err := handle.RetrieveJobs("")
+			So(err, ShouldBeNil)
+			So(all, ShouldHaveLength, 4)
+			So(all[0].Id, ShouldEqual, "urgent")
+		})
+	})
+}
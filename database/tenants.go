@@ -0,0 +1,130 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/models"
+)
+
+const tenantColumns = "id, name, created, max_concurrent, invocations_per_minute, cpu_seconds_per_day, max_build_context_bytes, weight"
+
+// CreateTenant saves a new tenant and its limits.
+func (s *Store) CreateTenant(tenant *models.Tenant) (*models.Tenant, error) {
+	ret := *tenant
+	ret.Created = time.Now()
+	if ret.Weight == 0 {
+		ret.Weight = 1
+	}
+
+	sql := `
+		INSERT INTO tenants (name, created, max_concurrent, invocations_per_minute, cpu_seconds_per_day, max_build_context_bytes, weight)
+		VALUES (:name, :created, :max_concurrent, :invocations_per_minute, :cpu_seconds_per_day, :max_build_context_bytes, :weight)`
+
+	result, err := s.handle.NamedExec(sql, ret)
+	if err != nil {
+		return nil, err
+	}
+
+	newId, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return s.RetrieveTenantById(newId)
+}
+
+// RetrieveTenantById returns a tenant, or NoMatchingTenant.
+func (s *Store) RetrieveTenantById(id int64) (*models.Tenant, error) {
+	ret := make([]models.Tenant, 0)
+	err := s.handle.Select(&ret, "SELECT "+tenantColumns+" FROM tenants WHERE id = $1", id)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveTenantById: %v", err)
+	}
+	if len(ret) == 0 {
+		return nil, interfaces.NoMatchingTenant
+	}
+	return &ret[0], nil
+}
+
+// RetrieveTenants returns every tenant.
+func (s *Store) RetrieveTenants() ([]models.Tenant, error) {
+	ret := make([]models.Tenant, 0)
+	err := s.handle.Select(&ret, "SELECT "+tenantColumns+" FROM tenants ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// UpdateTenantLimits replaces a tenant's limits and weight with those in
+// tenant.
+func (s *Store) UpdateTenantLimits(tenant *models.Tenant) error {
+	updated := *tenant
+	if updated.Weight == 0 {
+		updated.Weight = 1
+	}
+	sql := `
+		UPDATE tenants SET
+			max_concurrent = :max_concurrent,
+			invocations_per_minute = :invocations_per_minute,
+			cpu_seconds_per_day = :cpu_seconds_per_day,
+			max_build_context_bytes = :max_build_context_bytes,
+			weight = :weight
+		WHERE id = :id`
+	result, err := s.handle.NamedExec(sql, updated)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return interfaces.NoMatchingTenant
+	}
+	return nil
+}
+
+// RetrieveUsage returns how much of metric a tenant used in the window
+// starting at windowStart.
+func (s *Store) RetrieveUsage(tenantId int64, metric string, windowStart time.Time) (float64, error) {
+	ret := make([]float64, 0)
+	err := s.handle.Select(&ret, `SELECT value FROM tenant_usage
+		WHERE tenant_id = $1 AND metric = $2 AND window_start = $3`, tenantId, metric, windowStart.UTC())
+	if err != nil {
+		return 0, err
+	}
+	if len(ret) == 0 {
+		return 0, nil
+	}
+	return ret[0], nil
+}
+
+// AddUsage adds delta to a tenant's use of metric in the window starting
+// at windowStart.
+func (s *Store) AddUsage(tenantId int64, metric string, windowStart time.Time, delta float64) error {
+	_, err := s.handle.Exec(`INSERT INTO tenant_usage (tenant_id, metric, window_start, value)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tenant_id, metric, window_start) DO UPDATE SET value = value + excluded.value`,
+		tenantId, metric, windowStart.UTC(), delta)
+	return err
+}
+
+// RetrieveTenantUsage returns every usage counter for a tenant whose
+// window started at or after since.
+func (s *Store) RetrieveTenantUsage(tenantId int64, since time.Time) ([]models.TenantUsage, error) {
+	ret := make([]models.TenantUsage, 0)
+	err := s.handle.Select(&ret, `SELECT tenant_id, metric, window_start, value FROM tenant_usage
+		WHERE tenant_id = $1 AND window_start >= $2 ORDER BY window_start, metric`, tenantId, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// PruneUsage deletes usage counters whose window started before before.
+func (s *Store) PruneUsage(before time.Time) error {
+	_, err := s.handle.Exec("DELETE FROM tenant_usage WHERE window_start < $1", before.UTC())
+	return err
+}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sentimentron/functron/models"
+)
+
+// RetrieveUsageReport totals what invocations used for each day (UTC),
+// function and tenant which filter matches, ordered by day, function and
+// tenant.
+func (s *Store) RetrieveUsageReport(filter models.UsageFilter) ([]models.UsageReport, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.From != "" {
+		where("date(i.started) >= $%d", filter.From)
+	}
+	if filter.To != "" {
+		where("date(i.started) <= $%d", filter.To)
+	}
+	if filter.FunctionName != "" {
+		where("i.function_name = $%d", filter.FunctionName)
+	}
+	if filter.TenantId != nil {
+		where("i.tenant_id = $%d", *filter.TenantId)
+	}
+
+	sql := `
+		SELECT date(i.started) AS day, i.function_name, i.tenant_id, COALESCE(t.name, '') AS tenant_name,
+			COUNT(*) AS invocations, SUM(i.cpu_seconds) AS cpu_seconds, MAX(i.memory_peak_bytes) AS memory_peak_bytes,
+			SUM(i.block_read_bytes) AS block_read_bytes, SUM(i.block_write_bytes) AS block_write_bytes,
+			SUM(i.network_rx_bytes) AS network_rx_bytes, SUM(i.network_tx_bytes) AS network_tx_bytes
+		FROM invocations i LEFT JOIN tenants t ON t.id = i.tenant_id`
+	if len(conditions) > 0 {
+		sql += "\n\t\tWHERE " + strings.Join(conditions, " AND ")
+	}
+	sql += `
+		GROUP BY day, i.function_name, i.tenant_id
+		ORDER BY day, i.function_name, i.tenant_id`
+
+	ret := make([]models.UsageReport, 0)
+	if err := s.handle.Select(&ret, sql, args...); err != nil {
+		return nil, fmt.Errorf("RetrieveUsageReport: %v", err)
+	}
+	return ret, nil
+}
@@ -0,0 +1,121 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/models"
+)
+
+const webhookDeliveryColumns = "id, job_id, api_key_id, url, payload, status, attempts, next_attempt, created, finished"
+
+// SaveWebhookSecret sets the secret which signs an API key's deliveries,
+// replacing any it had.
+func (s *Store) SaveWebhookSecret(apiKeyId int64, secret string) (*models.WebhookSecret, error) {
+	ret := &models.WebhookSecret{APIKeyId: apiKeyId, Secret: secret, Created: time.Now()}
+	_, err := s.handle.NamedExec(`
+		INSERT INTO webhook_secrets (api_key_id, secret, created) VALUES (:api_key_id, :secret, :created)
+		ON CONFLICT (api_key_id) DO UPDATE SET secret = excluded.secret, created = excluded.created`, ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// RetrieveWebhookSecret returns an API key's webhook secret, or
+// NoMatchingWebhookSecret.
+func (s *Store) RetrieveWebhookSecret(apiKeyId int64) (*models.WebhookSecret, error) {
+	ret := make([]models.WebhookSecret, 0)
+	err := s.handle.Select(&ret, "SELECT api_key_id, secret, created FROM webhook_secrets WHERE api_key_id = $1", apiKeyId)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveWebhookSecret: %v", err)
+	}
+	if len(ret) == 0 {
+		return nil, interfaces.NoMatchingWebhookSecret
+	}
+	return &ret[0], nil
+}
+
+// CreateWebhookDelivery saves a delivery which is ready to be attempted.
+func (s *Store) CreateWebhookDelivery(delivery *models.WebhookDelivery) (*models.WebhookDelivery, error) {
+	ret := *delivery
+	ret.Created = time.Now()
+	ret.Status = models.WebhookPending
+	ret.Attempts = 0
+	ret.NextAttempt = &ret.Created
+	ret.Finished = nil
+
+	result, err := s.handle.NamedExec(`
+		INSERT INTO webhook_deliveries (job_id, api_key_id, url, payload, status, attempts, next_attempt, created)
+		VALUES (:job_id, :api_key_id, :url, :payload, :status, :attempts, :next_attempt, :created)`, ret)
+	if err != nil {
+		return nil, err
+	}
+	ret.Id, err = result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// RecordWebhookAttempt saves an attempt at a delivery, along with the
+// delivery's new status and when it should next be tried (if it should).
+func (s *Store) RecordWebhookAttempt(attempt *models.WebhookAttempt, status string, nextAttempt *time.Time) error {
+	tx, err := s.handle.Beginx()
+	if err != nil {
+		return err
+	}
+	_, err = tx.NamedExec(`
+		INSERT INTO webhook_attempts (delivery_id, attempt, started, duration_seconds, status_code, error)
+		VALUES (:delivery_id, :attempt, :started, :duration_seconds, :status_code, :error)`, attempt)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("RecordWebhookAttempt: %v", err)
+	}
+
+	var finished *time.Time
+	if status != models.WebhookPending {
+		now := time.Now()
+		finished = &now
+	}
+	_, err = tx.Exec("UPDATE webhook_deliveries SET status = $1, attempts = $2, next_attempt = $3, finished = $4 WHERE id = $5",
+		status, attempt.Attempt, nextAttempt, finished, attempt.DeliveryId)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("RecordWebhookAttempt: %v", err)
+	}
+	return tx.Commit()
+}
+
+// RetrievePendingWebhookDeliveries returns every delivery which still
+// needs to be attempted.
+func (s *Store) RetrievePendingWebhookDeliveries() ([]models.WebhookDelivery, error) {
+	ret := make([]models.WebhookDelivery, 0)
+	err := s.handle.Select(&ret, "SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE status = $1 ORDER BY id", models.WebhookPending)
+	if err != nil {
+		return nil, fmt.Errorf("RetrievePendingWebhookDeliveries: %v", err)
+	}
+	return ret, nil
+}
+
+// RetrieveWebhookDeliveries returns a job's deliveries, oldest first.
+func (s *Store) RetrieveWebhookDeliveries(jobId string) ([]models.WebhookDelivery, error) {
+	ret := make([]models.WebhookDelivery, 0)
+	err := s.handle.Select(&ret, "SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE job_id = $1 ORDER BY id", jobId)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveWebhookDeliveries: %v", err)
+	}
+	return ret, nil
+}
+
+// RetrieveWebhookAttempts returns each attempt at a delivery, in order.
+func (s *Store) RetrieveWebhookAttempts(deliveryId int64) ([]models.WebhookAttempt, error) {
+	ret := make([]models.WebhookAttempt, 0)
+	err := s.handle.Select(&ret, `SELECT delivery_id, attempt, started, duration_seconds, status_code, error
+		FROM webhook_attempts WHERE delivery_id = $1 ORDER BY attempt`, deliveryId)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveWebhookAttempts: %v", err)
+	}
+	return ret, nil
+}
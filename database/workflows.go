@@ -0,0 +1,146 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/models"
+)
+
+const workflowColumns = "id, definition, stdin, status, api_key_id, created, finished"
+
+const workflowNodeColumns = "workflow_id, node_id, status, output, error, started, finished"
+
+const workflowTaskColumns = "workflow_id, node_id, idx, input, status, output, stderr, exit_code, error"
+
+// CreateWorkflow saves a new workflow, along with a pending row for each of
+// its nodes.
+func (s *Store) CreateWorkflow(workflow *models.Workflow, nodeIds []string) (*models.Workflow, error) {
+	ret := *workflow
+	ret.Created = time.Now()
+	ret.Finished = nil
+	if ret.Stdin == nil {
+		ret.Stdin = []byte{}
+	}
+
+	tx, err := s.handle.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.NamedExec(`
+		INSERT INTO workflows (id, definition, stdin, status, api_key_id, created)
+		VALUES (:id, :definition, :stdin, :status, :api_key_id, :created)`, ret)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("CreateWorkflow: %v", err)
+	}
+	for _, nodeId := range nodeIds {
+		_, err = tx.Exec("INSERT INTO workflow_nodes (workflow_id, node_id, status) VALUES ($1, $2, $3)",
+			ret.Id, nodeId, models.WorkflowPending)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("CreateWorkflow: %v", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// RetrieveWorkflow returns a workflow, or NoMatchingWorkflow.
+func (s *Store) RetrieveWorkflow(id string) (*models.Workflow, error) {
+	ret := make([]models.Workflow, 0)
+	err := s.handle.Select(&ret, "SELECT "+workflowColumns+" FROM workflows WHERE id = $1", id)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveWorkflow: %v", err)
+	}
+	if len(ret) == 0 {
+		return nil, interfaces.NoMatchingWorkflow
+	}
+	return &ret[0], nil
+}
+
+// RetrieveUnfinishedWorkflows returns every workflow which is still
+// running, oldest first.
+func (s *Store) RetrieveUnfinishedWorkflows() ([]models.Workflow, error) {
+	ret := make([]models.Workflow, 0)
+	err := s.handle.Select(&ret, "SELECT "+workflowColumns+" FROM workflows WHERE status = $1 ORDER BY created", models.WorkflowRunning)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveUnfinishedWorkflows: %v", err)
+	}
+	return ret, nil
+}
+
+// FinishWorkflow records that a workflow has succeeded or failed.
+func (s *Store) FinishWorkflow(id string, status string) error {
+	_, err := s.handle.Exec("UPDATE workflows SET status = $1, finished = $2 WHERE id = $3", status, time.Now(), id)
+	return err
+}
+
+// RetrieveWorkflowNodes returns the state of each of a workflow's nodes.
+func (s *Store) RetrieveWorkflowNodes(workflowId string) ([]models.WorkflowNode, error) {
+	ret := make([]models.WorkflowNode, 0)
+	err := s.handle.Select(&ret, "SELECT "+workflowNodeColumns+" FROM workflow_nodes WHERE workflow_id = $1", workflowId)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveWorkflowNodes: %v", err)
+	}
+	return ret, nil
+}
+
+// UpdateWorkflowNode saves the state of a workflow node.
+func (s *Store) UpdateWorkflowNode(node *models.WorkflowNode) error {
+	_, err := s.handle.NamedExec(`
+		UPDATE workflow_nodes SET status = :status, output = :output, error = :error, started = :started, finished = :finished
+		WHERE workflow_id = :workflow_id AND node_id = :node_id`, node)
+	return err
+}
+
+// CreateWorkflowTasks saves the tasks which a workflow node will run.
+func (s *Store) CreateWorkflowTasks(tasks []models.WorkflowTask) error {
+	tx, err := s.handle.Beginx()
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		_, err = tx.NamedExec(`
+			INSERT INTO workflow_tasks (workflow_id, node_id, idx, input, status)
+			VALUES (:workflow_id, :node_id, :idx, :input, :status)`, task)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("CreateWorkflowTasks: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// RetrieveWorkflowTasks returns a workflow node's tasks, in order.
+func (s *Store) RetrieveWorkflowTasks(workflowId, nodeId string) ([]models.WorkflowTask, error) {
+	ret := make([]models.WorkflowTask, 0)
+	err := s.handle.Select(&ret, "SELECT "+workflowTaskColumns+" FROM workflow_tasks WHERE workflow_id = $1 AND node_id = $2 ORDER BY idx",
+		workflowId, nodeId)
+	if err != nil {
+		return nil, fmt.Errorf("RetrieveWorkflowTasks: %v", err)
+	}
+	return ret, nil
+}
+
+// UpdateWorkflowTask saves the outcome of a workflow task.
+func (s *Store) UpdateWorkflowTask(task *models.WorkflowTask) error {
+	_, err := s.handle.NamedExec(`
+		UPDATE workflow_tasks SET status = :status, output = :output, stderr = :stderr, exit_code = :exit_code, error = :error
+		WHERE workflow_id = :workflow_id AND node_id = :node_id AND idx = :idx`, task)
+	return err
+}
+
+// CountWorkflowTasks counts each node's tasks by status.
+func (s *Store) CountWorkflowTasks(workflowId string) ([]models.WorkflowTaskCount, error) {
+	ret := make([]models.WorkflowTaskCount, 0)
+	err := s.handle.Select(&ret, `SELECT node_id, status, COUNT(*) AS count FROM workflow_tasks
+		WHERE workflow_id = $1 GROUP BY node_id, status`, workflowId)
+	if err != nil {
+		return nil, fmt.Errorf("CountWorkflowTasks: %v", err)
+	}
+	return ret, nil
+}
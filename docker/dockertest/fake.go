@@ -0,0 +1,313 @@
+// Package dockertest provides a fake interfaces.ContainerRuntime, so that
+// Functron can be tested without docker.
+package dockertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/models"
+)
+
+// ErrBuildFailed is returned by Build when FailBuild is set.
+var ErrBuildFailed = errors.New("dockertest: build failed")
+
+// RunFunc is called in place of running a container.
+type RunFunc func(ctx context.Context, spec interfaces.RunSpec) (int, error)
+
+// Cat is the default RunFunc: it copies stdin to stdout, like `cat`.
+func Cat(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+	if spec.Stdin != nil {
+		if _, err := io.Copy(spec.Stdout, spec.Stdin); err != nil {
+			return -1, err
+		}
+	}
+	return 0, nil
+}
+
+// Sleep is a RunFunc which blocks until ctx is done, as a function
+// which never finishes would.
+func Sleep(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+	<-ctx.Done()
+	return -1, ctx.Err()
+}
+
+// Exit returns a RunFunc which writes message to stderr and exits with code.
+func Exit(code int, message string) RunFunc {
+	return func(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+		fmt.Fprint(spec.Stderr, message)
+		return code, nil
+	}
+}
+
+// FakeRuntime records what it's asked to do, and runs RunFunc in place of
+// each container. It's safe for concurrent use.
+type FakeRuntime struct {
+	// RunFunc is called for each container (Cat if nil)
+	RunFunc RunFunc
+	// FailBuild makes every Build fail
+	FailBuild bool
+	// BuildFunc, if set, is called at the start of each Build, e.g. to
+	// hold builds until several have started
+	BuildFunc func(spec interfaces.BuildSpec)
+	// Usage is what Stats reports for every container
+	Usage models.Usage
+
+	lock sync.Mutex
+	// Images which are currently built, by tag
+	Images map[string]interfaces.BuildSpec
+	// ImageIDs holds the ID of each image in Images which has one. Build
+	// gives each image a new ID, and keeps the image it replaces (untagged)
+	// in Untagged until it's removed by ID.
+	ImageIDs map[string]string
+	Untagged map[string]bool
+	// lastID is the last ID Build gave an image
+	lastID int
+	// Dockerfiles holds the Dockerfile each image was built from
+	Dockerfiles map[string]string
+	// ImageSizes is what ImageSize reports for each tag (0 if it's not set)
+	ImageSizes map[string]int64
+	// Containers which have been created but not started, by name
+	Containers map[string]interfaces.RunSpec
+	// Networks which have been created, and whether they're internal
+	Networks map[string]bool
+	// RemovedNetworks lists the networks which have been removed, in order
+	RemovedNetworks []string
+	// Builds, Runs, Creates and Removals record every call. Runs includes
+	// containers started after being created.
+	Builds   []interfaces.BuildSpec
+	Runs     []interfaces.RunSpec
+	Creates  []interfaces.RunSpec
+	Removals []string
+}
+
+// CreateFakeRuntime returns a FakeRuntime whose containers behave like `cat`.
+func CreateFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		Images:      make(map[string]interfaces.BuildSpec),
+		ImageIDs:    make(map[string]string),
+		Untagged:    make(map[string]bool),
+		Dockerfiles: make(map[string]string),
+		ImageSizes:  make(map[string]int64),
+		Containers:  make(map[string]interfaces.RunSpec),
+		Networks:    make(map[string]bool),
+	}
+}
+
+// Build pretends to build spec.Dir.
+func (f *FakeRuntime) Build(ctx context.Context, spec interfaces.BuildSpec) ([]byte, []byte, error) {
+	if f.BuildFunc != nil {
+		f.BuildFunc(spec)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.Builds = append(f.Builds, spec)
+	if f.FailBuild {
+		return []byte("Step 1/1\n"), []byte("build failed\n"), ErrBuildFailed
+	}
+	dockerfile, err := ioutil.ReadFile(filepath.Join(spec.Dir, "Dockerfile"))
+	if err != nil {
+		return nil, []byte(err.Error()), err
+	}
+	if id := f.ImageIDs[spec.Tag]; id != "" {
+		f.Untagged[id] = true
+	}
+	f.lastID++
+	f.Images[spec.Tag] = spec
+	f.ImageIDs[spec.Tag] = fmt.Sprintf("%012x", f.lastID)
+	f.Dockerfiles[spec.Tag] = string(dockerfile)
+	return []byte("Successfully tagged " + spec.Tag + "\n"), nil, nil
+}
+
+// Run calls RunFunc, if the image has been built.
+func (f *FakeRuntime) Run(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+	f.lock.Lock()
+	f.Runs = append(f.Runs, spec)
+	_, built := f.Images[spec.Image]
+	run := f.RunFunc
+	f.lock.Unlock()
+
+	if !built {
+		fmt.Fprintf(spec.Stderr, "Unable to find image '%s' locally\n", spec.Image)
+		return 125, nil
+	}
+	if run == nil {
+		run = Cat
+	}
+	return run(ctx, spec)
+}
+
+// Create records a container, if the image has been built.
+func (f *FakeRuntime) Create(ctx context.Context, spec interfaces.RunSpec) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.Creates = append(f.Creates, spec)
+	if _, built := f.Images[spec.Image]; !built {
+		return fmt.Errorf("dockertest: no such image: %s", spec.Image)
+	}
+	if _, exists := f.Containers[spec.Name]; exists {
+		return fmt.Errorf("dockertest: container %s already exists", spec.Name)
+	}
+	f.Containers[spec.Name] = spec
+	return nil
+}
+
+// Start calls RunFunc for a created container, which is then forgotten.
+func (f *FakeRuntime) Start(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+	f.lock.Lock()
+	created, ok := f.Containers[spec.Name]
+	delete(f.Containers, spec.Name)
+	run := f.RunFunc
+	f.lock.Unlock()
+
+	if !ok {
+		return -1, fmt.Errorf("dockertest: no such container: %s", spec.Name)
+	}
+	created.Stdin, created.Stdout, created.Stderr = spec.Stdin, spec.Stdout, spec.Stderr
+
+	f.lock.Lock()
+	f.Runs = append(f.Runs, created)
+	f.lock.Unlock()
+	if run == nil {
+		run = Cat
+	}
+	return run(ctx, created)
+}
+
+// Stats reports Usage.
+func (f *FakeRuntime) Stats(ctx context.Context, name string) (models.Usage, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.Usage, nil
+}
+
+// CreateNetwork records a network, unless one already has the name.
+func (f *FakeRuntime) CreateNetwork(ctx context.Context, name string, internal bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, exists := f.Networks[name]; !exists {
+		f.Networks[name] = internal
+	}
+	return nil
+}
+
+// RemoveNetwork forgets about a network, and records that it was removed.
+func (f *FakeRuntime) RemoveNetwork(ctx context.Context, name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, exists := f.Networks[name]; !exists {
+		return fmt.Errorf("dockertest: no such network: %s", name)
+	}
+	delete(f.Networks, name)
+	f.RemovedNetworks = append(f.RemovedNetworks, name)
+	return nil
+}
+
+// RemoveContainer forgets about a created container.
+func (f *FakeRuntime) RemoveContainer(ctx context.Context, name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.Containers[name]; !ok {
+		return fmt.Errorf("dockertest: no such container: %s", name)
+	}
+	delete(f.Containers, name)
+	return nil
+}
+
+// ListImages lists the repository, tag and ID of each image which is
+// currently built, one per line, as `docker images` would. Untagged images
+// are listed as "<none>".
+func (f *FakeRuntime) ListImages() (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	tags := make([]string, 0, len(f.Images)+len(f.Untagged))
+	for tag := range f.Images {
+		repository, version := tag, "latest"
+		if i := strings.LastIndex(tag, ":"); i >= 0 {
+			repository, version = tag[:i], tag[i+1:]
+		}
+		tags = append(tags, repository+"\t"+version+"\t"+f.ImageIDs[tag])
+	}
+	for id := range f.Untagged {
+		tags = append(tags, "<none>\t<none>\t"+id)
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, "\n"), nil
+}
+
+// RemoveImage forgets about an image, by tag or ID.
+func (f *FakeRuntime) RemoveImage(ctx context.Context, tag string) ([]byte, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.Removals = append(f.Removals, tag)
+	if f.Untagged[tag] {
+		delete(f.Untagged, tag)
+		return []byte("Deleted: " + tag + "\n"), nil
+	}
+	for t, id := range f.ImageIDs {
+		if id == tag {
+			tag = t
+		}
+	}
+	if _, ok := f.Images[tag]; !ok {
+		return nil, fmt.Errorf("dockertest: no such image: %s", tag)
+	}
+	delete(f.Images, tag)
+	delete(f.ImageIDs, tag)
+	return []byte("Untagged: " + tag + "\n"), nil
+}
+
+// ImageSize reports the size set in ImageSizes, if the image is built.
+func (f *FakeRuntime) ImageSize(ctx context.Context, tag string) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.Images[tag]; !ok {
+		return 0, fmt.Errorf("dockertest: no such image: %s", tag)
+	}
+	return f.ImageSizes[tag], nil
+}
+
+// RunCount returns how many containers have been run.
+func (f *FakeRuntime) RunCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.Runs)
+}
+
+// CreateCount returns how many containers have been created.
+func (f *FakeRuntime) CreateCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.Creates)
+}
+
+// ContainerCount returns how many created containers haven't been started
+// or removed.
+func (f *FakeRuntime) ContainerCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.Containers)
+}
+
+// BuildCount returns how many images have been built.
+func (f *FakeRuntime) BuildCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.Builds)
+}
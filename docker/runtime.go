@@ -0,0 +1,289 @@
+// Package docker runs Functron's containers using the docker command.
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sentimentron/functron/interfaces"
+)
+
+// killGracePeriod is how long to wait for `docker run` to exit after its
+// container has been killed, before killing the client too.
+const killGracePeriod = 10 * time.Second
+
+// CommandRuntime implements interfaces.ContainerRuntime by running the
+// docker command.
+type CommandRuntime struct {
+	// Binary is the docker command to run (normally just "docker")
+	Binary string
+}
+
+// CreateCommandRuntime returns a runtime which uses "docker" from $PATH.
+func CreateCommandRuntime() *CommandRuntime {
+	return &CommandRuntime{"docker"}
+}
+
+// labelArgs turns labels into --label flags, in a stable order.
+func labelArgs(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	ret := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		ret = append(ret, "--label", k+"="+labels[k])
+	}
+	return ret
+}
+
+// Build runs `docker build`.
+func (r *CommandRuntime) Build(ctx context.Context, spec interfaces.BuildSpec) ([]byte, []byte, error) {
+	args := []string{"build", "--rm"}
+	args = append(args, labelArgs(spec.Labels)...)
+	args = append(args, "-t", spec.Tag, spec.Dir)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, r.Binary, args...)
+	cmd.Dir = spec.Dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// Run runs `docker run`, and `docker kill` if ctx is done first. The
+// container is removed when it exits.
+func (r *CommandRuntime) Run(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+	envFile, err := writeEnvFile(spec.Env)
+	if err != nil {
+		return -1, err
+	}
+	defer removeEnvFile(envFile)
+	args := []string{"run", "-i", "--rm", "--stop-timeout", "5", "--name", spec.Name}
+	args = append(args, containerArgs(spec, envFile)...)
+	return r.attach(ctx, spec, args)
+}
+
+// Create runs `docker create`. The container is removed when it exits.
+func (r *CommandRuntime) Create(ctx context.Context, spec interfaces.RunSpec) error {
+	envFile, err := writeEnvFile(spec.Env)
+	if err != nil {
+		return err
+	}
+	defer removeEnvFile(envFile)
+	args := []string{"create", "-i", "--rm", "--stop-timeout", "5", "--name", spec.Name}
+	args = append(args, containerArgs(spec, envFile)...)
+	out, err := exec.CommandContext(ctx, r.Binary, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker create failed: %s: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// Start runs `docker start -ai`, and `docker kill` if ctx is done first.
+func (r *CommandRuntime) Start(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+	return r.attach(ctx, spec, []string{"start", "-ai", spec.Name})
+}
+
+// RemoveContainer runs `docker rm -f`.
+func (r *CommandRuntime) RemoveContainer(ctx context.Context, name string) error {
+	out, err := exec.CommandContext(ctx, r.Binary, "rm", "-f", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker rm failed: %s: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// CreateNetwork runs `docker network create`, unless `docker network
+// inspect` finds the network already exists.
+func (r *CommandRuntime) CreateNetwork(ctx context.Context, name string, internal bool) error {
+	if exec.CommandContext(ctx, r.Binary, "network", "inspect", name).Run() == nil {
+		return nil
+	}
+	args := []string{"network", "create", "--driver", "bridge"}
+	if internal {
+		args = append(args, "--internal")
+	}
+	out, err := exec.CommandContext(ctx, r.Binary, append(args, name)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker network create failed: %s: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// RemoveNetwork runs `docker network rm`.
+func (r *CommandRuntime) RemoveNetwork(ctx context.Context, name string) error {
+	out, err := exec.CommandContext(ctx, r.Binary, "network", "rm", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker network rm failed: %s: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// containerArgs turns spec's labels, volumes, network and image, and the
+// environment file written by writeEnvFile, into arguments for `docker run`
+// or `docker create`.
+func containerArgs(spec interfaces.RunSpec, envFile string) []string {
+	args := labelArgs(spec.Labels)
+	for _, v := range spec.Volumes {
+		args = append(args, "-v", v)
+	}
+	if envFile != "" {
+		args = append(args, "--env-file", envFile)
+	}
+	args = append(args, securityArgs(spec.Security)...)
+	if spec.Network != "" {
+		args = append(args, "--network", spec.Network)
+	}
+	return append(args, spec.Image)
+}
+
+// securityArgs turns s into arguments for `docker run` or `docker create`.
+func securityArgs(s interfaces.Security) []string {
+	var args []string
+	if s.User != "" {
+		args = append(args, "--user", s.User)
+	}
+	if s.ReadOnlyRootfs {
+		args = append(args, "--read-only")
+	}
+	paths := make([]string, 0, len(s.Tmpfs))
+	for path := range s.Tmpfs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		args = append(args, "--tmpfs", path+":"+s.Tmpfs[path])
+	}
+	for _, c := range s.CapDrop {
+		args = append(args, "--cap-drop", c)
+	}
+	if s.NoNewPrivileges {
+		args = append(args, "--security-opt", "no-new-privileges")
+	}
+	if s.SeccompProfile != "" {
+		args = append(args, "--security-opt", "seccomp="+s.SeccompProfile)
+	}
+	if s.Runtime != "" {
+		args = append(args, "--runtime", s.Runtime)
+	}
+	return args
+}
+
+// writeEnvFile writes env to a file which only we can read, for docker's
+// --env-file, so that values (which might be secret) don't appear in the
+// process list, and can't change how the docker command itself behaves. It
+// returns "" if there's nothing to write.
+func writeEnvFile(env []string) (string, error) {
+	if len(env) == 0 {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	for _, e := range env {
+		if strings.ContainsAny(e, "\r\n") {
+			return "", fmt.Errorf("%s contains a line break", strings.SplitN(e, "=", 2)[0])
+		}
+		buf.WriteString(e)
+		buf.WriteByte('\n')
+	}
+	f, err := os.CreateTemp("", "functron-env-")
+	if err != nil {
+		return "", fmt.Errorf("could not create environment file: %s", err)
+	}
+	_, err = f.Write(buf.Bytes())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("could not write environment file: %s", err)
+	}
+	return f.Name(), nil
+}
+
+// removeEnvFile removes a file written by writeEnvFile, if there was one.
+func removeEnvFile(path string) {
+	if path != "" {
+		os.Remove(path)
+	}
+}
+
+// attach runs a docker command which is attached to the container
+// spec.Name, killing the container if ctx is done before it exits.
+func (r *CommandRuntime) attach(ctx context.Context, spec interfaces.RunSpec, args []string) (int, error) {
+	cmd := exec.Command(r.Binary, args...)
+	cmd.Stdin = spec.Stdin
+	cmd.Stdout = spec.Stdout
+	cmd.Stderr = spec.Stderr
+	if err := cmd.Start(); err != nil {
+		return -1, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return exitCode(err)
+	case <-ctx.Done():
+	}
+
+	// Killing the client doesn't stop the container, so ask docker to
+	exec.Command(r.Binary, "kill", spec.Name).Run()
+	select {
+	case <-done:
+	case <-time.After(killGracePeriod):
+		cmd.Process.Kill()
+		<-done
+	}
+	return -1, ctx.Err()
+}
+
+// RemoveImage runs `docker rmi -f`.
+func (r *CommandRuntime) RemoveImage(ctx context.Context, tag string) ([]byte, error) {
+	return exec.CommandContext(ctx, r.Binary, "rmi", "-f", tag).CombinedOutput()
+}
+
+// ImageSize runs `docker image inspect`.
+func (r *CommandRuntime) ImageSize(ctx context.Context, tag string) (int64, error) {
+	out, err := exec.CommandContext(ctx, r.Binary, "image", "inspect", "--format", "{{.Size}}", tag).Output()
+	if err != nil {
+		return 0, fmt.Errorf("docker image inspect failed: %s", err)
+	}
+	size, err := strconv.ParseInt(string(bytes.TrimSpace(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse size of %s: %s", tag, err)
+	}
+	return size, nil
+}
+
+// ListImages runs `docker images`, printing each image's repository, tag
+// and ID.
+func (r *CommandRuntime) ListImages() (string, error) {
+	out, err := exec.Command(r.Binary, "images", "--format", "{{.Repository}}\t{{.Tag}}\t{{.ID}}").Output()
+	return string(out), err
+}
+
+// exitCode converts the result of cmd.Wait into an exit code. Failing to
+// run the command at all is still an error.
+func exitCode(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	return -1, err
+}
@@ -0,0 +1,111 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sentimentron/functron/interfaces"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestContainerArgs(t *testing.T) {
+	Convey("Given a container spec...", t, func() {
+		spec := interfaces.RunSpec{
+			Image:   "functron-echo:1.0",
+			Labels:  map[string]string{"b": "2", "a": "1"},
+			Volumes: []string{"/tmp/ws:/data"},
+			Env:     []string{"TOKEN=hunter2"},
+		}
+
+		Convey("Environment values shouldn't appear in the arguments...", func() {
+			So(containerArgs(spec, "/tmp/env"), ShouldResemble, []string{
+				"--label", "a=1", "--label", "b=2",
+				"-v", "/tmp/ws:/data",
+				"--env-file", "/tmp/env",
+				"functron-echo:1.0",
+			})
+		})
+
+		Convey("Its security options should be passed on...", func() {
+			spec.Env = nil
+			spec.Labels = nil
+			spec.Security = interfaces.Security{
+				User:            "1000:1000",
+				ReadOnlyRootfs:  true,
+				Tmpfs:           map[string]string{"/tmp": "size=64m"},
+				CapDrop:         []string{"ALL"},
+				NoNewPrivileges: true,
+				SeccompProfile:  "/etc/seccomp.json",
+				Runtime:         "runsc",
+			}
+			So(containerArgs(spec, ""), ShouldResemble, []string{
+				"-v", "/tmp/ws:/data",
+				"--user", "1000:1000",
+				"--read-only",
+				"--tmpfs", "/tmp:size=64m",
+				"--cap-drop", "ALL",
+				"--security-opt", "no-new-privileges",
+				"--security-opt", "seccomp=/etc/seccomp.json",
+				"--runtime", "runsc",
+				"functron-echo:1.0",
+			})
+		})
+
+		Convey("Its network should be passed on...", func() {
+			spec.Env = nil
+			spec.Labels = nil
+			spec.Network = "none"
+			So(containerArgs(spec, ""), ShouldResemble, []string{
+				"-v", "/tmp/ws:/data",
+				"--network", "none",
+				"functron-echo:1.0",
+			})
+		})
+	})
+}
+
+func TestEnvFile(t *testing.T) {
+	Convey("Given a container's environment...", t, func() {
+		env := []string{"TOKEN=hunter2", "DOCKER_HOST=tcp://example.com:2375"}
+
+		Convey("It should be written to a file only we can read...", func() {
+			path, err := writeEnvFile(env)
+			So(err, ShouldBeNil)
+			defer removeEnvFile(path)
+			info, err := os.Stat(path)
+			So(err, ShouldBeNil)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+			contents, err := os.ReadFile(path)
+			So(err, ShouldBeNil)
+			So(string(contents), ShouldEqual, "TOKEN=hunter2\nDOCKER_HOST=tcp://example.com:2375\n")
+
+		})
+
+		Convey("It shouldn't reach the docker command's own environment...", func() {
+			// Stand in for docker with something which prints its environment
+			binary := filepath.Join(t.TempDir(), "docker")
+			So(os.WriteFile(binary, []byte("#!/bin/sh\nenv\n"), 0700), ShouldBeNil)
+			r := &CommandRuntime{Binary: binary}
+			var stdout bytes.Buffer
+			code, err := r.Run(context.Background(), interfaces.RunSpec{Name: "env", Image: "functron-echo:1.0", Env: env, Stdout: &stdout})
+			So(err, ShouldBeNil)
+			So(code, ShouldEqual, 0)
+			So(stdout.String(), ShouldNotContainSubstring, "hunter2")
+			So(stdout.String(), ShouldNotContainSubstring, "example.com")
+		})
+
+		Convey("Values with line breaks should be refused...", func() {
+			_, err := writeEnvFile([]string{"TOKEN=a\nDOCKER_HOST=b"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Nothing should be written if it's empty...", func() {
+			path, err := writeEnvFile(nil)
+			So(err, ShouldBeNil)
+			So(path, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,191 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Sentimentron/functron/models"
+)
+
+// cgroupRoot is where the host's cgroups are mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// Stats reads a running container's usage from its cgroup, and its network
+// usage from its network namespace. Functron has to run on the docker host
+// (not in a container of its own) to see them.
+func (r *CommandRuntime) Stats(ctx context.Context, name string) (models.Usage, error) {
+	out, err := exec.CommandContext(ctx, r.Binary, "inspect", "--format", "{{.Id}} {{.State.Pid}}", name).Output()
+	if err != nil {
+		return models.Usage{}, fmt.Errorf("docker inspect failed: %s", err)
+	}
+	var id string
+	var pid int
+	if _, err := fmt.Sscan(string(out), &id, &pid); err != nil {
+		return models.Usage{}, fmt.Errorf("could not parse docker inspect output %q: %s", bytes.TrimSpace(out), err)
+	}
+	if pid == 0 {
+		return models.Usage{}, fmt.Errorf("container %s isn't running", name)
+	}
+
+	usage, err := cgroupUsage(cgroupRoot, id)
+	if err != nil {
+		return models.Usage{}, err
+	}
+	netDev, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/net/dev", pid))
+	if err != nil {
+		return models.Usage{}, err
+	}
+	usage.NetworkRxBytes, usage.NetworkTxBytes = parseNetDev(netDev)
+	return usage, nil
+}
+
+// cgroupUsage reads the usage of the container with the given ID from the
+// cgroups mounted at root, whichever version they are.
+func cgroupUsage(root, id string) (models.Usage, error) {
+	// cgroup v2 has a single hierarchy, with the list of controllers at
+	// its root
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		return cgroupV2Usage(root, id)
+	}
+	return cgroupV1Usage(root, id)
+}
+
+// readCgroupFile reads file from a container's cgroup for controller
+// (which is empty for cgroup v2), wherever the systemd or cgroupfs driver
+// put it.
+func readCgroupFile(root, controller, id, file string) ([]byte, error) {
+	base := filepath.Join(root, controller)
+	var err error
+	for _, dir := range []string{
+		filepath.Join(base, "system.slice", "docker-"+id+".scope"),
+		filepath.Join(base, "docker", id),
+	} {
+		var data []byte
+		data, err = ioutil.ReadFile(filepath.Join(dir, file))
+		if err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+// cgroupV2Usage reads a container's usage from cgroup v2.
+func cgroupV2Usage(root, id string) (models.Usage, error) {
+	var ret models.Usage
+	cpu, err := readCgroupFile(root, "", id, "cpu.stat")
+	if err != nil {
+		return ret, err
+	}
+	ret.CPUSeconds = float64(fieldValue(cpu, "usage_usec")) / 1e6
+
+	// memory.peak is only there on newer kernels
+	memory, err := readCgroupFile(root, "", id, "memory.peak")
+	if err != nil {
+		memory, err = readCgroupFile(root, "", id, "memory.current")
+	}
+	if err != nil {
+		return ret, err
+	}
+	ret.MemoryPeakBytes = parseInt(memory)
+
+	ioStat, err := readCgroupFile(root, "", id, "io.stat")
+	if err != nil {
+		return ret, err
+	}
+	// Each line is a device, e.g. "8:0 rbytes=4096 wbytes=0 rios=1 ..."
+	for _, line := range strings.Split(string(ioStat), "\n") {
+		for _, field := range strings.Fields(line) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "rbytes":
+				ret.BlockReadBytes += parseInt([]byte(kv[1]))
+			case "wbytes":
+				ret.BlockWriteBytes += parseInt([]byte(kv[1]))
+			}
+		}
+	}
+	return ret, nil
+}
+
+// cgroupV1Usage reads a container's usage from cgroup v1.
+func cgroupV1Usage(root, id string) (models.Usage, error) {
+	var ret models.Usage
+	cpu, err := readCgroupFile(root, "cpuacct", id, "cpuacct.usage")
+	if err != nil {
+		return ret, err
+	}
+	ret.CPUSeconds = float64(parseInt(cpu)) / 1e9
+
+	memory, err := readCgroupFile(root, "memory", id, "memory.max_usage_in_bytes")
+	if err != nil {
+		return ret, err
+	}
+	ret.MemoryPeakBytes = parseInt(memory)
+
+	blkio, err := readCgroupFile(root, "blkio", id, "blkio.throttle.io_service_bytes")
+	if err != nil {
+		return ret, err
+	}
+	// Each line is a device and operation, e.g. "8:0 Read 4096", with a
+	// "Total" line at the end
+	for _, line := range strings.Split(string(blkio), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		switch fields[1] {
+		case "Read":
+			ret.BlockReadBytes += parseInt([]byte(fields[2]))
+		case "Write":
+			ret.BlockWriteBytes += parseInt([]byte(fields[2]))
+		}
+	}
+	return ret, nil
+}
+
+// fieldValue finds "key value" among the lines of data, returning 0 if
+// it's not there.
+func fieldValue(data []byte, key string) int64 {
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			return parseInt([]byte(fields[1]))
+		}
+	}
+	return 0
+}
+
+// parseInt parses a counter, treating anything unparseable as 0.
+func parseInt(data []byte) int64 {
+	ret, _ := strconv.ParseInt(string(bytes.TrimSpace(data)), 10, 64)
+	return ret
+}
+
+// parseNetDev totals the bytes received and sent by every interface but
+// loopback in the contents of /proc/{pid}/net/dev.
+func parseNetDev(data []byte) (rx int64, tx int64) {
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "lo" {
+			continue
+		}
+		// Received bytes come first, and sent bytes are the ninth field
+		fields := strings.Fields(parts[1])
+		if len(fields) < 9 {
+			continue
+		}
+		rx += parseInt([]byte(fields[0]))
+		tx += parseInt([]byte(fields[8]))
+	}
+	return rx, tx
+}
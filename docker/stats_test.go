@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sentimentron/functron/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// writeFiles writes each of files (relative path to contents) under root.
+func writeFiles(root string, files map[string]string) {
+	for path, contents := range files {
+		path = filepath.Join(root, path)
+		So(os.MkdirAll(filepath.Dir(path), 0755), ShouldBeNil)
+		So(ioutil.WriteFile(path, []byte(contents), 0644), ShouldBeNil)
+	}
+}
+
+func TestStats(t *testing.T) {
+	Convey("Given a directory of cgroups...", t, func() {
+		root, err := ioutil.TempDir("", "functroncgroups")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(root)
+
+		Convey("Usage should be read from cgroup v2, as the systemd driver lays it out...", func() {
+			writeFiles(root, map[string]string{
+				"cgroup.controllers":                           "cpu io memory pids\n",
+				"system.slice/docker-abc.scope/cpu.stat":       "usage_usec 1500000\nuser_usec 1000000\n",
+				"system.slice/docker-abc.scope/memory.peak":    "8388608\n",
+				"system.slice/docker-abc.scope/memory.current": "4096\n",
+				"system.slice/docker-abc.scope/io.stat":        "8:0 rbytes=4096 wbytes=1024 rios=1 wios=1\n8:16 rbytes=4096 wbytes=0 rios=1 wios=0\n",
+			})
+			usage, err := cgroupUsage(root, "abc")
+			So(err, ShouldBeNil)
+			So(usage, ShouldResemble, models.Usage{
+				CPUSeconds:      1.5,
+				MemoryPeakBytes: 8388608,
+				BlockReadBytes:  8192,
+				BlockWriteBytes: 1024,
+			})
+		})
+
+		Convey("Usage should be read from cgroup v1, as the cgroupfs driver lays it out...", func() {
+			writeFiles(root, map[string]string{
+				"cpuacct/docker/abc/cpuacct.usage":                 "250000000\n",
+				"memory/docker/abc/memory.max_usage_in_bytes":      "1048576\n",
+				"blkio/docker/abc/blkio.throttle.io_service_bytes": "8:0 Read 512\n8:0 Write 2048\n8:0 Total 2560\nTotal 2560\n",
+			})
+			usage, err := cgroupUsage(root, "abc")
+			So(err, ShouldBeNil)
+			So(usage, ShouldResemble, models.Usage{
+				CPUSeconds:      0.25,
+				MemoryPeakBytes: 1048576,
+				BlockReadBytes:  512,
+				BlockWriteBytes: 2048,
+			})
+		})
+
+		Convey("Containers without a cgroup should be an error...", func() {
+			_, err := cgroupUsage(root, "missing")
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Network usage should exclude loopback...", t, func() {
+		rx, tx := parseNetDev([]byte(`Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:     100       1    0    0    0     0          0         0      100       1    0    0    0     0       0          0
+  eth0:    2000      10    0    0    0     0          0         0      300       3    0    0    0     0       0          0
+`))
+		So(rx, ShouldEqual, 2000)
+		So(tx, ShouldEqual, 300)
+	})
+}
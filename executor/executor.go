@@ -0,0 +1,478 @@
+// Package executor builds and runs functions: it unpacks a build context,
+// builds it into an image, runs containers from that image, and cleans up.
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/configuration"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/metrics"
+	"github.com/Sentimentron/functron/models"
+	"github.com/Sentimentron/functron/utils"
+)
+
+// RequestIDLabel is the image and container label which records the
+// request that created them.
+const RequestIDLabel = "functron.request-id"
+
+// DefaultStatsInterval is how often an Executor samples the usage of the
+// containers it runs, unless it's told otherwise.
+const DefaultStatsInterval = time.Second
+
+// Executor builds and runs functions on a ContainerRuntime.
+type Executor struct {
+	runtime interfaces.ContainerRuntime
+	// StatsInterval is how often running containers' usage is sampled.
+	// Whatever a container uses after the last sample isn't counted.
+	StatsInterval time.Duration
+	// IsolatedNetworkPrefix starts the names of the internal networks
+	// created for containers whose network is "isolated", one for each
+	// container.
+	IsolatedNetworkPrefix string
+	// Images, if set, records each named image's status as it's built and
+	// removed. Temporary images, and builds of an image which is already
+	// being built (e.g. by another server sharing the store), aren't
+	// recorded.
+	Images interfaces.ImageStore
+}
+
+// CreateExecutor returns an Executor which uses runtime.
+func CreateExecutor(runtime interfaces.ContainerRuntime) *Executor {
+	return &Executor{
+		runtime:               runtime,
+		StatsInterval:         DefaultStatsInterval,
+		IsolatedNetworkPrefix: configuration.DefaultIsolatedNetwork,
+	}
+}
+
+// BuildRequest describes an image to build.
+type BuildRequest struct {
+	FunctionName string
+	RequestID    string
+	Dockerfile   string
+	// BuildContext is a tar file, unpacked next to the Dockerfile and
+	// mounted at /data when the function runs
+	BuildContext io.Reader
+	// Image is the tag to build. If it's empty, a temporary name is used.
+	Image string
+}
+
+// Workspace is a built image, and the directory which is mounted into its
+// containers at /data.
+type Workspace struct {
+	executor *Executor
+	logger   *logging.Logger
+	built    bool
+	record   *imageRecord
+
+	Dir       string
+	Image     string
+	RequestID string
+
+	BuildStdout   []byte
+	BuildStderr   []byte
+	BuildDuration time.Duration
+}
+
+// Build unpacks req's build context into a new directory, and builds it
+// into an image. If the returned Workspace isn't nil (even alongside an
+// error), the caller must Close it.
+func (e *Executor) Build(ctx context.Context, req BuildRequest) (*Workspace, *api.Error) {
+	logger := logging.FromContext(ctx)
+
+	// Create a temporary directory for running `docker build`
+	dir, err := utils.GenerateSharedTemporaryDirectory()
+	if err != nil {
+		return nil, api.NewError(api.ErrWorkspace, "could not create a directory: %s", err)
+	}
+	logger.WithField("dir", dir).Debugf("Using temp directory")
+
+	w := &Workspace{
+		executor:  e,
+		logger:    logger,
+		Dir:       dir,
+		Image:     req.Image,
+		RequestID: req.RequestID,
+	}
+	if w.Image == "" {
+		// Temporary images are removed once they've run, so they aren't
+		// recorded: there'd be a row for every invocation
+		w.Image = utils.GenerateTemporaryName(req.FunctionName)
+	} else {
+		w.record = e.recordBuild(logger, w.Image, req.Dockerfile)
+	}
+	w.record.advance(models.ImageStatusPreparingForBuild, "preparing the build context")
+
+	// Write the docker file into that directory
+	err = ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(req.Dockerfile), 0644)
+	if err != nil {
+		w.record.advance(models.ImageStatusFailedPreparation, fmt.Sprintf("could not write the Dockerfile: %s", err))
+		return w, api.NewError(api.ErrWorkspace, "could not write the Dockerfile: %s", err)
+	}
+
+	// Unpack the tar file into that directory (do not allow escaping)
+	if req.BuildContext != nil {
+		err = utils.UnpackTarIntoDirectory(tar.NewReader(req.BuildContext), dir)
+		if err != nil {
+			w.record.advance(models.ImageStatusFailedPreparation, fmt.Sprintf("could not unpack the build context: %s", err))
+			return w, api.NewError(api.ErrInvalidContext, "could not unpack the build context: %s", err)
+		}
+	}
+
+	// Build the image
+	w.record.advance(models.ImageStatusBuildingDockerfile, "running docker build")
+	buildStart := time.Now()
+	w.BuildStdout, w.BuildStderr, err = e.runtime.Build(ctx, interfaces.BuildSpec{
+		Dir:    dir,
+		Tag:    w.Image,
+		Labels: map[string]string{RequestIDLabel: req.RequestID},
+	})
+	w.BuildDuration = time.Since(buildStart)
+	metrics.BuildDuration.Observe(w.BuildDuration.Seconds())
+	if err != nil {
+		logger.WithFields(logging.Fields{
+			"error":  err,
+			"stderr": string(w.BuildStderr),
+		}).Warnf("Failed to build Docker image")
+		w.record.advance(models.ImageStatusFailedDockerfile, fmt.Sprintf("docker build failed: %s", err))
+		return w, api.NewError(api.ErrBuildFailed, "docker build failed: %s", err)
+	}
+	logger.WithField("tag", w.Image).Infof("Built the docker image")
+	w.built = true
+
+	// docker build tags the image itself, so there's nothing more to commit
+	w.record.advance(models.ImageStatusCommitting, "tagged "+w.Image)
+	w.record.advance(models.ImageStatusCompleted, "built in "+w.BuildDuration.String())
+	return w, nil
+}
+
+// RunResult is the outcome of running a single container.
+type RunResult struct {
+	// ExitCode is nil if the container didn't finish
+	ExitCode *int
+	Stdout   []byte
+	Stderr   []byte
+	Duration time.Duration
+	// Usage is what the container used, as of the last time it was
+	// sampled. Sampled is false if it never was (e.g. because it finished
+	// before the first sample).
+	Usage   models.Usage
+	Sampled bool
+}
+
+// CPUSeconds returns the CPU time the container was sampled using, or how
+// long it ran if it was never sampled.
+func (r *RunResult) CPUSeconds() float64 {
+	if !r.Sampled {
+		return r.Duration.Seconds()
+	}
+	return r.Usage.CPUSeconds
+}
+
+// RunRequest describes how to run a container.
+type RunRequest struct {
+	Stdin io.Reader
+	// Timeout is how long the container may run before it's killed
+	Timeout time.Duration
+	// Stdout and Stderr, if set, also receive the container's output as
+	// it's written
+	Stdout io.Writer
+	Stderr io.Writer
+	// StreamStdout only writes the container's output to Stdout, and
+	// doesn't keep it in the RunResult, for output which is passed on
+	// rather than returned
+	StreamStdout bool
+	// Env is set in the container's environment, each as "KEY=value".
+	// Containers made by Create ignore it, since theirs is fixed when
+	// they're created, so the warm pool runs a new container for requests
+	// with one.
+	Env []string
+	// Security confines the container, and Network is the Docker network
+	// it joins, or "isolated" for an internal network of its own.
+	// Containers made by Create ignore both, as they do Env.
+	Security interfaces.Security
+	Network  string
+}
+
+// tee returns a writer which writes to buf, and to w if it's set.
+func tee(buf *bytes.Buffer, w io.Writer) io.Writer {
+	if w == nil {
+		return buf
+	}
+	return io.MultiWriter(buf, w)
+}
+
+// Run runs a container from the workspace's image, killing it if it runs
+// for longer than req.Timeout. The returned RunResult is never nil, so
+// output captured before a failure is available.
+func (w *Workspace) Run(ctx context.Context, req RunRequest) (*RunResult, *api.Error) {
+	spec := w.containerSpec()
+	spec.Env = req.Env
+	spec.Security = req.Security
+	spec.Network = req.Network
+	isolated, apiErr := w.isolate(ctx, &spec)
+	if apiErr != nil {
+		return &RunResult{}, apiErr
+	}
+	if isolated {
+		defer w.removeNetwork(spec.Network)
+	}
+	w.logger.WithField("container", spec.Name).Debugf("Running container...")
+	return w.run(ctx, req, spec, w.executor.runtime.Run)
+}
+
+// isolate creates an internal network for the container spec describes,
+// if its network is "isolated", and connects it to that instead. It
+// reports whether it did, in which case the caller must removeNetwork once
+// the container's gone.
+func (w *Workspace) isolate(ctx context.Context, spec *interfaces.RunSpec) (bool, *api.Error) {
+	if spec.Network != configuration.NetworkIsolated {
+		return false, nil
+	}
+	name := fmt.Sprintf("%s-%s", w.executor.IsolatedNetworkPrefix, spec.Name)
+	if err := w.executor.runtime.CreateNetwork(ctx, name, true); err != nil {
+		return false, api.NewError(api.ErrRunFailed, "could not create an isolated network: %s", err)
+	}
+	spec.Network = name
+	return true, nil
+}
+
+// removeNetwork removes a network made by isolate.
+func (w *Workspace) removeNetwork(name string) {
+	if err := w.executor.runtime.RemoveNetwork(context.Background(), name); err != nil {
+		metrics.CleanupFailures.WithLabelValues("network").Inc()
+		w.logger.WithFields(logging.Fields{"network": name, "error": err}).Warnf("Failed to remove network")
+	}
+}
+
+// containerSpec describes a new container for the workspace's image.
+func (w *Workspace) containerSpec() interfaces.RunSpec {
+	return interfaces.RunSpec{
+		Image:   w.Image,
+		Name:    fmt.Sprintf("functron-%s-%s", w.RequestID, utils.RandStringRunes(5)),
+		Labels:  map[string]string{RequestIDLabel: w.RequestID},
+		Volumes: []string{fmt.Sprintf("%s:/data", w.Dir)},
+	}
+}
+
+// run calls start to run the container described by spec, as described by
+// req, and works out what happened.
+func (w *Workspace) run(ctx context.Context, req RunRequest, spec interfaces.RunSpec, start func(context.Context, interfaces.RunSpec) (int, error)) (*RunResult, *api.Error) {
+	var stdout, stderr bytes.Buffer
+	ret := &RunResult{}
+	timeout := req.Timeout
+
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	spec.Stdin = req.Stdin
+	spec.Stdout = tee(&stdout, req.Stdout)
+	if req.StreamStdout && req.Stdout != nil {
+		spec.Stdout = req.Stdout
+	}
+	spec.Stderr = tee(&stderr, req.Stderr)
+
+	runStart := time.Now()
+	sampler := w.executor.sampleUsage(runCtx, spec.Name)
+	exitCode, err := start(runCtx, spec)
+	ret.Usage, ret.Sampled = sampler.stop()
+	ret.Duration = time.Since(runStart)
+	metrics.RunDuration.Observe(ret.Duration.Seconds())
+	ret.Stdout = stdout.Bytes()
+	ret.Stderr = stderr.Bytes()
+
+	switch {
+	case err != nil && runCtx.Err() == context.DeadlineExceeded:
+		return ret, api.NewError(api.ErrTimeout, "the function exceeded its %s timeout", timeout)
+	case err != nil:
+		return ret, api.NewError(api.ErrRunFailed, "could not run the container: %s", err)
+	}
+
+	ret.ExitCode = &exitCode
+	if exitCode != 0 {
+		return ret, api.NewError(api.ErrNonZeroExit, "the function exited with status %d", exitCode)
+	}
+	return ret, nil
+}
+
+// usageSampler samples a container's usage until it's stopped.
+type usageSampler struct {
+	usage   models.Usage
+	sampled bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// sampleUsage samples the usage of the container with the given name every
+// StatsInterval, until the returned sampler is stopped. Samples which fail
+// (e.g. because the container hasn't started yet) are ignored.
+func (e *Executor) sampleUsage(ctx context.Context, name string) *usageSampler {
+	s := &usageSampler{done: make(chan struct{})}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(e.StatsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			usage, err := e.runtime.Stats(ctx, name)
+			if err != nil {
+				continue
+			}
+			// Counters only go up, but the memory in use can go down
+			peak := s.usage.MemoryPeakBytes
+			s.usage, s.sampled = usage, true
+			if peak > usage.MemoryPeakBytes {
+				s.usage.MemoryPeakBytes = peak
+			}
+		}
+	}()
+	return s
+}
+
+// stop stops sampling, returning the last sample, and whether there was
+// one.
+func (s *usageSampler) stop() (models.Usage, bool) {
+	close(s.done)
+	s.wg.Wait()
+	return s.usage, s.sampled
+}
+
+// Container is a container which has been created from a workspace's
+// image, but not started, so that it can be run with less delay.
+type Container struct {
+	workspace *Workspace
+	spec      interfaces.RunSpec
+	// isolated is set if the container has a network of its own, which is
+	// removed with it
+	isolated bool
+}
+
+// Create creates a container from the workspace's image, confined by
+// security and connected to network, ready to Run. The caller must either
+// Run or Remove it.
+func (w *Workspace) Create(ctx context.Context, security interfaces.Security, network string) (*Container, *api.Error) {
+	spec := w.containerSpec()
+	spec.Security = security
+	spec.Network = network
+	isolated, apiErr := w.isolate(ctx, &spec)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if err := w.executor.runtime.Create(ctx, spec); err != nil {
+		if isolated {
+			w.removeNetwork(spec.Network)
+		}
+		return nil, api.NewError(api.ErrRunFailed, "could not create a container: %s", err)
+	}
+	w.logger.WithField("container", spec.Name).Debugf("Created container")
+	return &Container{w, spec, isolated}, nil
+}
+
+// Name returns the container's name.
+func (c *Container) Name() string {
+	return c.spec.Name
+}
+
+// Run starts the container, as Workspace.Run would run a new one. A
+// container can only be run once.
+func (c *Container) Run(ctx context.Context, req RunRequest) (*RunResult, *api.Error) {
+	c.workspace.logger.WithField("container", c.spec.Name).Debugf("Starting container...")
+	if c.isolated {
+		defer c.workspace.removeNetwork(c.spec.Network)
+	}
+	return c.workspace.run(ctx, req, c.spec, c.workspace.executor.runtime.Start)
+}
+
+// Remove deletes a container which hasn't been run, and its network if it
+// has one of its own.
+func (c *Container) Remove(ctx context.Context) error {
+	err := c.workspace.executor.runtime.RemoveContainer(ctx, c.spec.Name)
+	if err != nil {
+		metrics.CleanupFailures.WithLabelValues("container").Inc()
+		c.workspace.logger.WithFields(logging.Fields{"container": c.spec.Name, "error": err}).Warnf("Failed to remove container")
+	} else if c.isolated {
+		c.workspace.removeNetwork(c.spec.Network)
+	}
+	return err
+}
+
+// Close removes the workspace's image and directory, returning what the
+// image removal printed.
+func (w *Workspace) Close(ctx context.Context) ([]byte, *api.Error) {
+	var ret *api.Error
+	var output []byte
+
+	// If the build failed, there's no image to remove
+	if w.built {
+		w.logger.WithField("tag", w.Image).Debugf("Cleaning up...")
+		var err error
+		output, err = w.executor.runtime.RemoveImage(ctx, w.Image)
+		if err != nil {
+			metrics.CleanupFailures.WithLabelValues("image").Inc()
+			w.logger.WithFields(logging.Fields{"tag": w.Image, "error": err}).Warnf("Failed to remove image")
+			ret = api.NewError(api.ErrCleanupFailed, "could not remove image %s: %s", w.Image, err)
+		} else {
+			w.RecordRemoval("removed after the function ran")
+		}
+		w.built = false
+	}
+
+	if err := os.RemoveAll(w.Dir); err != nil {
+		metrics.CleanupFailures.WithLabelValues("directory").Inc()
+		w.logger.WithFields(logging.Fields{"dir": w.Dir, "error": err}).Warnf("Failed to remove directory")
+		if ret == nil {
+			ret = api.NewError(api.ErrCleanupFailed, "could not remove %s: %s", w.Dir, err)
+		}
+	}
+	return output, ret
+}
+
+// Result is the outcome of building, running and cleaning up a function.
+type Result struct {
+	Workspace *Workspace
+	// Run is nil if the container wasn't run
+	Run           *RunResult
+	CleanupOutput []byte
+	Errors        []api.Error
+}
+
+// Execute builds req, runs it once as described by run, and cleans up.
+func (e *Executor) Execute(ctx context.Context, req BuildRequest, run RunRequest) *Result {
+	ret := &Result{Errors: make([]api.Error, 0)}
+
+	w, apiErr := e.Build(ctx, req)
+	ret.Workspace = w
+	if apiErr == nil {
+		ret.Run, apiErr = w.Run(ctx, run)
+	}
+	if apiErr != nil {
+		ret.Errors = append(ret.Errors, *apiErr)
+	}
+
+	if w != nil {
+		ret.CleanupOutput, apiErr = w.Close(ctx)
+		if apiErr != nil {
+			ret.Errors = append(ret.Errors, *apiErr)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,253 @@
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/database"
+	"github.com/Sentimentron/functron/docker/dockertest"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// buildContext returns a tar file holding a single file.
+func buildContext(name, contents string) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))})
+	tw.Write([]byte(contents))
+	tw.Close()
+	return &buf
+}
+
+func TestExecute(t *testing.T) {
+	Convey("Given an executor with a fake runtime...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		e := CreateExecutor(runtime)
+		req := BuildRequest{
+			FunctionName: "echo",
+			RequestID:    "req-1",
+			Dockerfile:   "FROM alpine\nCMD cat\n",
+			BuildContext: buildContext("script.sh", "#!/bin/sh\n"),
+		}
+
+		Convey("A successful function should be built, run and cleaned up...", func() {
+			result := e.Execute(context.Background(), req, RunRequest{Stdin: strings.NewReader("hello"), Timeout: time.Second})
+			So(result.Errors, ShouldBeEmpty)
+			So(string(result.Run.Stdout), ShouldEqual, "hello")
+			So(*result.Run.ExitCode, ShouldEqual, 0)
+			So(runtime.Dockerfiles[result.Workspace.Image], ShouldEqual, req.Dockerfile)
+			So(runtime.Builds[0].Labels[RequestIDLabel], ShouldEqual, "req-1")
+			So(runtime.Images, ShouldBeEmpty)
+
+			_, err := os.Stat(result.Workspace.Dir)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("A failed build should be reported, and never run...", func() {
+			runtime.FailBuild = true
+			result := e.Execute(context.Background(), req, RunRequest{Timeout: time.Second})
+			So(result.Errors, ShouldHaveLength, 1)
+			So(result.Errors[0].Code, ShouldEqual, api.ErrBuildFailed)
+			So(result.Errors[0].Phase, ShouldEqual, api.PhaseBuild)
+			So(string(result.Workspace.BuildStderr), ShouldEqual, "build failed\n")
+			So(result.Run, ShouldBeNil)
+			So(runtime.RunCount(), ShouldEqual, 0)
+			So(runtime.Removals, ShouldBeEmpty)
+		})
+
+		Convey("Output should be copied to the request's writers as well...", func() {
+			var stdout bytes.Buffer
+			result := e.Execute(context.Background(), req, RunRequest{
+				Stdin:   strings.NewReader("hello"),
+				Timeout: time.Second,
+				Stdout:  &stdout,
+			})
+			So(result.Errors, ShouldBeEmpty)
+			So(stdout.String(), ShouldEqual, "hello")
+			So(string(result.Run.Stdout), ShouldEqual, "hello")
+		})
+
+		Convey("A non-zero exit should be reported with its exit code...", func() {
+			runtime.RunFunc = dockertest.Exit(3, "oops")
+			result := e.Execute(context.Background(), req, RunRequest{Timeout: time.Second})
+			So(result.Errors, ShouldHaveLength, 1)
+			So(result.Errors[0].Code, ShouldEqual, api.ErrNonZeroExit)
+			So(*result.Run.ExitCode, ShouldEqual, 3)
+			So(string(result.Run.Stderr), ShouldEqual, "oops")
+		})
+
+		Convey("A function which runs too long should time out...", func() {
+			runtime.RunFunc = dockertest.Sleep
+			result := e.Execute(context.Background(), req, RunRequest{Timeout: 10 * time.Millisecond})
+			So(result.Errors, ShouldHaveLength, 1)
+			So(result.Errors[0].Code, ShouldEqual, api.ErrTimeout)
+			So(result.Run.ExitCode, ShouldBeNil)
+			So(runtime.Images, ShouldBeEmpty)
+		})
+
+		Convey("A build context which isn't a tar file should be rejected...", func() {
+			req.BuildContext = strings.NewReader("not a tar file, but long enough to not be mistaken for the end of one")
+			result := e.Execute(context.Background(), req, RunRequest{Timeout: time.Second})
+			So(result.Errors, ShouldHaveLength, 1)
+			So(result.Errors[0].Code, ShouldEqual, api.ErrInvalidContext)
+			So(runtime.BuildCount(), ShouldEqual, 0)
+		})
+
+		Convey("What a running container uses should be sampled...", func() {
+			e.StatsInterval = 5 * time.Millisecond
+			runtime.Usage = models.Usage{CPUSeconds: 0.5, MemoryPeakBytes: 1 << 20}
+			runtime.RunFunc = func(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+				time.Sleep(50 * time.Millisecond)
+				return 0, nil
+			}
+			result := e.Execute(context.Background(), req, RunRequest{Timeout: time.Second})
+			So(result.Errors, ShouldBeEmpty)
+			So(result.Run.Usage, ShouldResemble, runtime.Usage)
+			So(result.Run.CPUSeconds(), ShouldEqual, 0.5)
+		})
+
+		Convey("Containers which were never sampled should count their run time as CPU time...", func() {
+			e.StatsInterval = time.Hour
+			runtime.Usage = models.Usage{CPUSeconds: 0.5}
+			result := e.Execute(context.Background(), req, RunRequest{Timeout: time.Second})
+			So(result.Errors, ShouldBeEmpty)
+			So(result.Run.Sampled, ShouldBeFalse)
+			So(result.Run.CPUSeconds(), ShouldEqual, result.Run.Duration.Seconds())
+		})
+
+		Convey("A created container should run like a new one...", func() {
+			req.Image = "functron-echo"
+			w, apiErr := e.Build(context.Background(), req)
+			So(apiErr, ShouldBeNil)
+			defer w.Close(context.Background())
+			So(w.Image, ShouldEqual, "functron-echo")
+
+			c, apiErr := w.Create(context.Background(), interfaces.Security{ReadOnlyRootfs: true}, "none")
+			So(apiErr, ShouldBeNil)
+			So(runtime.ContainerCount(), ShouldEqual, 1)
+			So(runtime.Creates[0].Security.ReadOnlyRootfs, ShouldBeTrue)
+			So(runtime.Creates[0].Network, ShouldEqual, "none")
+
+			result, apiErr := c.Run(context.Background(), RunRequest{Stdin: strings.NewReader("hello"), Timeout: time.Second})
+			So(apiErr, ShouldBeNil)
+			So(string(result.Stdout), ShouldEqual, "hello")
+			So(runtime.ContainerCount(), ShouldEqual, 0)
+			So(runtime.Runs[0].Volumes, ShouldResemble, []string{w.Dir + ":/data"})
+		})
+
+		Convey("Isolated containers should each get an internal network, removed with them...", func() {
+			w, apiErr := e.Build(context.Background(), req)
+			So(apiErr, ShouldBeNil)
+			defer w.Close(context.Background())
+
+			_, apiErr = w.Run(context.Background(), RunRequest{Timeout: time.Second, Network: "isolated"})
+			So(apiErr, ShouldBeNil)
+			So(runtime.Runs[0].Network, ShouldEqual, "functron-isolated-"+runtime.Runs[0].Name)
+			So(runtime.RemovedNetworks, ShouldResemble, []string{runtime.Runs[0].Network})
+
+			c, apiErr := w.Create(context.Background(), interfaces.Security{}, "isolated")
+			So(apiErr, ShouldBeNil)
+			network := runtime.Creates[0].Network
+			So(runtime.Networks, ShouldResemble, map[string]bool{network: true})
+			So(c.Remove(context.Background()), ShouldBeNil)
+			So(runtime.Networks, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestImageRecords(t *testing.T) {
+	Convey("Given an executor which records its images in a store...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "functronexecutor")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		store, err := database.CreateStore(tmpFile.Name())
+		So(err, ShouldBeNil)
+		defer os.Remove(tmpFile.Name())
+
+		runtime := dockertest.CreateFakeRuntime()
+		e := CreateExecutor(runtime)
+		e.Images = store
+		req := BuildRequest{
+			FunctionName: "echo",
+			RequestID:    "req-1",
+			Dockerfile:   "FROM alpine\nCMD cat\n",
+			Image:        "functron-echo",
+		}
+		history := func() []models.ImageStatus {
+			img, err := store.RetrieveImageByName("echo")
+			So(err, ShouldBeNil)
+			transitions, err := store.RetrieveImageStatusHistory(img.Id)
+			So(err, ShouldBeNil)
+			ret := make([]models.ImageStatus, 0)
+			for _, t := range transitions {
+				ret = append(ret, t.To)
+			}
+			return ret
+		}
+
+		Convey("A successful build should go through each status, and its removal be recorded...", func() {
+			w, apiErr := e.Build(context.Background(), req)
+			So(apiErr, ShouldBeNil)
+			img, err := store.RetrieveImageByName("echo")
+			So(err, ShouldBeNil)
+			So(img.Dockerfile, ShouldEqual, req.Dockerfile)
+			So(img.Committed, ShouldNotBeNil)
+
+			_, apiErr = w.Close(context.Background())
+			So(apiErr, ShouldBeNil)
+			So(history(), ShouldResemble, []models.ImageStatus{
+				models.ImageStatusScheduledForBuild,
+				models.ImageStatusPreparingForBuild,
+				models.ImageStatusBuildingDockerfile,
+				models.ImageStatusCommitting,
+				models.ImageStatusCompleted,
+				models.ImageStatusCleanedUp,
+			})
+		})
+
+		Convey("A failed build should be recorded as failed...", func() {
+			runtime.FailBuild = true
+			w, apiErr := e.Build(context.Background(), req)
+			So(apiErr, ShouldNotBeNil)
+			w.Close(context.Background())
+			So(history(), ShouldResemble, []models.ImageStatus{
+				models.ImageStatusScheduledForBuild,
+				models.ImageStatusPreparingForBuild,
+				models.ImageStatusBuildingDockerfile,
+				models.ImageStatusFailedDockerfile,
+			})
+		})
+
+		Convey("A build of an image which is already being built shouldn't be recorded...", func() {
+			_, err := store.PersistImageForBuild(&models.FunctronImage{Name: "echo"})
+			So(err, ShouldBeNil)
+			w, apiErr := e.Build(context.Background(), req)
+			So(apiErr, ShouldBeNil)
+			w.Close(context.Background())
+			So(history(), ShouldResemble, []models.ImageStatus{models.ImageStatusScheduledForBuild})
+		})
+
+		Convey("Temporary images shouldn't be recorded, however many are built...", func() {
+			req.Image = ""
+			for i := 0; i < 3; i++ {
+				w, apiErr := e.Build(context.Background(), req)
+				So(apiErr, ShouldBeNil)
+				_, apiErr = w.Close(context.Background())
+				So(apiErr, ShouldBeNil)
+			}
+			So(runtime.BuildCount(), ShouldEqual, 3)
+			names, err := store.RetrieveImages()
+			So(err, ShouldBeNil)
+			So(names, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,85 @@
+package executor
+
+import (
+	"strings"
+
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/models"
+)
+
+// imageRecord keeps the row for an image up to date in an ImageStore as
+// it's built and removed. A nil imageRecord records nothing, e.g. because
+// there's no store, or because another build of the same image is
+// recording it.
+type imageRecord struct {
+	images interfaces.ImageStore
+	image  *models.FunctronImage
+	logger *logging.Logger
+}
+
+// imageName returns the name an image built with tag is stored under: the
+// tag without its "functron-" prefix, as the ImageLibrary names them.
+func imageName(tag string) string {
+	return strings.TrimPrefix(tag, "functron-")
+}
+
+// recordBuild records that the image tagged tag is about to be built from
+// dockerfile, returning the imageRecord to update as it is. If the image
+// has a row already, it's scheduled to build again, unless it's being
+// built, in which case whoever's building it records it.
+func (e *Executor) recordBuild(logger *logging.Logger, tag, dockerfile string) *imageRecord {
+	if e.Images == nil {
+		return nil
+	}
+	name := imageName(tag)
+	logger = logger.WithField("image", name)
+
+	image, err := e.Images.RetrieveImageByName(name)
+	if err == interfaces.NoMatchingImage {
+		// If someone else stored it first, it's theirs to record
+		image, err = e.Images.PersistImageForBuild(&models.FunctronImage{Name: name, Dockerfile: dockerfile})
+		if err != nil {
+			logger.WithField("error", err).Infof("Not recording the image's build")
+			return nil
+		}
+		return &imageRecord{e.Images, image, logger}
+	} else if err != nil {
+		logger.WithField("error", err).Warnf("Could not retrieve the image's record")
+		return nil
+	}
+
+	if image.Status.Building() {
+		logger.WithField("status", image.Status).Infof("Image is already being built, not recording")
+		return nil
+	}
+	if err := e.Images.RescheduleImageBuild(image, "scheduled to build again"); err != nil {
+		logger.WithField("error", err).Infof("Not recording the image's build")
+		return nil
+	}
+	return &imageRecord{e.Images, image, logger}
+}
+
+// advance changes the image's status to status. If it can't, e.g. because
+// something else changed it first, nothing more is recorded.
+func (r *imageRecord) advance(status models.ImageStatus, message string) {
+	if r == nil || r.image == nil {
+		return
+	}
+	if err := r.images.UpdateStatus(r.image, status, message); err != nil {
+		fields := logging.Fields{"from": r.image.Status, "to": status, "error": err}
+		if err == interfaces.ImageChanged {
+			r.logger.WithFields(fields).Infof("Image's status was changed elsewhere, no longer recording it")
+		} else {
+			r.logger.WithFields(fields).Warnf("Could not record the image's status")
+		}
+		r.image = nil
+	}
+}
+
+// RecordRemoval records that the workspace's image has been removed (or
+// will be, once nothing's using it), for workspaces whose image outlives
+// Close, as the warm pool's do.
+func (w *Workspace) RecordRemoval(message string) {
+	w.record.advance(models.ImageStatusCleanedUp, message)
+}
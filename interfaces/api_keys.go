@@ -0,0 +1,21 @@
+package interfaces
+
+import (
+	"errors"
+
+	"github.com/Sentimentron/functron/models"
+)
+
+// NoMatchingAPIKey is returned when no API key has the hash presented.
+var NoMatchingAPIKey = errors.New("No matching API key")
+
+// KeyStore looks up the API keys presented by clients.
+type KeyStore interface {
+
+	// RetrieveAPIKeyByHash returns the key with the given hash, or
+	// NoMatchingAPIKey.
+	RetrieveAPIKeyByHash(hash string) (*models.APIKey, error)
+
+	// TouchAPIKey records that a key has just been used.
+	TouchAPIKey(id int64) error
+}
@@ -0,0 +1,109 @@
+package interfaces
+
+import (
+	"context"
+	"io"
+
+	"github.com/Sentimentron/functron/models"
+)
+
+// BuildSpec describes an image to build from a directory.
+type BuildSpec struct {
+	// Dir contains the Dockerfile and build context
+	Dir string
+	// Tag is applied to the built image
+	Tag string
+	// Labels are applied to the built image
+	Labels map[string]string
+}
+
+// Security describes how a container is confined. The zero value leaves
+// the runtime's defaults.
+type Security struct {
+	// User runs the container's process as "uid" or "uid:gid"
+	User string
+	// ReadOnlyRootfs makes the root filesystem read-only
+	ReadOnlyRootfs bool
+	// Tmpfs mounts a tmpfs at each path, with the given options (e.g.
+	// "size=64m")
+	Tmpfs map[string]string
+	// CapDrop lists capabilities to drop
+	CapDrop []string
+	// NoNewPrivileges stops processes gaining privileges
+	NoNewPrivileges bool
+	// SeccompProfile is the path to a seccomp profile
+	SeccompProfile string
+	// Runtime names the OCI runtime to run the container with
+	Runtime string
+}
+
+// RunSpec describes a container to run until it exits.
+type RunSpec struct {
+	// Image to create the container from
+	Image string
+	// Name given to the container, so that it can be killed
+	Name string
+	// Labels applied to the container
+	Labels map[string]string
+	// Volumes to mount, each as "host:container"
+	Volumes []string
+	// Env is set in the container's environment, each as "KEY=value"
+	Env []string
+	// Security confines the container
+	Security Security
+	// Network names the Docker network to connect the container to ("none"
+	// for no network at all). If empty, Docker's default is used.
+	Network string
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ContainerRuntime builds and runs function containers. It's implemented
+// over the docker command by docker.CommandRuntime, and faked for testing
+// by dockertest.FakeRuntime.
+type ContainerRuntime interface {
+
+	// Build builds and tags an image, returning what the build printed.
+	Build(ctx context.Context, spec BuildSpec) (stdout []byte, stderr []byte, err error)
+
+	// Run runs a container until it exits, returning its exit code. If ctx
+	// is done first, the container is killed and ctx.Err() is returned.
+	Run(ctx context.Context, spec RunSpec) (exitCode int, err error)
+
+	// Create creates a container as described by spec, without starting
+	// it. Its standard streams are attached by Start, so spec's are ignored.
+	Create(ctx context.Context, spec RunSpec) error
+
+	// Start starts a container made by Create, attaching spec's standard
+	// streams, and waits for it to exit as Run does. The container is
+	// removed once it exits.
+	Start(ctx context.Context, spec RunSpec) (exitCode int, err error)
+
+	// Stats reports what a running container has used so far.
+	Stats(ctx context.Context, name string) (models.Usage, error)
+
+	// CreateNetwork creates a bridge network, unless one already has the
+	// name. Containers on an internal network can't reach anything outside
+	// it.
+	CreateNetwork(ctx context.Context, name string, internal bool) error
+
+	// RemoveNetwork deletes a network which no containers are connected
+	// to.
+	RemoveNetwork(ctx context.Context, name string) error
+
+	// RemoveContainer deletes a container made by Create which hasn't been
+	// started.
+	RemoveContainer(ctx context.Context, name string) error
+
+	// RemoveImage deletes an image, returning what the removal printed.
+	RemoveImage(ctx context.Context, tag string) ([]byte, error)
+
+	// ImageSize returns how much disk an image uses, in bytes.
+	ImageSize(ctx context.Context, tag string) (int64, error)
+
+	// ListImages describes every image, one per line, starting with its
+	// repository and a tab.
+	ListImages() (string, error)
+}
@@ -0,0 +1,7 @@
+package interfaces
+
+import "errors"
+
+// NoMatchingFunction is returned when no function is registered with a
+// name.
+var NoMatchingFunction = errors.New("No matching function")
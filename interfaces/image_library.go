@@ -1,6 +1,7 @@
 package interfaces
 
 import (
+	"context"
 	"io"
 	"github.com/Sentimentron/functron/models"
 	"errors"
@@ -19,6 +20,30 @@ type OutputStream interface {
 
 var NoMatchingImage = errors.New("No matching image")
 
+// ImageChanged is returned when an image's status changed before it could
+// be updated.
+var ImageChanged = errors.New("Image changed concurrently")
+
+// InvalidImageTransition is returned when an image's status can't change
+// to the one asked for.
+var InvalidImageTransition = errors.New("Invalid image status transition")
+
+// ImageNotBuilt is returned by an ImageLibrary for images which haven't
+// been built, or have since been removed.
+var ImageNotBuilt = errors.New("image: not built")
+
+// ImageBeingRemoved is returned by an ImageLibrary for images which have
+// been deleted, but are still referenced.
+var ImageBeingRemoved = errors.New("image: being removed")
+
+// ImageRemovalDeferred is returned by an ImageLibrary when an image can't
+// be removed until its references are released.
+var ImageRemovalDeferred = errors.New("image: removal deferred until it's released")
+
+// InvalidImageHandle is returned by an ImageLibrary for handles which it
+// didn't hand out, or which have already been released.
+var InvalidImageHandle = errors.New("image: handle invalid")
+
 // ImageStore provides Functron's memory of what images it's built so far.
 type ImageStore interface {
 
@@ -31,9 +56,16 @@ type ImageStore interface {
 	// RetrieveImages returns a list of all the images which have been built so far.
 	RetrieveImages() ([]string, error)
 
-	// UpdateStatus changes the reported status of the image
+	// UpdateStatus changes the reported status of the image, recording
+	// message in its history. It returns InvalidImageTransition if the
+	// image's status can't change to newStatus, or ImageChanged if its
+	// status isn't image.Status any more.
 	// Updates the provided image argument in-place.
-	UpdateStatus(image *models.FunctronImage, newStatus models.ImageStatus) error
+	UpdateStatus(image *models.FunctronImage, newStatus models.ImageStatus, message string) error
+
+	// RescheduleImageBuild schedules an image to be built again, as
+	// UpdateStatus would, and restarts the clock on its removal.
+	RescheduleImageBuild(image *models.FunctronImage, message string) error
 
 	// RetrieveBuildPlan returns a struct which contains the images
 	// which need to be cleaned up, built etc.
@@ -41,7 +73,49 @@ type ImageStore interface {
 
 }
 
+// ImageUsageStore remembers when an ImageLibrary's images were last used,
+// and how big they are, across restarts.
+type ImageUsageStore interface {
+
+	// RetrieveImageUsage returns what was last saved for each image.
+	RetrieveImageUsage() ([]models.ImageUsage, error)
+
+	// SaveImageUsage records usage for images which are in the store,
+	// and puts off their removal until a while after they were last used.
+	// Images which aren't in the store are ignored.
+	SaveImageUsage(usage []models.ImageUsage) error
+}
+
 // DockerCommandRunner is an interface over docker, provided for testing.
 type DockerCommandRunner interface {
 	ListImages() (string, error)
-}
\ No newline at end of file
+	RemoveImage(ctx context.Context, tag string) ([]byte, error)
+	ImageSize(ctx context.Context, tag string) (int64, error)
+}
+
+// ImageLibrary hands out references to built images, so that they can't
+// be deleted while something's using them.
+type ImageLibrary interface {
+
+	// AcquireImage returns a reference to a built image.
+	AcquireImage(name string) (OpaqueImageHandle, error)
+
+	// AcquireLongLivedImage is like AcquireImage, for references which
+	// are expected to be held indefinitely (e.g. by containers kept
+	// ready), so they're never reported as leaks.
+	AcquireLongLivedImage(name string) (OpaqueImageHandle, error)
+
+	// ReleaseImage gives up a reference returned by AcquireImage. Each
+	// reference can only be released once.
+	ReleaseImage(handle OpaqueImageHandle) error
+
+	// DeleteImage removes an image. If there are references to it, it's
+	// removed when the last is released, and ImageRemovalDeferred is
+	// returned.
+	DeleteImage(name string) error
+
+	// ImageRebuilt records that an image has been built again under the
+	// same name, so a removal waiting for the old image's references
+	// removes the old image, rather than the new one.
+	ImageRebuilt(name string)
+}
@@ -0,0 +1,6 @@
+package interfaces
+
+import "errors"
+
+// NoMatchingJob is returned when a job doesn't exist.
+var NoMatchingJob = errors.New("No matching job")
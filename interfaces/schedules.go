@@ -0,0 +1,6 @@
+package interfaces
+
+import "errors"
+
+// NoMatchingSchedule is returned when no schedule has a name.
+var NoMatchingSchedule = errors.New("No matching schedule")
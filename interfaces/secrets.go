@@ -0,0 +1,6 @@
+package interfaces
+
+import "errors"
+
+// NoMatchingSecret is returned when no secret is stored with a name.
+var NoMatchingSecret = errors.New("No matching secret")
@@ -0,0 +1,6 @@
+package interfaces
+
+import "errors"
+
+// NoMatchingTenant is returned when a tenant doesn't exist.
+var NoMatchingTenant = errors.New("No matching tenant")
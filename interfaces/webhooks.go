@@ -0,0 +1,7 @@
+package interfaces
+
+import "errors"
+
+// NoMatchingWebhookSecret is returned when an API key has no webhook
+// secret yet.
+var NoMatchingWebhookSecret = errors.New("No matching webhook secret")
@@ -0,0 +1,6 @@
+package interfaces
+
+import "errors"
+
+// NoMatchingWorkflow is returned when a workflow doesn't exist.
+var NoMatchingWorkflow = errors.New("No matching workflow")
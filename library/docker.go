@@ -1,39 +1,99 @@
 package library
 
 import (
-	"github.com/Sentimentron/functron/interfaces"
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
-	"errors"
-	"fmt"
+	"time"
+
+	"github.com/Sentimentron/functron/interfaces"
 )
 
+// DockerImageLibrary hands out references to functron's images in docker.
+// Each handle can be released once, and images which are deleted while
+// they're referenced are removed when the last reference is released.
 type DockerImageLibrary struct {
-	runner interfaces.DockerCommandRunner
-	refCount map[string]int
-	handleMap map[interfaces.OpaqueImageHandle]string
+	runner     interfaces.DockerCommandRunner
+	refCount   map[string]int
+	handleMap  map[interfaces.OpaqueImageHandle]*heldHandle
 	nextHandle interfaces.OpaqueImageHandle
-	lock sync.Mutex
+	// pendingRemoval holds the images to remove on their last release,
+	// with the ID each name referred to when it was deleted (if the runner
+	// lists IDs)
+	pendingRemoval map[string]string
+	// replaced holds the IDs of images which were built again while they
+	// were waiting to be removed, which are removed by ID once the handles
+	// acquired before then are released
+	replaced map[string]bool
+	lock           sync.Mutex
+	// lastUsed records when each image was last acquired (or first seen
+	// by CollectGarbage, if it hasn't been), and sizes caches how big
+	// CollectGarbage found each one
+	lastUsed map[string]time.Time
+	sizes    map[string]int64
+	// acquired holds the images which have been acquired since the
+	// library was created
+	acquired map[string]bool
+	// Usage, if set, is where lastUsed and sizes are saved after each
+	// CollectGarbage, and loaded from by the first
+	Usage       interfaces.ImageUsageStore
+	usageLoaded bool
+}
+
+// heldHandle is a reference handed out by AcquireImage.
+type heldHandle struct {
+	name     string
+	id       string
+	acquired time.Time
+	// caller is where AcquireImage was called from
+	caller string
+	// reported is set once Leaks has returned the handle
+	reported bool
+	// longLived handles aren't leaks, however long they're held
+	longLived bool
+}
+
+// HeldHandle describes a reference which hasn't been released.
+type HeldHandle struct {
+	Handle   interfaces.OpaqueImageHandle
+	Name     string
+	Acquired time.Time
+	Caller   string
 }
 
 func CreateDockerImageLibrary(runner interfaces.DockerCommandRunner) *DockerImageLibrary {
 	return &DockerImageLibrary{
-		runner,
-	make(map[string]int),
-	make(map[interfaces.OpaqueImageHandle]string),
-	1,
-	sync.Mutex{}}
+		runner:         runner,
+		refCount:       make(map[string]int),
+		handleMap:      make(map[interfaces.OpaqueImageHandle]*heldHandle),
+		nextHandle:     1,
+		pendingRemoval: make(map[string]string),
+		replaced:       make(map[string]bool),
+		lastUsed:       make(map[string]time.Time),
+		sizes:          make(map[string]int64),
+		acquired:       make(map[string]bool),
+	}
 }
 
 func FormatToFunctronImageName(shortName string) string {
-	return fmt.Sprintf("functron-%s",shortName)
+	return fmt.Sprintf("functron-%s", shortName)
 }
 
 func (d *DockerImageLibrary) CheckImageBuilt(name string) (bool, error) {
+	_, built, err := d.findImage(name)
+	return built, err
+}
+
+// findImage returns whether the image called name has been built, and if
+// so, its ID (or "" if the runner doesn't list IDs).
+func (d *DockerImageLibrary) findImage(name string) (string, bool, error) {
 	// Get a list of all the available images
 	availableImages, err := d.runner.ListImages()
 	if err != nil {
-		return false, err
+		return "", false, err
 	}
 
 	for _, line := range strings.Split(availableImages, "\n") {
@@ -41,97 +101,218 @@ func (d *DockerImageLibrary) CheckImageBuilt(name string) (bool, error) {
 		if len(components) > 0 {
 			imageName := strings.TrimSpace(components[0])
 			if strings.HasPrefix(imageName, "functron-") {
-				shortImageName := strings.Replace(imageName, "functron-","",1)
+				shortImageName := strings.Replace(imageName, "functron-", "", 1)
 				if shortImageName == name {
-					return true, nil
+					return imageID(components), true, nil
 				}
 			}
 		}
 	}
-	return false, err
+	return "", false, nil
+}
+
+// tagged reports whether any of the images which have a tag has the ID
+// id, e.g. because it was built again identically.
+func (d *DockerImageLibrary) tagged(id string) (bool, error) {
+	availableImages, err := d.runner.ListImages()
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(availableImages, "\n") {
+		components := strings.Split(line, "\t")
+		if len(components) >= 2 && strings.TrimSpace(components[1]) != "<none>" && imageID(components) == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// imageID returns the ID from a line of ListImages, split into its
+// components, or "" if it doesn't have one.
+func imageID(components []string) string {
+	if len(components) < 3 {
+		return ""
+	}
+	return strings.TrimSpace(components[2])
 }
 
 func (d *DockerImageLibrary) AcquireImage(name string) (interfaces.OpaqueImageHandle, error) {
+	return d.acquire(name, false)
+}
+
+// AcquireLongLivedImage is like AcquireImage, but Leaks never reports the
+// handle.
+func (d *DockerImageLibrary) AcquireLongLivedImage(name string) (interfaces.OpaqueImageHandle, error) {
+	return d.acquire(name, true)
+}
+
+// acquire hands out a reference for AcquireImage or AcquireLongLivedImage,
+// recording who called them.
+func (d *DockerImageLibrary) acquire(name string, longLived bool) (interfaces.OpaqueImageHandle, error) {
 
 	// Acquire the lock to make sure that nothing can delete images whilst we're doing this.
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
+	// Images which are waiting to be removed can't be used again
+	if _, ok := d.pendingRemoval[name]; ok {
+		return -1, interfaces.ImageBeingRemoved
+	}
+
 	// Check that the image exists
-	imageBuiltYet, err := d.CheckImageBuilt(name)
-	if !imageBuiltYet {
-		return -1, errors.New("image: not built")
-	} else if err != nil {
+	id, imageBuiltYet, err := d.findImage(name)
+	if err != nil {
 		return -1, err
+	} else if !imageBuiltYet {
+		return -1, interfaces.ImageNotBuilt
 	}
 
-	// If it does, assign the handle
-	if _, ok := d.refCount[name]; !ok {
-		d.refCount[name] = 0
-	}
+	// If it does, count the reference and assign the handle
 	d.refCount[name] += 1
+	d.lastUsed[name] = time.Now()
+	d.acquired[name] = true
 
-	// Acquire and assign the handle
+	held := &heldHandle{name: name, id: id, acquired: time.Now(), longLived: longLived}
+	if _, file, line, ok := runtime.Caller(2); ok {
+		held.caller = fmt.Sprintf("%s:%d", file, line)
+	}
 	handle := d.nextHandle
-	d.handleMap[handle] = name
+	d.handleMap[handle] = held
 	d.nextHandle += 1
 
-	return interfaces.OpaqueImageHandle(handle), err
+	return handle, nil
 }
 
+// ReleaseImage gives up a reference. Each handle can only be released
+// once. If the image was deleted while it was referenced, releasing the
+// last reference removes it, even if it's been built again since.
 func (d *DockerImageLibrary) ReleaseImage(handle interfaces.OpaqueImageHandle) error {
 
 	// Acquire the lock so nothing else can happen whilst we're doing this
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	// Check that the handle references something
-	if _, ok := d.handleMap[handle]; !ok {
-		return errors.New("handle invalid")
+	// Check that the handle references something, and forget it
+	held, ok := d.handleMap[handle]
+	if !ok {
+		return interfaces.InvalidImageHandle
 	}
+	delete(d.handleMap, handle)
 
-	// Dereference the handle
-	imageName := d.handleMap[handle]
-	if _, ok := d.refCount[imageName]; !ok {
-		return errors.New("consistency error")
+	// Dereference the image
+	if d.refCount[held.name] <= 0 {
+		return fmt.Errorf("consistency error: %s has no references", held.name)
+	}
+	d.refCount[held.name] -= 1
+	replacedErr := d.removeReplaced(held.id)
+	if d.refCount[held.name] > 0 {
+		return replacedErr
 	}
-	d.refCount[imageName] -= 1
+	delete(d.refCount, held.name)
 
+	if _, ok := d.pendingRemoval[held.name]; !ok {
+		return replacedErr
+	}
+	_, err := d.runner.RemoveImage(context.Background(), FormatToFunctronImageName(held.name))
+	d.forget(held.name)
+	if err != nil {
+		return fmt.Errorf("could not remove %s: %s", held.name, err)
+	}
+	return replacedErr
+}
+
+// removeReplaced removes the image id, if it was built again while it was
+// waiting to be removed, and nothing references it any more. It must be
+// called with the lock held.
+func (d *DockerImageLibrary) removeReplaced(id string) error {
+	if !d.replaced[id] {
+		return nil
+	}
+	for _, held := range d.handleMap {
+		if held.id == id {
+			return nil
+		}
+	}
+	delete(d.replaced, id)
+
+	// If it was built again identically, the new image is the same one
+	tagged, err := d.tagged(id)
+	if err != nil {
+		return fmt.Errorf("could not check whether %s is still in use: %s", id, err)
+	} else if tagged {
+		return nil
+	}
+	if _, err := d.runner.RemoveImage(context.Background(), id); err != nil {
+		return fmt.Errorf("could not remove replaced image %s: %s", id, err)
+	}
 	return nil
 }
 
+// DeleteImage removes an image. If anything holds a reference to it, it's
+// removed once the last reference is released instead, ImageRemovalDeferred
+// is returned, and it can't be acquired again.
 func (d *DockerImageLibrary) DeleteImage(name string) error {
 	// Acquire the lock so nothing else can happen whilst we're doing this
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
 	// Check that the image exists
-	imageBuiltYet, err := d.CheckImageBuilt(name)
-	if !imageBuiltYet {
-		return errors.New("image: not built")
-	} else if err != nil {
+	id, imageBuiltYet, err := d.findImage(name)
+	if err != nil {
 		return err
+	} else if !imageBuiltYet {
+		return interfaces.ImageNotBuilt
 	}
 
-	// Check that there's nothing still referencing it
-	if count, ok := d.refCount[name]; ok {
-		if count != 0 {
-			return errors.New("image: still in use")
-		}
+	// If something's still referencing it, leave it to the last release
+	if d.refCount[name] > 0 {
+		d.pendingRemoval[name] = id
+		return interfaces.ImageRemovalDeferred
 	}
 
 	// Issue the command to Docker to remove the image
-	d.runner.RemoveImage(FormatToFunctronImageName(name))
+	_, err = d.runner.RemoveImage(context.Background(), FormatToFunctronImageName(name))
+	if err != nil {
+		return err
+	}
+	d.forget(name)
+	return nil
 }
 
-func (d *DockerImageLibrary) BuildImage(name string, spec *interfaces.ImageSpecification, monitor interfaces.OutputStream) {
-
-	// Create a temporary directory
-
-	// Download all Repositron specs to that directory
-
-	// Write the Docker file to the directory
+// ImageRebuilt forgets that name was waiting to be removed, as the image
+// its references hold no longer has the name. That image is removed by ID
+// once they're released instead.
+func (d *DockerImageLibrary) ImageRebuilt(name string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if id := d.pendingRemoval[name]; id != "" {
+		d.replaced[id] = true
+	}
+	delete(d.pendingRemoval, name)
+}
 
-	// Pass the context to the Docker agent
+// Leaks returns the handles which have been held for longer than age,
+// oldest first. Each is only returned once, so that it's only reported
+// once.
+func (d *DockerImageLibrary) Leaks(age time.Duration) []HeldHandle {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 
-}
\ No newline at end of file
+	ret := make([]HeldHandle, 0)
+	for handle, held := range d.handleMap {
+		if held.reported || held.longLived || time.Since(held.acquired) < age {
+			continue
+		}
+		held.reported = true
+		ret = append(ret, HeldHandle{
+			Handle:   handle,
+			Name:     held.name,
+			Acquired: held.acquired,
+			Caller:   held.caller,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Acquired.Before(ret[j].Acquired)
+	})
+	return ret
+}
@@ -0,0 +1,158 @@
+package library
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sentimentron/functron/docker/dockertest"
+	"github.com/Sentimentron/functron/interfaces"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestImageLibrary(t *testing.T) {
+	Convey("Given a library with a built image...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		tag := FormatToFunctronImageName("a")
+		runtime.Images[tag] = interfaces.BuildSpec{Tag: tag}
+		lib := CreateDockerImageLibrary(runtime)
+
+		Convey("Images which haven't been built can't be acquired...", func() {
+			_, err := lib.AcquireImage("missing")
+			So(err, ShouldEqual, interfaces.ImageNotBuilt)
+			So(lib.DeleteImage("missing"), ShouldEqual, interfaces.ImageNotBuilt)
+		})
+
+		Convey("Each handle should only be released once...", func() {
+			first, err := lib.AcquireImage("a")
+			So(err, ShouldBeNil)
+			second, err := lib.AcquireImage("a")
+			So(err, ShouldBeNil)
+			So(first, ShouldNotEqual, second)
+
+			So(lib.ReleaseImage(first), ShouldBeNil)
+			So(lib.ReleaseImage(first), ShouldEqual, interfaces.InvalidImageHandle)
+			So(lib.refCount["a"], ShouldEqual, 1)
+			So(lib.ReleaseImage(second), ShouldBeNil)
+			So(lib.refCount, ShouldBeEmpty)
+			So(lib.handleMap, ShouldBeEmpty)
+			So(lib.ReleaseImage(interfaces.OpaqueImageHandle(42)), ShouldEqual, interfaces.InvalidImageHandle)
+		})
+
+		Convey("Unreferenced images should be removed straight away...", func() {
+			So(lib.DeleteImage("a"), ShouldBeNil)
+			So(runtime.Removals, ShouldResemble, []string{tag})
+		})
+
+		Convey("Deleting a referenced image should wait for the last release...", func() {
+			first, err := lib.AcquireImage("a")
+			So(err, ShouldBeNil)
+			second, err := lib.AcquireImage("a")
+			So(err, ShouldBeNil)
+
+			So(lib.DeleteImage("a"), ShouldEqual, interfaces.ImageRemovalDeferred)
+			So(runtime.Removals, ShouldBeEmpty)
+			_, err = lib.AcquireImage("a")
+			So(err, ShouldEqual, interfaces.ImageBeingRemoved)
+
+			So(lib.ReleaseImage(first), ShouldBeNil)
+			So(runtime.Removals, ShouldBeEmpty)
+			So(lib.ReleaseImage(second), ShouldBeNil)
+			So(runtime.Removals, ShouldResemble, []string{tag})
+
+			Convey("Once it's gone, it can be built and acquired again...", func() {
+				runtime.Images[tag] = interfaces.BuildSpec{Tag: tag}
+				handle, err := lib.AcquireImage("a")
+				So(err, ShouldBeNil)
+				So(lib.ReleaseImage(handle), ShouldBeNil)
+			})
+		})
+
+		Convey("Rebuilding an image should remove the old one once it's released, and keep the new one...", func() {
+			runtime.ImageIDs[tag] = "old"
+			old, err := lib.AcquireImage("a")
+			So(err, ShouldBeNil)
+			So(lib.DeleteImage("a"), ShouldEqual, interfaces.ImageRemovalDeferred)
+
+			runtime.Untagged["old"] = true
+			runtime.ImageIDs[tag] = "new"
+			lib.ImageRebuilt("a")
+			handle, err := lib.AcquireImage("a")
+			So(err, ShouldBeNil)
+			So(lib.ReleaseImage(old), ShouldBeNil)
+			So(runtime.Removals, ShouldResemble, []string{"old"})
+			So(runtime.Untagged, ShouldBeEmpty)
+			So(lib.ReleaseImage(handle), ShouldBeNil)
+			So(runtime.Removals, ShouldResemble, []string{"old"})
+			So(runtime.Images, ShouldContainKey, tag)
+			So(lib.replaced, ShouldBeEmpty)
+		})
+
+		Convey("An identical rebuild shouldn't be removed when the old handles are released...", func() {
+			runtime.ImageIDs[tag] = "same"
+			old, err := lib.AcquireImage("a")
+			So(err, ShouldBeNil)
+			So(lib.DeleteImage("a"), ShouldEqual, interfaces.ImageRemovalDeferred)
+
+			lib.ImageRebuilt("a")
+			So(lib.ReleaseImage(old), ShouldBeNil)
+			So(runtime.Removals, ShouldBeEmpty)
+			So(runtime.Images, ShouldContainKey, tag)
+		})
+
+		Convey("Handles which are held for a long time should be reported once...", func() {
+			handle, err := lib.AcquireImage("a")
+			So(err, ShouldBeNil)
+			So(lib.Leaks(time.Hour), ShouldBeEmpty)
+
+			lib.handleMap[handle].acquired = time.Now().Add(-2 * time.Hour)
+			leaks := lib.Leaks(time.Hour)
+			So(leaks, ShouldHaveLength, 1)
+			So(leaks[0].Handle, ShouldEqual, handle)
+			So(leaks[0].Name, ShouldEqual, "a")
+			So(leaks[0].Caller, ShouldContainSubstring, "docker_test.go")
+			So(lib.Leaks(time.Hour), ShouldBeEmpty)
+		})
+
+		Convey("Long-lived handles should never be reported...", func() {
+			handle, err := lib.AcquireLongLivedImage("a")
+			So(err, ShouldBeNil)
+			lib.handleMap[handle].acquired = time.Now().Add(-2 * time.Hour)
+			So(lib.Leaks(time.Hour), ShouldBeEmpty)
+		})
+
+		Convey("Concurrent acquires, releases and deletes should keep count...", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						handle, err := lib.AcquireImage("a")
+						if err != nil {
+							continue
+						}
+						if lib.ReleaseImage(handle) != nil {
+							t.Error("could not release a handle")
+						}
+						if lib.ReleaseImage(handle) != interfaces.InvalidImageHandle {
+							t.Error("released a handle twice")
+						}
+					}
+				}()
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				time.Sleep(time.Millisecond)
+				lib.DeleteImage("a")
+			}()
+			wg.Wait()
+
+			So(lib.refCount, ShouldBeEmpty)
+			So(lib.handleMap, ShouldBeEmpty)
+			So(lib.pendingRemoval, ShouldBeEmpty)
+			So(runtime.Removals, ShouldResemble, []string{tag})
+		})
+	})
+}
@@ -0,0 +1,229 @@
+package library
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sentimentron/functron/models"
+)
+
+// GCPolicy decides which images CollectGarbage evicts.
+type GCPolicy struct {
+	// BudgetBytes is how much disk the library's images can use before
+	// the least recently used are evicted
+	BudgetBytes int64
+	// MinIdle is how long an image has to go unused before it can be
+	// evicted, so that images which have only just been built are left
+	// for whatever built them
+	MinIdle time.Duration
+	// Pinned images are never evicted
+	Pinned map[string]bool
+}
+
+// Eviction describes an image which CollectGarbage removed.
+type Eviction struct {
+	Name      string
+	SizeBytes int64
+	LastUsed  time.Time
+	// Reason explains why the image was chosen
+	Reason string
+}
+
+// CollectGarbage evicts the least recently used images which nothing
+// holds a reference to, until the library's images fit in the policy's
+// budget. Images which haven't been acquired since the library was created
+// count as used when they were last saved to Usage, or if they weren't,
+// when CollectGarbage first saw them.
+func (d *DockerImageLibrary) CollectGarbage(ctx context.Context, policy GCPolicy) ([]Eviction, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	names, total, err := d.survey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if total <= policy.BudgetBytes {
+		return nil, d.saveUsage()
+	}
+
+	candidates := make([]string, 0, len(names))
+	for _, name := range names {
+		if d.refCount[name] > 0 || policy.Pinned[name] || now.Sub(d.lastUsed[name]) < policy.MinIdle {
+			continue
+		}
+		candidates = append(candidates, name)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := d.lastUsed[candidates[i]], d.lastUsed[candidates[j]]
+		if a.Equal(b) {
+			return candidates[i] < candidates[j]
+		}
+		return a.Before(b)
+	})
+
+	evictions := make([]Eviction, 0)
+	for _, name := range candidates {
+		if total <= policy.BudgetBytes {
+			break
+		}
+		if _, err := d.runner.RemoveImage(ctx, FormatToFunctronImageName(name)); err != nil {
+			d.saveUsage()
+			return evictions, fmt.Errorf("could not evict %s: %s", name, err)
+		}
+		evictions = append(evictions, Eviction{
+			Name:      name,
+			SizeBytes: d.sizes[name],
+			LastUsed:  d.lastUsed[name],
+			Reason: fmt.Sprintf("least recently used (idle for %s) while images used %d bytes, over the budget of %d",
+				now.Sub(d.lastUsed[name]).Round(time.Second), total, policy.BudgetBytes),
+		})
+		total -= d.sizes[name]
+		d.forget(name)
+	}
+	return evictions, d.saveUsage()
+}
+
+// SaveUsage saves when each of the library's images was last used, and
+// how big it is, to Usage, as CollectGarbage does, without evicting
+// anything.
+func (d *DockerImageLibrary) SaveUsage(ctx context.Context) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, _, err := d.survey(ctx); err != nil {
+		return err
+	}
+	return d.saveUsage()
+}
+
+// Idle reports whether nothing holds a reference to name, and it hasn't
+// been used for at least minIdle.
+func (d *DockerImageLibrary) Idle(name string, minIdle time.Duration) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.refCount[name] > 0 {
+		return false
+	}
+	lastUsed, ok := d.lastUsed[name]
+	return !ok || time.Since(lastUsed) >= minIdle
+}
+
+// survey lists the library's images, and how many bytes they use in
+// total, noting when it first saw any which haven't been used and how big
+// each is. It must be called with the lock held.
+func (d *DockerImageLibrary) survey(ctx context.Context) ([]string, int64, error) {
+	if err := d.loadUsage(); err != nil {
+		return nil, 0, err
+	}
+	names, err := d.removableImages()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now()
+	listed := make(map[string]bool)
+	var total int64
+	for _, name := range names {
+		listed[name] = true
+		if _, ok := d.lastUsed[name]; !ok {
+			d.lastUsed[name] = now
+		}
+		size, ok := d.sizes[name]
+		if !ok {
+			size, err = d.runner.ImageSize(ctx, FormatToFunctronImageName(name))
+			if err != nil {
+				return nil, 0, err
+			}
+			d.sizes[name] = size
+		}
+		total += size
+	}
+	// Forget images which were removed some other way
+	for name := range d.lastUsed {
+		if !listed[name] {
+			d.forget(name)
+		}
+	}
+	return names, total, nil
+}
+
+// loadUsage fills in when images were last used, and how big they are,
+// from Usage, the first time it's called. It must be called with the lock
+// held.
+func (d *DockerImageLibrary) loadUsage() error {
+	if d.Usage == nil || d.usageLoaded {
+		return nil
+	}
+	usage, err := d.Usage.RetrieveImageUsage()
+	if err != nil {
+		return fmt.Errorf("could not load image usage: %s", err)
+	}
+	for _, u := range usage {
+		if _, ok := d.lastUsed[u.Name]; !ok {
+			d.lastUsed[u.Name] = u.LastUsed
+		}
+		if _, ok := d.sizes[u.Name]; !ok {
+			d.sizes[u.Name] = u.SizeBytes
+		}
+	}
+	d.usageLoaded = true
+	return nil
+}
+
+// saveUsage saves when each image CollectGarbage knows of was last used,
+// and how big it is, to Usage. It must be called with the lock held.
+func (d *DockerImageLibrary) saveUsage() error {
+	if d.Usage == nil {
+		return nil
+	}
+	usage := make([]models.ImageUsage, 0, len(d.lastUsed))
+	for name, lastUsed := range d.lastUsed {
+		if size, ok := d.sizes[name]; ok {
+			usage = append(usage, models.ImageUsage{Name: name, LastUsed: lastUsed, SizeBytes: size, Acquired: d.acquired[name]})
+		}
+	}
+	if err := d.Usage.SaveImageUsage(usage); err != nil {
+		return fmt.Errorf("could not save image usage: %s", err)
+	}
+	return nil
+}
+
+// removableImages lists the images which the library can remove: the
+// functron- images tagged latest, as FormatToFunctronImageName names
+// them. It must be called with the lock held.
+func (d *DockerImageLibrary) removableImages() ([]string, error) {
+	availableImages, err := d.runner.ListImages()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0)
+	for _, line := range strings.Split(availableImages, "\n") {
+		components := strings.Split(line, "\t")
+		if len(components) < 2 || strings.TrimSpace(components[1]) != "latest" {
+			continue
+		}
+		imageName := strings.TrimSpace(components[0])
+		if strings.HasPrefix(imageName, "functron-") {
+			ret = append(ret, strings.TrimPrefix(imageName, "functron-"))
+		}
+	}
+	return ret, nil
+}
+
+// forget stops tracking an image which has been removed. It must be called
+// with the lock held.
+func (d *DockerImageLibrary) forget(name string) {
+	delete(d.lastUsed, name)
+	delete(d.sizes, name)
+	delete(d.acquired, name)
+	delete(d.pendingRemoval, name)
+	if d.refCount[name] == 0 {
+		delete(d.refCount, name)
+	}
+}
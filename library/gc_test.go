@@ -0,0 +1,125 @@
+package library
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Sentimentron/functron/docker/dockertest"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	Convey("Given a library of three 100 byte images...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		for _, name := range []string{"a", "b", "c"} {
+			tag := FormatToFunctronImageName(name)
+			runtime.Images[tag] = interfaces.BuildSpec{Tag: tag}
+			runtime.ImageSizes[tag] = 100
+		}
+		// Images tagged for a single invocation aren't the library's
+		runtime.Images["functron-temp-abcde:1.0"] = interfaces.BuildSpec{Tag: "functron-temp-abcde:1.0"}
+		lib := CreateDockerImageLibrary(runtime)
+		ctx := context.Background()
+
+		// use acquires and releases name, as if it was last used ago
+		use := func(name string, ago time.Duration) {
+			handle, err := lib.AcquireImage(name)
+			So(err, ShouldBeNil)
+			So(lib.ReleaseImage(handle), ShouldBeNil)
+			lib.lastUsed[name] = time.Now().Add(-ago)
+		}
+		use("a", time.Hour)
+		use("b", 3*time.Hour)
+		use("c", 2*time.Hour)
+
+		evictedNames := func(evictions []Eviction) []string {
+			ret := make([]string, 0)
+			for _, e := range evictions {
+				ret = append(ret, e.Name)
+			}
+			return ret
+		}
+
+		Convey("Nothing should be evicted within the budget...", func() {
+			evictions, err := lib.CollectGarbage(ctx, GCPolicy{BudgetBytes: 300})
+			So(err, ShouldBeNil)
+			So(evictions, ShouldBeEmpty)
+			So(runtime.Removals, ShouldBeEmpty)
+		})
+
+		Convey("The least recently used should be evicted until the images fit...", func() {
+			evictions, err := lib.CollectGarbage(ctx, GCPolicy{BudgetBytes: 150})
+			So(err, ShouldBeNil)
+			So(evictedNames(evictions), ShouldResemble, []string{"b", "c"})
+			So(evictions[0].SizeBytes, ShouldEqual, 100)
+			So(evictions[0].Reason, ShouldContainSubstring, "over the budget of 150")
+			built, err := lib.CheckImageBuilt("a")
+			So(err, ShouldBeNil)
+			So(built, ShouldBeTrue)
+
+			Convey("Evicted images should be reported as not built...", func() {
+				_, err := lib.AcquireImage("b")
+				So(err, ShouldEqual, interfaces.ImageNotBuilt)
+			})
+		})
+
+		Convey("Images which are in use, pinned or recently used should be kept...", func() {
+			handle, err := lib.AcquireImage("b")
+			So(err, ShouldBeNil)
+			lib.lastUsed["b"] = time.Now().Add(-3 * time.Hour)
+			evictions, err := lib.CollectGarbage(ctx, GCPolicy{
+				MinIdle: 90 * time.Minute,
+				Pinned:  map[string]bool{"c": true},
+			})
+			So(err, ShouldBeNil)
+			So(evictions, ShouldBeEmpty)
+
+			So(lib.ReleaseImage(handle), ShouldBeNil)
+			evictions, err = lib.CollectGarbage(ctx, GCPolicy{MinIdle: 90 * time.Minute})
+			So(err, ShouldBeNil)
+			So(evictedNames(evictions), ShouldResemble, []string{"b", "c"})
+		})
+
+		Convey("Images which have never been used count from when they were first seen...", func() {
+			tag := FormatToFunctronImageName("d")
+			runtime.Images[tag] = interfaces.BuildSpec{Tag: tag}
+			runtime.ImageSizes[tag] = 100
+			evictions, err := lib.CollectGarbage(ctx, GCPolicy{BudgetBytes: 100, MinIdle: time.Minute})
+			So(err, ShouldBeNil)
+			So(evictedNames(evictions), ShouldResemble, []string{"b", "c", "a"})
+		})
+
+		Convey("When images were last used, and their sizes, should outlive the library...", func() {
+			usage := &usageStore{}
+			lib.Usage = usage
+			_, err := lib.CollectGarbage(ctx, GCPolicy{BudgetBytes: 300})
+			So(err, ShouldBeNil)
+			So(usage.saved, ShouldHaveLength, 3)
+
+			restarted := CreateDockerImageLibrary(runtime)
+			restarted.Usage = usage
+			runtime.ImageSizes = map[string]int64{}
+			evictions, err := restarted.CollectGarbage(ctx, GCPolicy{BudgetBytes: 150, MinIdle: time.Minute})
+			So(err, ShouldBeNil)
+			So(evictedNames(evictions), ShouldResemble, []string{"b", "c"})
+			So(evictions[0].SizeBytes, ShouldEqual, 100)
+		})
+	})
+}
+
+// usageStore keeps image usage in memory.
+type usageStore struct {
+	saved []models.ImageUsage
+}
+
+func (u *usageStore) RetrieveImageUsage() ([]models.ImageUsage, error) {
+	return u.saved, nil
+}
+
+func (u *usageStore) SaveImageUsage(usage []models.ImageUsage) error {
+	u.saved = usage
+	return nil
+}
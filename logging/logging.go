@@ -0,0 +1,199 @@
+// Package logging provides levelled, structured logging. Each line is
+// written as a single JSON object, so that concurrent invocations can be
+// told apart by their fields (e.g. request_id).
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level describes how important a log line is.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel converts a configuration string (e.g. "debug") into a Level.
+// An empty string means LevelInfo.
+func ParseLevel(s string) (Level, error) {
+	if s == "" {
+		return LevelInfo, nil
+	}
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("logging: unknown level '%s'", s)
+}
+
+// Fields are extra key/value pairs attached to each log line.
+type Fields map[string]interface{}
+
+// Logger writes JSON log lines at or above its level. Loggers derived with
+// WithField(s) share the parent's output and lock.
+type Logger struct {
+	out    io.Writer
+	lock   *sync.Mutex
+	level  Level
+	fields Fields
+	// redactions are replaced wherever they appear in a line, as they'd
+	// be encoded in it
+	redactions [][]byte
+}
+
+// Redacted replaces each of a Logger's redactions.
+const Redacted = "[REDACTED]"
+
+// New creates a Logger which writes lines at or above level to out.
+func New(out io.Writer, level Level) *Logger {
+	return &Logger{out, &sync.Mutex{}, level, Fields{}, nil}
+}
+
+var std = New(os.Stderr, LevelInfo)
+
+// Default returns the process-wide logger.
+func Default() *Logger {
+	return std
+}
+
+// SetDefault replaces the process-wide logger.
+func SetDefault(l *Logger) {
+	std = l
+}
+
+// WithField returns a Logger which adds key=value to every line.
+func (l *Logger) WithField(key string, value interface{}) *Logger {
+	return l.WithFields(Fields{key: value})
+}
+
+// WithFields returns a Logger which adds all of fields to every line.
+func (l *Logger) WithFields(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{l.out, l.lock, l.level, merged, l.redactions}
+}
+
+// WithRedactions returns a Logger which replaces each of values (such as
+// secrets) with Redacted wherever it appears in a line.
+func (l *Logger) WithRedactions(values ...string) *Logger {
+	redactions := append([][]byte(nil), l.redactions...)
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		encoded, _ := json.Marshal(v)
+		redactions = append(redactions, encoded[1:len(encoded)-1])
+	}
+	return &Logger{l.out, l.lock, l.level, l.fields, redactions}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LevelDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LevelWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, format, args...)
+}
+
+// Fatalf logs at LevelError, then exits the process.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.log(LevelError, format, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+
+	line := make(Fields, len(l.fields)+3)
+	for k, v := range l.fields {
+		// Errors don't marshal to anything useful
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		line[k] = v
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level.String()
+	line["msg"] = fmt.Sprintf(format, args...)
+
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		encoded, _ = json.Marshal(Fields{
+			"time":  line["time"],
+			"level": line["level"],
+			"msg":   line["msg"],
+			"error": fmt.Sprintf("logging: could not encode fields: %s", err),
+		})
+	}
+
+	for _, r := range l.redactions {
+		encoded = bytes.Replace(encoded, r, []byte(Redacted), -1)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(append(encoded, '\n'))
+}
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// NewContext returns a copy of ctx which carries l.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+// FromContext returns the Logger carried by ctx, or Default if there
+// isn't one.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey).(*Logger); ok {
+		return l
+	}
+	return Default()
+}
@@ -0,0 +1,65 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	Convey("Given a logger at info level...", t, func() {
+		buf := &bytes.Buffer{}
+		l := New(buf, LevelInfo)
+
+		Convey("Debug lines should be suppressed...", func() {
+			l.Debugf("hidden")
+			So(buf.Len(), ShouldEqual, 0)
+		})
+
+		Convey("Info lines should be written as JSON with their fields...", func() {
+			l.WithField("request_id", "abc").Infof("hello %s", "world")
+
+			var line map[string]interface{}
+			err := json.Unmarshal(buf.Bytes(), &line)
+			So(err, ShouldBeNil)
+			So(line["msg"], ShouldEqual, "hello world")
+			So(line["level"], ShouldEqual, "info")
+			So(line["request_id"], ShouldEqual, "abc")
+			So(strings.Count(buf.String(), "\n"), ShouldEqual, 1)
+		})
+
+		Convey("Derived loggers should not change their parent...", func() {
+			l.WithField("a", 1)
+			l.Infof("plain")
+			So(buf.String(), ShouldNotContainSubstring, `"a"`)
+		})
+
+		Convey("Redactions should be replaced in fields and messages...", func() {
+			r := l.WithRedactions("hunter2", `say "hi"`).WithField("password", "hunter2")
+			r.Infof("output was %s and say \"hi\"", "hunter2")
+			So(buf.String(), ShouldNotContainSubstring, "hunter2")
+			So(buf.String(), ShouldNotContainSubstring, "hi")
+			So(strings.Count(buf.String(), Redacted), ShouldEqual, 3)
+
+			l.Infof("hunter2")
+			So(buf.String(), ShouldContainSubstring, "hunter2")
+		})
+	})
+}
+
+func TestRequestIDs(t *testing.T) {
+	Convey("Generated request IDs should be valid and distinct", t, func() {
+		a, b := NewRequestID(), NewRequestID()
+		So(ValidRequestID(a), ShouldBeTrue)
+		So(a, ShouldNotEqual, b)
+	})
+
+	Convey("Unsafe request IDs should be rejected", t, func() {
+		So(ValidRequestID(""), ShouldBeFalse)
+		So(ValidRequestID("has space"), ShouldBeFalse)
+		So(ValidRequestID("a=b"), ShouldBeFalse)
+		So(ValidRequestID(strings.Repeat("a", 65)), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,247 @@
+// Package metrics exposes functron's internal counters, gauges and
+// histograms in the Prometheus text format at /metrics.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/Sentimentron/functron/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "functron"
+
+// Outcomes reported against Invocations.
+const (
+	OutcomeSuccess       = "success"
+	OutcomeBadRequest    = "bad_request"
+	OutcomeQuotaExceeded = "quota_exceeded"
+	OutcomeUnpackFailed  = "unpack_failure"
+	OutcomeBuildFailed   = "build_failure"
+	OutcomeRunFailed     = "run_failure"
+	OutcomeTimeout       = "timeout"
+	OutcomeError         = "error"
+)
+
+// FunctionAdHoc is the function label for invocations of functions which
+// aren't registered, whose names are whatever the caller chose.
+const FunctionAdHoc = "adhoc"
+
+// FunctionLabel returns how the function name is labelled in metrics: by
+// name if it's registered, or as FunctionAdHoc if it isn't, so that
+// callers can't create as many series as they like.
+func FunctionLabel(name string, registered bool) string {
+	if !registered {
+		return FunctionAdHoc
+	}
+	return name
+}
+
+var (
+	// Invocations counts every invocation, of registered or ad-hoc
+	// functions, by function (see FunctionLabel) and outcome.
+	Invocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "invocations_total",
+		Help:      "Number of function invocations, by registered function name (or \"adhoc\") and outcome.",
+	}, []string{"function", "outcome"})
+
+	// BuildDuration records how long `docker build` takes.
+	BuildDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "build_duration_seconds",
+		Help:      "Time spent building function images.",
+		Buckets:   prometheus.ExponentialBuckets(0.25, 2, 12),
+	})
+
+	// RunDuration records how long a function's container runs for.
+	RunDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "run_duration_seconds",
+		Help:      "Time spent running function containers.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	})
+
+	// QueueDepth is the number of invocations waiting for a free slot.
+	QueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Number of invocations waiting for a free slot.",
+	})
+
+	// SlotsHeld is the number of slots each queue (a tenant's interactive
+	// or background invocations of a function) holds, which is its share
+	// of the slots.
+	SlotsHeld = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "slots_held",
+		Help:      "Number of slots held, by tenant, registered function name (or \"adhoc\") and class.",
+	}, []string{"tenant", "function", "class"})
+
+	// SlotWait records how long each queue's invocations wait for a slot.
+	SlotWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "slot_wait_seconds",
+		Help:      "Time spent waiting for a free slot, by tenant, registered function name (or \"adhoc\") and class.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"tenant", "function", "class"})
+
+	// SlotsBusy is the number of slots currently running an invocation.
+	SlotsBusy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "slots_busy",
+		Help:      "Number of slots currently in use.",
+	})
+
+	// SlotsFree is the number of slots available for new invocations.
+	SlotsFree = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "slots_free",
+		Help:      "Number of slots available for new invocations.",
+	})
+
+	// BytesUnpacked counts the bytes written by UnpackTarIntoDirectory.
+	BytesUnpacked = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unpacked_bytes_total",
+		Help:      "Bytes unpacked from build context tar files.",
+	})
+
+	// CleanupFailures counts failures to tidy up after an invocation,
+	// by the stage which failed (e.g. "image").
+	CleanupFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cleanup_failures_total",
+		Help:      "Number of failed cleanup operations, by stage.",
+	}, []string{"stage"})
+
+	// ReaperErrors counts passes of the periodic image collection which
+	// failed, or couldn't remove every image they should have.
+	ReaperErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reaper_errors_total",
+		Help:      "Number of periodic image collection passes which failed.",
+	})
+
+	// ImagesEvicted counts images evicted to keep within the disk budget.
+	ImagesEvicted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "images_evicted_total",
+		Help:      "Number of images evicted to keep within the disk budget.",
+	})
+
+	// WarmContainers is the number of containers ready to run each
+	// registered function.
+	WarmContainers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "warm_containers",
+		Help:      "Number of containers ready to run, by function name.",
+	}, []string{"function"})
+
+	// WarmStarts counts invocations of registered functions by whether a
+	// container was ready ("hit") or had to be created ("miss").
+	WarmStarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "warm_starts_total",
+		Help:      "Number of warm pool invocations, by function name and result.",
+	}, []string{"function", "result"})
+
+	// ScheduledRuns counts the runs each schedule has started ("started")
+	// or skipped because the last one was still running ("skipped").
+	ScheduledRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scheduled_runs_total",
+		Help:      "Number of scheduled runs, by schedule name and result.",
+	}, []string{"schedule", "result"})
+
+	// WebhookAttempts counts attempts at delivering job results to callback
+	// URLs, by whether they were "delivered", will be "retried", or have
+	// "failed" for good.
+	WebhookAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_attempts_total",
+		Help:      "Number of webhook delivery attempts, by result.",
+	}, []string{"result"})
+
+	// QueuedJobs counts each attempt at a queued job by how it left the
+	// job: "succeeded", "failed", "retried", or "dead" once it's out of
+	// attempts. Jobs whose leases expired count as "retried" or "dead" too.
+	QueuedJobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queued_jobs_total",
+		Help:      "Number of attempts at queued jobs, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		Invocations,
+		BuildDuration,
+		RunDuration,
+		QueueDepth,
+		SlotsBusy,
+		SlotsFree,
+		SlotsHeld,
+		SlotWait,
+		BytesUnpacked,
+		CleanupFailures,
+		ReaperErrors,
+		ImagesEvicted,
+		WarmContainers,
+		WarmStarts,
+		ScheduledRuns,
+		WebhookAttempts,
+		QueuedJobs,
+	)
+}
+
+// ImageStatusCounter is implemented by anything that can report how many
+// images are in each ImageStatus (e.g. database.Store).
+type ImageStatusCounter interface {
+	CountImagesByStatus() (map[models.ImageStatus]int, error)
+}
+
+// imageCollector queries the image store each time /metrics is scraped.
+type imageCollector struct {
+	store ImageStatusCounter
+	desc  *prometheus.Desc
+}
+
+// RegisterImageStore exports image counts by status from the given store.
+func RegisterImageStore(store ImageStatusCounter) error {
+	return prometheus.Register(&imageCollector{
+		store,
+		prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "images"),
+			"Number of images known to functron, by status.",
+			[]string{"status"}, nil,
+		),
+	})
+}
+
+func (c *imageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *imageCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := c.store.CountImagesByStatus()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	// Report every known status so that series don't disappear when empty
+	for _, status := range models.ImageStatuses {
+		if _, ok := counts[status]; !ok {
+			counts[status] = 0
+		}
+	}
+	for status, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), string(status))
+	}
+}
+
+// Handler returns the HTTP handler which serves /metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
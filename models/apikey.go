@@ -0,0 +1,92 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Scope is a permission carried by an API key.
+type Scope string
+
+const (
+	// ScopeExec allows functions to be invoked.
+	ScopeExec Scope = "exec"
+	// ScopeRegisterFunctions allows functions to be registered and removed.
+	ScopeRegisterFunctions Scope = "register-functions"
+	// ScopeAdmin allows API keys and other server state to be managed.
+	ScopeAdmin Scope = "admin"
+	// ScopeManageSecrets allows secrets to be stored and removed.
+	ScopeManageSecrets Scope = "manage-secrets"
+)
+
+// AllScopes lists every valid Scope.
+var AllScopes = []Scope{ScopeExec, ScopeRegisterFunctions, ScopeAdmin, ScopeManageSecrets}
+
+// ParseScope checks that s names a valid Scope.
+func ParseScope(s string) (Scope, error) {
+	for _, scope := range AllScopes {
+		if string(scope) == s {
+			return scope, nil
+		}
+	}
+	return "", fmt.Errorf("unknown scope '%s'", s)
+}
+
+// Scopes is a set of Scope, stored in the database as a comma-separated list.
+type Scopes []Scope
+
+// Has returns true if scope is in the list.
+func (s Scopes) Has(scope Scope) bool {
+	for _, candidate := range s {
+		if candidate == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Value implements driver.Valuer.
+func (s Scopes) Value() (driver.Value, error) {
+	strs := make([]string, len(s))
+	for i, scope := range s {
+		strs[i] = string(scope)
+	}
+	return strings.Join(strs, ","), nil
+}
+
+// Scan implements sql.Scanner.
+func (s *Scopes) Scan(src interface{}) error {
+	var str string
+	switch v := src.(type) {
+	case string:
+		str = v
+	case []byte:
+		str = string(v)
+	default:
+		return fmt.Errorf("Scopes: can't scan %T", src)
+	}
+	*s = Scopes{}
+	for _, part := range strings.Split(str, ",") {
+		if part == "" {
+			continue
+		}
+		*s = append(*s, Scope(part))
+	}
+	return nil
+}
+
+// APIKey identifies a client of Functron. Only a hash of the key is
+// stored: the key itself is shown once, when it's created.
+type APIKey struct {
+	Id       int64      `json:"id" db:"id"`
+	Name     string     `json:"name" db:"name"`
+	Prefix   string     `json:"prefix" db:"prefix"`
+	Hash     string     `json:"-" db:"hash"`
+	Scopes   Scopes     `json:"scopes" db:"scopes"`
+	TenantId *int64     `json:"tenantId" db:"tenant_id"`
+	Created  time.Time  `json:"created" db:"created"`
+	LastUsed *time.Time `json:"lastUsed" db:"last_used"`
+	Revoked  *time.Time `json:"revoked" db:"revoked"`
+}
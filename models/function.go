@@ -0,0 +1,39 @@
+package models
+
+import (
+	"regexp"
+	"time"
+)
+
+// Function is a registered function: a Dockerfile and build context which
+// can be invoked by name.
+type Function struct {
+	Id         int64  `json:"id" db:"id"`
+	Name       string `json:"name" db:"name"`
+	Dockerfile string `json:"dockerFile" db:"docker_file"`
+	// BuildContext is a tar file, unpacked at /data when the function runs
+	BuildContext []byte `json:"-" db:"build_context"`
+	// TimeoutSeconds is used when an invocation doesn't specify one
+	TimeoutSeconds float64 `json:"timeoutSeconds" db:"timeout_seconds"`
+	// Weight is the function's share of its tenant's slots, relative to
+	// the tenant's other functions. It's saved as 1 if it's zero.
+	Weight float64 `json:"weight" db:"weight"`
+	// Env is set in the function's environment whenever it's invoked
+	Env EnvVars `json:"env" db:"env"`
+	// SecurityProfile names the configured profile which confines the
+	// function's containers, on top of the server's
+	SecurityProfile string `json:"securityProfile" db:"security_profile"`
+	// Network is the network mode the function runs with, or empty for the
+	// server's default
+	Network string    `json:"network" db:"network"`
+	Created time.Time `json:"created" db:"created"`
+	Updated time.Time `json:"updated" db:"updated"`
+}
+
+// functionNamePattern matches names which can be used in image tags and URLs.
+var functionNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,62}$`)
+
+// ValidFunctionName checks whether name can be used for a Function.
+func ValidFunctionName(name string) bool {
+	return functionNamePattern.MatchString(name)
+}
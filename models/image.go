@@ -4,25 +4,41 @@ import "time"
 
 type ImageStatus string
 const (
-	ImageStatusScheduledForBuild = "scheduled"
-	ImageStatusPreparingForBuild = "preparing"
-	ImageStatusBuildingDockerfile = "building_dockerfile"
-	ImageStatusRunningPostCommitScript = "building_commit_script"
-	ImageStatusCommitting="committing"
-	ImageStatusCompleted="completed"
+	ImageStatusScheduledForBuild ImageStatus = "scheduled"
+	ImageStatusPreparingForBuild ImageStatus = "preparing"
+	ImageStatusBuildingDockerfile ImageStatus = "building_dockerfile"
+	ImageStatusRunningPostCommitScript ImageStatus = "building_commit_script"
+	ImageStatusCommitting ImageStatus = "committing"
+	ImageStatusCompleted ImageStatus = "completed"
 	// Indicates that the image was removed to free space or its
 	// scheduled cleanup has passed.
-	ImageStatusCleanedUp="removed"
+	ImageStatusCleanedUp ImageStatus = "removed"
 	// These status updates indicate that the image failed at various stages.
-	ImageStatusFailedPreparation="failed_preparation"
-	ImageStatusFailedDockerfile = "failed_docker"
-	ImageStatusFailedCommitScript = "failed_commit_script"
-	ImageStatusFailedCommit = "failed_commit"
+	ImageStatusFailedPreparation ImageStatus = "failed_preparation"
+	ImageStatusFailedDockerfile ImageStatus = "failed_docker"
+	ImageStatusFailedCommitScript ImageStatus = "failed_commit_script"
+	ImageStatusFailedCommit ImageStatus = "failed_commit"
 	// Indiicates that Functron wasn't able to match up the image it built
 	// with the one reported by Docker.
-	ImageStatusInvalid = "invalid"
+	ImageStatusInvalid ImageStatus = "invalid"
 )
 
+// ImageStatuses lists every ImageStatus, e.g. for reporting.
+var ImageStatuses = []ImageStatus{
+	ImageStatusScheduledForBuild,
+	ImageStatusPreparingForBuild,
+	ImageStatusBuildingDockerfile,
+	ImageStatusRunningPostCommitScript,
+	ImageStatusCommitting,
+	ImageStatusCompleted,
+	ImageStatusCleanedUp,
+	ImageStatusFailedPreparation,
+	ImageStatusFailedDockerfile,
+	ImageStatusFailedCommitScript,
+	ImageStatusFailedCommit,
+	ImageStatusInvalid,
+}
+
 
 type FunctronImage struct {
 	Id                  int64       `json:"id" db:"id"`
@@ -34,4 +50,101 @@ type FunctronImage struct {
 	Committed           *time.Time  `json:"finished" db:"finished"`
 	ScheduledForRemoval *time.Time  `json:"scheduledRemoval" db:"scheduled_removal"`
 	Status              ImageStatus `json:"status" db:"status"`
+	// Pinned images are never evicted to save disk
+	Pinned bool `json:"pinned" db:"pinned"`
+}
+
+// imageTransitions lists the statuses each ImageStatus can change to. An
+// image which failed, or which has been built or removed, can be scheduled
+// to build again, e.g. when a warm function's image was evicted.
+var imageTransitions = map[ImageStatus][]ImageStatus{
+	ImageStatusScheduledForBuild:       {ImageStatusPreparingForBuild, ImageStatusCleanedUp},
+	ImageStatusPreparingForBuild:       {ImageStatusBuildingDockerfile, ImageStatusFailedPreparation},
+	ImageStatusBuildingDockerfile:      {ImageStatusRunningPostCommitScript, ImageStatusCommitting, ImageStatusFailedDockerfile},
+	ImageStatusRunningPostCommitScript: {ImageStatusCommitting, ImageStatusFailedCommitScript},
+	ImageStatusCommitting:              {ImageStatusCompleted, ImageStatusFailedCommit, ImageStatusInvalid},
+	ImageStatusCompleted:               {ImageStatusCleanedUp, ImageStatusInvalid, ImageStatusScheduledForBuild},
+	ImageStatusCleanedUp:               {ImageStatusScheduledForBuild},
+	ImageStatusFailedPreparation:       {ImageStatusScheduledForBuild, ImageStatusCleanedUp},
+	ImageStatusFailedDockerfile:        {ImageStatusScheduledForBuild, ImageStatusCleanedUp},
+	ImageStatusFailedCommitScript:      {ImageStatusScheduledForBuild, ImageStatusCleanedUp},
+	ImageStatusFailedCommit:            {ImageStatusScheduledForBuild, ImageStatusCleanedUp},
+	ImageStatusInvalid:                 {ImageStatusScheduledForBuild, ImageStatusCleanedUp},
+}
+
+// CanTransitionTo reports whether images with status s can change to next.
+func (s ImageStatus) CanTransitionTo(next ImageStatus) bool {
+	for _, allowed := range imageTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// ImageStatusTransition records an image's status changing. From is empty
+// for the image's first status.
+type ImageStatusTransition struct {
+	Id      int64       `json:"id" db:"id"`
+	ImageId int64       `json:"imageId" db:"image_id"`
+	From    ImageStatus `json:"from" db:"from_status"`
+	To      ImageStatus `json:"to" db:"to_status"`
+	Message string      `json:"message" db:"message"`
+	Created time.Time   `json:"created" db:"created"`
+}
+
+// Removed reports whether images with status s have been removed.
+func (s ImageStatus) Removed() bool {
+	return s == ImageStatusCleanedUp
+}
+
+// Building reports whether images with status s are still being built.
+func (s ImageStatus) Building() bool {
+	switch s {
+	case ImageStatusScheduledForBuild, ImageStatusPreparingForBuild, ImageStatusBuildingDockerfile,
+		ImageStatusRunningPostCommitScript, ImageStatusCommitting:
+		return true
+	}
+	return false
+}
+
+// Failed reports whether images with status s failed to build.
+func (s ImageStatus) Failed() bool {
+	switch s {
+	case ImageStatusFailedPreparation, ImageStatusFailedDockerfile, ImageStatusFailedCommitScript,
+		ImageStatusFailedCommit, ImageStatusInvalid:
+		return true
+	}
+	return false
+}
+
+// ImageUsage records when an image was last used, and how big it is, for
+// the garbage collector.
+type ImageUsage struct {
+	Name      string    `db:"name"`
+	LastUsed  time.Time `db:"last_used"`
+	SizeBytes int64     `db:"size_bytes"`
+	// Acquired is set if LastUsed is when something last used the image,
+	// rather than when the garbage collector first saw it
+	Acquired bool `db:"-"`
+}
+
+// The kinds of ImageChange.
+const (
+	ImageChangePinned      = "pinned"
+	ImageChangeUnpinned    = "unpinned"
+	ImageChangeRescheduled = "rescheduled"
+	ImageChangeRemoved     = "removed"
+)
+
+// ImageChange records a change made to an image through the API.
+type ImageChange struct {
+	Id      int64  `json:"id" db:"id"`
+	ImageId int64  `json:"imageId" db:"image_id"`
+	Change  string `json:"change" db:"change"`
+	// Detail describes the change, e.g. the new scheduled removal
+	Detail string `json:"detail" db:"detail"`
+	// APIKeyId is the key which made the change
+	APIKeyId *int64    `json:"apiKeyId" db:"api_key_id"`
+	Created  time.Time `json:"created" db:"created"`
 }
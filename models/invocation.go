@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// InvocationRunning is the outcome of an invocation which hasn't finished.
+const InvocationRunning = "running"
+
+// Invocation records a single call to a function.
+type Invocation struct {
+	Id           int64      `json:"id" db:"id"`
+	RequestID    string     `json:"requestId" db:"request_id"`
+	FunctionName string     `json:"functionName" db:"function_name"`
+	APIKeyId     *int64     `json:"apiKeyId" db:"api_key_id"`
+	TenantId     *int64     `json:"tenantId" db:"tenant_id"`
+	Started      time.Time  `json:"started" db:"started"`
+	Finished     *time.Time `json:"finished" db:"finished"`
+	Outcome      string     `json:"outcome" db:"outcome"`
+	Network      string     `json:"network" db:"network"`
+	// Usage is what the invocation's containers used, once it's finished
+	Usage
+}
@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// The statuses of a Job.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	// JobDead jobs kept failing in ways which running them again might
+	// have fixed, until they ran out of attempts
+	JobDead = "dead"
+)
+
+// Job is an invocation which waits in the queue until a worker claims it.
+// A worker holds a lease on each job it's running, which it renews as it
+// goes; jobs whose lease expires are queued again.
+type Job struct {
+	// Seq orders jobs of the same priority, oldest first
+	Seq      int64  `json:"-" db:"seq"`
+	Id       string `json:"id" db:"id"`
+	Function string `json:"function" db:"function_name"`
+	// Request is the api.JobRequest the job was submitted with, as JSON
+	Request []byte `json:"-" db:"request"`
+	// Jobs with a higher Priority are claimed first
+	Priority    int    `json:"priority" db:"priority"`
+	Status      string `json:"status" db:"status"`
+	APIKeyId    *int64 `json:"apiKeyId" db:"api_key_id"`
+	CallbackURL string `json:"callbackUrl" db:"callback_url"`
+	// Attempts counts the times the job has been claimed
+	Attempts     int        `json:"attempts" db:"attempts"`
+	MaxAttempts  int        `json:"maxAttempts" db:"max_attempts"`
+	LeaseOwner   string     `json:"-" db:"lease_owner"`
+	LeaseExpires *time.Time `json:"leaseExpires" db:"lease_expires"`
+	Enqueued     time.Time  `json:"enqueued" db:"enqueued"`
+	Started      *time.Time `json:"started" db:"started"`
+	Finished     *time.Time `json:"finished" db:"finished"`
+	// Result is the api.ExecResponse of the job's last attempt, as JSON
+	Result    []byte `json:"-" db:"result"`
+	LastError string `json:"lastError" db:"last_error"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// Schedule invokes a registered function whenever its cron expression
+// matches.
+type Schedule struct {
+	Id       int64  `json:"id" db:"id"`
+	Name     string `json:"name" db:"name"`
+	Cron     string `json:"cron" db:"cron"`
+	Function string `json:"function" db:"function_name"`
+	Stdin    []byte `json:"-" db:"stdin"`
+	// TimeoutSeconds overrides the function's timeout, if it isn't zero
+	TimeoutSeconds float64 `json:"timeoutSeconds" db:"timeout_seconds"`
+	Enabled        bool    `json:"enabled" db:"enabled"`
+	// SkipOverlapping schedules don't start a run while the last one's
+	// still going
+	SkipOverlapping bool `json:"skipOverlapping" db:"skip_overlapping"`
+	// APIKeyId is the key which saved the schedule, which its runs are
+	// made by
+	APIKeyId *int64     `json:"apiKeyId" db:"api_key_id"`
+	Created  time.Time  `json:"created" db:"created"`
+	Updated  time.Time  `json:"updated" db:"updated"`
+	LastRun  *time.Time `json:"lastRun" db:"last_run"`
+	NextRun  *time.Time `json:"nextRun" db:"next_run"`
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Secret is a named value which functions can be given in their
+// environment. Only the sealed (encrypted) value is stored.
+type Secret struct {
+	Id      int64     `json:"id" db:"id"`
+	Name    string    `json:"name" db:"name"`
+	Sealed  []byte    `json:"-" db:"sealed"`
+	Created time.Time `json:"created" db:"created"`
+	Updated time.Time `json:"updated" db:"updated"`
+}
+
+// secretNamePattern matches the names secrets can have.
+var secretNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,62}$`)
+
+// ValidSecretName checks whether name can be used for a Secret.
+func ValidSecretName(name string) bool {
+	return secretNamePattern.MatchString(name)
+}
+
+// EnvVar is an environment variable declared by a function or a request.
+// It's either set to Value, or to the value of the Secret it names.
+type EnvVar struct {
+	Name   string `json:"name"`
+	Value  string `json:"value,omitempty"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// envNamePattern matches the names environment variables can have.
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedEnvNamePattern matches the names which change how docker or the
+// dynamic linker behave, which functions can't set.
+var reservedEnvNamePattern = regexp.MustCompile(`^(?i:DOCKER_.*|LD_.*|PATH)$`)
+
+// ValidEnvName checks whether name can be used for an EnvVar.
+func ValidEnvName(name string) bool {
+	return envNamePattern.MatchString(name) && !reservedEnvNamePattern.MatchString(name)
+}
+
+// EnvVars is a list of EnvVar, stored in the database as JSON.
+type EnvVars []EnvVar
+
+// Value implements driver.Valuer.
+func (e EnvVars) Value() (driver.Value, error) {
+	if e == nil {
+		e = EnvVars{}
+	}
+	ret, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return string(ret), nil
+}
+
+// Scan implements sql.Scanner.
+func (e *EnvVars) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("EnvVars: can't scan %T", src)
+	}
+	*e = EnvVars{}
+	return json.Unmarshal(b, e)
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// Tenant groups API keys which share a set of limits. A limit of zero
+// means that there's no limit.
+type Tenant struct {
+	Id      int64     `json:"id" db:"id"`
+	Name    string    `json:"name" db:"name"`
+	Created time.Time `json:"created" db:"created"`
+
+	// MaxConcurrent is how many invocations may run at once.
+	MaxConcurrent int `json:"maxConcurrent" db:"max_concurrent"`
+	// InvocationsPerMinute is how many invocations may start each minute.
+	InvocationsPerMinute int `json:"invocationsPerMinute" db:"invocations_per_minute"`
+	// CPUSecondsPerDay is how much CPU time invocations may use each (UTC) day.
+	CPUSecondsPerDay float64 `json:"cpuSecondsPerDay" db:"cpu_seconds_per_day"`
+	// MaxBuildContextBytes is the largest build context a request may send.
+	MaxBuildContextBytes int64 `json:"maxBuildContextBytes" db:"max_build_context_bytes"`
+	// Weight is the tenant's share of the slots, relative to other
+	// tenants', when they're waiting for them. It's saved as 1 if it's zero.
+	Weight float64 `json:"weight" db:"weight"`
+}
+
+// Usage metrics tracked against tenants.
+const (
+	UsageInvocations = "invocations"
+	UsageCPUSeconds  = "cpu_seconds"
+)
+
+// TenantUsage is a tenant's consumption of one metric during one window.
+type TenantUsage struct {
+	TenantId    int64     `json:"tenantId" db:"tenant_id"`
+	Metric      string    `json:"metric" db:"metric"`
+	WindowStart time.Time `json:"windowStart" db:"window_start"`
+	Value       float64   `json:"value" db:"value"`
+}
@@ -0,0 +1,45 @@
+package models
+
+// Usage is what one or more containers used.
+type Usage struct {
+	CPUSeconds      float64 `json:"cpuSeconds" db:"cpu_seconds"`
+	MemoryPeakBytes int64   `json:"memoryPeakBytes" db:"memory_peak_bytes"`
+	BlockReadBytes  int64   `json:"blockReadBytes" db:"block_read_bytes"`
+	BlockWriteBytes int64   `json:"blockWriteBytes" db:"block_write_bytes"`
+	NetworkRxBytes  int64   `json:"networkRxBytes" db:"network_rx_bytes"`
+	NetworkTxBytes  int64   `json:"networkTxBytes" db:"network_tx_bytes"`
+}
+
+// Add adds other's usage to u. Counters are summed, but the peak memory
+// is the larger of the two.
+func (u *Usage) Add(other Usage) {
+	u.CPUSeconds += other.CPUSeconds
+	if other.MemoryPeakBytes > u.MemoryPeakBytes {
+		u.MemoryPeakBytes = other.MemoryPeakBytes
+	}
+	u.BlockReadBytes += other.BlockReadBytes
+	u.BlockWriteBytes += other.BlockWriteBytes
+	u.NetworkRxBytes += other.NetworkRxBytes
+	u.NetworkTxBytes += other.NetworkTxBytes
+}
+
+// UsageReport is the usage of one function, by one tenant, on one day
+// (UTC), for chargeback.
+type UsageReport struct {
+	Day          string `json:"day" db:"day"`
+	FunctionName string `json:"functionName" db:"function_name"`
+	TenantId     *int64 `json:"tenantId" db:"tenant_id"`
+	TenantName   string `json:"tenantName" db:"tenant_name"`
+	Invocations  int64  `json:"invocations" db:"invocations"`
+	Usage
+}
+
+// UsageFilter narrows a usage report. Empty fields match everything.
+type UsageFilter struct {
+	// From and To are the first and last days (UTC) to report, as
+	// YYYY-MM-DD
+	From         string
+	To           string
+	FunctionName string
+	TenantId     *int64
+}
@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// The statuses of a WebhookDelivery.
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	// WebhookFailed deliveries ran out of attempts
+	WebhookFailed = "failed"
+)
+
+// WebhookDelivery is a job's result, to be POSTed to the callback URL it
+// was submitted with.
+type WebhookDelivery struct {
+	Id       int64  `json:"id" db:"id"`
+	JobId    string `json:"jobId" db:"job_id"`
+	APIKeyId int64  `json:"apiKeyId" db:"api_key_id"`
+	URL      string `json:"url" db:"url"`
+	Payload  []byte `json:"-" db:"payload"`
+	Status   string `json:"status" db:"status"`
+	Attempts int    `json:"attempts" db:"attempts"`
+	// NextAttempt is when a pending delivery should next be tried
+	NextAttempt *time.Time `json:"nextAttempt" db:"next_attempt"`
+	Created     time.Time  `json:"created" db:"created"`
+	Finished    *time.Time `json:"finished" db:"finished"`
+}
+
+// WebhookAttempt is one try at making a WebhookDelivery. StatusCode is nil
+// if there wasn't a response.
+type WebhookAttempt struct {
+	DeliveryId      int64     `json:"deliveryId" db:"delivery_id"`
+	Attempt         int       `json:"attempt" db:"attempt"`
+	Started         time.Time `json:"started" db:"started"`
+	DurationSeconds float64   `json:"durationSeconds" db:"duration_seconds"`
+	StatusCode      *int      `json:"statusCode" db:"status_code"`
+	Error           string    `json:"error" db:"error"`
+}
+
+// WebhookSecret is the key which signs the deliveries for an API key's
+// jobs.
+type WebhookSecret struct {
+	APIKeyId int64     `json:"apiKeyId" db:"api_key_id"`
+	Secret   string    `json:"-" db:"secret"`
+	Created  time.Time `json:"created" db:"created"`
+}
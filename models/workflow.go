@@ -0,0 +1,58 @@
+package models
+
+import "time"
+
+// The statuses of workflows, their nodes and tasks. Only nodes are skipped,
+// and only tasks and nodes are pending.
+const (
+	WorkflowPending   = "pending"
+	WorkflowRunning   = "running"
+	WorkflowSucceeded = "succeeded"
+	WorkflowFailed    = "failed"
+	WorkflowSkipped   = "skipped"
+)
+
+// Workflow is a run of a workflow definition, stored so that it can resume
+// after a restart.
+type Workflow struct {
+	Id string `json:"id" db:"id"`
+	// Definition is an api.WorkflowDefinition, as JSON
+	Definition string     `json:"definition" db:"definition"`
+	Stdin      []byte     `json:"-" db:"stdin"`
+	Status     string     `json:"status" db:"status"`
+	APIKeyId   *int64     `json:"apiKeyId" db:"api_key_id"`
+	Created    time.Time  `json:"created" db:"created"`
+	Finished   *time.Time `json:"finished" db:"finished"`
+}
+
+// WorkflowNode is the state of one node of a Workflow.
+type WorkflowNode struct {
+	WorkflowId string     `json:"workflowId" db:"workflow_id"`
+	NodeId     string     `json:"nodeId" db:"node_id"`
+	Status     string     `json:"status" db:"status"`
+	Output     []byte     `json:"-" db:"output"`
+	Error      string     `json:"error" db:"error"`
+	Started    *time.Time `json:"started" db:"started"`
+	Finished   *time.Time `json:"finished" db:"finished"`
+}
+
+// WorkflowTask is a single run of a node's function: a node has one,
+// unless it maps its function over each line of its input.
+type WorkflowTask struct {
+	WorkflowId string `json:"workflowId" db:"workflow_id"`
+	NodeId     string `json:"nodeId" db:"node_id"`
+	Index      int    `json:"index" db:"idx"`
+	Input      []byte `json:"-" db:"input"`
+	Status     string `json:"status" db:"status"`
+	Output     []byte `json:"-" db:"output"`
+	Stderr     []byte `json:"-" db:"stderr"`
+	ExitCode   *int   `json:"exitCode" db:"exit_code"`
+	Error      string `json:"error" db:"error"`
+}
+
+// WorkflowTaskCount is how many of a node's tasks have a status.
+type WorkflowTaskCount struct {
+	NodeId string `db:"node_id"`
+	Status string `db:"status"`
+	Count  int    `db:"count"`
+}
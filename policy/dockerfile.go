@@ -0,0 +1,96 @@
+// Package policy checks submitted Dockerfiles against the rules configured
+// for this server, e.g. which instructions and base images are allowed,
+// and works out how function containers are confined.
+package policy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Instruction is a single (possibly multi-line) Dockerfile instruction.
+type Instruction struct {
+	// Line is the (1-based) line the instruction starts on
+	Line int
+	// Command is the upper-cased instruction, e.g. "RUN"
+	Command string
+	// Args is everything after the command, with continuations joined
+	Args string
+}
+
+// ParseError describes a line which isn't a valid instruction.
+type ParseError struct {
+	Line    int
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// Parse splits a Dockerfile into instructions. It understands comments and
+// backslash line continuations, which is all that's needed to check
+// policies; it doesn't interpret arguments.
+func Parse(dockerfile string) ([]Instruction, error) {
+	ret := make([]Instruction, 0)
+	lines := strings.Split(strings.Replace(dockerfile, "\r\n", "\n", -1), "\n")
+
+	var current *Instruction
+	for i, raw := range lines {
+		lineNumber := i + 1
+		line := strings.TrimSpace(raw)
+
+		// Comments and blank lines are ignored, even inside continuations
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		continues := strings.HasSuffix(line, "\\")
+		if continues {
+			line = strings.TrimSpace(strings.TrimSuffix(line, "\\"))
+		}
+
+		if current == nil {
+			word, args := line, ""
+			if i := strings.IndexAny(line, " \t"); i >= 0 {
+				word, args = line[:i], strings.TrimSpace(line[i:])
+			}
+			command := strings.ToUpper(word)
+			if !isCommand(command) {
+				return ret, &ParseError{lineNumber, fmt.Sprintf("unknown instruction '%s'", word)}
+			}
+			current = &Instruction{lineNumber, command, args}
+		} else if line != "" {
+			if current.Args != "" {
+				current.Args += " "
+			}
+			current.Args += line
+		}
+
+		if !continues {
+			ret = append(ret, *current)
+			current = nil
+		}
+	}
+
+	// A trailing continuation just ends the instruction
+	if current != nil {
+		ret = append(ret, *current)
+	}
+	return ret, nil
+}
+
+var commands = []string{
+	"ADD", "ARG", "CMD", "COPY", "ENTRYPOINT", "ENV", "EXPOSE", "FROM",
+	"HEALTHCHECK", "LABEL", "MAINTAINER", "ONBUILD", "RUN", "SHELL",
+	"STOPSIGNAL", "USER", "VOLUME", "WORKDIR",
+}
+
+func isCommand(s string) bool {
+	for _, c := range commands {
+		if c == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/Sentimentron/functron/configuration"
+)
+
+// Rules which can be broken.
+const (
+	RuleParse           = "parse_error"
+	RuleForbidden       = "forbidden_instruction"
+	RuleMissingCommand  = "missing_command"
+	RuleBaseImage       = "base_image_not_allowed"
+	RuleBaseImageDigest = "base_image_not_pinned"
+	RuleTooManyRuns     = "too_many_run_instructions"
+)
+
+// Violation describes one way in which a Dockerfile breaks the policy.
+type Violation struct {
+	// Line is the (1-based) line of the offending instruction, or 0 if the
+	// violation applies to the whole file
+	Line        int    `json:"line"`
+	Instruction string `json:"instruction,omitempty"`
+	Rule        string `json:"rule"`
+	Message     string `json:"message"`
+}
+
+// Check returns every way in which dockerfile breaks p. An empty result
+// means the Dockerfile is acceptable.
+func Check(p *configuration.DockerfilePolicy, dockerfile string) []Violation {
+	ret := make([]Violation, 0)
+
+	instructions, err := Parse(dockerfile)
+	if err != nil {
+		line := 0
+		if parseErr, ok := err.(*ParseError); ok {
+			line = parseErr.Line
+		}
+		return append(ret, Violation{line, "", RuleParse, err.Error()})
+	}
+
+	// Names given to earlier build stages, which later FROMs can refer to
+	stages := make(map[string]bool)
+	hasCommand := false
+	runCount := 0
+
+	for _, ins := range instructions {
+		for _, forbidden := range p.ForbiddenInstructions {
+			if strings.EqualFold(ins.Command, forbidden) {
+				ret = append(ret, Violation{ins.Line, ins.Command, RuleForbidden,
+					fmt.Sprintf("%s is not allowed", ins.Command)})
+			}
+		}
+
+		switch ins.Command {
+		case "CMD", "ENTRYPOINT":
+			hasCommand = true
+		case "RUN":
+			runCount++
+			if p.MaxRunInstructions > 0 && runCount == p.MaxRunInstructions+1 {
+				ret = append(ret, Violation{ins.Line, ins.Command, RuleTooManyRuns,
+					fmt.Sprintf("at most %d RUN instruction(s) are allowed", p.MaxRunInstructions)})
+			}
+		case "FROM":
+			image, alias := parseFrom(ins.Args)
+			if stages[strings.ToLower(image)] {
+				// Refers to an earlier stage, which has already been checked
+			} else {
+				ret = append(ret, checkBaseImage(p, ins, image)...)
+			}
+			if alias != "" {
+				stages[strings.ToLower(alias)] = true
+			}
+		}
+	}
+
+	if p.RequireCommand && !hasCommand {
+		ret = append(ret, Violation{0, "", RuleMissingCommand,
+			"the function must be specified with CMD or ENTRYPOINT"})
+	}
+	return ret
+}
+
+// parseFrom extracts the image and stage name from FROM's arguments, i.e.
+// "[--platform=...] image [AS name]".
+func parseFrom(args string) (string, string) {
+	fields := strings.Fields(args)
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return "", ""
+	}
+	if len(fields) >= 3 && strings.EqualFold(fields[1], "AS") {
+		return fields[0], fields[2]
+	}
+	return fields[0], ""
+}
+
+// splitImage breaks "repo[:tag][@digest]" into its parts, dropping the
+// default registry and namespace so that "docker.io/library/python" and
+// "python" are the same image.
+func splitImage(image string) (string, string, string) {
+	var repo, tag, digest string
+	repo = image
+	if i := strings.Index(repo, "@"); i >= 0 {
+		repo, digest = repo[:i], repo[i+1:]
+	}
+	// A colon after the last slash separates the tag (an earlier one is
+	// a registry port)
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo, tag = repo[:i], repo[i+1:]
+	}
+	repo = strings.TrimPrefix(repo, "docker.io/")
+	repo = strings.TrimPrefix(repo, "library/")
+	return repo, tag, digest
+}
+
+// imageAllowed checks an image against an allowlist pattern. A pattern
+// without a tag (e.g. "python") allows any tag of that repository;
+// otherwise the pattern is matched against "repo:tag" and may use globs
+// (e.g. "python:3.*").
+func imageAllowed(pattern, image string) bool {
+	patternRepo, patternTag, patternDigest := splitImage(pattern)
+	repo, tag, digest := splitImage(image)
+
+	if ok, _ := path.Match(patternRepo, repo); !ok {
+		return false
+	}
+	if patternTag != "" {
+		if ok, _ := path.Match(patternTag, tag); !ok {
+			return false
+		}
+	}
+	if patternDigest != "" && patternDigest != digest {
+		return false
+	}
+	return true
+}
+
+func checkBaseImage(p *configuration.DockerfilePolicy, ins Instruction, image string) []Violation {
+	ret := make([]Violation, 0)
+	if image == "" {
+		return append(ret, Violation{ins.Line, ins.Command, RuleParse, "FROM needs an image"})
+	}
+
+	if len(p.AllowedBaseImages) > 0 {
+		allowed := false
+		for _, pattern := range p.AllowedBaseImages {
+			if imageAllowed(pattern, image) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			ret = append(ret, Violation{ins.Line, ins.Command, RuleBaseImage,
+				fmt.Sprintf("base image '%s' is not in the allowlist", image)})
+		}
+	}
+
+	if p.RequireDigest {
+		if _, _, digest := splitImage(image); digest == "" {
+			ret = append(ret, Violation{ins.Line, ins.Command, RuleBaseImageDigest,
+				fmt.Sprintf("base image '%s' must be pinned with @sha256:...", image)})
+		}
+	}
+	return ret
+}
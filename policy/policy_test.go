@@ -0,0 +1,96 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/Sentimentron/functron/configuration"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParse(t *testing.T) {
+	Convey("Given a Dockerfile with comments and continuations...", t, func() {
+		dockerfile := "# A comment\nFROM python:3.6\n\nRUN apt-get update && \\\n    # inline comment\n    apt-get install -y curl\ncmd python3 /data/main.py\n"
+
+		instructions, err := Parse(dockerfile)
+		So(err, ShouldBeNil)
+		So(instructions, ShouldHaveLength, 3)
+
+		Convey("Instructions should start on the right lines", func() {
+			So(instructions[0], ShouldResemble, Instruction{2, "FROM", "python:3.6"})
+			So(instructions[1].Line, ShouldEqual, 4)
+			So(instructions[1].Args, ShouldEqual, "apt-get update && apt-get install -y curl")
+			So(instructions[2], ShouldResemble, Instruction{7, "CMD", "python3 /data/main.py"})
+		})
+	})
+
+	Convey("Unknown instructions should be reported with their line", t, func() {
+		_, err := Parse("FROM ubuntu\nRUNN true\n")
+		So(err, ShouldNotBeNil)
+		So(err.(*ParseError).Line, ShouldEqual, 2)
+	})
+}
+
+func TestCheck(t *testing.T) {
+	Convey("Given the default policy...", t, func() {
+		p := configuration.DefaultDockerfilePolicy
+
+		Convey("A Dockerfile following the README should pass", func() {
+			So(Check(&p, "FROM python:latest\nCMD python3 /data/main.py"), ShouldBeEmpty)
+		})
+
+		Convey("ADD should be rejected with its line number", func() {
+			v := Check(&p, "FROM python:latest\nADD . /src\nCMD python3 /data/main.py")
+			So(v, ShouldHaveLength, 1)
+			So(v[0].Rule, ShouldEqual, RuleForbidden)
+			So(v[0].Line, ShouldEqual, 2)
+		})
+
+		Convey("A missing CMD should be rejected", func() {
+			v := Check(&p, "FROM python:latest\nRUN true")
+			So(v, ShouldHaveLength, 1)
+			So(v[0].Rule, ShouldEqual, RuleMissingCommand)
+		})
+
+		Convey("ENTRYPOINT should count as specifying the function", func() {
+			So(Check(&p, "FROM python:latest\nENTRYPOINT [\"python3\", \"/data/main.py\"]"), ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given a policy restricting base images...", t, func() {
+		p := configuration.DockerfilePolicy{
+			AllowedBaseImages:  []string{"python:3.*", "alpine", "registry.local:5000/base"},
+			RequireDigest:      true,
+			MaxRunInstructions: 1,
+		}
+		digest := "@sha256:0123456789abcdef"
+
+		Convey("Allowed, pinned images should pass", func() {
+			So(Check(&p, "FROM python:3.6"+digest), ShouldBeEmpty)
+			So(Check(&p, "FROM docker.io/library/alpine:3.7"+digest), ShouldBeEmpty)
+			So(Check(&p, "FROM registry.local:5000/base:1"+digest), ShouldBeEmpty)
+		})
+
+		Convey("Other images should be rejected", func() {
+			v := Check(&p, "FROM python:2.7"+digest)
+			So(v, ShouldHaveLength, 1)
+			So(v[0].Rule, ShouldEqual, RuleBaseImage)
+		})
+
+		Convey("Unpinned images should be rejected", func() {
+			v := Check(&p, "FROM alpine:3.7")
+			So(v, ShouldHaveLength, 1)
+			So(v[0].Rule, ShouldEqual, RuleBaseImageDigest)
+		})
+
+		Convey("Later stages may build on earlier ones", func() {
+			So(Check(&p, "FROM alpine"+digest+" AS build\nFROM build"), ShouldBeEmpty)
+		})
+
+		Convey("Too many RUN instructions should be rejected once", func() {
+			v := Check(&p, "FROM alpine"+digest+"\nRUN a\nRUN b\nRUN c")
+			So(v, ShouldHaveLength, 1)
+			So(v[0].Rule, ShouldEqual, RuleTooManyRuns)
+			So(v[0].Line, ShouldEqual, 3)
+		})
+	})
+}
@@ -0,0 +1,85 @@
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Sentimentron/functron/configuration"
+	"github.com/Sentimentron/functron/interfaces"
+)
+
+// DefaultTmpfsSize is the size of the tmpfs at /tmp, for profiles with a
+// read-only root filesystem which don't give one.
+const DefaultTmpfsSize = "64m"
+
+// Tighten combines the server's baseline security profile with one a
+// function chose, so that the result is at least as strict as both:
+//   - A non-root user in the baseline can't be replaced with root
+//   - A read-only root filesystem, no-new-privileges and dropped
+//     capabilities from either apply
+//   - The baseline's seccomp profile and OCI runtime can't be replaced, and
+//     a chosen seccomp profile can't be "unconfined"
+func Tighten(baseline configuration.SecurityProfile, chosen configuration.SecurityProfile) configuration.SecurityProfile {
+	ret := baseline
+	if chosen.UID != nil && (baseline.UID == nil || *chosen.UID != 0) {
+		ret.UID, ret.GID = chosen.UID, chosen.GID
+		if chosen.GID == nil || (*chosen.GID == 0 && baseline.GID != nil && *baseline.GID != 0) {
+			ret.GID = baseline.GID
+		}
+	}
+	ret.ReadOnlyRootfs = baseline.ReadOnlyRootfs || chosen.ReadOnlyRootfs
+	if chosen.TmpfsSize != "" {
+		ret.TmpfsSize = chosen.TmpfsSize
+	}
+	ret.DropCapabilities = union(baseline.DropCapabilities, chosen.DropCapabilities)
+	ret.NoNewPrivileges = baseline.NoNewPrivileges || chosen.NoNewPrivileges
+	if baseline.SeccompProfile == "" && chosen.SeccompProfile != "unconfined" {
+		ret.SeccompProfile = chosen.SeccompProfile
+	}
+	if baseline.Runtime == "" {
+		ret.Runtime = chosen.Runtime
+	}
+	return ret
+}
+
+// union returns the capabilities in either a or b, upper-cased, sorted and
+// without duplicates.
+func union(a, b []string) []string {
+	seen := make(map[string]bool)
+	ret := make([]string, 0, len(a)+len(b))
+	for _, c := range append(append([]string(nil), a...), b...) {
+		c = strings.ToUpper(c)
+		if !seen[c] {
+			seen[c] = true
+			ret = append(ret, c)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Security describes how containers should be confined under p.
+func Security(p configuration.SecurityProfile) interfaces.Security {
+	ret := interfaces.Security{
+		ReadOnlyRootfs:  p.ReadOnlyRootfs,
+		CapDrop:         p.DropCapabilities,
+		NoNewPrivileges: p.NoNewPrivileges,
+		SeccompProfile:  p.SeccompProfile,
+		Runtime:         p.Runtime,
+	}
+	if p.UID != nil {
+		ret.User = fmt.Sprintf("%d", *p.UID)
+		if p.GID != nil {
+			ret.User += fmt.Sprintf(":%d", *p.GID)
+		}
+	}
+	if p.ReadOnlyRootfs {
+		size := p.TmpfsSize
+		if size == "" {
+			size = DefaultTmpfsSize
+		}
+		ret.Tmpfs = map[string]string{"/tmp": "rw,nosuid,nodev,size=" + size}
+	}
+	return ret
+}
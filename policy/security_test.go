@@ -0,0 +1,92 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/Sentimentron/functron/configuration"
+	"github.com/Sentimentron/functron/interfaces"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func id(i int) *int {
+	return &i
+}
+
+func TestTighten(t *testing.T) {
+	Convey("Given a baseline which runs as a non-root user...", t, func() {
+		baseline := configuration.SecurityProfile{
+			UID:              id(1000),
+			GID:              id(1000),
+			DropCapabilities: []string{"net_raw"},
+			SeccompProfile:   "/etc/functron/seccomp.json",
+		}
+
+		Convey("A chosen profile shouldn't be able to run as root...", func() {
+			p := Tighten(baseline, configuration.SecurityProfile{UID: id(0), GID: id(0)})
+			So(*p.UID, ShouldEqual, 1000)
+			So(*p.GID, ShouldEqual, 1000)
+		})
+
+		Convey("But should be able to pick another user...", func() {
+			p := Tighten(baseline, configuration.SecurityProfile{UID: id(2000)})
+			So(*p.UID, ShouldEqual, 2000)
+			So(*p.GID, ShouldEqual, 1000)
+		})
+
+		Convey("Or replace the seccomp profile...", func() {
+			p := Tighten(baseline, configuration.SecurityProfile{SeccompProfile: "unconfined"})
+			So(p.SeccompProfile, ShouldEqual, "/etc/functron/seccomp.json")
+		})
+
+		Convey("Restrictions from both should apply...", func() {
+			p := Tighten(baseline, configuration.SecurityProfile{
+				ReadOnlyRootfs:   true,
+				NoNewPrivileges:  true,
+				DropCapabilities: []string{"ALL", "NET_RAW"},
+				Runtime:          "runsc",
+			})
+			So(p.ReadOnlyRootfs, ShouldBeTrue)
+			So(p.NoNewPrivileges, ShouldBeTrue)
+			So(p.DropCapabilities, ShouldResemble, []string{"ALL", "NET_RAW"})
+			So(p.Runtime, ShouldEqual, "runsc")
+		})
+	})
+
+	Convey("Given an empty baseline...", t, func() {
+		Convey("A chosen profile should apply as it is...", func() {
+			p := Tighten(configuration.SecurityProfile{}, configuration.SecurityProfile{UID: id(0), SeccompProfile: "strict.json"})
+			So(*p.UID, ShouldEqual, 0)
+			So(p.SeccompProfile, ShouldEqual, "strict.json")
+		})
+
+		Convey("Except for an unconfined seccomp profile...", func() {
+			p := Tighten(configuration.SecurityProfile{}, configuration.SecurityProfile{SeccompProfile: "unconfined"})
+			So(p.SeccompProfile, ShouldEqual, "")
+		})
+	})
+}
+
+func TestSecurity(t *testing.T) {
+	Convey("A profile should become container options...", t, func() {
+		s := Security(configuration.SecurityProfile{
+			UID:              id(1000),
+			GID:              id(100),
+			ReadOnlyRootfs:   true,
+			DropCapabilities: []string{"ALL"},
+			NoNewPrivileges:  true,
+			Runtime:          "runsc",
+		})
+		So(s, ShouldResemble, interfaces.Security{
+			User:            "1000:100",
+			ReadOnlyRootfs:  true,
+			Tmpfs:           map[string]string{"/tmp": "rw,nosuid,nodev,size=64m"},
+			CapDrop:         []string{"ALL"},
+			NoNewPrivileges: true,
+			Runtime:         "runsc",
+		})
+	})
+
+	Convey("An empty profile should leave the defaults...", t, func() {
+		So(Security(configuration.SecurityProfile{}), ShouldResemble, interfaces.Security{})
+	})
+}
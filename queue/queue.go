@@ -0,0 +1,270 @@
+// Package queue runs jobs from a durable queue. Workers claim the queued
+// job with the highest priority, holding a lease on it which they renew
+// while it runs. Jobs whose worker stops renewing its lease (because the
+// server restarted, say) are queued again. Jobs which keep failing in
+// ways that running them again might fix are retried, until they run out
+// of attempts and become dead; dead jobs stay in the store until they're
+// requeued.
+package queue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Sentimentron/functron/configuration"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/metrics"
+	"github.com/Sentimentron/functron/models"
+)
+
+// Store is where a Queue keeps jobs.
+type Store interface {
+	EnqueueJob(job *models.Job) (*models.Job, error)
+	ClaimJob(owner string, leaseExpires time.Time) (*models.Job, error)
+	RenewJobLease(id, owner string, leaseExpires time.Time) error
+	SettleJob(id, owner, status string, result []byte, lastError string) error
+	RequeueExpiredJobs(now time.Time) ([]models.Job, error)
+}
+
+// Outcome is how an attempt at a job went.
+type Outcome struct {
+	// Status is JobSucceeded or JobFailed
+	Status string
+	// Result is recorded as the job's result
+	Result []byte
+	// Error describes why the attempt failed
+	Error string
+	// Retry is set for failures which might not happen again, which the
+	// job's attempted again for, if it has any attempts left
+	Retry bool
+}
+
+// Handler runs the jobs a Queue claims.
+type Handler interface {
+	// Run makes an attempt at job. ctx is cancelled if the lease on job is
+	// lost.
+	Run(ctx context.Context, job *models.Job) Outcome
+	// Settled is called once an attempt at job has been recorded, with
+	// job.Status set to the status it's been left in. That's JobQueued if
+	// it'll be attempted again.
+	Settled(job *models.Job, outcome Outcome)
+}
+
+// Queue claims jobs and runs them with a Handler.
+type Queue struct {
+	store   Store
+	handler Handler
+	config  configuration.QueueConfig
+	// owner identifies the Queue's leases
+	owner string
+	// wake is sent to when there might be new jobs to claim
+	wake    chan struct{}
+	running sync.WaitGroup
+}
+
+// CreateQueue returns a Queue which keeps jobs in store and runs them with
+// handler, filling in any of config's fields which are zero. Workers is
+// defaulted to workers.
+func CreateQueue(store Store, handler Handler, config configuration.QueueConfig, workers int) *Queue {
+	if config.Workers == 0 {
+		config.Workers = workers
+	}
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = 3
+	}
+	if config.LeaseSeconds == 0 {
+		config.LeaseSeconds = 60
+	}
+	if config.PollSeconds == 0 {
+		config.PollSeconds = 1
+	}
+	return &Queue{
+		store:   store,
+		handler: handler,
+		config:  config,
+		owner:   logging.NewRequestID(),
+		wake:    make(chan struct{}, config.Workers),
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Enqueue saves job in the queue, and wakes a worker to claim it. Jobs
+// which don't say how many attempts they get have the configured number.
+func (q *Queue) Enqueue(job *models.Job) (*models.Job, error) {
+	if job.MaxAttempts == 0 {
+		job.MaxAttempts = q.config.MaxAttempts
+	}
+	ret, err := q.store.EnqueueJob(job)
+	if err != nil {
+		return nil, err
+	}
+	q.Notify()
+	return ret, nil
+}
+
+// Notify wakes an idle worker, if there is one, to look for jobs.
+func (q *Queue) Notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts the workers, and releases jobs whose leases have expired,
+// until ctx is done. Expired leases are released straight away, so jobs
+// left running when the server last stopped are requeued as soon as
+// their leases run out.
+func (q *Queue) Run(ctx context.Context) {
+	for i := 0; i < q.config.Workers; i++ {
+		q.running.Add(1)
+		go func() {
+			defer q.running.Done()
+			q.work(ctx)
+		}()
+	}
+
+	ticker := time.NewTicker(seconds(q.config.LeaseSeconds) / 2)
+	defer ticker.Stop()
+	for {
+		if err := q.RequeueExpired(); err != nil {
+			logging.Default().WithField("error", err).Errorf("Could not requeue expired jobs")
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			q.running.Wait()
+			return
+		}
+	}
+}
+
+// work runs jobs until the queue's empty, then waits to be woken, or for
+// the poll interval, before looking again.
+func (q *Queue) work(ctx context.Context) {
+	poll := time.NewTicker(seconds(q.config.PollSeconds))
+	defer poll.Stop()
+	for {
+		for ctx.Err() == nil && q.RunNext(ctx) {
+		}
+		select {
+		case <-q.wake:
+		case <-poll.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RunNext claims the next job and runs it, renewing its lease as it goes.
+// It returns false if there wasn't a job to run.
+func (q *Queue) RunNext(ctx context.Context) bool {
+	lease := seconds(q.config.LeaseSeconds)
+	job, err := q.store.ClaimJob(q.owner, time.Now().Add(lease))
+	if err != nil {
+		logging.Default().WithField("error", err).Errorf("Could not claim job")
+		return false
+	}
+	if job == nil {
+		return false
+	}
+	logger := logging.Default().WithFields(logging.Fields{"job_id": job.Id, "attempt": job.Attempts})
+	logger.Infof("Claimed job")
+
+	runCtx, cancel := context.WithCancel(ctx)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		q.renew(runCtx, cancel, logger, job, lease)
+	}()
+	outcome := q.handler.Run(runCtx, job)
+	cancel()
+	<-renewed
+
+	q.settle(logger, job, outcome)
+	return true
+}
+
+// renew extends the lease on job every third of its length, until ctx is
+// done, cancelling it if the lease is lost.
+func (q *Queue) renew(ctx context.Context, cancel context.CancelFunc, logger *logging.Logger, job *models.Job, lease time.Duration) {
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := q.store.RenewJobLease(job.Id, q.owner, time.Now().Add(lease))
+			if err == interfaces.NoMatchingJob {
+				logger.Warnf("Lost the lease on job")
+				cancel()
+				return
+			} else if err != nil {
+				logger.WithField("error", err).Errorf("Could not renew the lease on job")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// settle records outcome, queueing job again if it should be retried and
+// has attempts left.
+func (q *Queue) settle(logger *logging.Logger, job *models.Job, outcome Outcome) {
+	status := outcome.Status
+	result := status
+	if outcome.Retry {
+		status, result = models.JobQueued, "retried"
+		if job.Attempts >= job.MaxAttempts {
+			status, result = models.JobDead, models.JobDead
+		}
+	}
+
+	err := q.store.SettleJob(job.Id, q.owner, status, outcome.Result, outcome.Error)
+	if err == interfaces.NoMatchingJob {
+		// The lease expired, so the job's been released already
+		logger.Warnf("Lost the lease on job before it was settled")
+		return
+	} else if err != nil {
+		// The lease will expire, and the job will be attempted again
+		logger.WithField("error", err).Errorf("Could not settle job")
+		return
+	}
+	metrics.QueuedJobs.WithLabelValues(result).Inc()
+	logger.WithField("status", status).Infof("Settled job")
+
+	job.Status, job.Result, job.LastError = status, outcome.Result, outcome.Error
+	q.handler.Settled(job, outcome)
+	if status == models.JobQueued {
+		q.Notify()
+	}
+}
+
+// RequeueExpired releases every job whose lease has expired, queueing it
+// again or, if it's out of attempts, leaving it dead.
+func (q *Queue) RequeueExpired() error {
+	jobs, err := q.store.RequeueExpiredJobs(time.Now())
+	if err != nil {
+		return err
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		result := "retried"
+		if job.Status == models.JobDead {
+			result = models.JobDead
+		}
+		metrics.QueuedJobs.WithLabelValues(result).Inc()
+		logging.Default().WithFields(logging.Fields{"job_id": job.Id, "status": job.Status}).Warnf("Released job with an expired lease")
+		q.handler.Settled(job, Outcome{Status: models.JobFailed, Result: job.Result, Error: job.LastError, Retry: true})
+	}
+	if len(jobs) > 0 {
+		q.Notify()
+	}
+	return nil
+}
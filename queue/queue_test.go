@@ -0,0 +1,119 @@
+package queue
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sentimentron/functron/configuration"
+	"github.com/Sentimentron/functron/database"
+	"github.com/Sentimentron/functron/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeHandler fails each job with a retryable error until it's been
+// attempted succeedOn times, and records the statuses it's settled with.
+type fakeHandler struct {
+	succeedOn int
+
+	lock    sync.Mutex
+	settled []string
+}
+
+func (h *fakeHandler) Run(ctx context.Context, job *models.Job) Outcome {
+	if job.Attempts < h.succeedOn {
+		return Outcome{Status: models.JobFailed, Error: "workspace unavailable", Retry: true}
+	}
+	return Outcome{Status: models.JobSucceeded, Result: []byte("done")}
+}
+
+func (h *fakeHandler) Settled(job *models.Job, outcome Outcome) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.settled = append(h.settled, job.Status)
+}
+
+func TestQueue(t *testing.T) {
+	Convey("Given a queue with a new store...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "functronqueue")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		store, err := database.CreateStore(tmpFile.Name())
+		So(err, ShouldBeNil)
+		defer os.Remove(tmpFile.Name())
+
+		handler := &fakeHandler{succeedOn: 2}
+		q := CreateQueue(store, handler, configuration.QueueConfig{MaxAttempts: 2}, 1)
+		ctx := context.Background()
+
+		Convey("A job which fails in a way that might not happen again should be retried...", func() {
+			job, err := q.Enqueue(&models.Job{Id: "retried", Function: "f", Request: []byte("{}")})
+			So(err, ShouldBeNil)
+			So(job.MaxAttempts, ShouldEqual, 2)
+
+			So(q.RunNext(ctx), ShouldBeTrue)
+			So(q.RunNext(ctx), ShouldBeTrue)
+			So(q.RunNext(ctx), ShouldBeFalse)
+			So(handler.settled, ShouldResemble, []string{models.JobQueued, models.JobSucceeded})
+
+			job, err = store.RetrieveJob("retried")
+			So(err, ShouldBeNil)
+			So(job.Status, ShouldEqual, models.JobSucceeded)
+			So(job.Attempts, ShouldEqual, 2)
+			So(job.Result, ShouldResemble, []byte("done"))
+		})
+
+		Convey("A job which runs out of attempts should be dead...", func() {
+			handler.succeedOn = 10
+			_, err := q.Enqueue(&models.Job{Id: "dead", Function: "f", Request: []byte("{}")})
+			So(err, ShouldBeNil)
+			for q.RunNext(ctx) {
+			}
+			So(handler.settled, ShouldResemble, []string{models.JobQueued, models.JobDead})
+			job, _ := store.RetrieveJob("dead")
+			So(job.Status, ShouldEqual, models.JobDead)
+			So(job.LastError, ShouldEqual, "workspace unavailable")
+		})
+
+		Convey("A job left running by a worker which stopped should be run again...", func() {
+			_, err := q.Enqueue(&models.Job{Id: "orphan", Function: "f", Request: []byte("{}")})
+			So(err, ShouldBeNil)
+			_, err = store.ClaimJob("stopped", time.Now().Add(-time.Second))
+			So(err, ShouldBeNil)
+			So(q.RunNext(ctx), ShouldBeFalse)
+
+			So(q.RequeueExpired(), ShouldBeNil)
+			So(handler.settled, ShouldResemble, []string{models.JobQueued})
+			So(q.RunNext(ctx), ShouldBeTrue)
+			job, _ := store.RetrieveJob("orphan")
+			So(job.Status, ShouldEqual, models.JobSucceeded)
+		})
+
+		Convey("Running the queue should work through jobs as they're submitted...", func() {
+			ctx, cancel := context.WithCancel(ctx)
+			done := make(chan struct{})
+			go func() {
+				q.Run(ctx)
+				close(done)
+			}()
+			handler.succeedOn = 1
+			_, err := q.Enqueue(&models.Job{Id: "background", Function: "f", Request: []byte("{}")})
+			So(err, ShouldBeNil)
+
+			var job *models.Job
+			for i := 0; i < 100; i++ {
+				job, _ = store.RetrieveJob("background")
+				if job.Status == models.JobSucceeded {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(job.Status, ShouldEqual, models.JobSucceeded)
+			cancel()
+			<-done
+		})
+	})
+}
@@ -0,0 +1,155 @@
+// Package quota enforces per-tenant limits on invocations.
+package quota
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sentimentron/functron/models"
+)
+
+// Names of the limits reported in LimitError.
+const (
+	LimitConcurrent       = "concurrent_executions"
+	LimitPerMinute        = "invocations_per_minute"
+	LimitCPUSecondsPerDay = "cpu_seconds_per_day"
+	LimitBuildContext     = "build_context_bytes"
+)
+
+// usageRetention is how long usage counters are kept before pruning.
+const usageRetention = 48 * time.Hour
+
+// UsageStore persists usage counters so they survive a restart
+// (e.g. database.Store).
+type UsageStore interface {
+	RetrieveUsage(tenantId int64, metric string, windowStart time.Time) (float64, error)
+	AddUsage(tenantId int64, metric string, windowStart time.Time, delta float64) error
+	PruneUsage(before time.Time) error
+}
+
+// LimitError is returned when an invocation would exceed a tenant's limit.
+type LimitError struct {
+	// Limit names the limit which was hit
+	Limit string
+	// RetryAfter is how long until retrying might succeed. It's zero if
+	// retrying the same request won't ever succeed.
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("quota: %s exceeded", e.Limit)
+}
+
+// Limiter admits invocations on behalf of tenants.
+type Limiter struct {
+	store     UsageStore
+	lock      sync.Mutex
+	running   map[int64]int
+	lastPrune time.Time
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// CreateLimiter returns a Limiter which keeps usage counters in store.
+func CreateLimiter(store UsageStore) *Limiter {
+	return &Limiter{
+		store:   store,
+		running: make(map[int64]int),
+		now:     time.Now,
+	}
+}
+
+// Admission is a running invocation which counts against a tenant's limits.
+type Admission struct {
+	limiter  *Limiter
+	tenantId int64
+	finished bool
+}
+
+// Admit checks an invocation with a build context of contextBytes against
+// tenant's limits. If it's allowed, the invocation is counted and the
+// caller must call Finish on the returned Admission. If it isn't, a
+// *LimitError is returned.
+func (l *Limiter) Admit(tenant *models.Tenant, contextBytes int64) (*Admission, error) {
+	if tenant.MaxBuildContextBytes > 0 && contextBytes > tenant.MaxBuildContextBytes {
+		return nil, &LimitError{LimitBuildContext, 0}
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now().UTC()
+	minute := now.Truncate(time.Minute)
+	day := now.Truncate(24 * time.Hour)
+
+	if tenant.MaxConcurrent > 0 && l.running[tenant.Id] >= tenant.MaxConcurrent {
+		return nil, &LimitError{LimitConcurrent, time.Second}
+	}
+
+	if tenant.InvocationsPerMinute > 0 {
+		used, err := l.store.RetrieveUsage(tenant.Id, models.UsageInvocations, minute)
+		if err != nil {
+			return nil, err
+		}
+		if used >= float64(tenant.InvocationsPerMinute) {
+			return nil, &LimitError{LimitPerMinute, minute.Add(time.Minute).Sub(now)}
+		}
+	}
+
+	if tenant.CPUSecondsPerDay > 0 {
+		used, err := l.store.RetrieveUsage(tenant.Id, models.UsageCPUSeconds, day)
+		if err != nil {
+			return nil, err
+		}
+		if used >= tenant.CPUSecondsPerDay {
+			return nil, &LimitError{LimitCPUSecondsPerDay, day.Add(24 * time.Hour).Sub(now)}
+		}
+	}
+
+	err := l.store.AddUsage(tenant.Id, models.UsageInvocations, minute, 1)
+	if err != nil {
+		return nil, err
+	}
+	l.running[tenant.Id]++
+
+	// Old counters are no use to anyone
+	if now.Sub(l.lastPrune) > time.Hour {
+		if err := l.store.PruneUsage(now.Add(-usageRetention)); err == nil {
+			l.lastPrune = now
+		}
+	}
+
+	return &Admission{l, tenant.Id, false}, nil
+}
+
+// Finish records that the invocation has ended, having used cpuSeconds of
+// CPU time. It's safe to call more than once.
+func (a *Admission) Finish(cpuSeconds float64) error {
+	l := a.limiter
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if a.finished {
+		return nil
+	}
+	a.finished = true
+	l.running[a.tenantId]--
+	if l.running[a.tenantId] <= 0 {
+		delete(l.running, a.tenantId)
+	}
+
+	if cpuSeconds <= 0 {
+		return nil
+	}
+	day := l.now().UTC().Truncate(24 * time.Hour)
+	return l.store.AddUsage(a.tenantId, models.UsageCPUSeconds, day, cpuSeconds)
+}
+
+// Running returns how many invocations a tenant currently has running.
+func (l *Limiter) Running(tenantId int64) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.running[tenantId]
+}
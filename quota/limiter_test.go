@@ -0,0 +1,89 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Sentimentron/functron/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type usageKey struct {
+	tenantId int64
+	metric   string
+	window   time.Time
+}
+
+type memoryUsageStore map[usageKey]float64
+
+func (m memoryUsageStore) RetrieveUsage(tenantId int64, metric string, windowStart time.Time) (float64, error) {
+	return m[usageKey{tenantId, metric, windowStart}], nil
+}
+
+func (m memoryUsageStore) AddUsage(tenantId int64, metric string, windowStart time.Time, delta float64) error {
+	m[usageKey{tenantId, metric, windowStart}] += delta
+	return nil
+}
+
+func (m memoryUsageStore) PruneUsage(before time.Time) error {
+	return nil
+}
+
+func TestLimiter(t *testing.T) {
+	Convey("Given a limiter at a fixed time...", t, func() {
+		store := memoryUsageStore{}
+		l := CreateLimiter(store)
+		now := time.Date(2018, 3, 1, 12, 30, 15, 0, time.UTC)
+		l.now = func() time.Time { return now }
+
+		Convey("Concurrent executions should be limited", func() {
+			tenant := &models.Tenant{Id: 1, MaxConcurrent: 1}
+			a, err := l.Admit(tenant, 0)
+			So(err, ShouldBeNil)
+
+			_, err = l.Admit(tenant, 0)
+			So(err, ShouldHaveSameTypeAs, &LimitError{})
+			So(err.(*LimitError).Limit, ShouldEqual, LimitConcurrent)
+
+			So(a.Finish(0), ShouldBeNil)
+			So(a.Finish(0), ShouldBeNil)
+			So(l.Running(1), ShouldEqual, 0)
+			_, err = l.Admit(tenant, 0)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Invocations per minute should be limited until the next minute", func() {
+			tenant := &models.Tenant{Id: 2, InvocationsPerMinute: 2}
+			for i := 0; i < 2; i++ {
+				a, err := l.Admit(tenant, 0)
+				So(err, ShouldBeNil)
+				a.Finish(0)
+			}
+			_, err := l.Admit(tenant, 0)
+			So(err.(*LimitError).Limit, ShouldEqual, LimitPerMinute)
+			So(err.(*LimitError).RetryAfter, ShouldEqual, 45*time.Second)
+
+			now = now.Add(time.Minute)
+			_, err = l.Admit(tenant, 0)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("CPU seconds should be limited per day", func() {
+			tenant := &models.Tenant{Id: 3, CPUSecondsPerDay: 10}
+			a, err := l.Admit(tenant, 0)
+			So(err, ShouldBeNil)
+			So(a.Finish(12), ShouldBeNil)
+
+			_, err = l.Admit(tenant, 0)
+			So(err.(*LimitError).Limit, ShouldEqual, LimitCPUSecondsPerDay)
+			So(err.(*LimitError).RetryAfter, ShouldEqual, 11*time.Hour+29*time.Minute+45*time.Second)
+		})
+
+		Convey("Oversized build contexts should be rejected without a retry hint", func() {
+			tenant := &models.Tenant{Id: 4, MaxBuildContextBytes: 100}
+			_, err := l.Admit(tenant, 101)
+			So(err.(*LimitError).Limit, ShouldEqual, LimitBuildContext)
+			So(err.(*LimitError).RetryAfter, ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,49 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCron(t *testing.T) {
+	Convey("Given a time...", t, func() {
+		// A Wednesday
+		start := time.Date(2026, 3, 4, 10, 17, 30, 0, time.UTC)
+		next := func(expr string) time.Time {
+			c, err := ParseCron(expr)
+			So(err, ShouldBeNil)
+			return c.Next(start)
+		}
+
+		Convey("Every minute should be the next minute...", func() {
+			So(next("* * * * *"), ShouldEqual, time.Date(2026, 3, 4, 10, 18, 0, 0, time.UTC))
+		})
+		Convey("Steps, ranges and lists should work...", func() {
+			So(next("*/15 * * * *"), ShouldEqual, time.Date(2026, 3, 4, 10, 30, 0, 0, time.UTC))
+			So(next("0 9-11 * * *"), ShouldEqual, time.Date(2026, 3, 4, 11, 0, 0, 0, time.UTC))
+			So(next("5,10 8 * * *"), ShouldEqual, time.Date(2026, 3, 5, 8, 5, 0, 0, time.UTC))
+		})
+		Convey("Macros should work...", func() {
+			So(next("@nightly"), ShouldEqual, time.Date(2026, 3, 5, 0, 0, 0, 0, time.UTC))
+			So(next("@monthly"), ShouldEqual, time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC))
+		})
+		Convey("Days of the week should work, with 7 as Sunday...", func() {
+			So(next("30 2 * * 1-5"), ShouldEqual, time.Date(2026, 3, 5, 2, 30, 0, 0, time.UTC))
+			So(next("0 0 * * 7"), ShouldEqual, time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC))
+		})
+		Convey("Days of the month or week should match either, if both are given...", func() {
+			So(next("0 0 1 * 5"), ShouldEqual, time.Date(2026, 3, 6, 0, 0, 0, 0, time.UTC))
+		})
+		Convey("Dates which never happen should never match...", func() {
+			So(next("0 0 30 2 *").IsZero(), ShouldBeTrue)
+		})
+		Convey("Invalid expressions should be refused...", func() {
+			for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+				_, err := ParseCron(expr)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
@@ -0,0 +1,140 @@
+// Package schedule triggers registered functions on cron schedules.
+package schedule
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/metrics"
+	"github.com/Sentimentron/functron/models"
+)
+
+// tickInterval is how often the Scheduler looks for schedules which are
+// due. Cron expressions only go down to the minute.
+const tickInterval = 10 * time.Second
+
+// Store is where a Scheduler finds schedules.
+type Store interface {
+	RetrieveSchedules() ([]models.Schedule, error)
+	UpdateScheduleRun(id int64, lastRun time.Time, nextRun *time.Time) error
+}
+
+// Trigger runs a schedule's function once.
+type Trigger func(ctx context.Context, schedule *models.Schedule)
+
+// Scheduler triggers schedules when they're due.
+type Scheduler struct {
+	store   Store
+	trigger Trigger
+	now     func() time.Time
+
+	lock sync.Mutex
+	// running counts each schedule's runs which haven't finished, by ID
+	running map[int64]int
+	wg      sync.WaitGroup
+}
+
+// CreateScheduler returns a Scheduler which finds schedules in store and
+// runs them with trigger.
+func CreateScheduler(store Store, trigger Trigger) *Scheduler {
+	return &Scheduler{
+		store:   store,
+		trigger: trigger,
+		now:     time.Now,
+		running: make(map[int64]int),
+	}
+}
+
+// NextRun returns when a schedule with the cron expression expr should
+// next run after t, or nil if it never will.
+func NextRun(expr string, t time.Time) (*time.Time, error) {
+	c, err := ParseCron(expr)
+	if err != nil {
+		return nil, err
+	}
+	next := c.Next(t)
+	if next.IsZero() {
+		return nil, nil
+	}
+	return &next, nil
+}
+
+// Run triggers schedules as they fall due, until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Tick()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Tick triggers every enabled schedule which is due, and works out when
+// each should next run. A schedule which was due more than once since the
+// last tick (because the server was down, say) only runs once.
+func (s *Scheduler) Tick() {
+	logger := logging.Default()
+	schedules, err := s.store.RetrieveSchedules()
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not retrieve schedules")
+		return
+	}
+
+	now := s.now()
+	for i := range schedules {
+		schedule := &schedules[i]
+		if !schedule.Enabled || schedule.NextRun == nil || schedule.NextRun.After(now) {
+			continue
+		}
+		scheduleLogger := logger.WithFields(logging.Fields{"schedule": schedule.Name, "function": schedule.Function})
+
+		// Move the schedule on before running it, so that it doesn't run
+		// twice if the server restarts while it's running
+		next, err := NextRun(schedule.Cron, now)
+		if err != nil {
+			scheduleLogger.WithField("error", err).Warnf("Schedule has an invalid cron expression")
+		}
+		if err := s.store.UpdateScheduleRun(schedule.Id, now, next); err != nil {
+			scheduleLogger.WithField("error", err).Errorf("Could not update schedule")
+			continue
+		}
+
+		s.lock.Lock()
+		overlapping := schedule.SkipOverlapping && s.running[schedule.Id] > 0
+		if !overlapping {
+			s.running[schedule.Id]++
+		}
+		s.lock.Unlock()
+		if overlapping {
+			metrics.ScheduledRuns.WithLabelValues(schedule.Name, "skipped").Inc()
+			scheduleLogger.Warnf("Skipping scheduled run, since the last one is still running")
+			continue
+		}
+
+		metrics.ScheduledRuns.WithLabelValues(schedule.Name, "started").Inc()
+		scheduleLogger.Infof("Starting scheduled run")
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.trigger(logging.NewContext(context.Background(), scheduleLogger), schedule)
+
+			s.lock.Lock()
+			s.running[schedule.Id]--
+			if s.running[schedule.Id] == 0 {
+				delete(s.running, schedule.Id)
+			}
+			s.lock.Unlock()
+		}()
+	}
+}
+
+// Wait blocks until every run the Scheduler has started has finished.
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
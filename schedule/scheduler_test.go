@@ -0,0 +1,92 @@
+package schedule
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sentimentron/functron/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// memoryStore keeps schedules in memory.
+type memoryStore struct {
+	lock      sync.Mutex
+	schedules []models.Schedule
+}
+
+func (m *memoryStore) RetrieveSchedules() ([]models.Schedule, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]models.Schedule(nil), m.schedules...), nil
+}
+
+func (m *memoryStore) UpdateScheduleRun(id int64, lastRun time.Time, nextRun *time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i := range m.schedules {
+		if m.schedules[i].Id == id {
+			m.schedules[i].LastRun, m.schedules[i].NextRun = &lastRun, nextRun
+		}
+	}
+	return nil
+}
+
+func TestScheduler(t *testing.T) {
+	Convey("Given a scheduler with a nightly schedule which is due...", t, func() {
+		now := time.Date(2026, 3, 4, 0, 0, 5, 0, time.UTC)
+		due := now.Add(-5 * time.Second)
+		store := &memoryStore{schedules: []models.Schedule{
+			{Id: 1, Name: "nightly", Cron: "@nightly", Function: "report", Enabled: true, NextRun: &due},
+		}}
+
+		var lock sync.Mutex
+		runs := 0
+		release := make(chan struct{})
+		s := CreateScheduler(store, func(ctx context.Context, sc *models.Schedule) {
+			lock.Lock()
+			runs++
+			lock.Unlock()
+			<-release
+		})
+		s.now = func() time.Time { return now }
+		count := func() int {
+			lock.Lock()
+			defer lock.Unlock()
+			return runs
+		}
+
+		Convey("It should run once, and be moved on to the next night...", func() {
+			s.Tick()
+			s.Tick()
+			close(release)
+			s.Wait()
+			So(count(), ShouldEqual, 1)
+			So(*store.schedules[0].LastRun, ShouldEqual, now)
+			So(*store.schedules[0].NextRun, ShouldEqual, time.Date(2026, 3, 5, 0, 0, 0, 0, time.UTC))
+		})
+
+		Convey("Disabled schedules shouldn't run...", func() {
+			store.schedules[0].Enabled = false
+			s.Tick()
+			close(release)
+			s.Wait()
+			So(count(), ShouldEqual, 0)
+		})
+
+		Convey("Overlapping runs should only be skipped if the schedule says so...", func() {
+			s.Tick()
+			store.schedules[0].NextRun = &due
+			s.Tick()
+
+			store.schedules[0].SkipOverlapping = true
+			store.schedules[0].NextRun = &due
+			s.Tick()
+			close(release)
+			s.Wait()
+			So(count(), ShouldEqual, 2)
+			So(s.running, ShouldBeEmpty)
+		})
+	})
+}
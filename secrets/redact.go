@@ -0,0 +1,138 @@
+package secrets
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Redacted replaces the value of a secret wherever it's redacted.
+const Redacted = "[REDACTED]"
+
+// Redactor replaces the values of secrets with Redacted. A nil Redactor
+// leaves everything as it is.
+type Redactor struct {
+	// values are longest first, so that a secret which contains another
+	// is redacted whole
+	values [][]byte
+}
+
+// CreateRedactor returns a Redactor for values, or nil if none of them
+// are empty.
+func CreateRedactor(values []string) *Redactor {
+	ret := &Redactor{}
+	for _, v := range values {
+		if v != "" {
+			ret.values = append(ret.values, []byte(v))
+		}
+	}
+	if len(ret.values) == 0 {
+		return nil
+	}
+	sort.Slice(ret.values, func(i, j int) bool {
+		return len(ret.values[i]) > len(ret.values[j])
+	})
+	return ret
+}
+
+// Values returns the values which r redacts.
+func (r *Redactor) Values() []string {
+	if r == nil {
+		return nil
+	}
+	ret := make([]string, len(r.values))
+	for i, v := range r.values {
+		ret[i] = string(v)
+	}
+	return ret
+}
+
+// Bytes returns a copy of b with every value redacted.
+func (r *Redactor) Bytes(b []byte) []byte {
+	if r == nil || b == nil {
+		return b
+	}
+	ret, _ := r.redact(b, true)
+	return ret
+}
+
+// String returns s with every value redacted.
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, v := range r.values {
+		s = strings.Replace(s, string(v), Redacted, -1)
+	}
+	return s
+}
+
+// redact returns b with every value redacted. Unless final is set, it
+// stops before any trailing bytes which could be the start of a value, and
+// returns them as well.
+func (r *Redactor) redact(b []byte, final bool) ([]byte, []byte) {
+	ret := make([]byte, 0, len(b))
+	i := 0
+scan:
+	for i < len(b) {
+		// Wait for more if what's left could still become a longer value
+		// than it already is
+		if !final {
+			for _, v := range r.values {
+				if len(b)-i < len(v) && bytes.HasPrefix(v, b[i:]) {
+					break scan
+				}
+			}
+		}
+		for _, v := range r.values {
+			if bytes.HasPrefix(b[i:], v) {
+				ret = append(ret, Redacted...)
+				i += len(v)
+				continue scan
+			}
+		}
+		ret = append(ret, b[i])
+		i++
+	}
+	return ret, b[i:]
+}
+
+// Writer redacts what's written to it before passing it on. A value might
+// be split between writes, so the end of each write can be held back until
+// the next; Flush writes it.
+type Writer struct {
+	redactor *Redactor
+	out      io.Writer
+	pending  []byte
+}
+
+// Writer returns a Writer which writes to out.
+func (r *Redactor) Writer(out io.Writer) *Writer {
+	return &Writer{redactor: r, out: out}
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.redactor == nil {
+		return w.out.Write(p)
+	}
+	redacted, rest := w.redactor.redact(append(w.pending, p...), false)
+	w.pending = append([]byte(nil), rest...)
+	if len(redacted) > 0 {
+		if _, err := w.out.Write(redacted); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush redacts and writes anything which has been held back.
+func (w *Writer) Flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	_, err := w.out.Write(w.redactor.Bytes(w.pending))
+	w.pending = nil
+	return err
+}
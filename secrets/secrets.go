@@ -0,0 +1,75 @@
+// Package secrets encrypts the secrets which functions can be given in
+// their environment, and redacts their values from anything they print.
+//
+// Secrets are sealed with AES-256-GCM under a master key from the
+// configuration, so the database only ever holds ciphertext. Each secret
+// is bound to its name, so one secret's ciphertext can't be passed off as
+// another's.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// KeyBytes is how long a master key must be.
+const KeyBytes = 32
+
+// ErrCorrupt is returned by Open if a secret wasn't sealed under the same
+// master key and name, or has been tampered with.
+var ErrCorrupt = errors.New("secrets: could not decrypt the secret")
+
+// Cipher seals and opens secrets under a master key.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// CreateCipher returns a Cipher which uses key, a base64-encoded master key
+// of KeyBytes bytes.
+func CreateCipher(key string) (*Cipher, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: the master key isn't valid base64: %v", err)
+	}
+	if len(raw) != KeyBytes {
+		return nil, fmt.Errorf("secrets: the master key must be %d bytes, not %d", KeyBytes, len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead}, nil
+}
+
+// Seal encrypts the value of the secret called name. The result starts
+// with a random nonce, so sealing the same value twice gives different
+// results.
+func (c *Cipher) Seal(name string, value []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, value, []byte(name)), nil
+}
+
+// Open decrypts a value which Seal encrypted for the secret called name,
+// or returns ErrCorrupt.
+func (c *Cipher) Open(name string, sealed []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, ErrCorrupt
+	}
+	ret, err := c.aead.Open(nil, sealed[:n], sealed[n:], []byte(name))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return ret, nil
+}
@@ -0,0 +1,104 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var testKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, KeyBytes))
+
+func TestCipher(t *testing.T) {
+	Convey("Given a cipher...", t, func() {
+		c, err := CreateCipher(testKey)
+		So(err, ShouldBeNil)
+
+		Convey("Secrets should survive being sealed and opened...", func() {
+			sealed, err := c.Seal("token", []byte("hunter2"))
+			So(err, ShouldBeNil)
+			So(bytes.Contains(sealed, []byte("hunter2")), ShouldBeFalse)
+
+			value, err := c.Open("token", sealed)
+			So(err, ShouldBeNil)
+			So(string(value), ShouldEqual, "hunter2")
+
+			Convey("But not as another secret...", func() {
+				_, err := c.Open("other", sealed)
+				So(err, ShouldEqual, ErrCorrupt)
+			})
+
+			Convey("Or under another key...", func() {
+				other, err := CreateCipher(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{8}, KeyBytes)))
+				So(err, ShouldBeNil)
+				_, err = other.Open("token", sealed)
+				So(err, ShouldEqual, ErrCorrupt)
+			})
+
+			Convey("Or once they've been tampered with...", func() {
+				sealed[len(sealed)-1] ^= 1
+				_, err := c.Open("token", sealed)
+				So(err, ShouldEqual, ErrCorrupt)
+			})
+		})
+
+		Convey("Sealing the same value twice should give different results...", func() {
+			a, err := c.Seal("token", []byte("hunter2"))
+			So(err, ShouldBeNil)
+			b, err := c.Seal("token", []byte("hunter2"))
+			So(err, ShouldBeNil)
+			So(a, ShouldNotResemble, b)
+		})
+	})
+
+	Convey("Master keys of the wrong size should be refused...", t, func() {
+		_, err := CreateCipher(base64.StdEncoding.EncodeToString([]byte("short")))
+		So(err, ShouldNotBeNil)
+		_, err = CreateCipher("not base64!")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestRedactor(t *testing.T) {
+	Convey("Given a redactor...", t, func() {
+		r := CreateRedactor([]string{"hunter2", "hunter22", ""})
+
+		Convey("Values should be redacted, longest first...", func() {
+			So(string(r.Bytes([]byte("a hunter22 and a hunter2"))), ShouldEqual, "a [REDACTED] and a [REDACTED]")
+			So(r.String("hunter2hunter2"), ShouldEqual, "[REDACTED][REDACTED]")
+		})
+
+		Convey("Values split between writes should be redacted...", func() {
+			var out bytes.Buffer
+			w := r.Writer(&out)
+			for _, part := range []string{"a hun", "ter", "2 and a hunt", "er", " b hunter2"} {
+				n, err := w.Write([]byte(part))
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, len(part))
+			}
+			So(w.Flush(), ShouldBeNil)
+			So(out.String(), ShouldEqual, "a [REDACTED] and a hunter b [REDACTED]")
+		})
+
+		Convey("What's held back should be written by Flush...", func() {
+			var out bytes.Buffer
+			w := r.Writer(&out)
+			w.Write([]byte("ends with hunt"))
+			So(out.String(), ShouldEqual, "ends with ")
+			So(w.Flush(), ShouldBeNil)
+			So(out.String(), ShouldEqual, "ends with hunt")
+		})
+	})
+
+	Convey("A redactor with no values should change nothing...", t, func() {
+		r := CreateRedactor(nil)
+		So(r, ShouldBeNil)
+		So(string(r.Bytes([]byte("hunter2"))), ShouldEqual, "hunter2")
+
+		var out bytes.Buffer
+		w := r.Writer(&out)
+		w.Write([]byte("hunt"))
+		So(out.String(), ShouldEqual, "hunt")
+	})
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sentimentron/functron/auth"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/models"
+)
+
+// CreateKeyRequest is the body of POST /v1/admin/keys.
+type CreateKeyRequest struct {
+	Name     string
+	Scopes   []string
+	TenantId *int64
+}
+
+// UpdateKeyRequest is the body of PUT /v1/admin/keys/{id}.
+type UpdateKeyRequest struct {
+	// TenantId moves the key under a tenant's quotas (or none, if null)
+	TenantId *int64
+}
+
+// HandleKeys lists API keys (GET) or issues a new one (POST). It's what gets
+// run when you go to /v1/admin/keys.
+func (s *Server) HandleKeys(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+
+	switch req.Method {
+	case "GET":
+		keys, err := s.store.RetrieveAPIKeys()
+		if err != nil {
+			logger.WithField("error", err).Errorf("Could not list API keys")
+			writeErrors(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"Keys": keys})
+
+	case "POST":
+		var r CreateKeyRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			writeErrors(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if r.Name == "" {
+			writeErrors(w, http.StatusBadRequest, "NoName")
+			return
+		}
+		scopes := models.Scopes{}
+		for _, s := range r.Scopes {
+			scope, err := models.ParseScope(s)
+			if err != nil {
+				writeErrors(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			scopes = append(scopes, scope)
+		}
+
+		if r.TenantId != nil {
+			if _, err := s.store.RetrieveTenantById(*r.TenantId); err != nil {
+				writeErrors(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		plaintext, key, err := auth.IssueKey(s.store, r.Name, scopes, r.TenantId)
+		if err != nil {
+			logger.WithField("error", err).Errorf("Could not issue API key")
+			writeErrors(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		logger.WithFields(logging.Fields{"new_key_id": key.Id, "scopes": key.Scopes}).Infof("Issued API key")
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"Key": plaintext, "APIKey": key})
+
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// HandleKey revokes a single API key (DELETE /v1/admin/keys/{id}), or
+// assigns it to a tenant (PUT /v1/admin/keys/{id}).
+func (s *Server) HandleKey(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(req.URL.Path, "/v1/admin/keys/"), 10, 64)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, "InvalidKeyId")
+		return
+	}
+
+	switch req.Method {
+	case "DELETE":
+		err = s.store.RevokeAPIKey(id)
+		if err == interfaces.NoMatchingAPIKey {
+			writeErrors(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			logger.WithField("error", err).Errorf("Could not revoke API key")
+			writeErrors(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		logger.WithField("revoked_key_id", id).Infof("Revoked API key")
+		w.WriteHeader(http.StatusNoContent)
+
+	case "PUT":
+		var r UpdateKeyRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			writeErrors(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if r.TenantId != nil {
+			if _, err := s.store.RetrieveTenantById(*r.TenantId); err != nil {
+				writeErrors(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		err = s.store.AssignAPIKeyToTenant(id, r.TenantId)
+		if err == interfaces.NoMatchingAPIKey {
+			writeErrors(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			logger.WithField("error", err).Errorf("Could not assign API key")
+			writeErrors(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		logger.WithFields(logging.Fields{"key_id": id, "tenant_id": r.TenantId}).Infof("Assigned API key to tenant")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// HandleInvocations lists recent invocations, and the keys which made them.
+// It's what gets run when you go to /v1/admin/invocations?limit=N.
+func (s *Server) HandleInvocations(w http.ResponseWriter, req *http.Request) {
+	limit := 100
+	if l := req.URL.Query().Get("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed <= 0 {
+			writeErrors(w, http.StatusBadRequest, "InvalidLimit")
+			return
+		}
+		limit = parsed
+	}
+
+	invocations, err := s.store.RetrieveInvocations(limit)
+	if err != nil {
+		logging.FromContext(req.Context()).WithField("error", err).Errorf("Could not list invocations")
+		writeErrors(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"Invocations": invocations})
+}
+
+// HandleTenants lists tenants (GET) or creates one (POST). It's what gets
+// run when you go to /v1/admin/tenants.
+func (s *Server) HandleTenants(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+
+	switch req.Method {
+	case "GET":
+		tenants, err := s.store.RetrieveTenants()
+		if err != nil {
+			logger.WithField("error", err).Errorf("Could not list tenants")
+			writeErrors(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"Tenants": tenants})
+
+	case "POST":
+		var t models.Tenant
+		if err := json.NewDecoder(req.Body).Decode(&t); err != nil {
+			writeErrors(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if t.Name == "" {
+			writeErrors(w, http.StatusBadRequest, "NoName")
+			return
+		}
+		if t.Weight < 0 {
+			writeErrors(w, http.StatusBadRequest, "InvalidWeight")
+			return
+		}
+		tenant, err := s.store.CreateTenant(&t)
+		if err != nil {
+			logger.WithField("error", err).Errorf("Could not create tenant")
+			writeErrors(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		logger.WithField("tenant_id", tenant.Id).Infof("Created tenant")
+		writeJSON(w, http.StatusCreated, tenant)
+
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// HandleTenant shows a tenant's limits and recent usage (GET), or replaces
+// its limits (PUT /v1/admin/tenants/{id}).
+func (s *Server) HandleTenant(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(req.URL.Path, "/v1/admin/tenants/"), 10, 64)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, "InvalidTenantId")
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		tenant, err := s.store.RetrieveTenantById(id)
+		if err == interfaces.NoMatchingTenant {
+			writeErrors(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			writeErrors(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		usage, err := s.store.RetrieveTenantUsage(id, time.Now().Add(-24*time.Hour).Truncate(24*time.Hour))
+		if err != nil {
+			logger.WithField("error", err).Errorf("Could not retrieve tenant usage")
+			writeErrors(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"Tenant":  tenant,
+			"Running": s.limiter.Running(id),
+			"Usage":   usage,
+		})
+
+	case "PUT":
+		var t models.Tenant
+		if err := json.NewDecoder(req.Body).Decode(&t); err != nil {
+			writeErrors(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if t.Weight < 0 {
+			writeErrors(w, http.StatusBadRequest, "InvalidWeight")
+			return
+		}
+		t.Id = id
+		err = s.store.UpdateTenantLimits(&t)
+		if err == interfaces.NoMatchingTenant {
+			writeErrors(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			logger.WithField("error", err).Errorf("Could not update tenant")
+			writeErrors(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		logger.WithField("tenant_id", id).Infof("Updated tenant limits")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
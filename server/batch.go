@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/executor"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/metrics"
+	"github.com/Sentimentron/functron/models"
+	"github.com/Sentimentron/functron/secrets"
+	"github.com/Sentimentron/functron/slots"
+)
+
+// maxBatchInputs is the most inputs a single batch can have.
+const maxBatchInputs = 1000
+
+// HandleBatch decodes an api.BatchRequest, builds its function once, runs
+// it with each input, and responds with an api.BatchResponse. It's what
+// gets run when you go to /v2/batch.
+func (s *Server) HandleBatch(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+	out := api.BatchResponse{
+		RequestID: logging.RequestIDFromContext(req.Context()),
+		Results:   make([]api.BatchResult, 0),
+		Errors:    make([]api.Error, 0),
+	}
+
+	returnError := func(err *api.Error) {
+		metrics.Invocations.WithLabelValues(metrics.FunctionAdHoc, metrics.OutcomeBadRequest).Inc()
+		out.Errors = append(out.Errors, *err)
+		writeBatchResponse(w, &out)
+	}
+
+	if req.Body == nil {
+		returnError(api.NewError(api.ErrBodyMissing, "the request has no body"))
+		return
+	}
+	defer req.Body.Close()
+
+	var r api.BatchRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logger.WithField("error", err).Warnf("Request decode failure")
+		returnError(api.NewError(api.ErrInvalidJSON, "could not decode the request: %s", err))
+		return
+	}
+	if !validTimeout(r.TimeoutSeconds) {
+		returnError(api.NewError(api.ErrInvalidTimeout, "timeoutSeconds must be positive, not %v", r.TimeoutSeconds))
+		return
+	}
+	if len(r.Inputs) == 0 || len(r.Inputs) > maxBatchInputs {
+		returnError(api.NewError(api.ErrInvalidRequest, "a batch needs between 1 and %d inputs, not %d", maxBatchInputs, len(r.Inputs)))
+		return
+	}
+	if r.Parallelism < 0 {
+		returnError(api.NewError(api.ErrInvalidRequest, "parallelism can't be negative"))
+		return
+	}
+	if r.Parallelism == 0 || r.Parallelism > s.slots.Size() {
+		r.Parallelism = s.slots.Size()
+	}
+	env, apiErr := s.envVars(r.Env, false)
+	if apiErr != nil {
+		returnError(apiErr)
+		return
+	}
+
+	ex := execution{
+		FnName:       r.FnName,
+		Dockerfile:   r.DockerFile,
+		BuildContext: r.BuildContext,
+		Timeout:      seconds(r.TimeoutSeconds),
+		Vars:         env,
+		Background:   true,
+
+		SecurityProfile: r.SecurityProfile,
+		Network:         r.Network,
+	}
+	ctx, redactor, apiErr := s.resolve(req.Context(), &ex)
+	if apiErr != nil {
+		out.Errors = append(out.Errors, *apiErr)
+		writeBatchResponse(w, &out)
+		return
+	}
+	err := s.admit(ctx, ex, func(ctx context.Context, flow slots.Flow) ([]api.Error, float64, models.Usage) {
+		return s.runBatch(ctx, flow, ex, redactor, &r, &out)
+	})
+	if err != nil {
+		out.Errors = append(out.Errors, *err)
+	}
+	writeBatchResponse(w, &out)
+}
+
+// runBatch builds ex, then runs it with each of r's inputs, filling in out
+// as it goes, with redactor's secrets redacted. Each input waits for a slot
+// for flow, so a big batch shares the slots with everyone else. It returns
+// every error, for the invocation's outcome, and the total CPU time to
+// charge and what the containers used.
+func (s *Server) runBatch(ctx context.Context, flow slots.Flow, ex execution, redactor *secrets.Redactor, r *api.BatchRequest, out *api.BatchResponse) ([]api.Error, float64, models.Usage) {
+	logger := logging.FromContext(ctx)
+
+	// The build needs a slot of its own, but gives it up before the runs
+	// start so that they can use every slot
+	slot := s.slots.Acquire(flow)
+	ws, apiErr := s.executor.Build(ctx, executor.BuildRequest{
+		FunctionName: ex.FnName,
+		RequestID:    out.RequestID,
+		Dockerfile:   ex.Dockerfile,
+		BuildContext: bytes.NewReader(ex.BuildContext),
+	})
+	s.slots.Release(slot)
+
+	if ws != nil {
+		out.Image = ws.Image
+		out.Build.Stdout = ws.BuildStdout
+		out.Build.Stderr = ws.BuildStderr
+		out.BuildSeconds = ws.BuildDuration.Seconds()
+		defer func() {
+			var cleanupErr *api.Error
+			out.Cleanup, cleanupErr = ws.Close(ctx)
+			if cleanupErr != nil {
+				out.Errors = append(out.Errors, *cleanupErr)
+			}
+		}()
+	}
+	if apiErr != nil {
+		out.Errors = append(out.Errors, *apiErr)
+		return out.Errors, 0, models.Usage{}
+	}
+
+	// Fan the inputs out to Parallelism workers, each of which waits for a
+	// free slot before running one
+	out.Results = make([]api.BatchResult, len(r.Inputs))
+	var cpuSeconds float64
+	var usage models.Usage
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	indices := make(chan int)
+	for i := 0; i < r.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				slot := s.slots.Acquire(flow)
+				result, runErr := ws.Run(ctx, executor.RunRequest{
+					Stdin:    bytes.NewReader(r.Inputs[index]),
+					Timeout:  ex.Timeout,
+					Env:      ex.Env,
+					Security: ex.Security,
+					Network:  ex.Network,
+				})
+				s.slots.Release(slot)
+
+				out.Results[index] = batchResult(redactor, result, runErr)
+				lock.Lock()
+				cpuSeconds += result.CPUSeconds()
+				usage.Add(result.Usage)
+				lock.Unlock()
+			}
+		}()
+	}
+	for i := range r.Inputs {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	errors := make([]api.Error, 0)
+	failed := 0
+	for _, result := range out.Results {
+		if len(result.Errors) > 0 {
+			errors = append(errors, result.Errors...)
+			failed++
+		}
+	}
+	logger.WithFields(logging.Fields{"inputs": len(r.Inputs), "failed": failed}).Infof("Batch finished")
+	out.Usage = usageInfo(usage)
+	return errors, cpuSeconds, usage
+}
+
+// batchResult describes the outcome of running one input, with redactor's
+// secrets redacted.
+func batchResult(redactor *secrets.Redactor, result *executor.RunResult, err *api.Error) api.BatchResult {
+	ret := api.BatchResult{
+		ExitCode:   result.ExitCode,
+		Stdout:     redactor.Bytes(result.Stdout),
+		Stderr:     redactor.Bytes(result.Stderr),
+		RunSeconds: result.Duration.Seconds(),
+		Usage:      usageInfo(result.Usage),
+		Errors:     make([]api.Error, 0),
+	}
+	if err != nil {
+		e := *err
+		e.Message = redactor.String(e.Message)
+		ret.Errors = append(ret.Errors, e)
+	}
+	return ret
+}
+
+// writeBatchResponse sends out with a status code which reflects its
+// errors. Inputs which failed don't affect the status code.
+func writeBatchResponse(w http.ResponseWriter, out *api.BatchResponse) {
+	setRetryAfter(w, out.Errors)
+	writeJSON(w, statusFor(out.Errors), out)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/metrics"
+)
+
+// Functron implements a very basic model for running-on-demand functions:
+// Each request looks like this:
+// {
+//      DockerFile: "DockerFileConfiguration"
+//      TarFile: "Base64EncodedTarFileCopiedBeforeDockerBuild"
+//      StdInput: "Base64EncodedStandardInput"
+//      Cmd: "PathToExecutableInsideTarFile"
+//      Timeout: 5.0
+// }
+// Each response looks like this:
+// {
+//      StdErr: ""
+//      StdOut: ""
+//      Errors: "AnyErrorsEncountered"
+// }
+//
+// New clients should prefer /v2/exec, which has a typed response.
+
+type Request struct {
+	DockerFile string
+	TarFile    string
+	FnName     string
+	Stdin      string
+	Timeout    float64
+}
+
+// v1Errors holds the strings which /v1/exec has always reported for each
+// kind of error.
+var v1Errors = map[api.ErrorCode]string{
+	api.ErrBodyMissing:     "NoBody",
+	api.ErrPolicyViolation: "PolicyViolation",
+	api.ErrQuotaExceeded:   "QuotaExceeded",
+	api.ErrContextTooLarge: "QuotaExceeded",
+	api.ErrWorkspace:       "DockerBuildTempDir",
+	api.ErrInvalidContext:  "InvalidBuildContext",
+	api.ErrBuildFailed:     "BuildFailure",
+	api.ErrRunFailed:       "Can't start command",
+	api.ErrTimeout:         "Process exceeded timeout",
+	api.ErrNonZeroExit:     "Process did not exit right",
+	api.ErrCleanupFailed:   "CleanupFailure",
+	api.ErrInternal:        "InternalError",
+}
+
+// ExecuteFunction reads a HTTP POST request as JSON, unpacks it, builds and
+// runs commands inside the container, and returns the response alongside any
+// errors. It's what gets run when you go to /v1/exec.
+func (s *Server) ExecuteFunction(w http.ResponseWriter, req *http.Request) {
+	var r Request
+	logger := logging.FromContext(req.Context())
+
+	out := make(map[string]interface{})
+	out["Errors"] = make([]string, 0)
+	out["CmdErr"] = api.Bytes{}
+	out["CmdOut"] = ""
+	out["CleanupErr"] = ""
+	out["CleanupOut"] = api.Bytes{}
+	out["BuildContextStderr"] = api.Bytes{}
+	out["BuildContextStdout"] = api.Bytes{}
+	out["RequestID"] = logging.RequestIDFromContext(req.Context())
+
+	addError := func(strError string) {
+		out["Errors"] = append(out["Errors"].([]string), strError)
+	}
+
+	returnError := func(strError string) {
+		metrics.Invocations.WithLabelValues(metrics.FunctionAdHoc, metrics.OutcomeBadRequest).Inc()
+		addError(strError)
+		writeJSON(w, http.StatusBadRequest, out)
+	}
+
+	// Check that the client sent the body
+	if req.Body == nil {
+		returnError(v1Errors[api.ErrBodyMissing])
+		return
+	}
+	defer req.Body.Close()
+
+	//
+	// Decode the request
+	//
+	logger.Debugf("Decoding request...")
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithField("error", err).Warnf("Request read failure")
+		returnError(err.Error())
+		return
+	}
+
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		logger.WithField("error", err).Warnf("Request decode failure")
+		returnError(err.Error())
+		return
+	}
+
+	// Parse and validate the timeout
+	timeout, err := time.ParseDuration(fmt.Sprintf("%.2fs", r.Timeout))
+	if err != nil {
+		logger.WithField("error", err).Warnf("Request decode failure")
+		returnError(err.Error())
+		return
+	}
+
+	// base64decode the stdin and the tar file
+	stdin, err := base64.StdEncoding.DecodeString(r.Stdin)
+	if err != nil {
+		logger.WithField("error", err).Warnf("Request decode failure")
+		returnError(err.Error())
+		return
+	}
+	buildContext, err := base64.StdEncoding.DecodeString(r.TarFile)
+	if err != nil {
+		logger.WithField("error", err).Warnf("Request decode failure")
+		returnError(err.Error())
+		return
+	}
+
+	result, apiErr := s.invoke(req.Context(), execution{
+		FnName:       r.FnName,
+		Dockerfile:   r.DockerFile,
+		BuildContext: buildContext,
+		Stdin:        stdin,
+		Timeout:      timeout,
+	})
+	if apiErr != nil {
+		addError(v1Errors[apiErr.Code])
+		switch apiErr.Code {
+		case api.ErrPolicyViolation:
+			out["PolicyViolations"] = apiErr.PolicyViolations
+			writeJSON(w, http.StatusBadRequest, out)
+		case api.ErrQuotaExceeded:
+			out["Limit"] = apiErr.Limit
+			out["RetryAfter"] = apiErr.RetryAfterSeconds
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", apiErr.RetryAfterSeconds))
+			writeJSON(w, http.StatusTooManyRequests, out)
+		case api.ErrContextTooLarge:
+			out["Limit"] = apiErr.Limit
+			writeJSON(w, http.StatusRequestEntityTooLarge, out)
+		default:
+			writeJSON(w, http.StatusInternalServerError, out)
+		}
+		return
+	}
+
+	if result.Workspace != nil {
+		out["TempName"] = result.Workspace.Image
+		out["BuildContextStdout"] = api.Bytes(result.Workspace.BuildStdout)
+		out["BuildContextStderr"] = api.Bytes(result.Workspace.BuildStderr)
+	}
+	if result.Run != nil {
+		out["CmdOut"] = base64.StdEncoding.EncodeToString(result.Run.Stdout)
+		out["CmdErr"] = api.Bytes(result.Run.Stderr)
+	}
+	out["CleanupOut"] = api.Bytes(result.CleanupOutput)
+
+	status := http.StatusOK
+	for _, e := range result.Errors {
+		switch e.Code {
+		case api.ErrCleanupFailed:
+			out["CleanupErr"] = e.Message
+			continue
+		case api.ErrBuildFailed:
+			out["DetailedError"] = e.Message
+			status = http.StatusBadRequest
+		case api.ErrInvalidContext, api.ErrRunFailed:
+			status = http.StatusBadRequest
+		case api.ErrWorkspace:
+			status = http.StatusInternalServerError
+		}
+		addError(v1Errors[e.Code])
+	}
+	writeJSON(w, status, out)
+}
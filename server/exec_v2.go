@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/executor"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/metrics"
+	"github.com/Sentimentron/functron/models"
+)
+
+// HandleExec decodes an api.ExecRequest, builds and runs it, and responds
+// with an api.ExecResponse. It's what gets run when you go to /v2/exec.
+func (s *Server) HandleExec(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+	out := api.ExecResponse{
+		RequestID: logging.RequestIDFromContext(req.Context()),
+		Errors:    make([]api.Error, 0),
+	}
+
+	returnError := func(err *api.Error) {
+		metrics.Invocations.WithLabelValues(metrics.FunctionAdHoc, metrics.OutcomeBadRequest).Inc()
+		out.Errors = append(out.Errors, *err)
+		writeExecResponse(w, &out)
+	}
+
+	if req.Method != http.MethodPost {
+		returnError(api.NewError(api.ErrMethodNotAllowed, "use POST, not %s", req.Method))
+		return
+	}
+	if req.Body == nil {
+		returnError(api.NewError(api.ErrBodyMissing, "the request has no body"))
+		return
+	}
+	defer req.Body.Close()
+
+	var r api.ExecRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		logger.WithField("error", err).Warnf("Request decode failure")
+		returnError(api.NewError(api.ErrInvalidJSON, "could not decode the request: %s", err))
+		return
+	}
+	if !validTimeout(r.TimeoutSeconds) {
+		returnError(api.NewError(api.ErrInvalidTimeout, "timeoutSeconds must be positive, not %v", r.TimeoutSeconds))
+		return
+	}
+
+	env, apiErr := s.envVars(r.Env, false)
+	if apiErr != nil {
+		returnError(apiErr)
+		return
+	}
+
+	result, err := s.invoke(req.Context(), execution{
+		FnName:       r.FnName,
+		Dockerfile:   r.DockerFile,
+		BuildContext: r.BuildContext,
+		Stdin:        r.Stdin,
+		Timeout:      seconds(r.TimeoutSeconds),
+		Vars:         env,
+
+		SecurityProfile: r.SecurityProfile,
+		Network:         r.Network,
+	})
+	out = execResponse(out.RequestID, result, err)
+	writeExecResponse(w, &out)
+}
+
+// seconds converts a timeout in (fractional) seconds to a time.Duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// validTimeout checks that a timeout in seconds is usable.
+func validTimeout(s float64) bool {
+	return s > 0 && !math.IsInf(s, 0) && !math.IsNaN(s)
+}
+
+// execResponse describes the outcome of invoke.
+func execResponse(requestID string, result *executor.Result, err *api.Error) api.ExecResponse {
+	out := api.ExecResponse{
+		RequestID: requestID,
+		Errors:    make([]api.Error, 0),
+	}
+	if err != nil {
+		out.Errors = append(out.Errors, *err)
+		return out
+	}
+
+	if result.Workspace != nil {
+		out.Image = result.Workspace.Image
+		out.Build.Stdout = result.Workspace.BuildStdout
+		out.Build.Stderr = result.Workspace.BuildStderr
+		out.Timings.BuildSeconds = result.Workspace.BuildDuration.Seconds()
+	}
+	if result.Run != nil {
+		out.ExitCode = result.Run.ExitCode
+		out.Stdout = result.Run.Stdout
+		out.Stderr = result.Run.Stderr
+		out.Timings.RunSeconds = result.Run.Duration.Seconds()
+		out.Usage = usageInfo(result.Run.Usage)
+	}
+	out.Cleanup = result.CleanupOutput
+	out.Errors = append(out.Errors, result.Errors...)
+	return out
+}
+
+// usageInfo describes usage for API responses.
+func usageInfo(usage models.Usage) api.Usage {
+	return api.Usage{
+		CPUSeconds:      usage.CPUSeconds,
+		MemoryPeakBytes: usage.MemoryPeakBytes,
+		BlockReadBytes:  usage.BlockReadBytes,
+		BlockWriteBytes: usage.BlockWriteBytes,
+		NetworkRxBytes:  usage.NetworkRxBytes,
+		NetworkTxBytes:  usage.NetworkTxBytes,
+	}
+}
+
+// writeExecResponse sends out with a status code which reflects its errors.
+func writeExecResponse(w http.ResponseWriter, out *api.ExecResponse) {
+	setRetryAfter(w, out.Errors)
+	writeJSON(w, statusFor(out.Errors), out)
+}
+
+// writeAPIError sends err as an api.ErrorResponse.
+func writeAPIError(w http.ResponseWriter, err *api.Error) {
+	errors := []api.Error{*err}
+	setRetryAfter(w, errors)
+	writeJSON(w, statusFor(errors), api.ErrorResponse{Errors: errors})
+}
+
+// setRetryAfter tells the client when to retry a request which was over
+// quota.
+func setRetryAfter(w http.ResponseWriter, errors []api.Error) {
+	for _, e := range errors {
+		if e.Code == api.ErrQuotaExceeded {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", e.RetryAfterSeconds))
+		}
+	}
+}
+
+// statusFor picks the HTTP status code for a response with errors. The
+// first error decides, since later ones (e.g. cleanup) follow from it. A
+// function which ran but exited non-zero is still a successful request.
+func statusFor(errors []api.Error) int {
+	if len(errors) == 0 {
+		return http.StatusOK
+	}
+	switch errors[0].Code {
+	case api.ErrBodyMissing, api.ErrInvalidJSON, api.ErrInvalidTimeout, api.ErrInvalidRequest, api.ErrInvalidContext:
+		return http.StatusBadRequest
+	case api.ErrNotFound:
+		return http.StatusNotFound
+	case api.ErrConflict:
+		return http.StatusConflict
+	case api.ErrMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case api.ErrPolicyViolation, api.ErrBuildFailed:
+		return http.StatusUnprocessableEntity
+	case api.ErrQuotaExceeded:
+		return http.StatusTooManyRequests
+	case api.ErrContextTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case api.ErrTimeout:
+		return http.StatusGatewayTimeout
+	case api.ErrNonZeroExit, api.ErrCleanupFailed:
+		return http.StatusOK
+	default:
+		return http.StatusInternalServerError
+	}
+}
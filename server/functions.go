@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/models"
+	"github.com/Sentimentron/functron/policy"
+)
+
+// functionInfo describes f for API responses.
+func functionInfo(f *models.Function) api.Function {
+	return api.Function{
+		Name:              f.Name,
+		DockerFile:        f.Dockerfile,
+		BuildContextBytes: len(f.BuildContext),
+		TimeoutSeconds:    f.TimeoutSeconds,
+		Weight:            f.Weight,
+		Env:               envInfo(f.Env),
+		SecurityProfile:   f.SecurityProfile,
+		Network:           f.Network,
+		Created:           f.Created,
+		Updated:           f.Updated,
+	}
+}
+
+// functionName extracts {name} from /v2/functions/{name}[/...].
+func functionName(path string) string {
+	name := strings.TrimPrefix(path, "/v2/functions/")
+	if i := strings.Index(name, "/"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// retrieveFunction looks up a registered function, describing any problem
+// as an api.Error.
+func (s *Server) retrieveFunction(logger *logging.Logger, name string) (*models.Function, *api.Error) {
+	f, err := s.store.RetrieveFunctionByName(name)
+	if err == interfaces.NoMatchingFunction {
+		return nil, api.NewError(api.ErrNotFound, "no function is registered as '%s'", name)
+	} else if err != nil {
+		logger.WithField("error", err).Errorf("Could not retrieve function")
+		return nil, api.NewError(api.ErrInternal, "could not retrieve the function")
+	}
+	return f, nil
+}
+
+// HandleListFunctions lists registered functions (GET /v2/functions).
+func (s *Server) HandleListFunctions(w http.ResponseWriter, req *http.Request) {
+	functions, err := s.store.RetrieveFunctions()
+	if err != nil {
+		logging.FromContext(req.Context()).WithField("error", err).Errorf("Could not list functions")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not list functions"))
+		return
+	}
+	out := api.FunctionList{Functions: make([]api.Function, 0, len(functions))}
+	for i := range functions {
+		out.Functions = append(out.Functions, functionInfo(&functions[i]))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// HandleRegisterFunction registers a function, replacing any with the same
+// name (POST /v2/functions).
+func (s *Server) HandleRegisterFunction(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+
+	var r api.RegisterFunctionRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		writeAPIError(w, api.NewError(api.ErrInvalidJSON, "could not decode the request: %s", err))
+		return
+	}
+	if !models.ValidFunctionName(r.Name) {
+		writeAPIError(w, api.NewError(api.ErrInvalidRequest, "'%s' isn't a valid function name", r.Name))
+		return
+	}
+	if !validTimeout(r.TimeoutSeconds) {
+		writeAPIError(w, api.NewError(api.ErrInvalidTimeout, "timeoutSeconds must be positive, not %v", r.TimeoutSeconds))
+		return
+	}
+	if r.Weight < 0 {
+		writeAPIError(w, api.NewError(api.ErrInvalidRequest, "weight can't be negative"))
+		return
+	}
+	env, apiErr := s.envVars(r.Env, true)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if _, apiErr := s.securityFor(r.SecurityProfile); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if _, apiErr := s.networkMode(r.Network); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	// Reject Dockerfiles which would never be allowed to run
+	violations := policy.Check(s.dockerfilePolicy, r.DockerFile)
+	if len(violations) > 0 {
+		writeAPIError(w, policyError(violations))
+		return
+	}
+
+	f, err := s.store.SaveFunction(&models.Function{
+		Name:            r.Name,
+		Dockerfile:      r.DockerFile,
+		BuildContext:    r.BuildContext,
+		TimeoutSeconds:  r.TimeoutSeconds,
+		Weight:          r.Weight,
+		Env:             env,
+		SecurityProfile: r.SecurityProfile,
+		Network:         r.Network,
+	})
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not register function")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not register the function"))
+		return
+	}
+	if s.warm != nil {
+		s.warm.Retire(f.Name)
+	}
+	logger.WithField("function", f.Name).Infof("Registered function")
+	writeJSON(w, http.StatusCreated, functionInfo(f))
+}
+
+// HandleGetFunction describes a registered function (GET /v2/functions/{name}).
+func (s *Server) HandleGetFunction(w http.ResponseWriter, req *http.Request) {
+	f, apiErr := s.retrieveFunction(logging.FromContext(req.Context()), functionName(req.URL.Path))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSON(w, http.StatusOK, functionInfo(f))
+}
+
+// HandleDeleteFunction removes a registered function
+// (DELETE /v2/functions/{name}).
+func (s *Server) HandleDeleteFunction(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+	name := functionName(req.URL.Path)
+
+	err := s.store.DeleteFunction(name)
+	if err == interfaces.NoMatchingFunction {
+		writeAPIError(w, api.NewError(api.ErrNotFound, "no function is registered as '%s'", name))
+		return
+	} else if err != nil {
+		logger.WithField("error", err).Errorf("Could not delete function")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not delete the function"))
+		return
+	}
+	if s.warm != nil {
+		s.warm.Retire(name)
+	}
+	logger.WithField("function", name).Infof("Deleted function")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleInvoke runs a registered function, responding with an
+// api.ExecResponse (POST /v2/functions/{name}/invoke).
+func (s *Server) HandleInvoke(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+	requestID := logging.RequestIDFromContext(req.Context())
+
+	f, apiErr := s.retrieveFunction(logger, functionName(req.URL.Path))
+	if apiErr != nil {
+		out := execResponse(requestID, nil, apiErr)
+		writeExecResponse(w, &out)
+		return
+	}
+
+	// An empty body invokes the function with no stdin
+	var r api.InvokeRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil && err != io.EOF {
+		out := execResponse(requestID, nil, api.NewError(api.ErrInvalidJSON, "could not decode the request: %s", err))
+		writeExecResponse(w, &out)
+		return
+	}
+
+	ex, apiErr := functionExecution(f, r.Stdin, r.TimeoutSeconds)
+	if apiErr != nil {
+		out := execResponse(requestID, nil, apiErr)
+		writeExecResponse(w, &out)
+		return
+	}
+	env, apiErr := s.envVars(r.Env, false)
+	if apiErr != nil {
+		out := execResponse(requestID, nil, apiErr)
+		writeExecResponse(w, &out)
+		return
+	}
+	ex.Vars = append(ex.Vars, env...)
+	result, apiErr := s.invoke(req.Context(), ex)
+	out := execResponse(requestID, result, apiErr)
+	writeExecResponse(w, &out)
+}
+
+// functionExecution describes an invocation of f, with its environment. A
+// timeout of zero means the function's own.
+func functionExecution(f *models.Function, stdin []byte, timeoutSeconds float64) (execution, *api.Error) {
+	if timeoutSeconds == 0 {
+		timeoutSeconds = f.TimeoutSeconds
+	}
+	if !validTimeout(timeoutSeconds) {
+		return execution{}, api.NewError(api.ErrInvalidTimeout, "timeoutSeconds must be positive, not %v", timeoutSeconds)
+	}
+	return execution{
+		FnName:       f.Name,
+		Dockerfile:   f.Dockerfile,
+		BuildContext: f.BuildContext,
+		Stdin:        stdin,
+		Timeout:      seconds(timeoutSeconds),
+		Registered:   true,
+		Vars:         append(models.EnvVars(nil), f.Env...),
+		Weight:       f.Weight,
+
+		SecurityProfile: f.SecurityProfile,
+		Network:         f.Network,
+	}, nil
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/auth"
+	"github.com/Sentimentron/functron/logging"
+)
+
+// maxHTTPBody is the largest request body an HTTP function will be sent.
+const maxHTTPBody = 32 << 20
+
+// maxHeaderBlock is how far into a function's output its header block can
+// end.
+const maxHeaderBlock = 64 << 10
+
+// httpFunctionPath returns the path registered functions are served under,
+// with a trailing slash.
+func httpFunctionPath(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return "/fn/"
+	}
+	return "/" + prefix + "/fn/"
+}
+
+// HandleHTTPFunction invokes a registered function for an arbitrary HTTP
+// request (ANY /{prefix}/fn/{name}[/...]), CGI style. The request body is
+// the function's stdin, the rest of the request is in its environment, and
+// its stdout is the response body. Its output can start with a header
+// block to set the status code and headers, as a CGI script's does.
+func (s *Server) HandleHTTPFunction(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+
+	rest := strings.TrimPrefix(req.URL.Path, s.httpPrefix)
+	name, pathInfo := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		name, pathInfo = rest[:i], rest[i:]
+	}
+	f, apiErr := s.retrieveFunction(logger, name)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	stdin, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxHTTPBody))
+	if err != nil {
+		writeAPIError(w, api.NewError(api.ErrInvalidRequest, "could not read the request body: %s", err))
+		return
+	}
+	ex, apiErr := functionExecution(f, stdin, 0)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	ex.Env = cgiEnvironment(req, name, pathInfo, len(stdin))
+
+	result, apiErr := s.invoke(req.Context(), ex)
+	out := execResponse(logging.RequestIDFromContext(req.Context()), result, apiErr)
+	if stageFailed(out.Errors) {
+		// A function which ran but failed is a bad gateway, as a CGI
+		// script which fails is; anything else is described as usual
+		if out.Errors[0].Code == api.ErrNonZeroExit {
+			setRetryAfter(w, out.Errors)
+			writeJSON(w, http.StatusBadGateway, api.ErrorResponse{Errors: out.Errors})
+			return
+		}
+		writeAPIError(w, &out.Errors[0])
+		return
+	}
+
+	header, body, ok := parseHeaderBlock(out.Stdout)
+	status := http.StatusOK
+	if ok {
+		for key, values := range header {
+			if key == "Status" {
+				continue
+			}
+			for _, v := range values {
+				w.Header().Add(key, v)
+			}
+		}
+		if header.Get("Location") != "" {
+			status = http.StatusFound
+		}
+		if line := header.Get("Status"); line != "" {
+			code, err := strconv.Atoi(strings.Fields(line)[0])
+			if err != nil || code < 100 || code > 999 {
+				logger.WithField("status", line).Warnf("Function sent an invalid status")
+				writeAPIError(w, api.NewError(api.ErrInternal, "the function sent an invalid Status header '%s'", line))
+				return
+			}
+			status = code
+		}
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// cgiEnvironment describes req in the variables a CGI script would see,
+// plus FUNCTRON_FUNCTION and FUNCTRON_REQUEST_ID. Each header is passed as
+// HTTP_{NAME}, except for the API key.
+func cgiEnvironment(req *http.Request, name, pathInfo string, contentLength int) []string {
+	env := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_PROTOCOL=" + req.Proto,
+		"REQUEST_METHOD=" + req.Method,
+		"REQUEST_URI=" + req.URL.RequestURI(),
+		"SCRIPT_NAME=" + strings.TrimSuffix(req.URL.Path, pathInfo),
+		"PATH_INFO=" + pathInfo,
+		"QUERY_STRING=" + req.URL.RawQuery,
+		"REMOTE_ADDR=" + req.RemoteAddr,
+		"CONTENT_LENGTH=" + strconv.Itoa(contentLength),
+		"CONTENT_TYPE=" + req.Header.Get("Content-Type"),
+		"FUNCTRON_FUNCTION=" + name,
+		"FUNCTRON_REQUEST_ID=" + logging.RequestIDFromContext(req.Context()),
+	}
+	for key, values := range req.Header {
+		switch key {
+		case "Authorization", http.CanonicalHeaderKey(auth.APIKeyHeader), "Content-Type", "Content-Length":
+			continue
+		}
+		name := "HTTP_" + strings.ToUpper(strings.Replace(key, "-", "_", -1))
+		env = append(env, name+"="+strings.Join(values, ", "))
+	}
+	return env
+}
+
+// parseHeaderBlock splits a function's output into a header block and a
+// body, if it starts with one: lines of "Name: value" ended by a blank
+// line. Output which doesn't is all body. Output which starts with a blank
+// line has an empty header block, so functions can always send a body
+// verbatim.
+func parseHeaderBlock(stdout []byte) (http.Header, []byte, bool) {
+	end := bytes.Index(stdout, []byte("\n\n"))
+	sep := 2
+	if crlf := bytes.Index(stdout, []byte("\r\n\r\n")); crlf >= 0 && (end < 0 || crlf < end) {
+		end, sep = crlf, 4
+	}
+	switch {
+	case bytes.HasPrefix(stdout, []byte("\r\n")):
+		return http.Header{}, stdout[2:], true
+	case bytes.HasPrefix(stdout, []byte("\n")):
+		return http.Header{}, stdout[1:], true
+	case end < 0 || end > maxHeaderBlock:
+		return nil, stdout, false
+	}
+
+	block := stdout[:end]
+	for _, line := range bytes.Split(block, []byte("\n")) {
+		if !validHeaderLine(bytes.TrimSuffix(line, []byte("\r"))) {
+			return nil, stdout, false
+		}
+	}
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(block, []byte("\r\n\r\n")...))))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		return nil, stdout, false
+	}
+	return http.Header(header), stdout[end+sep:], true
+}
+
+// validHeaderLine checks whether line is "Name: value", with a name made
+// of the characters HTTP allows.
+func validHeaderLine(line []byte) bool {
+	i := bytes.IndexByte(line, ':')
+	if i <= 0 {
+		return false
+	}
+	for _, c := range line[:i] {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", rune(c)) &&
+			!('0' <= c && c <= '9') && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,410 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/auth"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/library"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/metrics"
+	"github.com/Sentimentron/functron/models"
+)
+
+// HandleListImages lists stored images (GET /v2/images).
+func (s *Server) HandleListImages(w http.ResponseWriter, req *http.Request) {
+	images, err := s.store.RetrieveAllImages()
+	if err != nil {
+		logging.FromContext(req.Context()).WithField("error", err).Errorf("Could not list images")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not list images"))
+		return
+	}
+
+	out := api.ImageList{Images: make([]api.Image, 0, len(images))}
+	for i := range images {
+		out.Images = append(out.Images, imageInfo(&images[i]))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// imageInfo describes img for API responses.
+func imageInfo(img *models.FunctronImage) api.Image {
+	return api.Image{
+		Name:             img.Name,
+		Status:           string(img.Status),
+		Created:          img.Created,
+		Finished:         img.Committed,
+		ScheduledRemoval: img.ScheduledForRemoval,
+		Pinned:           img.Pinned,
+	}
+}
+
+// imageName extracts the image's name from /v2/images/{name}, or
+// /v2/images/{name}/history.
+func imageName(path string) string {
+	name := strings.TrimPrefix(path, "/v2/images/")
+	if i := strings.Index(name, "/"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// retrieveImage looks up the image named in the URL, describing any
+// problem as an API error.
+func (s *Server) retrieveImage(logger *logging.Logger, name string) (*models.FunctronImage, *api.Error) {
+	img, err := s.store.RetrieveImageByName(name)
+	if err == interfaces.NoMatchingImage {
+		return nil, api.NewError(api.ErrNotFound, "there's no image called '%s'", name)
+	} else if err != nil {
+		logger.WithField("error", err).Errorf("Could not retrieve image")
+		return nil, api.NewError(api.ErrInternal, "could not retrieve the image")
+	}
+	return img, nil
+}
+
+// writeImage sends img, and the changes made to it.
+func (s *Server) writeImage(w http.ResponseWriter, logger *logging.Logger, img *models.FunctronImage) {
+	changes, err := s.store.RetrieveImageChanges(img.Id)
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not retrieve image changes")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not retrieve the image's changes"))
+		return
+	}
+	out := api.ImageDetail{Image: imageInfo(img), Changes: make([]api.ImageChange, 0, len(changes))}
+	for _, c := range changes {
+		out.Changes = append(out.Changes, api.ImageChange{
+			Change:   c.Change,
+			Detail:   c.Detail,
+			APIKeyId: c.APIKeyId,
+			Created:  c.Created,
+		})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// changeFailed describes an error from changing an image.
+func changeFailed(logger *logging.Logger, img *models.FunctronImage, err error) *api.Error {
+	if err == interfaces.ImageChanged {
+		return api.NewError(api.ErrConflict, "image '%s' changed while it was being updated, so try again", img.Name)
+	}
+	logger.WithField("error", err).Errorf("Could not change image")
+	return api.NewError(api.ErrInternal, "could not change the image")
+}
+
+// HandleGetImage describes an image, and the changes made to it
+// (GET /v2/images/{name}).
+func (s *Server) HandleGetImage(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+	img, apiErr := s.retrieveImage(logger, imageName(req.URL.Path))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	s.writeImage(w, logger, img)
+}
+
+// HandleImageHistory describes every change to an image's status
+// (GET /v2/images/{name}/history).
+func (s *Server) HandleImageHistory(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+	img, apiErr := s.retrieveImage(logger, imageName(req.URL.Path))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	history, err := s.store.RetrieveImageStatusHistory(img.Id)
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not retrieve image history")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not retrieve the image's history"))
+		return
+	}
+
+	out := api.ImageTimeline{Name: img.Name, Status: string(img.Status), Transitions: make([]api.ImageTransition, 0, len(history))}
+	for _, t := range history {
+		out.Transitions = append(out.Transitions, api.ImageTransition{
+			From:    string(t.From),
+			To:      string(t.To),
+			Message: t.Message,
+			At:      t.Created,
+		})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// HandleUpdateImage pins or unpins an image, or changes when it's removed
+// (PATCH /v2/images/{name}).
+func (s *Server) HandleUpdateImage(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+
+	var r api.UpdateImageRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		writeAPIError(w, api.NewError(api.ErrInvalidJSON, "could not decode the request: %s", err))
+		return
+	}
+	if r.ScheduledRemoval != nil && !r.ScheduledRemoval.After(time.Now()) {
+		writeAPIError(w, api.NewError(api.ErrInvalidRequest, "scheduledRemoval must be in the future (DELETE the image to remove it now)"))
+		return
+	}
+
+	img, apiErr := s.retrieveImage(logger, imageName(req.URL.Path))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if img.Status.Removed() {
+		writeAPIError(w, api.NewError(api.ErrConflict, "image '%s' has already been removed", img.Name))
+		return
+	}
+	if r.Pinned != nil && *r.Pinned && img.Status.Failed() {
+		writeAPIError(w, api.NewError(api.ErrConflict, "image '%s' failed to build, so there's nothing to pin", img.Name))
+		return
+	}
+
+	var keyId *int64
+	if key := auth.KeyFromContext(req.Context()); key != nil {
+		keyId = &key.Id
+	}
+	if r.Pinned != nil && *r.Pinned != img.Pinned {
+		updated, err := s.store.PinImage(img, *r.Pinned, keyId)
+		if err != nil {
+			writeAPIError(w, changeFailed(logger, img, err))
+			return
+		}
+		img = updated
+		logger.WithFields(logging.Fields{"image": img.Name, "pinned": img.Pinned}).Infof("Changed image's pin")
+	}
+	if r.ScheduledRemoval != nil {
+		detail := "scheduled for removal at " + r.ScheduledRemoval.UTC().Format(time.RFC3339)
+		updated, err := s.store.RescheduleImageRemoval(img, *r.ScheduledRemoval, detail, keyId)
+		if err != nil {
+			writeAPIError(w, changeFailed(logger, img, err))
+			return
+		}
+		img = updated
+		logger.WithFields(logging.Fields{"image": img.Name, "scheduled_removal": r.ScheduledRemoval}).Infof("Rescheduled image's removal")
+	}
+	s.writeImage(w, logger, img)
+}
+
+// HandleRemoveImage removes an image before it's scheduled to be
+// (DELETE /v2/images/{name}). If it's in use, it's removed once it's
+// released.
+func (s *Server) HandleRemoveImage(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+	img, apiErr := s.retrieveImage(logger, imageName(req.URL.Path))
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	imgLogger := logger.WithField("image", img.Name)
+	switch {
+	case img.Status.Removed():
+		apiErr = api.NewError(api.ErrConflict, "image '%s' has already been removed", img.Name)
+	case img.Status.Building():
+		apiErr = api.NewError(api.ErrConflict, "image '%s' is still being built", img.Name)
+	case img.Pinned:
+		apiErr = api.NewError(api.ErrConflict, "image '%s' is pinned, so unpin it first", img.Name)
+	}
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	var keyId *int64
+	if key := auth.KeyFromContext(req.Context()); key != nil {
+		keyId = &key.Id
+	}
+	err := s.images.DeleteImage(img.Name)
+	if err == interfaces.ImageRemovalDeferred {
+		// The next garbage collection records the removal, once it's
+		// happened
+		if _, err := s.store.RescheduleImageRemoval(img, time.Now(), "removal requested, once the image is released", keyId); err != nil {
+			writeAPIError(w, changeFailed(imgLogger, img, err))
+			return
+		}
+		imgLogger.Infof("Image will be removed once it's released")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	} else if err != nil && err != interfaces.ImageNotBuilt {
+		metrics.CleanupFailures.WithLabelValues("image").Inc()
+		imgLogger.WithField("error", err).Warnf("Failed to remove image")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not remove the image: %s", err))
+		return
+	}
+	if _, err := s.store.RecordImageRemoval(img, keyId); err != nil {
+		writeAPIError(w, changeFailed(imgLogger, img, err))
+		return
+	}
+	imgLogger.Infof("Removed image")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleCollectGarbage removes every image which is past its scheduled
+// removal, and evicts images if they're over the disk budget
+// (POST /v2/images/gc).
+func (s *Server) HandleCollectGarbage(w http.ResponseWriter, req *http.Request) {
+	out := api.GCResult{Evicted: make([]api.EvictedImage, 0)}
+	removed, errs, err := s.removeExpiredImages(req.Context())
+	if err != nil {
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not find images to remove"))
+		return
+	}
+	out.Removed, out.Errors = removed, errs
+
+	evictions, err := s.evictImages(req.Context())
+	for _, e := range evictions {
+		out.Evicted = append(out.Evicted, api.EvictedImage{
+			Name:      e.Name,
+			SizeBytes: e.SizeBytes,
+			LastUsed:  e.LastUsed,
+			Reason:    e.Reason,
+		})
+	}
+	if err != nil {
+		out.Errors = append(out.Errors, *api.NewError(api.ErrCleanupFailed, "could not evict images: %s", err))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// removeExpiredImages removes every image which is past its scheduled
+// removal, returning the names of those it removed, and what went wrong
+// with any it couldn't. Saving the images' usage first puts off the
+// removal of those which have been used recently, and images which are
+// referenced (e.g. by warm containers) or were used within MinIdleSeconds
+// are left for a later call.
+func (s *Server) removeExpiredImages(ctx context.Context) ([]string, []api.Error, error) {
+	logger := logging.FromContext(ctx)
+
+	if err := s.images.SaveUsage(ctx); err != nil {
+		logger.WithField("error", err).Warnf("Could not save image usage")
+	}
+	plan, err := s.store.RetrieveBuildPlan()
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not retrieve build plan")
+		return nil, nil, err
+	}
+
+	removed, errs := make([]string, 0), make([]api.Error, 0)
+	for i := range plan.ImagesNeedingCleanup {
+		img := &plan.ImagesNeedingCleanup[i]
+		imgLogger := logger.WithField("image", img.Name)
+
+		// Images which are still being built are left until they're done
+		if !img.Status.CanTransitionTo(models.ImageStatusCleanedUp) {
+			imgLogger.WithField("status", img.Status).Infof("Image can't be removed yet")
+			continue
+		}
+		if !s.images.Idle(img.Name, seconds(s.imageGC.MinIdleSeconds)) {
+			imgLogger.Infof("Image is in use, so it's being kept")
+			continue
+		}
+
+		// Images which are in use are removed once they're released.
+		// Images which have already gone just need recording.
+		err := s.images.DeleteImage(img.Name)
+		if err == interfaces.ImageRemovalDeferred {
+			imgLogger.Infof("Image will be removed once it's released")
+			continue
+		} else if err != nil && err != interfaces.ImageNotBuilt {
+			metrics.CleanupFailures.WithLabelValues("image").Inc()
+			imgLogger.WithField("error", err).Warnf("Failed to remove image")
+			errs = append(errs, *api.NewError(api.ErrCleanupFailed, "could not remove %s: %s", img.Name, err))
+			continue
+		}
+		if err := s.store.UpdateStatus(img, models.ImageStatusCleanedUp, "removed after its scheduled removal"); err != nil {
+			imgLogger.WithField("error", err).Errorf("Could not record image removal")
+			errs = append(errs, *api.NewError(api.ErrInternal, "removed %s, but could not record it", img.Name))
+			continue
+		}
+		imgLogger.Infof("Removed expired image")
+		removed = append(removed, img.Name)
+	}
+	return removed, errs, nil
+}
+
+// evictImages evicts the least recently used images which aren't pinned,
+// if they're over the disk budget, logging why each one was chosen.
+func (s *Server) evictImages(ctx context.Context) ([]library.Eviction, error) {
+	if s.imageGC.DiskBudgetBytes <= 0 {
+		return nil, nil
+	}
+	logger := logging.FromContext(ctx)
+
+	pinned, err := s.store.RetrievePinnedImages()
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not retrieve pinned images")
+		return nil, err
+	}
+	policy := library.GCPolicy{
+		BudgetBytes: s.imageGC.DiskBudgetBytes,
+		MinIdle:     seconds(s.imageGC.MinIdleSeconds),
+		Pinned:      make(map[string]bool),
+	}
+	for _, name := range pinned {
+		policy.Pinned[name] = true
+	}
+
+	evictions, err := s.images.CollectGarbage(ctx, policy)
+	for _, e := range evictions {
+		metrics.ImagesEvicted.Inc()
+		logger.WithFields(logging.Fields{
+			"image":     e.Name,
+			"bytes":     e.SizeBytes,
+			"last_used": e.LastUsed,
+			"reason":    e.Reason,
+		}).Infof("Evicted image")
+
+		// Images which are in the store are recorded as removed
+		if img, err := s.store.RetrieveImageByName(e.Name); err == nil && img.Status.CanTransitionTo(models.ImageStatusCleanedUp) {
+			if err := s.store.UpdateStatus(img, models.ImageStatusCleanedUp, "evicted: "+e.Reason); err != nil {
+				logger.WithFields(logging.Fields{"image": e.Name, "error": err}).Errorf("Could not record image removal")
+			}
+		}
+	}
+	if err != nil {
+		metrics.CleanupFailures.WithLabelValues("image").Inc()
+		logger.WithField("error", err).Warnf("Failed to evict images")
+	}
+	return evictions, err
+}
+
+// reportLeaks logs each reference to an image which has been held for
+// longer than LeakSeconds, once.
+func (s *Server) reportLeaks(ctx context.Context) {
+	logger := logging.FromContext(ctx)
+	for _, h := range s.images.Leaks(seconds(s.imageGC.LeakSeconds)) {
+		logger.WithFields(logging.Fields{
+			"image":    h.Name,
+			"handle":   h.Handle,
+			"acquired": h.Acquired,
+			"caller":   h.Caller,
+		}).Warnf("Image reference has been held for a long time, and may have leaked")
+	}
+}
+
+// RunImageGC removes images which are past their scheduled removal,
+// evicts images to keep within the disk budget, and reports leaked
+// references to them, every IntervalSeconds until ctx is done.
+func (s *Server) RunImageGC(ctx context.Context) {
+	ticker := time.NewTicker(seconds(s.imageGC.IntervalSeconds))
+	defer ticker.Stop()
+	for {
+		if _, errs, err := s.removeExpiredImages(ctx); err != nil || len(errs) > 0 {
+			metrics.ReaperErrors.Inc()
+		}
+		if _, err := s.evictImages(ctx); err != nil {
+			metrics.ReaperErrors.Inc()
+		}
+		s.reportLeaks(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
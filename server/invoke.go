@@ -0,0 +1,365 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/auth"
+	"github.com/Sentimentron/functron/executor"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/metrics"
+	"github.com/Sentimentron/functron/models"
+	"github.com/Sentimentron/functron/policy"
+	"github.com/Sentimentron/functron/quota"
+	"github.com/Sentimentron/functron/secrets"
+	"github.com/Sentimentron/functron/slots"
+	"github.com/Sentimentron/functron/warmpool"
+)
+
+// execution is a decoded request to build and run a function, whichever
+// version of the API it arrived through.
+type execution struct {
+	FnName       string
+	Dockerfile   string
+	BuildContext []byte
+	Stdin        []byte
+	Timeout      time.Duration
+	// StdinReader, if set, is read as the function's standard input in
+	// place of Stdin
+	StdinReader io.Reader
+	// Stdout and Stderr, if set, receive the function's output as it runs.
+	// If StreamStdout is set, the output is only written to Stdout, and
+	// isn't kept in the result.
+	Stdout       io.Writer
+	Stderr       io.Writer
+	StreamStdout bool
+	// Acquired, if set, is called once the invocation has a slot
+	Acquired func()
+	// Registered is set for registered functions, which can use the warm
+	// pool
+	Registered bool
+	// Vars are the environment variables declared by the function and the
+	// request, which are resolved (decrypting any secrets) into Env
+	Vars models.EnvVars
+	// Env is set in the container's environment, each as "KEY=value",
+	// after Vars
+	Env []string
+	// Weight is the function's share of its tenant's slots (1 if it's
+	// zero)
+	Weight float64
+	// Background is set for work which nobody's waiting on, such as jobs,
+	// which can't use the slots reserved for interactive requests
+	Background bool
+	// SecurityProfile names the configured profile the function chose, if
+	// any, which is resolved along with the server's into Security
+	SecurityProfile string
+	Security        interfaces.Security
+	// Network is the network mode the function chose (or the server's
+	// default, once it's resolved). The executor creates a network for
+	// each "isolated" container.
+	Network string
+}
+
+// invoke checks ex against the Dockerfile policy and the caller's quotas,
+// then builds and runs it in a free slot, recording metrics and invocation
+// history as it goes. If ex is refused before anything runs, invoke returns
+// an error and no Result.
+func (s *Server) invoke(ctx context.Context, ex execution) (*executor.Result, *api.Error) {
+	ctx, redactor, apiErr := s.resolve(ctx, &ex)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	var ret *executor.Result
+	err := s.admit(ctx, ex, func(ctx context.Context, flow slots.Flow) ([]api.Error, float64, models.Usage) {
+		// Wait for a free slot before doing anything expensive
+		slot := s.slots.Acquire(flow)
+		defer s.slots.Release(slot)
+		if ex.Acquired != nil {
+			ex.Acquired()
+		}
+
+		run := executor.RunRequest{
+			Stdin:        bytes.NewReader(ex.Stdin),
+			Timeout:      ex.Timeout,
+			Env:          ex.Env,
+			Security:     ex.Security,
+			Network:      ex.Network,
+			StreamStdout: ex.StreamStdout,
+		}
+		if ex.StdinReader != nil {
+			run.Stdin = ex.StdinReader
+		}
+		// Secrets are redacted from output as it's streamed, as well as
+		// from the result
+		if ex.Stdout != nil {
+			stdout := redactor.Writer(ex.Stdout)
+			defer stdout.Flush()
+			run.Stdout = stdout
+		}
+		if ex.Stderr != nil {
+			stderr := redactor.Writer(ex.Stderr)
+			defer stderr.Flush()
+			run.Stderr = stderr
+		}
+		if ex.Registered && s.warm != nil {
+			ret = s.invokeWarm(ctx, ex, run)
+		} else {
+			ret = s.executor.Execute(ctx, executor.BuildRequest{
+				FunctionName: ex.FnName,
+				RequestID:    logging.RequestIDFromContext(ctx),
+				Dockerfile:   ex.Dockerfile,
+				BuildContext: bytes.NewReader(ex.BuildContext),
+			}, run)
+		}
+
+		redactResult(redactor, ret)
+
+		if ret.Run == nil {
+			return ret.Errors, 0, models.Usage{}
+		}
+		return ret.Errors, ret.Run.CPUSeconds(), ret.Run.Usage
+	})
+	return ret, err
+}
+
+// resolve fills in ex.Security from its security profile and ex's
+// network, and resolves ex.Vars, adding them to the start of ex.Env. It
+// returns a Redactor for the values of any secrets, and a copy of ctx whose
+// logger redacts them. If any can't be resolved, it returns an error, and
+// the invocation is counted in metrics.
+func (s *Server) resolve(ctx context.Context, ex *execution) (context.Context, *secrets.Redactor, *api.Error) {
+	logger := logging.FromContext(ctx)
+	fail := func(apiErr *api.Error) (context.Context, *secrets.Redactor, *api.Error) {
+		outcome := metrics.OutcomeBadRequest
+		if apiErr.Code == api.ErrInternal {
+			outcome = metrics.OutcomeError
+		}
+		metrics.Invocations.WithLabelValues(metrics.FunctionLabel(ex.FnName, ex.Registered), outcome).Inc()
+		return ctx, nil, apiErr
+	}
+
+	security, apiErr := s.securityFor(ex.SecurityProfile)
+	if apiErr != nil {
+		return fail(apiErr)
+	}
+	ex.Security = security
+	ex.Network, apiErr = s.networkMode(ex.Network)
+	if apiErr != nil {
+		return fail(apiErr)
+	}
+	env, redactor, apiErr := s.environment(logger, ex.Vars)
+	if apiErr != nil {
+		return fail(apiErr)
+	}
+	if len(env) > 0 {
+		ex.Env = append(env, ex.Env...)
+	}
+	if redactor != nil {
+		ctx = logging.NewContext(ctx, logger.WithRedactions(redactor.Values()...))
+	}
+	return ctx, redactor, nil
+}
+
+// redactResult redacts secrets from the output and errors in result.
+func redactResult(redactor *secrets.Redactor, result *executor.Result) {
+	if redactor == nil {
+		return
+	}
+	if result.Run != nil {
+		result.Run.Stdout = redactor.Bytes(result.Run.Stdout)
+		result.Run.Stderr = redactor.Bytes(result.Run.Stderr)
+	}
+	for i := range result.Errors {
+		result.Errors[i].Message = redactor.String(result.Errors[i].Message)
+	}
+}
+
+// invokeAs invokes a registered function on behalf of the key with the
+// given ID (or no key, if it's nil), for work which didn't come from a
+// request, such as a workflow's tasks. The invocation gets a request ID of
+// its own, which the response carries.
+func (s *Server) invokeAs(ctx context.Context, keyId *int64, function string, stdin []byte, timeoutSeconds float64) api.ExecResponse {
+	requestID := logging.NewRequestID()
+	logger := logging.FromContext(ctx).WithField("request_id", requestID)
+	ctx = logging.ContextWithRequestID(ctx, requestID)
+	ctx = logging.NewContext(ctx, logger)
+
+	if keyId != nil {
+		key, err := s.store.RetrieveAPIKeyById(*keyId)
+		if err != nil {
+			logger.WithField("error", err).Errorf("Could not retrieve API key")
+			return execResponse(requestID, nil, api.NewError(api.ErrInternal, "could not retrieve the invoking API key"))
+		}
+		ctx = auth.ContextWithKey(ctx, key)
+	}
+
+	f, apiErr := s.retrieveFunction(logger, function)
+	if apiErr != nil {
+		return execResponse(requestID, nil, apiErr)
+	}
+	ex, apiErr := functionExecution(f, stdin, timeoutSeconds)
+	if apiErr != nil {
+		return execResponse(requestID, nil, apiErr)
+	}
+	ex.Background = true
+	result, apiErr := s.invoke(ctx, ex)
+	return execResponse(requestID, result, apiErr)
+}
+
+// invokeWarm runs a registered function in a container from the warm
+// pool. The function's image is kept, so there's nothing to clean up, and
+// the build is only reported by the invocation which built it.
+func (s *Server) invokeWarm(ctx context.Context, ex execution, run executor.RunRequest) *executor.Result {
+	ret := &executor.Result{Errors: make([]api.Error, 0)}
+	c, w, apiErr := s.warm.Acquire(ctx, warmpool.Function{
+		Name:         ex.FnName,
+		Dockerfile:   ex.Dockerfile,
+		BuildContext: ex.BuildContext,
+		Security:     ex.Security,
+		Network:      ex.Network,
+		Env:          ex.Env,
+	})
+	ret.Workspace = w
+	if apiErr == nil {
+		ret.Run, apiErr = c.Run(ctx, run)
+	}
+	if apiErr != nil {
+		ret.Errors = append(ret.Errors, *apiErr)
+	}
+	return ret
+}
+
+// admit checks ex against the Dockerfile policy and the caller's quotas.
+// If it's allowed, admit calls work with the flow to acquire slots for,
+// and records the outcome, CPU time and usage work returns in metrics,
+// the invocation history and the tenant's usage. Otherwise it returns an
+// error, and work isn't called.
+func (s *Server) admit(ctx context.Context, ex execution, work func(ctx context.Context, flow slots.Flow) ([]api.Error, float64, models.Usage)) *api.Error {
+	logger := logging.FromContext(ctx).WithField("function", ex.FnName)
+	requestID := logging.RequestIDFromContext(ctx)
+	outcome := metrics.OutcomeBadRequest
+	defer func() {
+		metrics.Invocations.WithLabelValues(metrics.FunctionLabel(ex.FnName, ex.Registered), outcome).Inc()
+	}()
+
+	// Check that the Dockerfile is allowed
+	violations := policy.Check(s.dockerfilePolicy, ex.Dockerfile)
+	if len(violations) > 0 {
+		logger.WithField("violations", violations).Warnf("Dockerfile rejected by policy")
+		return policyError(violations)
+	}
+
+	// Record the invocation, and which key made it
+	invocation := &models.Invocation{RequestID: requestID, FunctionName: ex.FnName, Network: ex.Network}
+	key := auth.KeyFromContext(ctx)
+	if key != nil {
+		invocation.APIKeyId = &key.Id
+		invocation.TenantId = key.TenantId
+	}
+
+	// Check the invocation against the tenant's quotas
+	flow := slots.Flow{Function: ex.FnName, FunctionWeight: ex.Weight, Interactive: !ex.Background, Registered: ex.Registered}
+	var admission *quota.Admission
+	if key != nil && key.TenantId != nil {
+		tenant, err := s.store.RetrieveTenantById(*key.TenantId)
+		if err != nil {
+			logger.WithField("error", err).Errorf("Could not look up tenant")
+			outcome = metrics.OutcomeError
+			return api.NewError(api.ErrInternal, "could not look up tenant")
+		}
+		flow.Tenant, flow.TenantWeight = tenant.Name, tenant.Weight
+		admission, err = s.limiter.Admit(tenant, int64(len(ex.BuildContext)))
+		if limitErr, ok := err.(*quota.LimitError); ok {
+			logger.WithFields(logging.Fields{"tenant_id": tenant.Id, "limit": limitErr.Limit}).Warnf("Quota exceeded")
+			outcome = metrics.OutcomeQuotaExceeded
+			return limitError(limitErr)
+		} else if err != nil {
+			logger.WithField("error", err).Errorf("Could not check quotas")
+			outcome = metrics.OutcomeError
+			return api.NewError(api.ErrInternal, "could not check quotas")
+		}
+	}
+
+	// Tenants' quotas are charged for the CPU time their containers use
+	var cpuSeconds float64
+	if admission != nil {
+		defer func() {
+			if err := admission.Finish(cpuSeconds); err != nil {
+				logger.WithField("error", err).Errorf("Could not record usage")
+			}
+		}()
+	}
+
+	invocation, err := s.store.PersistInvocation(invocation)
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not record invocation")
+		outcome = metrics.OutcomeError
+		return api.NewError(api.ErrInternal, "could not record invocation")
+	}
+	var usage models.Usage
+	defer func() {
+		if err := s.store.FinishInvocation(invocation.Id, outcome, usage); err != nil {
+			logger.WithField("error", err).Errorf("Could not record invocation outcome")
+		}
+	}()
+
+	var errors []api.Error
+	errors, cpuSeconds, usage = work(logging.NewContext(ctx, logger), flow)
+	outcome = outcomeFor(errors)
+	logger.WithField("outcome", outcome).Infof("Invocation finished")
+	return nil
+}
+
+// outcomeFor summarises errors for metrics and invocation history. Cleanup
+// failures don't count against the function.
+func outcomeFor(errors []api.Error) string {
+	for _, e := range errors {
+		switch e.Code {
+		case api.ErrWorkspace:
+			return metrics.OutcomeError
+		case api.ErrInvalidContext:
+			return metrics.OutcomeUnpackFailed
+		case api.ErrBuildFailed:
+			return metrics.OutcomeBuildFailed
+		case api.ErrRunFailed, api.ErrNonZeroExit:
+			return metrics.OutcomeRunFailed
+		case api.ErrTimeout:
+			return metrics.OutcomeTimeout
+		}
+	}
+	return metrics.OutcomeSuccess
+}
+
+// policyError describes a Dockerfile which broke the policy.
+func policyError(violations []policy.Violation) *api.Error {
+	ret := api.NewError(api.ErrPolicyViolation, "the Dockerfile breaks %d policy rule(s)", len(violations))
+	for _, v := range violations {
+		ret.PolicyViolations = append(ret.PolicyViolations, api.PolicyViolation{
+			Line:        v.Line,
+			Instruction: v.Instruction,
+			Rule:        v.Rule,
+			Message:     v.Message,
+		})
+	}
+	return ret
+}
+
+// limitError describes a request which would exceed its tenant's quota.
+// Only limits which could allow the request later have a RetryAfterSeconds.
+func limitError(err *quota.LimitError) *api.Error {
+	if err.RetryAfter <= 0 {
+		ret := api.NewError(api.ErrContextTooLarge, "%s", err.Error())
+		ret.Limit = err.Limit
+		return ret
+	}
+	ret := api.NewError(api.ErrQuotaExceeded, "%s", err.Error())
+	ret.Limit = err.Limit
+	ret.RetryAfterSeconds = int(math.Ceil(err.RetryAfter.Seconds()))
+	return ret
+}
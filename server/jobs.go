@@ -0,0 +1,480 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/auth"
+	"github.com/Sentimentron/functron/executor"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/models"
+	"github.com/Sentimentron/functron/queue"
+)
+
+// jobRetention is how long a finished job's events are kept in memory.
+// Streams of jobs which have been forgotten are rebuilt from the store,
+// without their output.
+const jobRetention = time.Hour
+
+// job holds the events a queued job has reported so far, so they can be
+// streamed. Everything else about it is kept in the store.
+type job struct {
+	lock     sync.Mutex
+	status   api.JobStatus
+	finished *time.Time
+	events   []api.StreamEvent
+	updated  chan struct{}
+}
+
+// createJob returns a job whose events so far are info's status, and its
+// result if it's finished.
+func createJob(info api.Job) *job {
+	j := &job{updated: make(chan struct{})}
+	j.setStatus(info.Status, info.Result)
+	return j
+}
+
+// publish records e, and wakes anyone waiting for it. It must be called
+// with the lock held.
+func (j *job) publish(e api.StreamEvent) {
+	j.events = append(j.events, e)
+	close(j.updated)
+	j.updated = make(chan struct{})
+}
+
+// setStatus moves the job on, recording result if it's finished. It does
+// nothing if the job already has the status.
+func (j *job) setStatus(status api.JobStatus, result *api.ExecResponse) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.status == status {
+		return
+	}
+
+	j.status, j.finished = status, nil
+	j.publish(api.StreamEvent{Type: api.EventStatus, Status: status})
+	if status.Finished() {
+		now := time.Now()
+		j.finished = &now
+		j.publish(api.StreamEvent{Type: api.EventResult, Result: result})
+	}
+}
+
+// eventsFrom returns the events after the first n, a channel which is
+// closed when there are more, and whether the job has finished.
+func (j *job) eventsFrom(n int) ([]api.StreamEvent, <-chan struct{}, bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.events[n:], j.updated, j.status.Finished()
+}
+
+// expired returns true if the job finished longer than jobRetention ago.
+func (j *job) expired() bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.finished != nil && time.Since(*j.finished) > jobRetention
+}
+
+// jobWriter turns a job's output into stream events.
+type jobWriter struct {
+	job  *job
+	kind string
+}
+
+func (w jobWriter) Write(p []byte) (int, error) {
+	data := make([]byte, len(p))
+	copy(data, p)
+
+	w.job.lock.Lock()
+	defer w.job.lock.Unlock()
+	w.job.publish(api.StreamEvent{Type: w.kind, Data: data})
+	return len(p), nil
+}
+
+// jobTable holds the events of jobs which are queued, running, or
+// recently finished.
+type jobTable struct {
+	lock sync.Mutex
+	jobs map[string]*job
+}
+
+func createJobTable() *jobTable {
+	return &jobTable{jobs: make(map[string]*job)}
+}
+
+// attach returns the events of the job described by info, starting to
+// record them if they weren't already. Jobs which finished too long ago
+// are forgotten.
+func (t *jobTable) attach(info api.Job) *job {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for id, candidate := range t.jobs {
+		if candidate.expired() {
+			delete(t.jobs, id)
+		}
+	}
+	j, ok := t.jobs[info.ID]
+	if !ok {
+		j = createJob(info)
+		t.jobs[info.ID] = j
+	}
+	return j
+}
+
+// describeJob returns job as the API describes it. Dead jobs which never
+// got a result (because their lease expired) are given one describing why.
+func describeJob(job *models.Job) api.Job {
+	ret := api.Job{
+		ID:          job.Id,
+		Function:    job.Function,
+		Status:      api.JobStatus(job.Status),
+		Created:     job.Enqueued,
+		Started:     job.Started,
+		Finished:    job.Finished,
+		CallbackURL: job.CallbackURL,
+		Priority:    job.Priority,
+		Attempts:    job.Attempts,
+		MaxAttempts: job.MaxAttempts,
+		LastError:   job.LastError,
+	}
+	if !ret.Status.Finished() {
+		return ret
+	}
+	if len(job.Result) > 0 {
+		var result api.ExecResponse
+		if err := json.Unmarshal(job.Result, &result); err == nil {
+			ret.Result = &result
+			return ret
+		}
+	}
+	ret.Result = &api.ExecResponse{
+		RequestID: job.Id,
+		Errors:    []api.Error{*api.NewError(api.ErrInternal, "the job has no result: %s", job.LastError)},
+	}
+	return ret
+}
+
+// jobVisibleTo checks whether key may see job: only the key which
+// submitted it, or an admin, can.
+func jobVisibleTo(job *models.Job, key *models.APIKey) bool {
+	if job.APIKeyId == nil || key == nil {
+		return job.APIKeyId == nil && key == nil
+	}
+	return *job.APIKeyId == key.Id || key.Scopes.Has(models.ScopeAdmin)
+}
+
+// jobExecution works out what a job should run. Registered functions are
+// looked up each time, so a job runs the function as it is when the job
+// starts.
+func (s *Server) jobExecution(logger *logging.Logger, r *api.JobRequest) (execution, *api.Error) {
+	var ex execution
+	switch {
+	case r.Function != "" && r.Exec == nil:
+		f, apiErr := s.retrieveFunction(logger, r.Function)
+		if apiErr != nil {
+			return execution{}, apiErr
+		}
+		ex, apiErr = functionExecution(f, r.Stdin, r.TimeoutSeconds)
+		if apiErr != nil {
+			return execution{}, apiErr
+		}
+	case r.Function == "" && r.Exec != nil:
+		if !validTimeout(r.Exec.TimeoutSeconds) {
+			return execution{}, api.NewError(api.ErrInvalidTimeout, "timeoutSeconds must be positive, not %v", r.Exec.TimeoutSeconds)
+		}
+		env, apiErr := s.envVars(r.Exec.Env, false)
+		if apiErr != nil {
+			return execution{}, apiErr
+		}
+		ex = execution{
+			FnName:       r.Exec.FnName,
+			Dockerfile:   r.Exec.DockerFile,
+			BuildContext: r.Exec.BuildContext,
+			Stdin:        r.Exec.Stdin,
+			Timeout:      seconds(r.Exec.TimeoutSeconds),
+			Vars:         env,
+
+			SecurityProfile: r.Exec.SecurityProfile,
+			Network:         r.Exec.Network,
+		}
+	default:
+		return execution{}, api.NewError(api.ErrInvalidRequest, "a job needs either a function or exec, but not both")
+	}
+
+	env, apiErr := s.envVars(r.Env, false)
+	if apiErr != nil {
+		return execution{}, apiErr
+	}
+	ex.Vars = append(ex.Vars, env...)
+	return ex, nil
+}
+
+// HandleSubmitJob adds a job to the queue, and responds with 202 and its
+// api.Job (POST /v2/jobs).
+func (s *Server) HandleSubmitJob(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+
+	var r api.JobRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		writeAPIError(w, api.NewError(api.ErrInvalidJSON, "could not decode the request: %s", err))
+		return
+	}
+	ex, apiErr := s.jobExecution(logger, &r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	key := auth.KeyFromContext(req.Context())
+	if r.CallbackURL != "" {
+		if apiErr := s.validCallbackURL(r.CallbackURL, key); apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+	}
+
+	request, err := json.Marshal(r)
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not encode job request")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not queue the job"))
+		return
+	}
+	queued := &models.Job{
+		Id:          logging.NewRequestID(),
+		Function:    ex.FnName,
+		Request:     request,
+		Priority:    r.Priority,
+		CallbackURL: r.CallbackURL,
+	}
+	if key != nil {
+		queued.APIKeyId = &key.Id
+	}
+	queued, err = s.queue.Enqueue(queued)
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not queue job")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not queue the job"))
+		return
+	}
+
+	info := describeJob(queued)
+	s.jobs.attach(info)
+	logger.WithFields(logging.Fields{"job_id": info.ID, "priority": info.Priority}).Infof("Queued job")
+	w.Header().Set("Location", "/v2/jobs/"+info.ID)
+	writeJSON(w, http.StatusAccepted, info)
+}
+
+// jobRunner runs the jobs a Server's queue claims.
+type jobRunner struct {
+	s *Server
+}
+
+// Run makes an attempt at a queued job, reporting its progress as stream
+// events. The attempt's an invocation by the key which submitted the job,
+// with the job's ID as its request ID.
+func (r jobRunner) Run(ctx context.Context, queued *models.Job) queue.Outcome {
+	s := r.s
+	logger := logging.Default().WithFields(logging.Fields{"request_id": queued.Id, "attempt": queued.Attempts})
+	ctx = logging.ContextWithRequestID(ctx, queued.Id)
+	ctx = logging.NewContext(ctx, logger)
+
+	j := s.jobs.attach(describeJob(queued))
+	if queued.APIKeyId != nil {
+		key, err := s.store.RetrieveAPIKeyById(*queued.APIKeyId)
+		if err != nil {
+			logger.WithField("error", err).Errorf("Could not retrieve API key")
+			return jobOutcome(queued.Id, nil, api.NewError(api.ErrInternal, "could not retrieve the submitting API key"))
+		}
+		ctx = auth.ContextWithKey(ctx, key)
+	}
+
+	var request api.JobRequest
+	if err := json.Unmarshal(queued.Request, &request); err != nil {
+		logger.WithField("error", err).Errorf("Could not decode job request")
+		return jobOutcome(queued.Id, nil, api.NewError(api.ErrInvalidRequest, "could not decode the job's request"))
+	}
+	ex, apiErr := s.jobExecution(logger, &request)
+	if apiErr != nil {
+		return jobOutcome(queued.Id, nil, apiErr)
+	}
+
+	j.setStatus(api.JobRunning, nil)
+	ex.Background = true
+	ex.Stdout = jobWriter{j, api.EventStdout}
+	ex.Stderr = jobWriter{j, api.EventStderr}
+	result, apiErr := s.invoke(ctx, ex)
+	return jobOutcome(queued.Id, result, apiErr)
+}
+
+// jobOutcome summarises an attempt at a job for the queue. Attempts which
+// failed because of a problem with the server, rather than the function,
+// are retried.
+func jobOutcome(id string, result *executor.Result, apiErr *api.Error) queue.Outcome {
+	out := execResponse(id, result, apiErr)
+	ret := queue.Outcome{Status: models.JobSucceeded}
+	for _, e := range out.Errors {
+		if e.Code == api.ErrCleanupFailed {
+			continue
+		}
+		if ret.Status == models.JobSucceeded {
+			ret.Status, ret.Error = models.JobFailed, e.Error()
+		}
+		switch e.Code {
+		case api.ErrWorkspace, api.ErrRunFailed, api.ErrInternal:
+			ret.Retry = true
+		}
+	}
+	ret.Result, _ = json.Marshal(out)
+	return ret
+}
+
+// Settled reports a job's new status to anyone streaming it, and once it's
+// finished, delivers it to its callback URL.
+func (r jobRunner) Settled(queued *models.Job, outcome queue.Outcome) {
+	info := describeJob(queued)
+	r.s.jobs.attach(info).setStatus(info.Status, info.Result)
+	if info.Status.Finished() && queued.CallbackURL != "" && queued.APIKeyId != nil {
+		logger := logging.Default().WithField("request_id", queued.Id)
+		r.s.sendCallback(logger, info, *queued.APIKeyId)
+	}
+}
+
+// RunQueue runs queued jobs until ctx is done. Jobs left running when the
+// server last stopped are queued again once their leases expire.
+func (s *Server) RunQueue(ctx context.Context) {
+	s.queue.Run(ctx)
+}
+
+// retrieveJob finds the job named in the URL, as long as the caller can
+// see it.
+func (s *Server) retrieveJob(req *http.Request) (*models.Job, *api.Error) {
+	id := strings.TrimPrefix(req.URL.Path, "/v2/jobs/")
+	for _, suffix := range []string{"/stream", "/requeue", "/deliveries"} {
+		id = strings.TrimSuffix(id, suffix)
+	}
+	queued, err := s.store.RetrieveJob(id)
+	if err == interfaces.NoMatchingJob || (err == nil && !jobVisibleTo(queued, auth.KeyFromContext(req.Context()))) {
+		return nil, api.NewError(api.ErrNotFound, "no job has the ID '%s'", id)
+	} else if err != nil {
+		logging.FromContext(req.Context()).WithField("error", err).Errorf("Could not retrieve job")
+		return nil, api.NewError(api.ErrInternal, "could not retrieve the job")
+	}
+	return queued, nil
+}
+
+// HandleGetJob describes a job (GET /v2/jobs/{id}).
+func (s *Server) HandleGetJob(w http.ResponseWriter, req *http.Request) {
+	queued, apiErr := s.retrieveJob(req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSON(w, http.StatusOK, describeJob(queued))
+}
+
+// HandleListJobs describes the caller's jobs, newest first
+// (GET /v2/jobs). The status parameter picks out jobs with one status,
+// e.g. ?status=dead for the dead letters.
+func (s *Server) HandleListJobs(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+	status := req.URL.Query().Get("status")
+	switch api.JobStatus(status) {
+	case "", api.JobQueued, api.JobRunning, api.JobSucceeded, api.JobFailed, api.JobDead:
+	default:
+		writeAPIError(w, api.NewError(api.ErrInvalidRequest, "'%s' isn't a job status", status))
+		return
+	}
+
+	jobs, err := s.store.RetrieveJobs(status)
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not retrieve jobs")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not retrieve jobs"))
+		return
+	}
+	key := auth.KeyFromContext(req.Context())
+	out := api.JobList{Jobs: make([]api.Job, 0, len(jobs))}
+	for i := range jobs {
+		if jobVisibleTo(&jobs[i], key) {
+			out.Jobs = append(out.Jobs, describeJob(&jobs[i]))
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// HandleRequeueJob queues a dead job again, with all of its attempts, and
+// responds with 202 and its api.Job (POST /v2/jobs/{id}/requeue).
+func (s *Server) HandleRequeueJob(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+	queued, apiErr := s.retrieveJob(req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	err := s.store.RequeueJob(queued.Id)
+	if err == interfaces.NoMatchingJob {
+		writeAPIError(w, api.NewError(api.ErrInvalidRequest, "only dead jobs can be requeued, and job '%s' is %s", queued.Id, queued.Status))
+		return
+	} else if err != nil {
+		logger.WithField("error", err).Errorf("Could not requeue job")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not requeue the job"))
+		return
+	}
+	s.queue.Notify()
+
+	queued, apiErr = s.retrieveJob(req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	info := describeJob(queued)
+	s.jobs.attach(info).setStatus(info.Status, nil)
+	logger.WithField("job_id", info.ID).Infof("Requeued dead job")
+	writeJSON(w, http.StatusAccepted, info)
+}
+
+// HandleStreamJob sends each of a job's api.StreamEvents as a line of JSON,
+// as they happen, finishing with its result (GET /v2/jobs/{id}/stream).
+// Events from before the request are sent first.
+func (s *Server) HandleStreamJob(w http.ResponseWriter, req *http.Request) {
+	queued, apiErr := s.retrieveJob(req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	j := s.jobs.attach(describeJob(queued))
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	sent := 0
+	for {
+		events, updated, finished := j.eventsFrom(sent)
+		for _, e := range events {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+		sent += len(events)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if finished {
+			return
+		}
+
+		select {
+		case <-updated:
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
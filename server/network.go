@@ -0,0 +1,17 @@
+package server
+
+import (
+	"github.com/Sentimentron/functron/api"
+)
+
+// networkMode checks that a function can choose the network mode (or
+// none, if it's empty), returning the mode it gets.
+func (s *Server) networkMode(mode string) (string, *api.Error) {
+	if mode == "" {
+		return s.network.DefaultMode(), nil
+	}
+	if !s.network.Allows(mode) {
+		return "", api.NewError(api.ErrInvalidRequest, "network '%s' isn't allowed", mode)
+	}
+	return mode, nil
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/logging"
+)
+
+// maxPipelineStages is the most functions a pipeline can chain together.
+const maxPipelineStages = 20
+
+// HandlePipeline runs registered functions as a pipeline, streaming each
+// one's standard output into the next one's standard input, and responds
+// with an api.PipelineResponse (POST /v2/pipelines). Stages run at once
+// when there are slots for them. Each stage only asks for a slot once the
+// one before it has one, and never waits for the next stage to read its
+// output, so pipelines can't deadlock waiting for each other's slots.
+func (s *Server) HandlePipeline(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+	out := api.PipelineResponse{
+		RequestID: logging.RequestIDFromContext(req.Context()),
+		Stages:    make([]api.PipelineStage, 0),
+		Errors:    make([]api.Error, 0),
+	}
+
+	returnError := func(err *api.Error) {
+		out.Errors = append(out.Errors, *err)
+		writePipelineResponse(w, &out)
+	}
+
+	var r api.PipelineRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		returnError(api.NewError(api.ErrInvalidJSON, "could not decode the request: %s", err))
+		return
+	}
+	if len(r.Functions) == 0 || len(r.Functions) > maxPipelineStages {
+		returnError(api.NewError(api.ErrInvalidRequest, "a pipeline needs between 1 and %d functions, not %d", maxPipelineStages, len(r.Functions)))
+		return
+	}
+
+	// Check every stage exists before running any of them
+	executions := make([]execution, 0, len(r.Functions))
+	for _, name := range r.Functions {
+		f, apiErr := s.retrieveFunction(logger, name)
+		if apiErr != nil {
+			returnError(apiErr)
+			return
+		}
+		ex, apiErr := functionExecution(f, nil, r.TimeoutSeconds)
+		if apiErr != nil {
+			returnError(apiErr)
+			return
+		}
+		executions = append(executions, ex)
+	}
+
+	stages := s.runPipeline(req.Context(), out.RequestID, executions, r.Stdin)
+	for i, stage := range stages {
+		out.Stages = append(out.Stages, stage.PipelineStage)
+		if stageFailed(stage.Errors) {
+			failed := i
+			out.FailedStage = &failed
+			out.Errors = append(out.Errors, stage.Errors...)
+			logger.WithFields(logging.Fields{"stage": i, "function": stage.Function}).Warnf("Pipeline stage failed")
+			break
+		}
+	}
+	if out.FailedStage == nil {
+		out.Stdout = stages[len(stages)-1].stdout
+	}
+	writePipelineResponse(w, &out)
+}
+
+// pipelineStage is how one stage of a pipeline went, and, for the last
+// stage, its output.
+type pipelineStage struct {
+	api.PipelineStage
+	stdout []byte
+}
+
+// runPipeline runs executions as the stages of a pipeline, the first
+// reading stdin. Once a stage fails, the stages after it are cancelled,
+// and their results shouldn't be reported.
+func (s *Server) runPipeline(ctx context.Context, requestID string, executions []execution, stdin []byte) []pipelineStage {
+	n := len(executions)
+	ret := make([]pipelineStage, n)
+
+	// acquired[i] is closed once stage i-1 has a slot (or has given up on
+	// getting one), so that stage i can ask for one
+	acquired := make([]chan struct{}, n+1)
+	for i := range acquired {
+		acquired[i] = make(chan struct{})
+	}
+	close(acquired[0])
+
+	// pipes[i] carries stage i's output to stage i+1
+	pipes := make([]*stagePipe, n-1)
+	for i := range pipes {
+		pipes[i] = createStagePipe()
+	}
+
+	contexts := make([]context.Context, n)
+	cancels := make([]context.CancelFunc, n)
+	for i := range contexts {
+		contexts[i], cancels[i] = context.WithCancel(ctx)
+		defer cancels[i]()
+	}
+
+	var wg sync.WaitGroup
+	for i := range executions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var once sync.Once
+			next := func() { once.Do(func() { close(acquired[i+1]) }) }
+			defer next()
+			<-acquired[i]
+
+			ex := executions[i]
+			ex.Acquired = next
+			if i == 0 {
+				ex.Stdin = stdin
+			} else {
+				ex.StdinReader = pipes[i-1]
+				defer pipes[i-1].CloseRead()
+			}
+			var written countingWriter
+			if i < n-1 {
+				written.out = pipes[i]
+				ex.Stdout, ex.StreamStdout = &written, true
+				defer pipes[i].CloseWrite()
+			}
+
+			result, apiErr := s.invoke(contexts[i], ex)
+			stageOut := execResponse(requestID, result, apiErr)
+			ret[i] = pipelineStage{
+				PipelineStage: api.PipelineStage{
+					Function:    ex.FnName,
+					ExitCode:    stageOut.ExitCode,
+					StdoutBytes: len(stageOut.Stdout),
+					Stderr:      stageOut.Stderr,
+					Timings:     stageOut.Timings,
+					Errors:      stageOut.Errors,
+				},
+				stdout: stageOut.Stdout,
+			}
+			if i < n-1 {
+				ret[i].StdoutBytes = written.n
+			}
+			if stageFailed(stageOut.Errors) {
+				for j := i + 1; j < n; j++ {
+					cancels[j]()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	return ret
+}
+
+// countingWriter counts what's written to out.
+type countingWriter struct {
+	out io.Writer
+	n   int
+}
+
+// Write implements io.Writer.
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.out.Write(p)
+	w.n += n
+	return n, err
+}
+
+// stagePipe carries one pipeline stage's output to the next. Unlike an
+// io.Pipe, writes never wait for the reader: a stage can finish even if the
+// next one is still waiting for a slot, and what it wrote is held until
+// the next stage reads it.
+type stagePipe struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	buf     bytes.Buffer
+	// closed is set once the writer's done, and abandoned once the reader
+	// is, after which writes are discarded
+	closed    bool
+	abandoned bool
+}
+
+func createStagePipe() *stagePipe {
+	p := &stagePipe{}
+	p.changed = sync.NewCond(&p.lock)
+	return p
+}
+
+// Write implements io.Writer.
+func (p *stagePipe) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.abandoned {
+		p.buf.Write(b)
+		p.changed.Broadcast()
+	}
+	return len(b), nil
+}
+
+// Read implements io.Reader, waiting for the writer if there's nothing to
+// read yet.
+func (p *stagePipe) Read(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for p.buf.Len() == 0 && !p.closed && !p.abandoned {
+		p.changed.Wait()
+	}
+	if p.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return p.buf.Read(b)
+}
+
+// CloseWrite tells the reader there's nothing more to come.
+func (p *stagePipe) CloseWrite() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	p.changed.Broadcast()
+}
+
+// CloseRead discards what's been written, and anything written later.
+func (p *stagePipe) CloseRead() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.abandoned = true
+	p.buf.Reset()
+	p.changed.Broadcast()
+}
+
+// stageFailed checks whether a stage's errors should stop a pipeline.
+// Failing to clean up after a stage which ran doesn't.
+func stageFailed(errors []api.Error) bool {
+	for _, e := range errors {
+		if e.Code != api.ErrCleanupFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// writePipelineResponse sends out with a status code which reflects its
+// errors.
+func writePipelineResponse(w http.ResponseWriter, out *api.PipelineResponse) {
+	setRetryAfter(w, out.Errors)
+	writeJSON(w, statusFor(out.Errors), out)
+}
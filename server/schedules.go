@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/auth"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/models"
+	"github.com/Sentimentron/functron/schedule"
+)
+
+// scheduleInfo describes sc for API responses.
+func scheduleInfo(sc *models.Schedule) api.Schedule {
+	return api.Schedule{
+		Name:            sc.Name,
+		Cron:            sc.Cron,
+		Function:        sc.Function,
+		Stdin:           sc.Stdin,
+		TimeoutSeconds:  sc.TimeoutSeconds,
+		Enabled:         sc.Enabled,
+		SkipOverlapping: sc.SkipOverlapping,
+		Created:         sc.Created,
+		Updated:         sc.Updated,
+		LastRun:         sc.LastRun,
+		NextRun:         sc.NextRun,
+	}
+}
+
+// HandleListSchedules lists schedules (GET /v2/schedules).
+func (s *Server) HandleListSchedules(w http.ResponseWriter, req *http.Request) {
+	schedules, err := s.store.RetrieveSchedules()
+	if err != nil {
+		logging.FromContext(req.Context()).WithField("error", err).Errorf("Could not list schedules")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not list schedules"))
+		return
+	}
+	out := api.ScheduleList{Schedules: make([]api.Schedule, 0, len(schedules))}
+	for i := range schedules {
+		out.Schedules = append(out.Schedules, scheduleInfo(&schedules[i]))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// HandleSaveSchedule saves a schedule, replacing any with the same name
+// (POST /v2/schedules). Its runs are made by the key which saved it.
+func (s *Server) HandleSaveSchedule(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+
+	var r api.ScheduleRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		writeAPIError(w, api.NewError(api.ErrInvalidJSON, "could not decode the request: %s", err))
+		return
+	}
+	if !models.ValidFunctionName(r.Name) {
+		writeAPIError(w, api.NewError(api.ErrInvalidRequest, "'%s' isn't a valid schedule name", r.Name))
+		return
+	}
+	if r.TimeoutSeconds != 0 && !validTimeout(r.TimeoutSeconds) {
+		writeAPIError(w, api.NewError(api.ErrInvalidTimeout, "timeoutSeconds must be positive, not %v", r.TimeoutSeconds))
+		return
+	}
+	if _, apiErr := s.retrieveFunction(logger, r.Function); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	sc := &models.Schedule{
+		Name:            r.Name,
+		Cron:            r.Cron,
+		Function:        r.Function,
+		Stdin:           r.Stdin,
+		TimeoutSeconds:  r.TimeoutSeconds,
+		Enabled:         r.Enabled == nil || *r.Enabled,
+		SkipOverlapping: r.SkipOverlapping,
+	}
+	next, err := schedule.NextRun(r.Cron, time.Now())
+	if err != nil {
+		writeAPIError(w, api.NewError(api.ErrInvalidRequest, "invalid cron expression '%s': %s", r.Cron, err))
+		return
+	}
+	if sc.Enabled {
+		sc.NextRun = next
+	}
+	if key := auth.KeyFromContext(req.Context()); key != nil {
+		sc.APIKeyId = &key.Id
+	}
+
+	sc, err = s.store.SaveSchedule(sc)
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not save schedule")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not save the schedule"))
+		return
+	}
+	logger.WithFields(logging.Fields{"schedule": sc.Name, "function": sc.Function}).Infof("Saved schedule")
+	writeJSON(w, http.StatusCreated, scheduleInfo(sc))
+}
+
+// scheduleName extracts {name} from /v2/schedules/{name}.
+func scheduleName(path string) string {
+	return strings.TrimPrefix(path, "/v2/schedules/")
+}
+
+// HandleGetSchedule describes a schedule (GET /v2/schedules/{name}).
+func (s *Server) HandleGetSchedule(w http.ResponseWriter, req *http.Request) {
+	name := scheduleName(req.URL.Path)
+	sc, err := s.store.RetrieveScheduleByName(name)
+	if err == interfaces.NoMatchingSchedule {
+		writeAPIError(w, api.NewError(api.ErrNotFound, "no schedule is called '%s'", name))
+		return
+	} else if err != nil {
+		logging.FromContext(req.Context()).WithField("error", err).Errorf("Could not retrieve schedule")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not retrieve the schedule"))
+		return
+	}
+	writeJSON(w, http.StatusOK, scheduleInfo(sc))
+}
+
+// HandleDeleteSchedule removes a schedule (DELETE /v2/schedules/{name}).
+// Runs which have already started carry on.
+func (s *Server) HandleDeleteSchedule(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+	name := scheduleName(req.URL.Path)
+
+	err := s.store.DeleteSchedule(name)
+	if err == interfaces.NoMatchingSchedule {
+		writeAPIError(w, api.NewError(api.ErrNotFound, "no schedule is called '%s'", name))
+		return
+	} else if err != nil {
+		logger.WithField("error", err).Errorf("Could not delete schedule")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not delete the schedule"))
+		return
+	}
+	logger.WithField("schedule", name).Infof("Deleted schedule")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runSchedule invokes sc's function once, as the key which saved it. Like
+// any other invocation, it's recorded in the invocation history.
+func (s *Server) runSchedule(ctx context.Context, sc *models.Schedule) {
+	out := s.invokeAs(ctx, sc.APIKeyId, sc.Function, sc.Stdin, sc.TimeoutSeconds)
+	logger := logging.FromContext(ctx).WithField("request_id", out.RequestID)
+	if len(out.Errors) > 0 {
+		logger.WithField("error", out.Errors[0].Message).Warnf("Scheduled run failed")
+		return
+	}
+	logger.Infof("Scheduled run finished")
+}
+
+// RunScheduler triggers schedules as they fall due, until ctx is done.
+func (s *Server) RunScheduler(ctx context.Context) {
+	s.scheduler.Run(ctx)
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/models"
+	"github.com/Sentimentron/functron/secrets"
+)
+
+// secretInfo describes secret for API responses, without its value.
+func secretInfo(secret *models.Secret) api.Secret {
+	return api.Secret{Name: secret.Name, Created: secret.Created, Updated: secret.Updated}
+}
+
+// secretName extracts {name} from /v2/secrets/{name}.
+func secretName(path string) string {
+	return strings.TrimPrefix(path, "/v2/secrets/")
+}
+
+// secretsDisabled describes a request which needs secrets, when no master
+// key is configured.
+func secretsDisabled() *api.Error {
+	return api.NewError(api.ErrInvalidRequest, "secrets can't be used, since the server has no secretsKey")
+}
+
+// HandleListSecrets lists stored secrets, without their values
+// (GET /v2/secrets).
+func (s *Server) HandleListSecrets(w http.ResponseWriter, req *http.Request) {
+	stored, err := s.store.RetrieveSecrets()
+	if err != nil {
+		logging.FromContext(req.Context()).WithField("error", err).Errorf("Could not list secrets")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not list secrets"))
+		return
+	}
+	out := api.SecretList{Secrets: make([]api.Secret, 0, len(stored))}
+	for i := range stored {
+		out.Secrets = append(out.Secrets, secretInfo(&stored[i]))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// HandlePutSecret encrypts and stores a secret, replacing any with the
+// same name (PUT /v2/secrets/{name}).
+//
+// Only functions can use secrets, so whoever can register functions can
+// read every secret, e.g. by printing it in some other form: redaction
+// only replaces the exact value. The secrets key only protects secrets
+// stored in the database, not from anyone who can run the server.
+func (s *Server) HandlePutSecret(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+	name := secretName(req.URL.Path)
+
+	if s.secrets == nil {
+		writeAPIError(w, secretsDisabled())
+		return
+	}
+	if !models.ValidSecretName(name) {
+		writeAPIError(w, api.NewError(api.ErrInvalidRequest, "'%s' isn't a valid secret name", name))
+		return
+	}
+	var r api.PutSecretRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		writeAPIError(w, api.NewError(api.ErrInvalidJSON, "could not decode the request: %s", err))
+		return
+	}
+	if r.Value == "" {
+		writeAPIError(w, api.NewError(api.ErrInvalidRequest, "a secret can't be empty"))
+		return
+	}
+
+	sealed, err := s.secrets.Seal(name, []byte(r.Value))
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not encrypt secret")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not encrypt the secret"))
+		return
+	}
+	secret, err := s.store.SaveSecret(&models.Secret{Name: name, Sealed: sealed})
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not store secret")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not store the secret"))
+		return
+	}
+	logger.WithField("secret", name).Infof("Stored secret")
+	writeJSON(w, http.StatusOK, secretInfo(secret))
+}
+
+// HandleDeleteSecret removes a secret (DELETE /v2/secrets/{name}).
+// Functions which use it can't be invoked until it's stored again.
+func (s *Server) HandleDeleteSecret(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+	name := secretName(req.URL.Path)
+
+	err := s.store.DeleteSecret(name)
+	if err == interfaces.NoMatchingSecret {
+		writeAPIError(w, api.NewError(api.ErrNotFound, "no secret is stored as '%s'", name))
+		return
+	} else if err != nil {
+		logger.WithField("error", err).Errorf("Could not delete secret")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not delete the secret"))
+		return
+	}
+	logger.WithField("secret", name).Infof("Deleted secret")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// envVars converts environment variables from a request, checking that
+// they're valid. Only requests which register functions can use secrets.
+// It doesn't check that their secrets exist, since they can be stored
+// later.
+func (s *Server) envVars(vars []api.EnvVar, allowSecrets bool) (models.EnvVars, *api.Error) {
+	ret := make(models.EnvVars, 0, len(vars))
+	for _, v := range vars {
+		if !models.ValidEnvName(v.Name) {
+			return nil, api.NewError(api.ErrInvalidRequest, "'%s' isn't a valid environment variable name", v.Name)
+		}
+		if strings.ContainsAny(v.Value, "\r\n") {
+			return nil, api.NewError(api.ErrInvalidRequest, "%s's value can't contain line breaks", v.Name)
+		}
+		if v.Secret != "" {
+			if !allowSecrets {
+				return nil, api.NewError(api.ErrInvalidRequest, "%s: secrets can only be used by registered functions", v.Name)
+			}
+			if v.Value != "" {
+				return nil, api.NewError(api.ErrInvalidRequest, "%s can have a value or a secret, but not both", v.Name)
+			}
+			if s.secrets == nil {
+				return nil, secretsDisabled()
+			}
+			if !models.ValidSecretName(v.Secret) {
+				return nil, api.NewError(api.ErrInvalidRequest, "'%s' isn't a valid secret name", v.Secret)
+			}
+		}
+		ret = append(ret, models.EnvVar{Name: v.Name, Value: v.Value, Secret: v.Secret})
+	}
+	return ret, nil
+}
+
+// envInfo describes environment variables for API responses. Secrets are
+// described by name.
+func envInfo(vars models.EnvVars) []api.EnvVar {
+	ret := make([]api.EnvVar, 0, len(vars))
+	for _, v := range vars {
+		ret = append(ret, api.EnvVar{Name: v.Name, Value: v.Value, Secret: v.Secret})
+	}
+	return ret
+}
+
+// environment resolves vars into "KEY=value" form, decrypting any secrets,
+// and returns a Redactor for the secrets' values. Where a name's declared
+// more than once, the last declaration wins.
+func (s *Server) environment(logger *logging.Logger, vars models.EnvVars) ([]string, *secrets.Redactor, *api.Error) {
+	order := make([]string, 0, len(vars))
+	values := make(map[string]string, len(vars))
+	secretValues := make(map[string]string)
+	for _, v := range vars {
+		if _, ok := values[v.Name]; !ok {
+			order = append(order, v.Name)
+		}
+		delete(secretValues, v.Name)
+		values[v.Name] = v.Value
+		if v.Secret == "" {
+			continue
+		}
+
+		if s.secrets == nil {
+			return nil, nil, secretsDisabled()
+		}
+		secret, err := s.store.RetrieveSecretByName(v.Secret)
+		if err == interfaces.NoMatchingSecret {
+			return nil, nil, api.NewError(api.ErrInvalidRequest, "no secret is stored as '%s'", v.Secret)
+		} else if err != nil {
+			logger.WithField("error", err).Errorf("Could not retrieve secret")
+			return nil, nil, api.NewError(api.ErrInternal, "could not retrieve secret '%s'", v.Secret)
+		}
+		value, err := s.secrets.Open(secret.Name, secret.Sealed)
+		if err != nil {
+			logger.WithFields(logging.Fields{"secret": secret.Name, "error": err}).Errorf("Could not decrypt secret")
+			return nil, nil, api.NewError(api.ErrInternal, "could not decrypt secret '%s'", v.Secret)
+		}
+		values[v.Name] = string(value)
+		secretValues[v.Name] = string(value)
+	}
+
+	env := make([]string, 0, len(order))
+	for _, name := range order {
+		env = append(env, fmt.Sprintf("%s=%s", name, values[name]))
+	}
+	redact := make([]string, 0, len(secretValues))
+	for _, v := range secretValues {
+		redact = append(redact, v)
+	}
+	return env, secrets.CreateRedactor(redact), nil
+}
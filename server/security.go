@@ -0,0 +1,21 @@
+package server
+
+import (
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/policy"
+)
+
+// securityFor works out how to confine a function which chose the named
+// security profile (or none, if it's empty). The server's own profile
+// still applies, so a function can only make itself more restricted.
+func (s *Server) securityFor(profile string) (interfaces.Security, *api.Error) {
+	if profile == "" {
+		return policy.Security(s.security), nil
+	}
+	chosen, ok := s.securityProfiles[profile]
+	if !ok {
+		return interfaces.Security{}, api.NewError(api.ErrInvalidRequest, "no security profile is configured as '%s'", profile)
+	}
+	return policy.Security(policy.Tighten(s.security, chosen)), nil
+}
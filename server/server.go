@@ -0,0 +1,281 @@
+// Package server implements Functron's HTTP API.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/auth"
+	"github.com/Sentimentron/functron/configuration"
+	"github.com/Sentimentron/functron/database"
+	"github.com/Sentimentron/functron/executor"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/library"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/metrics"
+	"github.com/Sentimentron/functron/models"
+	"github.com/Sentimentron/functron/queue"
+	"github.com/Sentimentron/functron/quota"
+	"github.com/Sentimentron/functron/schedule"
+	"github.com/Sentimentron/functron/secrets"
+	"github.com/Sentimentron/functron/slots"
+	"github.com/Sentimentron/functron/warmpool"
+	"github.com/Sentimentron/functron/webhook"
+	"github.com/Sentimentron/functron/workflow"
+)
+
+// Server holds everything Functron's HTTP handlers share.
+type Server struct {
+	store            *database.Store
+	runtime          interfaces.ContainerRuntime
+	executor         *executor.Executor
+	slots            *slots.Pool
+	limiter          *quota.Limiter
+	auth             *auth.Authenticator
+	dockerfilePolicy *configuration.DockerfilePolicy
+	jobs             *jobTable
+	images           *library.DockerImageLibrary
+	imageGC          configuration.ImageGCConfig
+	// warm is nil unless the configuration has a WarmPool
+	warm      *warmpool.Pool
+	workflows *workflow.Engine
+	scheduler *schedule.Scheduler
+	webhooks  *webhook.Dispatcher
+	queue     *queue.Queue
+	// secrets is nil unless the configuration has a SecretsKey
+	secrets *secrets.Cipher
+	// security confines every container, and securityProfiles can confine
+	// a function's further
+	security         configuration.SecurityProfile
+	securityProfiles map[string]configuration.SecurityProfile
+	network          configuration.NetworkConfig
+	// httpPrefix is where registered functions are served as plain HTTP
+	// endpoints, e.g. "/fn/"
+	httpPrefix string
+}
+
+// CreateServer returns a Server which records everything in store and runs
+// functions on runtime.
+func CreateServer(c *configuration.Configuration, store *database.Store, runtime interfaces.ContainerRuntime) *Server {
+	s := &Server{
+		store:            store,
+		runtime:          runtime,
+		executor:         executor.CreateExecutor(runtime),
+		slots:            slots.CreatePool(c.Slots, c.InteractiveSlots),
+		limiter:          quota.CreateLimiter(store),
+		auth:             auth.CreateAuthenticator(store),
+		dockerfilePolicy: c.DockerfilePolicy,
+		jobs:             createJobTable(),
+		images:           library.CreateDockerImageLibrary(runtime),
+		imageGC:          c.ImageGC,
+		httpPrefix:       httpFunctionPath(c.HTTPPrefix),
+		security:         c.Security,
+		securityProfiles: c.SecurityProfiles,
+		network:          c.Network,
+	}
+	s.executor.IsolatedNetworkPrefix = c.Network.IsolatedNetworkPrefix()
+	s.executor.Images = store
+	s.images.Usage = store
+	if s.imageGC.IntervalSeconds == 0 {
+		s.imageGC.IntervalSeconds = 300
+	}
+	if s.imageGC.MinIdleSeconds == 0 {
+		s.imageGC.MinIdleSeconds = 600
+	}
+	if s.imageGC.LeakSeconds == 0 {
+		s.imageGC.LeakSeconds = 3600
+	}
+	if c.SecretsKey != "" {
+		cipher, err := secrets.CreateCipher(c.SecretsKey)
+		if err != nil {
+			logging.Default().WithField("error", err).Errorf("Could not use the secretsKey, so secrets are disabled")
+		}
+		s.secrets = cipher
+	}
+	if c.WarmPool != nil {
+		s.warm = warmpool.CreatePool(s.executor, s.images, *c.WarmPool)
+		go s.warm.Maintain(context.Background())
+	}
+	s.workflows = workflow.CreateEngine(store, s.invokeForWorkflow, s.slots.Size())
+	s.scheduler = schedule.CreateScheduler(store, s.runSchedule)
+	s.webhooks = webhook.CreateDispatcher(store, c.Webhooks)
+	s.queue = queue.CreateQueue(store, jobRunner{s}, c.Queue, s.slots.Size())
+	return s
+}
+
+// Slots returns how many functions can be built and run at once.
+func (s *Server) Slots() int {
+	return s.slots.Size()
+}
+
+// Handler returns an http.Handler which serves every route.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/exec", s.auth.Require(models.ScopeExec, s.ExecuteFunction))
+	mux.HandleFunc("/v2/exec", s.auth.Require(models.ScopeExec, s.HandleExec))
+	mux.HandleFunc("/v2/batch", byMethod(map[string]http.HandlerFunc{
+		"POST": s.auth.Require(models.ScopeExec, s.HandleBatch),
+	}))
+	mux.HandleFunc("/v2/functions", byMethod(map[string]http.HandlerFunc{
+		"GET":  s.auth.Require(models.ScopeExec, s.HandleListFunctions),
+		"POST": s.auth.Require(models.ScopeRegisterFunctions, s.HandleRegisterFunction),
+	}))
+	function := byMethod(map[string]http.HandlerFunc{
+		"GET":    s.auth.Require(models.ScopeExec, s.HandleGetFunction),
+		"DELETE": s.auth.Require(models.ScopeRegisterFunctions, s.HandleDeleteFunction),
+	})
+	invoke := byMethod(map[string]http.HandlerFunc{
+		"POST": s.auth.Require(models.ScopeExec, s.HandleInvoke),
+	})
+	mux.HandleFunc("/v2/functions/", func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/invoke") {
+			invoke(w, req)
+		} else {
+			function(w, req)
+		}
+	})
+	mux.HandleFunc(s.httpPrefix, s.auth.RequireAllowingURLKey(models.ScopeExec, s.HandleHTTPFunction))
+	mux.HandleFunc("/v2/pipelines", byMethod(map[string]http.HandlerFunc{
+		"POST": s.auth.Require(models.ScopeExec, s.HandlePipeline),
+	}))
+	mux.HandleFunc("/v2/workflows", byMethod(map[string]http.HandlerFunc{
+		"POST": s.auth.Require(models.ScopeExec, s.HandleSubmitWorkflow),
+	}))
+	mux.HandleFunc("/v2/workflows/", byMethod(map[string]http.HandlerFunc{
+		"GET": s.auth.Require(models.ScopeExec, s.HandleGetWorkflow),
+	}))
+	mux.HandleFunc("/v2/schedules", byMethod(map[string]http.HandlerFunc{
+		"GET":  s.auth.Require(models.ScopeExec, s.HandleListSchedules),
+		"POST": s.auth.Require(models.ScopeRegisterFunctions, s.HandleSaveSchedule),
+	}))
+	mux.HandleFunc("/v2/schedules/", byMethod(map[string]http.HandlerFunc{
+		"GET":    s.auth.Require(models.ScopeExec, s.HandleGetSchedule),
+		"DELETE": s.auth.Require(models.ScopeRegisterFunctions, s.HandleDeleteSchedule),
+	}))
+	mux.HandleFunc("/v2/jobs", byMethod(map[string]http.HandlerFunc{
+		"GET":  s.auth.Require(models.ScopeExec, s.HandleListJobs),
+		"POST": s.auth.Require(models.ScopeExec, s.HandleSubmitJob),
+	}))
+	getJob := byMethod(map[string]http.HandlerFunc{
+		"GET": s.auth.Require(models.ScopeExec, s.HandleGetJob),
+	})
+	streamJob := byMethod(map[string]http.HandlerFunc{
+		"GET": s.auth.Require(models.ScopeExec, s.HandleStreamJob),
+	})
+	jobDeliveries := byMethod(map[string]http.HandlerFunc{
+		"GET": s.auth.Require(models.ScopeExec, s.HandleJobDeliveries),
+	})
+	requeueJob := byMethod(map[string]http.HandlerFunc{
+		"POST": s.auth.Require(models.ScopeExec, s.HandleRequeueJob),
+	})
+	mux.HandleFunc("/v2/jobs/", func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/stream"):
+			streamJob(w, req)
+		case strings.HasSuffix(req.URL.Path, "/deliveries"):
+			jobDeliveries(w, req)
+		case strings.HasSuffix(req.URL.Path, "/requeue"):
+			requeueJob(w, req)
+		default:
+			getJob(w, req)
+		}
+	})
+	mux.HandleFunc("/v2/webhooks/secret", byMethod(map[string]http.HandlerFunc{
+		"GET":  s.auth.Require(models.ScopeExec, s.HandleWebhookSecret),
+		"POST": s.auth.Require(models.ScopeExec, s.HandleWebhookSecret),
+	}))
+	mux.HandleFunc("/v2/secrets", byMethod(map[string]http.HandlerFunc{
+		"GET": s.auth.Require(models.ScopeManageSecrets, s.HandleListSecrets),
+	}))
+	mux.HandleFunc("/v2/secrets/", byMethod(map[string]http.HandlerFunc{
+		"PUT":    s.auth.Require(models.ScopeManageSecrets, s.HandlePutSecret),
+		"DELETE": s.auth.Require(models.ScopeManageSecrets, s.HandleDeleteSecret),
+	}))
+	mux.HandleFunc("/v2/images", byMethod(map[string]http.HandlerFunc{
+		"GET": s.auth.Require(models.ScopeAdmin, s.HandleListImages),
+	}))
+	mux.HandleFunc("/v2/images/gc", byMethod(map[string]http.HandlerFunc{
+		"POST": s.auth.Require(models.ScopeAdmin, s.HandleCollectGarbage),
+	}))
+	image := byMethod(map[string]http.HandlerFunc{
+		"GET":    s.auth.Require(models.ScopeAdmin, s.HandleGetImage),
+		"PATCH":  s.auth.Require(models.ScopeAdmin, s.HandleUpdateImage),
+		"DELETE": s.auth.Require(models.ScopeAdmin, s.HandleRemoveImage),
+	})
+	imageHistory := byMethod(map[string]http.HandlerFunc{
+		"GET": s.auth.Require(models.ScopeAdmin, s.HandleImageHistory),
+	})
+	mux.HandleFunc("/v2/images/", func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/history") {
+			imageHistory(w, req)
+		} else {
+			image(w, req)
+		}
+	})
+	mux.HandleFunc("/v1/admin/keys", s.auth.Require(models.ScopeAdmin, s.HandleKeys))
+	mux.HandleFunc("/v1/admin/keys/", s.auth.Require(models.ScopeAdmin, s.HandleKey))
+	mux.HandleFunc("/v1/admin/invocations", s.auth.Require(models.ScopeAdmin, s.HandleInvocations))
+	mux.HandleFunc("/v1/admin/tenants", s.auth.Require(models.ScopeAdmin, s.HandleTenants))
+	mux.HandleFunc("/v1/admin/tenants/", s.auth.Require(models.ScopeAdmin, s.HandleTenant))
+	mux.HandleFunc("/v1/usage", s.auth.Require(models.ScopeAdmin, s.HandleUsage))
+	mux.HandleFunc("/v1/ping", HandlePing)
+	mux.Handle("/metrics", metrics.Handler())
+	return logRequest(mux)
+}
+
+// byMethod dispatches each request to the handler for its method, or
+// responds with 405.
+func byMethod(handlers map[string]http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		handler, ok := handlers[req.Method]
+		if !ok {
+			writeAPIError(w, api.NewError(api.ErrMethodNotAllowed, "%s isn't supported here", req.Method))
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// writeJSON sends v as the response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeErrors(w http.ResponseWriter, status int, errors ...string) {
+	writeJSON(w, status, map[string]interface{}{"Errors": errors})
+}
+
+// HandlePing deliberately does nothing and just returns a status code of 200.
+// It's here so that clients can check that they can see Functron.
+func HandlePing(w http.ResponseWriter, req *http.Request) {
+
+}
+
+// logRequest assigns each request an ID (taken from the X-Request-ID header
+// if the client sent a usable one), echoes it back in the response, and
+// attaches a logger carrying it to the request's context.
+func logRequest(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(logging.RequestIDHeader)
+		if !logging.ValidRequestID(requestID) {
+			requestID = logging.NewRequestID()
+		}
+		w.Header().Set(logging.RequestIDHeader, requestID)
+
+		logger := logging.Default().WithField("request_id", requestID)
+		logger.WithFields(logging.Fields{
+			"remote": r.RemoteAddr,
+			"method": r.Method,
+			"url":    auth.RedactURL(r.URL),
+		}).Infof("Request received")
+
+		ctx := logging.ContextWithRequestID(r.Context(), requestID)
+		ctx = logging.NewContext(ctx, logger)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,1185 @@
+package server
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/auth"
+	"github.com/Sentimentron/functron/configuration"
+	"github.com/Sentimentron/functron/database"
+	"github.com/Sentimentron/functron/docker/dockertest"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/library"
+	"github.com/Sentimentron/functron/metrics"
+	"github.com/Sentimentron/functron/models"
+	"github.com/Sentimentron/functron/slots"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// emptyContext is a tar file with nothing in it.
+func emptyContext() []byte {
+	var buf bytes.Buffer
+	tar.NewWriter(&buf).Close()
+	return buf.Bytes()
+}
+
+// createTestServer returns a Server backed by a new database and runtime,
+// and an API key which can use it.
+func createTestServer(runtime *dockertest.FakeRuntime) (*Server, string) {
+	tmpFile, err := ioutil.TempFile("", "functronserver")
+	So(err, ShouldBeNil)
+	os.Remove(tmpFile.Name())
+	store, err := database.CreateStore(tmpFile.Name())
+	So(err, ShouldBeNil)
+
+	c := &configuration.Configuration{
+		DockerfilePolicy: &configuration.DefaultDockerfilePolicy,
+		SecretsKey:       testSecretsKey,
+	}
+	key, _, err := auth.IssueKey(store, "tests", models.Scopes{models.ScopeExec, models.ScopeAdmin}, nil)
+	So(err, ShouldBeNil)
+	return CreateServer(c, store, runtime), key
+}
+
+// testSecretsKey is the master key test servers encrypt secrets with.
+var testSecretsKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+
+func post(handler http.Handler, key, path string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	req.Header.Set(auth.APIKeyHeader, key)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestExecV2(t *testing.T) {
+	Convey("Given a server with a fake runtime...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		s, key := createTestServer(runtime)
+		handler := s.Handler()
+
+		exec := func(r api.ExecRequest) (int, api.ExecResponse) {
+			body, err := json.Marshal(r)
+			So(err, ShouldBeNil)
+			w := post(handler, key, "/v2/exec", body)
+			var out api.ExecResponse
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			return w.Code, out
+		}
+		r := api.ExecRequest{
+			FnName:         "echo",
+			DockerFile:     "FROM alpine\nCMD cat\n",
+			BuildContext:   emptyContext(),
+			Stdin:          []byte("hello"),
+			TimeoutSeconds: 5,
+		}
+
+		Convey("A successful function should return its output...", func() {
+			status, out := exec(r)
+			So(status, ShouldEqual, http.StatusOK)
+			So(out.Errors, ShouldBeEmpty)
+			So(string(out.Stdout), ShouldEqual, "hello")
+			So(*out.ExitCode, ShouldEqual, 0)
+			So(out.RequestID, ShouldNotEqual, "")
+			So(out.Image, ShouldNotEqual, "")
+		})
+
+		Convey("Its temporary images shouldn't be recorded, however many times it runs...", func() {
+			for i := 0; i < 3; i++ {
+				status, _ := exec(r)
+				So(status, ShouldEqual, http.StatusOK)
+			}
+			names, err := s.store.RetrieveImages()
+			So(err, ShouldBeNil)
+			So(names, ShouldBeEmpty)
+		})
+
+		Convey("It should be counted as an ad-hoc invocation, not by its name...", func() {
+			counter := metrics.Invocations.WithLabelValues(metrics.FunctionAdHoc, metrics.OutcomeSuccess)
+			before := testutil.ToFloat64(counter)
+			r.FnName = "unregistered-echo"
+			status, _ := exec(r)
+			So(status, ShouldEqual, http.StatusOK)
+			So(testutil.ToFloat64(counter), ShouldEqual, before+1)
+			So(metrics.Invocations.DeleteLabelValues(r.FnName, metrics.OutcomeSuccess), ShouldBeFalse)
+		})
+
+		Convey("Empty fields should still be present...", func() {
+			r.Stdin = nil
+			body, _ := json.Marshal(r)
+			w := post(handler, key, "/v2/exec", body)
+			var raw map[string]interface{}
+			So(json.NewDecoder(w.Body).Decode(&raw), ShouldBeNil)
+			So(raw["stdout"], ShouldEqual, "")
+			So(raw["stderr"], ShouldEqual, "")
+			So(raw["errors"], ShouldResemble, []interface{}{})
+		})
+
+		Convey("A build failure should be a 422 in the build phase...", func() {
+			runtime.FailBuild = true
+			status, out := exec(r)
+			So(status, ShouldEqual, http.StatusUnprocessableEntity)
+			So(out.Errors[0].Code, ShouldEqual, api.ErrBuildFailed)
+			So(out.Errors[0].Phase, ShouldEqual, api.PhaseBuild)
+			So(out.ExitCode, ShouldBeNil)
+			So(string(out.Build.Stderr), ShouldEqual, "build failed\n")
+		})
+
+		Convey("A non-zero exit should still be a 200...", func() {
+			runtime.RunFunc = dockertest.Exit(2, "oops")
+			status, out := exec(r)
+			So(status, ShouldEqual, http.StatusOK)
+			So(out.Errors[0].Code, ShouldEqual, api.ErrNonZeroExit)
+			So(*out.ExitCode, ShouldEqual, 2)
+		})
+
+		Convey("A timeout should be a 504...", func() {
+			runtime.RunFunc = dockertest.Sleep
+			r.TimeoutSeconds = 0.01
+			status, out := exec(r)
+			So(status, ShouldEqual, http.StatusGatewayTimeout)
+			So(out.Errors[0].Code, ShouldEqual, api.ErrTimeout)
+		})
+
+		Convey("A Dockerfile which breaks the policy should be a 422...", func() {
+			r.DockerFile = "FROM alpine\nADD . /\n"
+			status, out := exec(r)
+			So(status, ShouldEqual, http.StatusUnprocessableEntity)
+			So(out.Errors[0].Code, ShouldEqual, api.ErrPolicyViolation)
+			So(out.Errors[0].PolicyViolations, ShouldNotBeEmpty)
+			So(runtime.BuildCount(), ShouldEqual, 0)
+		})
+
+		Convey("A missing timeout should be a 400 in the decode phase...", func() {
+			r.TimeoutSeconds = 0
+			status, out := exec(r)
+			So(status, ShouldEqual, http.StatusBadRequest)
+			So(out.Errors[0].Code, ShouldEqual, api.ErrInvalidTimeout)
+			So(out.Errors[0].Phase, ShouldEqual, api.PhaseDecode)
+		})
+
+		Convey("Invalid JSON should be a 400...", func() {
+			w := post(handler, key, "/v2/exec", []byte("{"))
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func TestBatch(t *testing.T) {
+	Convey("Given a server with a fake runtime...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		s, key := createTestServer(runtime)
+		handler := s.Handler()
+
+		batch := func(r api.BatchRequest) (int, api.BatchResponse) {
+			body, err := json.Marshal(r)
+			So(err, ShouldBeNil)
+			w := post(handler, key, "/v2/batch", body)
+			var out api.BatchResponse
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			return w.Code, out
+		}
+		r := api.BatchRequest{
+			FnName:         "echo",
+			DockerFile:     "FROM alpine\nCMD cat\n",
+			BuildContext:   emptyContext(),
+			Inputs:         []api.Bytes{[]byte("one"), []byte("two"), []byte("three")},
+			TimeoutSeconds: 5,
+		}
+
+		Convey("Each input should be run once, against a single build...", func() {
+			status, out := batch(r)
+			So(status, ShouldEqual, http.StatusOK)
+			So(out.Errors, ShouldBeEmpty)
+			So(out.Results, ShouldHaveLength, 3)
+			for i, input := range r.Inputs {
+				So(string(out.Results[i].Stdout), ShouldEqual, string(input))
+				So(*out.Results[i].ExitCode, ShouldEqual, 0)
+			}
+			So(runtime.BuildCount(), ShouldEqual, 1)
+			So(runtime.RunCount(), ShouldEqual, 3)
+			So(runtime.Images, ShouldBeEmpty)
+		})
+
+		Convey("Inputs which fail should be reported individually...", func() {
+			runtime.RunFunc = func(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+				stdin, _ := ioutil.ReadAll(spec.Stdin)
+				if string(stdin) == "two" {
+					return dockertest.Exit(1, "no")(ctx, spec)
+				}
+				return 0, nil
+			}
+			status, out := batch(r)
+			So(status, ShouldEqual, http.StatusOK)
+			So(out.Results[0].Errors, ShouldBeEmpty)
+			So(out.Results[1].Errors[0].Code, ShouldEqual, api.ErrNonZeroExit)
+			So(string(out.Results[1].Stderr), ShouldEqual, "no")
+			So(out.Results[2].Errors, ShouldBeEmpty)
+		})
+
+		Convey("A failed build should have no results...", func() {
+			runtime.FailBuild = true
+			status, out := batch(r)
+			So(status, ShouldEqual, http.StatusUnprocessableEntity)
+			So(out.Errors[0].Code, ShouldEqual, api.ErrBuildFailed)
+			So(out.Results, ShouldBeEmpty)
+			So(runtime.RunCount(), ShouldEqual, 0)
+		})
+
+		Convey("A batch with no inputs should be rejected...", func() {
+			r.Inputs = nil
+			status, out := batch(r)
+			So(status, ShouldEqual, http.StatusBadRequest)
+			So(out.Errors[0].Code, ShouldEqual, api.ErrInvalidRequest)
+		})
+	})
+}
+
+func TestPipelines(t *testing.T) {
+	Convey("Given a server with two slots, and functions which produce and consume output...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		s, key := createTestServer(runtime)
+		s.slots = slots.CreatePool(make([]configuration.SlotConfig, 2), 0)
+		handler := s.Handler()
+		for _, name := range []string{"produce", "consume", "fail"} {
+			_, err := s.store.SaveFunction(&models.Function{Name: name, Dockerfile: "FROM alpine\nCMD ./" + name + "\n", TimeoutSeconds: 5})
+			So(err, ShouldBeNil)
+		}
+
+		// produce only writes its second line once consume has read its
+		// first, which it can only do if the two run at once
+		read := make(chan struct{})
+		var once sync.Once
+		readFirst := func() { once.Do(func() { close(read) }) }
+		runtime.RunFunc = func(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+			switch {
+			case strings.HasPrefix(spec.Image, "functron-produce-"):
+				fmt.Fprintln(spec.Stdout, "first")
+				select {
+				case <-read:
+				case <-time.After(time.Second):
+					return 1, nil
+				}
+				fmt.Fprintln(spec.Stdout, "second")
+			case strings.HasPrefix(spec.Image, "functron-consume-"):
+				lines := bufio.NewScanner(spec.Stdin)
+				for lines.Scan() {
+					if lines.Text() == "first" {
+						readFirst()
+					}
+					fmt.Fprintln(spec.Stdout, strings.ToUpper(lines.Text()))
+				}
+			case strings.HasPrefix(spec.Image, "functron-fail-"):
+				ioutil.ReadAll(spec.Stdin)
+				return 2, nil
+			}
+			return 0, nil
+		}
+		pipeline := func(functions ...string) (int, api.PipelineResponse) {
+			body, err := json.Marshal(api.PipelineRequest{Functions: functions})
+			So(err, ShouldBeNil)
+			w := post(handler, key, "/v2/pipelines", body)
+			var out api.PipelineResponse
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			return w.Code, out
+		}
+
+		Convey("Each stage's output should be streamed into the next as it's written...", func() {
+			status, out := pipeline("produce", "consume")
+			So(status, ShouldEqual, http.StatusOK)
+			So(out.Errors, ShouldBeEmpty)
+			So(string(out.Stdout), ShouldEqual, "FIRST\nSECOND\n")
+			So(out.Stages, ShouldHaveLength, 2)
+			So(out.Stages[0].StdoutBytes, ShouldEqual, len("first\nsecond\n"))
+		})
+
+		Convey("A pipeline with more stages than slots should still finish...", func() {
+			s.slots = slots.CreatePool(nil, 0)
+			readFirst()
+			status, out := pipeline("produce", "consume", "consume")
+			So(status, ShouldEqual, http.StatusOK)
+			So(string(out.Stdout), ShouldEqual, "FIRST\nSECOND\n")
+		})
+
+		Convey("A failed stage should stop the pipeline there...", func() {
+			readFirst()
+			_, out := pipeline("produce", "fail", "consume")
+			So(out.Stages, ShouldHaveLength, 2)
+			So(*out.FailedStage, ShouldEqual, 1)
+			So(out.Errors[0].Code, ShouldEqual, api.ErrNonZeroExit)
+			So(out.Stdout, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestSchedules(t *testing.T) {
+	Convey("Given a server with a registered function...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		s, _ := createTestServer(runtime)
+		_, err := s.store.SaveFunction(&models.Function{Name: "echo", Dockerfile: "FROM alpine\nCMD cat\n", TimeoutSeconds: 5})
+		So(err, ShouldBeNil)
+		_, owner, err := auth.IssueKey(s.store, "scheduler", models.Scopes{models.ScopeExec}, nil)
+		So(err, ShouldBeNil)
+
+		Convey("A due schedule should run as its owner, and be recorded...", func() {
+			due := time.Now().Add(-time.Minute)
+			_, err := s.store.SaveSchedule(&models.Schedule{
+				Name:     "nightly",
+				Cron:     "@nightly",
+				Function: "echo",
+				Stdin:    []byte("report"),
+				Enabled:  true,
+				APIKeyId: &owner.Id,
+				NextRun:  &due,
+			})
+			So(err, ShouldBeNil)
+
+			s.scheduler.Tick()
+			s.scheduler.Wait()
+			So(runtime.RunCount(), ShouldEqual, 1)
+
+			invocations, err := s.store.RetrieveInvocations(10)
+			So(err, ShouldBeNil)
+			So(invocations, ShouldHaveLength, 1)
+			So(invocations[0].FunctionName, ShouldEqual, "echo")
+			So(*invocations[0].APIKeyId, ShouldEqual, owner.Id)
+
+			sc, err := s.store.RetrieveScheduleByName("nightly")
+			So(err, ShouldBeNil)
+			So(sc.NextRun.After(time.Now()), ShouldBeTrue)
+		})
+	})
+}
+
+func TestHTTPFunctions(t *testing.T) {
+	Convey("Given a server with a registered function...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		s, key := createTestServer(runtime)
+		handler := s.Handler()
+		_, err := s.store.SaveFunction(&models.Function{Name: "web", Dockerfile: "FROM alpine\nCMD ./serve\n", TimeoutSeconds: 5})
+		So(err, ShouldBeNil)
+
+		var env []string
+		output := ""
+		runtime.RunFunc = func(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+			env = spec.Env
+			stdin, _ := ioutil.ReadAll(spec.Stdin)
+			fmt.Fprintf(spec.Stdout, output, stdin)
+			return 0, nil
+		}
+		request := func(method, path string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, path, strings.NewReader("body"))
+			req.Header.Set(auth.APIKeyHeader, key)
+			req.Header.Set("X-Hook-Event", "push")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		Convey("The request should be passed to the function, CGI style...", func() {
+			output = "got %s"
+			w := request("PUT", "/fn/web/a/b?x=1")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, "got body")
+			So(env, ShouldContain, "REQUEST_METHOD=PUT")
+			So(env, ShouldContain, "PATH_INFO=/a/b")
+			So(env, ShouldContain, "SCRIPT_NAME=/fn/web")
+			So(env, ShouldContain, "QUERY_STRING=x=1")
+			So(env, ShouldContain, "CONTENT_LENGTH=4")
+			So(env, ShouldContain, "HTTP_X_HOOK_EVENT=push")
+			So(strings.Join(env, "\n"), ShouldNotContainSubstring, key)
+		})
+
+		Convey("The key can be sent in the URL, and isn't passed on...", func() {
+			output = "ok"
+			req := httptest.NewRequest("POST", "/fn/web?x=1&"+auth.APIKeyParameter+"="+key, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(env, ShouldContain, "QUERY_STRING=x=1")
+			So(strings.Join(env, "\n"), ShouldNotContainSubstring, key)
+		})
+
+		Convey("A header block should set the status and headers...", func() {
+			output = "Status: 201 Created\r\nContent-Type: text/plain\r\nX-Result: %s\r\n\r\ndone"
+			w := request("POST", "/fn/web")
+			So(w.Code, ShouldEqual, http.StatusCreated)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "text/plain")
+			So(w.Header().Get("X-Result"), ShouldEqual, "body")
+			So(w.Header().Get("Status"), ShouldEqual, "")
+			So(w.Body.String(), ShouldEqual, "done")
+		})
+
+		Convey("Output which only looks like headers should be sent as it is...", func() {
+			output = "Dear %s,\nthis isn't a header\n\nbye"
+			w := request("POST", "/fn/web")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, "Dear body,\nthis isn't a header\n\nbye")
+
+			output = "\nName: %s\n\n"
+			w = request("POST", "/fn/web")
+			So(w.Body.String(), ShouldEqual, "Name: body\n\n")
+		})
+
+		Convey("A function which fails should be a bad gateway...", func() {
+			runtime.RunFunc = dockertest.Exit(2, "oops")
+			w := request("GET", "/fn/web")
+			So(w.Code, ShouldEqual, http.StatusBadGateway)
+		})
+
+		Convey("Missing functions should be reported...", func() {
+			w := request("GET", "/fn/nope")
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
+
+func TestExecV1(t *testing.T) {
+	Convey("Given a server with a fake runtime...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		s, key := createTestServer(runtime)
+		handler := s.Handler()
+
+		exec := func(r Request) (int, map[string]interface{}) {
+			body, err := json.Marshal(r)
+			So(err, ShouldBeNil)
+			w := post(handler, key, "/v1/exec", body)
+			var out map[string]interface{}
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			return w.Code, out
+		}
+		r := Request{
+			FnName:     "echo",
+			DockerFile: "FROM alpine\nCMD cat\n",
+			TarFile:    base64.StdEncoding.EncodeToString(emptyContext()),
+			Stdin:      base64.StdEncoding.EncodeToString([]byte("hello")),
+			Timeout:    5,
+		}
+
+		Convey("A successful function should keep the old response shape...", func() {
+			status, out := exec(r)
+			So(status, ShouldEqual, http.StatusOK)
+			So(out["Errors"], ShouldResemble, []interface{}{})
+			So(out["CmdOut"], ShouldEqual, base64.StdEncoding.EncodeToString([]byte("hello")))
+			So(out["TempName"], ShouldNotEqual, "")
+		})
+
+		Convey("Errors should always be a list of the old strings...", func() {
+			runtime.FailBuild = true
+			status, out := exec(r)
+			So(status, ShouldEqual, http.StatusBadRequest)
+			So(out["Errors"], ShouldResemble, []interface{}{"BuildFailure"})
+		})
+	})
+}
+
+func TestSecrets(t *testing.T) {
+	Convey("Given a server with a function which prints its environment...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		s, key := createTestServer(runtime)
+		handler := s.Handler()
+		secretsKey, _, err := auth.IssueKey(s.store, "secrets", models.Scopes{models.ScopeManageSecrets}, nil)
+		So(err, ShouldBeNil)
+
+		_, err = s.store.SaveFunction(&models.Function{
+			Name:           "env",
+			Dockerfile:     "FROM alpine\nCMD env\n",
+			TimeoutSeconds: 5,
+			Env:            models.EnvVars{{Name: "GREETING", Value: "hi"}, {Name: "TOKEN", Secret: "token"}},
+		})
+		So(err, ShouldBeNil)
+
+		var env []string
+		runtime.RunFunc = func(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+			env = spec.Env
+			for _, e := range spec.Env {
+				fmt.Fprintln(spec.Stdout, e)
+				fmt.Fprintln(spec.Stderr, e)
+			}
+			return 0, nil
+		}
+		send := func(method, key, path string, body interface{}) *httptest.ResponseRecorder {
+			encoded, err := json.Marshal(body)
+			So(err, ShouldBeNil)
+			req := httptest.NewRequest(method, path, bytes.NewReader(encoded))
+			req.Header.Set(auth.APIKeyHeader, key)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+		invoke := func(r api.InvokeRequest) (int, api.ExecResponse) {
+			w := send("POST", key, "/v2/functions/env/invoke", r)
+			var out api.ExecResponse
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			return w.Code, out
+		}
+
+		Convey("Storing secrets should need the manage-secrets scope...", func() {
+			w := send("PUT", key, "/v2/secrets/token", api.PutSecretRequest{Value: "hunter2"})
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("Invoking it before its secret is stored should fail...", func() {
+			status, out := invoke(api.InvokeRequest{})
+			So(status, ShouldEqual, http.StatusBadRequest)
+			So(out.Errors[0].Message, ShouldContainSubstring, "no secret is stored as 'token'")
+			So(runtime.RunCount(), ShouldEqual, 0)
+		})
+
+		Convey("Once its secret is stored...", func() {
+			w := send("PUT", secretsKey, "/v2/secrets/token", api.PutSecretRequest{Value: "hunter2"})
+			So(w.Code, ShouldEqual, http.StatusOK)
+
+			Convey("It should only be stored encrypted...", func() {
+				secret, err := s.store.RetrieveSecretByName("token")
+				So(err, ShouldBeNil)
+				So(string(secret.Sealed), ShouldNotContainSubstring, "hunter2")
+
+				w := send("GET", secretsKey, "/v2/secrets", nil)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Body.String(), ShouldContainSubstring, `"name":"token"`)
+				So(w.Body.String(), ShouldNotContainSubstring, "hunter2")
+			})
+
+			Convey("The function should get it, and have it redacted from its output...", func() {
+				status, out := invoke(api.InvokeRequest{Env: []api.EnvVar{{Name: "GREETING", Value: "hello"}}})
+				So(status, ShouldEqual, http.StatusOK)
+				So(env, ShouldResemble, []string{"GREETING=hello", "TOKEN=hunter2"})
+				So(string(out.Stdout), ShouldEqual, "GREETING=hello\nTOKEN=[REDACTED]\n")
+				So(string(out.Stderr), ShouldEqual, "GREETING=hello\nTOKEN=[REDACTED]\n")
+			})
+
+			Convey("Requests shouldn't be able to use it...", func() {
+				w := send("POST", key, "/v2/exec", api.ExecRequest{
+					FnName:         "adhoc",
+					DockerFile:     "FROM alpine\nCMD env\n",
+					BuildContext:   emptyContext(),
+					TimeoutSeconds: 5,
+					Env:            []api.EnvVar{{Name: "KEY", Secret: "token"}},
+				})
+				So(w.Code, ShouldEqual, http.StatusBadRequest)
+				So(w.Body.String(), ShouldContainSubstring, "secrets can only be used by registered functions")
+				status, _ := invoke(api.InvokeRequest{Env: []api.EnvVar{{Name: "KEY", Secret: "token"}}})
+				So(status, ShouldEqual, http.StatusBadRequest)
+				So(runtime.RunCount(), ShouldEqual, 0)
+			})
+
+			Convey("Deleting it should stop the function being invoked...", func() {
+				w := send("DELETE", secretsKey, "/v2/secrets/token", nil)
+				So(w.Code, ShouldEqual, http.StatusNoContent)
+				status, _ := invoke(api.InvokeRequest{})
+				So(status, ShouldEqual, http.StatusBadRequest)
+			})
+		})
+
+		Convey("Invalid variables should be refused...", func() {
+			status, _ := invoke(api.InvokeRequest{Env: []api.EnvVar{{Name: "NOT-VALID", Value: "x"}}})
+			So(status, ShouldEqual, http.StatusBadRequest)
+			status, _ = invoke(api.InvokeRequest{Env: []api.EnvVar{{Name: "BOTH", Value: "x", Secret: "token"}}})
+			So(status, ShouldEqual, http.StatusBadRequest)
+			status, _ = invoke(api.InvokeRequest{Env: []api.EnvVar{{Name: "SPLIT", Value: "x\nY=z"}}})
+			So(status, ShouldEqual, http.StatusBadRequest)
+			So(runtime.RunCount(), ShouldEqual, 0)
+		})
+
+		Convey("Variables which would change how docker runs should be refused...", func() {
+			for _, name := range []string{"DOCKER_HOST", "docker_config", "LD_PRELOAD", "PATH"} {
+				status, out := invoke(api.InvokeRequest{Env: []api.EnvVar{{Name: name, Value: "x"}}})
+				So(status, ShouldEqual, http.StatusBadRequest)
+				So(out.Errors[0].Message, ShouldContainSubstring, name)
+			}
+			So(runtime.RunCount(), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestSecurityProfiles(t *testing.T) {
+	Convey("Given a server with a security profile and a stricter one for functions...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		s, key := createTestServer(runtime)
+		handler := s.Handler()
+		registerKey, _, err := auth.IssueKey(s.store, "register", models.Scopes{models.ScopeRegisterFunctions}, nil)
+		So(err, ShouldBeNil)
+		uid := 1000
+		s.security = configuration.SecurityProfile{UID: &uid, DropCapabilities: []string{"NET_RAW"}}
+		s.securityProfiles = map[string]configuration.SecurityProfile{
+			"strict": {ReadOnlyRootfs: true, DropCapabilities: []string{"all"}, NoNewPrivileges: true},
+			"root":   {UID: new(int)},
+		}
+
+		exec := func(profile string) (int, api.ExecResponse) {
+			body, err := json.Marshal(api.ExecRequest{
+				FnName:          "hello",
+				DockerFile:      "FROM alpine\nCMD echo hello\n",
+				TimeoutSeconds:  5,
+				SecurityProfile: profile,
+			})
+			So(err, ShouldBeNil)
+			w := post(handler, key, "/v2/exec", body)
+			var out api.ExecResponse
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			return w.Code, out
+		}
+
+		Convey("Functions without a profile should get the server's...", func() {
+			status, _ := exec("")
+			So(status, ShouldEqual, http.StatusOK)
+			So(runtime.Runs, ShouldHaveLength, 1)
+			So(runtime.Runs[0].Security, ShouldResemble, interfaces.Security{User: "1000", CapDrop: []string{"NET_RAW"}})
+		})
+
+		Convey("A function's profile should add to the server's...", func() {
+			status, _ := exec("strict")
+			So(status, ShouldEqual, http.StatusOK)
+			So(runtime.Runs, ShouldHaveLength, 1)
+			security := runtime.Runs[0].Security
+			So(security.User, ShouldEqual, "1000")
+			So(security.ReadOnlyRootfs, ShouldBeTrue)
+			So(security.Tmpfs, ShouldContainKey, "/tmp")
+			So(security.CapDrop, ShouldResemble, []string{"ALL", "NET_RAW"})
+			So(security.NoNewPrivileges, ShouldBeTrue)
+		})
+
+		Convey("A function's profile shouldn't be able to run it as root...", func() {
+			status, _ := exec("root")
+			So(status, ShouldEqual, http.StatusOK)
+			So(runtime.Runs[0].Security.User, ShouldEqual, "1000")
+		})
+
+		Convey("Unknown profiles should be rejected...", func() {
+			status, out := exec("lax")
+			So(status, ShouldEqual, http.StatusBadRequest)
+			So(out.Errors[0].Code, ShouldEqual, api.ErrInvalidRequest)
+			So(runtime.Runs, ShouldBeEmpty)
+
+			body, err := json.Marshal(api.RegisterFunctionRequest{
+				Name:            "hello",
+				DockerFile:      "FROM alpine\n",
+				TimeoutSeconds:  5,
+				SecurityProfile: "lax",
+			})
+			So(err, ShouldBeNil)
+			w := post(handler, registerKey, "/v2/functions", body)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Registered functions should keep their profile...", func() {
+			body, err := json.Marshal(api.RegisterFunctionRequest{
+				Name:            "hello",
+				DockerFile:      "FROM alpine\nCMD echo hello\n",
+				TimeoutSeconds:  5,
+				SecurityProfile: "strict",
+			})
+			So(err, ShouldBeNil)
+			w := post(handler, registerKey, "/v2/functions", body)
+			So(w.Code, ShouldEqual, http.StatusCreated)
+			var f api.Function
+			So(json.NewDecoder(w.Body).Decode(&f), ShouldBeNil)
+			So(f.SecurityProfile, ShouldEqual, "strict")
+
+			w = post(handler, key, "/v2/functions/hello/invoke", []byte("{}"))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(runtime.Runs, ShouldHaveLength, 1)
+			So(runtime.Runs[0].Security.ReadOnlyRootfs, ShouldBeTrue)
+		})
+	})
+}
+
+func TestNetworks(t *testing.T) {
+	Convey("Given a server whose functions are offline by default...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		s, key := createTestServer(runtime)
+		handler := s.Handler()
+		s.network = configuration.NetworkConfig{Default: configuration.NetworkNone, Allowed: []string{"internal-services"}}
+
+		exec := func(network string) (int, api.ExecResponse) {
+			body, err := json.Marshal(api.ExecRequest{
+				FnName:         "hello",
+				DockerFile:     "FROM alpine\nCMD echo hello\n",
+				TimeoutSeconds: 5,
+				Network:        network,
+			})
+			So(err, ShouldBeNil)
+			w := post(handler, key, "/v2/exec", body)
+			var out api.ExecResponse
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			return w.Code, out
+		}
+		lastInvocation := func() models.Invocation {
+			invocations, err := s.store.RetrieveInvocations(1)
+			So(err, ShouldBeNil)
+			So(invocations, ShouldHaveLength, 1)
+			return invocations[0]
+		}
+
+		Convey("Functions which don't choose a network should get none...", func() {
+			status, _ := exec("")
+			So(status, ShouldEqual, http.StatusOK)
+			So(runtime.Runs[0].Network, ShouldEqual, "none")
+			So(lastInvocation().Network, ShouldEqual, "none")
+		})
+
+		Convey("Allowed networks should be joined by name...", func() {
+			status, _ := exec("internal-services")
+			So(status, ShouldEqual, http.StatusOK)
+			So(runtime.Runs[0].Network, ShouldEqual, "internal-services")
+			So(lastInvocation().Network, ShouldEqual, "internal-services")
+		})
+
+		Convey("Each isolated container should get a network of its own, removed afterwards...", func() {
+			networks := make([]string, 0)
+			runtime.RunFunc = func(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+				networks = append(networks, spec.Network)
+				return 0, nil
+			}
+			status, _ := exec("isolated")
+			So(status, ShouldEqual, http.StatusOK)
+			status, _ = exec("isolated")
+			So(status, ShouldEqual, http.StatusOK)
+
+			So(networks, ShouldHaveLength, 2)
+			So(networks[0], ShouldStartWith, configuration.DefaultIsolatedNetwork+"-")
+			So(networks[1], ShouldNotEqual, networks[0])
+			So(runtime.RemovedNetworks, ShouldResemble, networks)
+			So(runtime.Networks, ShouldBeEmpty)
+			So(lastInvocation().Network, ShouldEqual, "isolated")
+		})
+
+		Convey("Other networks should be rejected...", func() {
+			status, out := exec("host")
+			So(status, ShouldEqual, http.StatusBadRequest)
+			So(out.Errors[0].Code, ShouldEqual, api.ErrInvalidRequest)
+			So(runtime.Runs, ShouldBeEmpty)
+
+			status, _ = exec("bridge")
+			So(status, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
+
+func TestUsage(t *testing.T) {
+	Convey("Given a server whose containers use some resources...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		s, key := createTestServer(runtime)
+		handler := s.Handler()
+		s.executor.StatsInterval = 5 * time.Millisecond
+		runtime.Usage = models.Usage{CPUSeconds: 0.25, MemoryPeakBytes: 4096, NetworkRxBytes: 100}
+		runtime.RunFunc = func(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+			time.Sleep(50 * time.Millisecond)
+			return 0, nil
+		}
+
+		body, err := json.Marshal(api.ExecRequest{FnName: "hello", DockerFile: "FROM alpine\nCMD echo hello\n", TimeoutSeconds: 5})
+		So(err, ShouldBeNil)
+		w := post(handler, key, "/v2/exec", body)
+		So(w.Code, ShouldEqual, http.StatusOK)
+		var out api.ExecResponse
+		So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+
+		Convey("The response should say what the function used...", func() {
+			So(out.Usage, ShouldResemble, api.Usage{CPUSeconds: 0.25, MemoryPeakBytes: 4096, NetworkRxBytes: 100})
+		})
+
+		Convey("The invocation's history should record it...", func() {
+			invocations, err := s.store.RetrieveInvocations(1)
+			So(err, ShouldBeNil)
+			So(invocations[0].Usage, ShouldResemble, runtime.Usage)
+		})
+
+		Convey("The usage report should total it by day...", func() {
+			req := httptest.NewRequest("GET", "/v1/usage?from="+time.Now().UTC().Format("2006-01-02"), nil)
+			req.Header.Set(auth.APIKeyHeader, key)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var report struct{ Usage []models.UsageReport }
+			So(json.NewDecoder(w.Body).Decode(&report), ShouldBeNil)
+			So(report.Usage, ShouldHaveLength, 1)
+			So(report.Usage[0].FunctionName, ShouldEqual, "hello")
+			So(report.Usage[0].Invocations, ShouldEqual, 1)
+			So(report.Usage[0].CPUSeconds, ShouldEqual, 0.25)
+
+			req = httptest.NewRequest("GET", "/v1/usage?from=yesterday", nil)
+			req.Header.Set(auth.APIKeyHeader, key)
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+
+		Convey("Tenants should be charged for the CPU time, not how long the container ran...", func() {
+			tenant, err := s.store.CreateTenant(&models.Tenant{Name: "team-a"})
+			So(err, ShouldBeNil)
+			tenantKey, _, err := auth.IssueKey(s.store, "team-a", models.Scopes{models.ScopeExec}, &tenant.Id)
+			So(err, ShouldBeNil)
+			w := post(handler, tenantKey, "/v2/exec", body)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			used, err := s.store.RetrieveUsage(tenant.Id, models.UsageCPUSeconds, time.Now().UTC().Truncate(24*time.Hour))
+			So(err, ShouldBeNil)
+			So(used, ShouldEqual, 0.25)
+		})
+	})
+}
+
+func TestImageGC(t *testing.T) {
+	Convey("Given a server with more images than its disk budget...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		s, key := createTestServer(runtime)
+		handler := s.Handler()
+		s.imageGC.DiskBudgetBytes = 150
+		s.imageGC.MinIdleSeconds = 0.01
+		for _, name := range []string{"old", "pinned"} {
+			tag := library.FormatToFunctronImageName(name)
+			runtime.Images[tag] = interfaces.BuildSpec{Tag: tag}
+			runtime.ImageSizes[tag] = 100
+		}
+		_, err := s.store.PersistImageForBuild(&models.FunctronImage{Name: "pinned", Pinned: true})
+		So(err, ShouldBeNil)
+
+		collect := func() api.GCResult {
+			w := post(handler, key, "/v2/images/gc", nil)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var out api.GCResult
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			So(out.Errors, ShouldBeEmpty)
+			return out
+		}
+
+		Convey("The periodic collection should remove images past their scheduled removal...", func() {
+			past := time.Now().Add(-time.Hour)
+			tag := library.FormatToFunctronImageName("expired")
+			runtime.Images[tag] = interfaces.BuildSpec{Tag: tag}
+			_, err := s.store.PersistImageForBuild(&models.FunctronImage{Name: "expired", ScheduledForRemoval: &past})
+			So(err, ShouldBeNil)
+			s.imageGC.IntervalSeconds = 0.01
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				s.RunImageGC(ctx)
+				close(done)
+			}()
+			for {
+				img, err := s.store.RetrieveImageByName("expired")
+				So(err, ShouldBeNil)
+				if img.Status.Removed() {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+			<-done
+			So(runtime.Removals, ShouldContain, tag)
+		})
+
+		Convey("Images past their scheduled removal which were used recently should be kept...", func() {
+			past := time.Now().Add(-time.Hour)
+			for _, name := range []string{"busy", "held"} {
+				tag := library.FormatToFunctronImageName(name)
+				runtime.Images[tag] = interfaces.BuildSpec{Tag: tag}
+				_, err := s.store.PersistImageForBuild(&models.FunctronImage{Name: name, ScheduledForRemoval: &past})
+				So(err, ShouldBeNil)
+			}
+			s.imageGC.MinIdleSeconds = 3600
+			handle, err := s.images.AcquireImage("busy")
+			So(err, ShouldBeNil)
+			So(s.images.ReleaseImage(handle), ShouldBeNil)
+			held, err := s.images.AcquireLongLivedImage("held")
+			So(err, ShouldBeNil)
+			defer s.images.ReleaseImage(held)
+
+			removed, errs, err := s.removeExpiredImages(context.Background())
+			So(err, ShouldBeNil)
+			So(errs, ShouldBeEmpty)
+			So(removed, ShouldBeEmpty)
+			for _, name := range []string{"busy", "held"} {
+				img, err := s.store.RetrieveImageByName(name)
+				So(err, ShouldBeNil)
+				So(img.Status.Removed(), ShouldBeFalse)
+				So(runtime.Removals, ShouldNotContain, library.FormatToFunctronImageName(name))
+			}
+			img, err := s.store.RetrieveImageByName("busy")
+			So(err, ShouldBeNil)
+			So(img.ScheduledForRemoval.After(time.Now()), ShouldBeTrue)
+		})
+
+		Convey("Images which have only just been seen should be kept...", func() {
+			So(collect().Evicted, ShouldBeEmpty)
+			usage, err := s.store.RetrieveImageUsage()
+			So(err, ShouldBeNil)
+			So(usage, ShouldHaveLength, 1)
+			So(usage[0].Name, ShouldEqual, "pinned")
+			So(usage[0].SizeBytes, ShouldEqual, 100)
+
+			Convey("Once they've been idle, the unpinned one should be evicted...", func() {
+				time.Sleep(20 * time.Millisecond)
+				out := collect()
+				So(out.Evicted, ShouldHaveLength, 1)
+				So(out.Evicted[0].Name, ShouldEqual, "old")
+				So(out.Evicted[0].SizeBytes, ShouldEqual, 100)
+				So(out.Evicted[0].Reason, ShouldNotBeEmpty)
+				_, built := runtime.Images[library.FormatToFunctronImageName("pinned")]
+				So(built, ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestImageManagement(t *testing.T) {
+	Convey("Given a server with a built image...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		s, key := createTestServer(runtime)
+		handler := s.Handler()
+		tag := library.FormatToFunctronImageName("kept")
+		runtime.Images[tag] = interfaces.BuildSpec{Tag: tag}
+		img, err := s.store.PersistImageForBuild(&models.FunctronImage{Name: "kept"})
+		So(err, ShouldBeNil)
+		for _, status := range []models.ImageStatus{
+			models.ImageStatusPreparingForBuild,
+			models.ImageStatusBuildingDockerfile,
+			models.ImageStatusCommitting,
+			models.ImageStatusCompleted,
+		} {
+			So(s.store.UpdateStatus(img, status, "built"), ShouldBeNil)
+		}
+
+		send := func(method string, body interface{}) *httptest.ResponseRecorder {
+			encoded, err := json.Marshal(body)
+			So(err, ShouldBeNil)
+			req := httptest.NewRequest(method, "/v2/images/kept", bytes.NewReader(encoded))
+			req.Header.Set(auth.APIKeyHeader, key)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+		detail := func(w *httptest.ResponseRecorder) api.ImageDetail {
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var out api.ImageDetail
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			return out
+		}
+		pinned := true
+
+		Convey("It should be described, with no changes yet...", func() {
+			out := detail(send("GET", nil))
+			So(out.Name, ShouldEqual, "kept")
+			So(out.Pinned, ShouldBeFalse)
+			So(out.Changes, ShouldBeEmpty)
+		})
+
+		Convey("Pinning it should be recorded, and stop it being removed...", func() {
+			out := detail(send("PATCH", api.UpdateImageRequest{Pinned: &pinned}))
+			So(out.Pinned, ShouldBeTrue)
+			So(out.Changes, ShouldHaveLength, 1)
+			So(out.Changes[0].Change, ShouldEqual, models.ImageChangePinned)
+			So(out.Changes[0].APIKeyId, ShouldNotBeNil)
+
+			So(send("DELETE", nil).Code, ShouldEqual, http.StatusConflict)
+			So(runtime.Removals, ShouldBeEmpty)
+		})
+
+		Convey("Its removal should be rescheduled, but only into the future...", func() {
+			past := time.Now().Add(-time.Hour)
+			So(send("PATCH", api.UpdateImageRequest{ScheduledRemoval: &past}).Code, ShouldEqual, http.StatusBadRequest)
+
+			later := time.Now().Add(72 * time.Hour).Truncate(time.Second)
+			out := detail(send("PATCH", api.UpdateImageRequest{ScheduledRemoval: &later}))
+			So(out.ScheduledRemoval.Equal(later), ShouldBeTrue)
+			So(out.Changes, ShouldHaveLength, 1)
+			So(out.Changes[0].Change, ShouldEqual, models.ImageChangeRescheduled)
+		})
+
+		Convey("Removing it early should be recorded, and only happen once...", func() {
+			So(send("DELETE", nil).Code, ShouldEqual, http.StatusNoContent)
+			So(runtime.Removals, ShouldResemble, []string{tag})
+			out := detail(send("GET", nil))
+			So(out.Status, ShouldEqual, string(models.ImageStatusCleanedUp))
+			So(out.Changes[0].Change, ShouldEqual, models.ImageChangeRemoved)
+
+			So(send("DELETE", nil).Code, ShouldEqual, http.StatusConflict)
+			So(send("PATCH", api.UpdateImageRequest{Pinned: &pinned}).Code, ShouldEqual, http.StatusConflict)
+		})
+
+		Convey("Removing it while it's in use should wait until it's released...", func() {
+			handle, err := s.images.AcquireImage("kept")
+			So(err, ShouldBeNil)
+			So(send("DELETE", nil).Code, ShouldEqual, http.StatusAccepted)
+			So(runtime.Removals, ShouldBeEmpty)
+
+			So(s.images.ReleaseImage(handle), ShouldBeNil)
+			So(runtime.Removals, ShouldResemble, []string{tag})
+			w := post(handler, key, "/v2/images/gc", nil)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(detail(send("GET", nil)).Status, ShouldEqual, string(models.ImageStatusCleanedUp))
+		})
+
+		Convey("Its history should list every change of status...", func() {
+			So(send("DELETE", nil).Code, ShouldEqual, http.StatusNoContent)
+			req := httptest.NewRequest("GET", "/v2/images/kept/history", nil)
+			req.Header.Set(auth.APIKeyHeader, key)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			var out api.ImageTimeline
+			So(json.NewDecoder(w.Body).Decode(&out), ShouldBeNil)
+			So(out.Status, ShouldEqual, string(models.ImageStatusCleanedUp))
+			So(out.Transitions, ShouldHaveLength, 6)
+			So(out.Transitions[0].From, ShouldBeEmpty)
+			So(out.Transitions[0].To, ShouldEqual, string(models.ImageStatusScheduledForBuild))
+			So(out.Transitions[5].From, ShouldEqual, string(models.ImageStatusCompleted))
+			So(out.Transitions[5].To, ShouldEqual, string(models.ImageStatusCleanedUp))
+			So(out.Transitions[5].Message, ShouldNotBeEmpty)
+		})
+
+		Convey("Images which don't exist should be reported...", func() {
+			req := httptest.NewRequest("GET", "/v2/images/missing", nil)
+			req.Header.Set(auth.APIKeyHeader, key)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
+
+// createWarmTestServer returns a server with a warm pool, which records
+// everything in store.
+func createWarmTestServer(runtime *dockertest.FakeRuntime, store *database.Store) *Server {
+	c := &configuration.Configuration{
+		DockerfilePolicy: &configuration.DefaultDockerfilePolicy,
+		SecretsKey:       testSecretsKey,
+		WarmPool:         &configuration.WarmPoolConfig{MaxContainers: 1, IdleSeconds: 60},
+	}
+	return CreateServer(c, store, runtime)
+}
+
+func TestWarmImages(t *testing.T) {
+	Convey("Given a server with a warm pool, and a registered function...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		tmp, key := createTestServer(runtime)
+		s := createWarmTestServer(runtime, tmp.store)
+		handler := s.Handler()
+		registerKey, _, err := auth.IssueKey(s.store, "register", models.Scopes{models.ScopeRegisterFunctions}, nil)
+		So(err, ShouldBeNil)
+
+		register := func() {
+			body, err := json.Marshal(api.RegisterFunctionRequest{
+				Name:           "hello",
+				DockerFile:     "FROM alpine\nCMD echo hello\n",
+				TimeoutSeconds: 5,
+			})
+			So(err, ShouldBeNil)
+			So(post(handler, registerKey, "/v2/functions", body).Code, ShouldEqual, http.StatusCreated)
+		}
+		get := func(path string, out interface{}) {
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set(auth.APIKeyHeader, key)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(json.NewDecoder(w.Body).Decode(out), ShouldBeNil)
+		}
+		images := func() []api.Image {
+			var out api.ImageList
+			get("/v2/images", &out)
+			return out.Images
+		}
+		history := func(name string) []string {
+			var out api.ImageTimeline
+			get("/v2/images/"+name+"/history", &out)
+			ret := make([]string, 0)
+			for _, t := range out.Transitions {
+				ret = append(ret, t.To)
+			}
+			return ret
+		}
+		built := []string{
+			string(models.ImageStatusScheduledForBuild),
+			string(models.ImageStatusPreparingForBuild),
+			string(models.ImageStatusBuildingDockerfile),
+			string(models.ImageStatusCommitting),
+			string(models.ImageStatusCompleted),
+		}
+		register()
+
+		Convey("Two servers building it at once should record one build...", func() {
+			other := createWarmTestServer(runtime, s.store)
+			started, release := make(chan struct{}, 2), make(chan struct{})
+			runtime.BuildFunc = func(interfaces.BuildSpec) {
+				started <- struct{}{}
+				<-release
+			}
+
+			var wg sync.WaitGroup
+			codes := make([]int, 2)
+			for i, h := range []http.Handler{handler, other.Handler()} {
+				wg.Add(1)
+				go func(i int, h http.Handler) {
+					defer wg.Done()
+					codes[i] = post(h, key, "/v2/functions/hello/invoke", []byte("{}")).Code
+				}(i, h)
+			}
+			<-started
+			<-started
+			close(release)
+			wg.Wait()
+
+			So(codes, ShouldResemble, []int{http.StatusOK, http.StatusOK})
+			listed := images()
+			So(listed, ShouldHaveLength, 1)
+			So(listed[0].Status, ShouldEqual, string(models.ImageStatusCompleted))
+			So(history(listed[0].Name), ShouldResemble, built)
+		})
+
+		Convey("Invoking it should record the image it's built...", func() {
+			So(post(handler, key, "/v2/functions/hello/invoke", []byte("{}")).Code, ShouldEqual, http.StatusOK)
+			listed := images()
+			So(listed, ShouldHaveLength, 1)
+			name := listed[0].Name
+			So(runtime.Images, ShouldContainKey, library.FormatToFunctronImageName(name))
+			So(listed[0].Status, ShouldEqual, string(models.ImageStatusCompleted))
+			So(listed[0].Finished, ShouldNotBeNil)
+
+			var detail api.ImageDetail
+			get("/v2/images/"+name, &detail)
+			So(detail.Name, ShouldEqual, name)
+			So(history(name), ShouldResemble, built)
+
+			Convey("Once the function's replaced, its image should be recorded as removed...", func() {
+				register()
+				for {
+					transitions := history(name)
+					if transitions[len(transitions)-1] == string(models.ImageStatusCleanedUp) {
+						break
+					}
+					time.Sleep(time.Millisecond)
+				}
+				req := httptest.NewRequest("DELETE", "/v2/images/"+name, nil)
+				req.Header.Set(auth.APIKeyHeader, key)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, http.StatusConflict)
+
+				Convey("And building it again should reuse its record...", func() {
+					So(post(handler, key, "/v2/functions/hello/invoke", []byte("{}")).Code, ShouldEqual, http.StatusOK)
+					So(images(), ShouldHaveLength, 1)
+					again := append(append(append([]string{}, built...), string(models.ImageStatusCleanedUp)), built...)
+					So(history(name), ShouldResemble, again)
+				})
+			})
+		})
+	})
+}
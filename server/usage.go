@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/models"
+)
+
+// HandleUsage reports what invocations used, totalled by day (UTC),
+// function and tenant, for chargeback. It's what gets run when you go to
+// /v1/usage?from=YYYY-MM-DD&to=YYYY-MM-DD&function=NAME&tenant=ID, where
+// every parameter's optional.
+func (s *Server) HandleUsage(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeErrors(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+		return
+	}
+
+	query := req.URL.Query()
+	filter := models.UsageFilter{
+		From:         query.Get("from"),
+		To:           query.Get("to"),
+		FunctionName: query.Get("function"),
+	}
+	for _, day := range []string{filter.From, filter.To} {
+		if _, err := time.Parse("2006-01-02", day); day != "" && err != nil {
+			writeErrors(w, http.StatusBadRequest, "InvalidDay")
+			return
+		}
+	}
+	if t := query.Get("tenant"); t != "" {
+		id, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			writeErrors(w, http.StatusBadRequest, "InvalidTenant")
+			return
+		}
+		filter.TenantId = &id
+	}
+
+	usage, err := s.store.RetrieveUsageReport(filter)
+	if err != nil {
+		logging.FromContext(req.Context()).WithField("error", err).Errorf("Could not report usage")
+		writeErrors(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"Usage": usage})
+}
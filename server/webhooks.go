@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/auth"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/models"
+	"github.com/Sentimentron/functron/webhook"
+)
+
+// validCallbackURL checks that a job's callback URL is an absolute HTTP(S)
+// URL to a host deliveries can be made to, and that there's a key whose
+// secret can sign its deliveries.
+func (s *Server) validCallbackURL(callback string, key *models.APIKey) *api.Error {
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return api.NewError(api.ErrInvalidRequest, "callbackUrl must be an absolute http or https URL, not '%s'", callback)
+	}
+	if err := s.webhooks.CheckURL(callback); err != nil {
+		return api.NewError(api.ErrInvalidRequest, "callbackUrl is not allowed: %s", err)
+	}
+	if key == nil {
+		return api.NewError(api.ErrInvalidRequest, "callbacks need an API key to sign them")
+	}
+	return nil
+}
+
+// sendCallback starts delivering a finished job to its callback URL,
+// signed with the secret of the key which submitted it.
+func (s *Server) sendCallback(logger *logging.Logger, info api.Job, apiKeyId int64) {
+	payload, err := json.Marshal(api.WebhookPayload{Event: api.EventJobFinished, Job: info})
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not encode webhook payload")
+		return
+	}
+	// Make sure there's a secret to sign it with
+	if _, apiErr := s.webhookSecret(logger, apiKeyId, false); apiErr != nil {
+		return
+	}
+	if _, err := s.webhooks.Send(info.ID, apiKeyId, info.CallbackURL, payload); err != nil {
+		logger.WithField("error", err).Errorf("Could not save webhook delivery")
+	}
+}
+
+// webhookSecret returns the secret which signs deliveries for a key's
+// jobs, generating one if it hasn't got one, or if rotate is set.
+func (s *Server) webhookSecret(logger *logging.Logger, apiKeyId int64, rotate bool) (*models.WebhookSecret, *api.Error) {
+	if !rotate {
+		secret, err := s.store.RetrieveWebhookSecret(apiKeyId)
+		if err == nil {
+			return secret, nil
+		} else if err != interfaces.NoMatchingWebhookSecret {
+			logger.WithField("error", err).Errorf("Could not retrieve webhook secret")
+			return nil, api.NewError(api.ErrInternal, "could not retrieve the webhook secret")
+		}
+	}
+
+	generated, err := webhook.GenerateSecret()
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not generate webhook secret")
+		return nil, api.NewError(api.ErrInternal, "could not generate a webhook secret")
+	}
+	secret, err := s.store.SaveWebhookSecret(apiKeyId, generated)
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not save webhook secret")
+		return nil, api.NewError(api.ErrInternal, "could not save the webhook secret")
+	}
+	logger.WithField("api_key_id", apiKeyId).Infof("Generated webhook secret")
+	return secret, nil
+}
+
+// HandleWebhookSecret responds with the secret which signs deliveries for
+// the caller's jobs (GET /v2/webhooks/secret), or replaces it with a new
+// one (POST /v2/webhooks/secret). Deliveries which are being retried are
+// signed with the new secret from then on.
+func (s *Server) HandleWebhookSecret(w http.ResponseWriter, req *http.Request) {
+	key := auth.KeyFromContext(req.Context())
+	if key == nil {
+		writeAPIError(w, api.NewError(api.ErrInvalidRequest, "webhook secrets belong to API keys"))
+		return
+	}
+	secret, apiErr := s.webhookSecret(logging.FromContext(req.Context()), key.Id, req.Method == "POST")
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSON(w, http.StatusOK, api.WebhookSecret{Secret: secret.Secret, Created: secret.Created})
+}
+
+// HandleJobDeliveries describes each delivery of a job's result, and every
+// attempt at it (GET /v2/jobs/{id}/deliveries). They can only be seen by
+// the key which submitted the job, or an admin.
+func (s *Server) HandleJobDeliveries(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+	queued, apiErr := s.retrieveJob(req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	deliveries, err := s.store.RetrieveWebhookDeliveries(queued.Id)
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not retrieve webhook deliveries")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not retrieve the deliveries"))
+		return
+	}
+
+	out := api.WebhookDeliveryList{Deliveries: make([]api.WebhookDelivery, 0, len(deliveries))}
+	for _, d := range deliveries {
+		attempts, err := s.store.RetrieveWebhookAttempts(d.Id)
+		if err != nil {
+			logger.WithField("error", err).Errorf("Could not retrieve webhook attempts")
+			writeAPIError(w, api.NewError(api.ErrInternal, "could not retrieve the deliveries"))
+			return
+		}
+		delivery := api.WebhookDelivery{
+			ID:          d.Id,
+			URL:         d.URL,
+			Status:      d.Status,
+			NextAttempt: d.NextAttempt,
+			Created:     d.Created,
+			Finished:    d.Finished,
+			Attempts:    make([]api.WebhookAttempt, 0, len(attempts)),
+		}
+		for _, a := range attempts {
+			delivery.Attempts = append(delivery.Attempts, api.WebhookAttempt{
+				Attempt:         a.Attempt,
+				Started:         a.Started,
+				DurationSeconds: a.DurationSeconds,
+				StatusCode:      a.StatusCode,
+				Error:           a.Error,
+			})
+		}
+		out.Deliveries = append(out.Deliveries, delivery)
+	}
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+// ResumeWebhooks carries on with deliveries which were pending when the
+// server last stopped.
+func (s *Server) ResumeWebhooks() error {
+	return s.webhooks.Resume()
+}
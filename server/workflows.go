@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/auth"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/models"
+	"github.com/Sentimentron/functron/workflow"
+)
+
+// HandleSubmitWorkflow validates and starts a workflow, and responds with
+// 202 and its api.Workflow (POST /v2/workflows). Every node's function
+// must be registered.
+func (s *Server) HandleSubmitWorkflow(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+
+	var r api.WorkflowRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		writeAPIError(w, api.NewError(api.ErrInvalidJSON, "could not decode the request: %s", err))
+		return
+	}
+	if apiErr := workflow.Validate(&r.WorkflowDefinition); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	for _, n := range r.Nodes {
+		if _, apiErr := s.retrieveFunction(logger, n.Function); apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+	}
+
+	var keyId *int64
+	if key := auth.KeyFromContext(req.Context()); key != nil {
+		keyId = &key.Id
+	}
+	wf, err := s.workflows.Submit(r.WorkflowDefinition, r.Stdin, keyId)
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not create workflow")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not create the workflow"))
+		return
+	}
+	s.writeWorkflow(w, req, http.StatusAccepted, wf)
+	logger.WithField("workflow_id", wf.Id).Infof("Submitted workflow")
+}
+
+// HandleGetWorkflow describes a workflow and each of its nodes (GET
+// /v2/workflows/{id}). Only the key which submitted it, or an admin, can
+// see it.
+func (s *Server) HandleGetWorkflow(w http.ResponseWriter, req *http.Request) {
+	logger := logging.FromContext(req.Context())
+	id := strings.TrimPrefix(req.URL.Path, "/v2/workflows/")
+
+	wf, err := s.store.RetrieveWorkflow(id)
+	if err != nil && err != interfaces.NoMatchingWorkflow {
+		logger.WithField("error", err).Errorf("Could not retrieve workflow")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not retrieve the workflow"))
+		return
+	}
+	if err == interfaces.NoMatchingWorkflow || !workflowVisibleTo(wf, auth.KeyFromContext(req.Context())) {
+		writeAPIError(w, api.NewError(api.ErrNotFound, "no workflow has the ID '%s'", id))
+		return
+	}
+	s.writeWorkflow(w, req, http.StatusOK, wf)
+}
+
+// writeWorkflow responds with wf's current state.
+func (s *Server) writeWorkflow(w http.ResponseWriter, req *http.Request, status int, wf *models.Workflow) {
+	described, err := s.workflows.Describe(wf)
+	if err != nil {
+		logging.FromContext(req.Context()).WithField("error", err).Errorf("Could not describe workflow")
+		writeAPIError(w, api.NewError(api.ErrInternal, "could not describe the workflow"))
+		return
+	}
+	w.Header().Set("Location", "/v2/workflows/"+wf.Id)
+	writeJSON(w, status, described)
+}
+
+// workflowVisibleTo checks whether key may see wf, as job.visibleTo does
+// for jobs.
+func workflowVisibleTo(wf *models.Workflow, key *models.APIKey) bool {
+	if wf.APIKeyId == nil || key == nil {
+		return wf.APIKeyId == nil && key == nil
+	}
+	return *wf.APIKeyId == key.Id || key.Scopes.Has(models.ScopeAdmin)
+}
+
+// invokeForWorkflow runs one of a workflow's tasks as an invocation by the
+// key which submitted the workflow, so that it counts against the same
+// quotas.
+func (s *Server) invokeForWorkflow(ctx context.Context, wf *models.Workflow, function string, stdin []byte) workflow.Result {
+	out := s.invokeAs(ctx, wf.APIKeyId, function, stdin, 0)
+	ret := workflow.Result{Stdout: out.Stdout, Stderr: out.Stderr, ExitCode: out.ExitCode}
+	for i := range out.Errors {
+		if out.Errors[i].Code != api.ErrCleanupFailed {
+			ret.Error = &out.Errors[i]
+			break
+		}
+	}
+	return ret
+}
+
+// ResumeWorkflows restarts every workflow which was running when the
+// server last stopped.
+func (s *Server) ResumeWorkflows() error {
+	return s.workflows.Resume()
+}
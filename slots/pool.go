@@ -0,0 +1,314 @@
+// Package slots hands out the execution slots described in Functron's
+// configuration, so that only a fixed number of invocations build and run
+// at once.
+//
+// When callers are waiting, free slots are shared out fairly: first
+// between tenants, in proportion to their weights, then between each
+// tenant's functions, in proportion to theirs. A few slots can be reserved
+// for interactive callers, so that background work (jobs, batches and the
+// like) can never take every slot.
+package slots
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sentimentron/functron/configuration"
+	"github.com/Sentimentron/functron/metrics"
+)
+
+// Slot is a single unit of execution capacity.
+type Slot struct {
+	// Index of this slot in the configuration
+	Index int
+	// Config is the slot's configuration (tags, environment etc.)
+	Config configuration.SlotConfig
+
+	// flow is the flow holding the slot
+	flow Flow
+}
+
+// Flow describes who's asking for a slot. Requests with the same Tenant,
+// Function and Interactive wait in the same queue, in order.
+type Flow struct {
+	// Tenant is empty for keys without a tenant, which share a queue
+	Tenant   string
+	Function string
+	// Weights are each 1 if they're zero
+	TenantWeight   float64
+	FunctionWeight float64
+	// Interactive requests have someone waiting on them, and can use the
+	// reserved slots
+	Interactive bool
+	// Registered is set if Function is registered, so that it can be
+	// labelled by name in metrics
+	Registered bool
+}
+
+// tenantLabel returns the tenant's name for metrics.
+func (f Flow) tenantLabel() string {
+	if f.Tenant == "" {
+		return "none"
+	}
+	return f.Tenant
+}
+
+// functionLabel returns the function's name for metrics.
+func (f Flow) functionLabel() string {
+	return metrics.FunctionLabel(f.Function, f.Registered)
+}
+
+// class returns how f is labelled in metrics.
+func (f Flow) class() string {
+	if f.Interactive {
+		return "interactive"
+	}
+	return "background"
+}
+
+func weight(w float64) float64 {
+	if w <= 0 {
+		return 1
+	}
+	return w
+}
+
+// waiter is a request for a slot which couldn't be granted straight away.
+type waiter struct {
+	flow    Flow
+	arrived time.Time
+	granted chan *Slot
+}
+
+// queue holds one function's waiters (of one class), and its virtual
+// time: the more slots it's been granted for its weight, the later it is.
+type queue struct {
+	key     string
+	pass    float64
+	waiters []*waiter
+}
+
+// tenantQueue holds a tenant's function queues, and its own virtual time
+// relative to other tenants.
+type tenantQueue struct {
+	name   string
+	pass   float64
+	queues map[string]*queue
+	// virtual is the pass of the function queue last granted a slot,
+	// which queues joining the tenant start from
+	virtual float64
+}
+
+// Pool tracks which slots are free, and who's waiting for them.
+type Pool struct {
+	lock  sync.Mutex
+	free  []*Slot
+	total int
+	// reserved slots can only be used by interactive flows
+	reserved   int
+	background int
+	waiting    int
+	tenants    map[string]*tenantQueue
+	// virtual is the pass of the tenant last granted a slot, which tenants
+	// joining the queue start from
+	virtual float64
+}
+
+// CreatePool creates a Pool from the configured slots, reserving some of
+// them for interactive flows. If no slots are configured, a single
+// default slot is used. At least one slot is always left for background
+// flows.
+func CreatePool(configs []configuration.SlotConfig, reserved int) *Pool {
+	if len(configs) == 0 {
+		configs = []configuration.SlotConfig{{}}
+	}
+	if reserved > len(configs)-1 {
+		reserved = len(configs) - 1
+	}
+	if reserved < 0 {
+		reserved = 0
+	}
+	p := &Pool{
+		total:    len(configs),
+		reserved: reserved,
+		tenants:  make(map[string]*tenantQueue),
+	}
+	for i := len(configs) - 1; i >= 0; i-- {
+		p.free = append(p.free, &Slot{Index: i, Config: configs[i]})
+	}
+	metrics.SlotsFree.Set(float64(p.total))
+	metrics.SlotsBusy.Set(0)
+	return p
+}
+
+// Acquire blocks until a slot is granted to flow, then returns it. Callers
+// must return the slot with Release.
+func (p *Pool) Acquire(flow Flow) *Slot {
+	w := &waiter{flow: flow, arrived: time.Now(), granted: make(chan *Slot, 1)}
+
+	p.lock.Lock()
+	p.enqueue(w)
+	p.dispatch()
+	p.lock.Unlock()
+
+	return <-w.granted
+}
+
+// Release returns a slot to the pool, granting it to whoever's next.
+func (p *Pool) Release(s *Slot) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !s.flow.Interactive {
+		p.background--
+	}
+	metrics.SlotsHeld.WithLabelValues(s.flow.tenantLabel(), s.flow.functionLabel(), s.flow.class()).Dec()
+	s.flow = Flow{}
+	p.free = append(p.free, s)
+	p.dispatch()
+}
+
+// Size returns the total number of slots.
+func (p *Pool) Size() int {
+	return p.total
+}
+
+// Reserved returns the number of slots reserved for interactive flows.
+func (p *Pool) Reserved() int {
+	return p.reserved
+}
+
+// enqueue adds w to the back of its flow's queue. Tenants and queues which
+// had nobody waiting catch up with the current virtual time, so that being
+// idle doesn't bank a share to use later. It must be called with the lock
+// held.
+func (p *Pool) enqueue(w *waiter) {
+	t, ok := p.tenants[w.flow.Tenant]
+	if !ok {
+		t = &tenantQueue{name: w.flow.Tenant, queues: make(map[string]*queue)}
+		p.tenants[w.flow.Tenant] = t
+	}
+	key := w.flow.class() + "/" + w.flow.Function
+	q, ok := t.queues[key]
+	if !ok {
+		q = &queue{key: key}
+		t.queues[key] = q
+	}
+	if t.waiting() == 0 && t.pass < p.virtual {
+		t.pass = p.virtual
+	}
+	if len(q.waiters) == 0 && q.pass < t.virtual {
+		q.pass = t.virtual
+	}
+	q.waiters = append(q.waiters, w)
+	p.waiting++
+	metrics.QueueDepth.Set(float64(p.waiting))
+}
+
+// dispatch grants free slots to waiters until there are no free slots, or
+// nobody who can use them. It must be called with the lock held.
+func (p *Pool) dispatch() {
+	for len(p.free) > 0 {
+		// Background flows can't use the reserved slots
+		backgroundAllowed := p.background < p.total-p.reserved
+		t, q := p.next(backgroundAllowed)
+		if q == nil {
+			break
+		}
+
+		w := q.waiters[0]
+		q.waiters = q.waiters[1:]
+		p.virtual, t.virtual = t.pass, q.pass
+		t.pass += 1 / weight(w.flow.TenantWeight)
+		q.pass += 1 / weight(w.flow.FunctionWeight)
+		p.prune()
+
+		s := p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+		s.flow = w.flow
+		if !w.flow.Interactive {
+			p.background++
+		}
+		p.waiting--
+
+		tenant, class := w.flow.tenantLabel(), w.flow.class()
+		metrics.QueueDepth.Set(float64(p.waiting))
+		metrics.SlotsHeld.WithLabelValues(tenant, w.flow.functionLabel(), class).Inc()
+		metrics.SlotWait.WithLabelValues(tenant, w.flow.functionLabel(), class).Observe(time.Since(w.arrived).Seconds())
+		w.granted <- s
+	}
+	metrics.SlotsFree.Set(float64(len(p.free)))
+	metrics.SlotsBusy.Set(float64(p.total - len(p.free)))
+}
+
+// prune forgets tenants and queues which have nobody waiting, and haven't
+// been granted more than their share: they'd start from the virtual time
+// anyway if they came back. It must be called with the lock held.
+func (p *Pool) prune() {
+	for name, t := range p.tenants {
+		for key, q := range t.queues {
+			if len(q.waiters) == 0 && q.pass <= t.virtual {
+				delete(t.queues, key)
+			}
+		}
+		if len(t.queues) == 0 && t.pass <= p.virtual {
+			delete(p.tenants, name)
+		}
+	}
+}
+
+// waiting returns how many of the tenant's requests are waiting.
+func (t *tenantQueue) waiting() int {
+	ret := 0
+	for _, q := range t.queues {
+		ret += len(q.waiters)
+	}
+	return ret
+}
+
+// next returns the tenant with the earliest pass which has someone who
+// can be granted a slot, and its queue with the earliest pass. Ties go to
+// the first by name, so that the order's predictable.
+func (p *Pool) next(backgroundAllowed bool) (*tenantQueue, *queue) {
+	names := make([]string, 0, len(p.tenants))
+	for name := range p.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var bestTenant *tenantQueue
+	var bestQueue *queue
+	for _, name := range names {
+		t := p.tenants[name]
+		if bestTenant != nil && t.pass >= bestTenant.pass {
+			continue
+		}
+		if q := t.next(backgroundAllowed); q != nil {
+			bestTenant, bestQueue = t, q
+		}
+	}
+	return bestTenant, bestQueue
+}
+
+// next returns the tenant's queue with the earliest pass which can be
+// granted a slot, or nil.
+func (t *tenantQueue) next(backgroundAllowed bool) *queue {
+	keys := make([]string, 0, len(t.queues))
+	for key := range t.queues {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var best *queue
+	for _, key := range keys {
+		q := t.queues[key]
+		if len(q.waiters) == 0 || (!backgroundAllowed && !q.waiters[0].flow.Interactive) {
+			continue
+		}
+		if best == nil || q.pass < best.pass {
+			best = q
+		}
+	}
+	return best
+}
@@ -0,0 +1,144 @@
+package slots
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sentimentron/functron/configuration"
+	"github.com/Sentimentron/functron/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// waitFor blocks until n requests are waiting for a slot.
+func waitFor(p *Pool, n int) {
+	for i := 0; i < 1000; i++ {
+		p.lock.Lock()
+		waiting := p.waiting
+		p.lock.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	So(n, ShouldEqual, -1)
+}
+
+// grantOrder queues a request for each flow in turn, while p's only slot
+// is held, then lets them all run and returns who was granted the slot,
+// in order.
+func grantOrder(p *Pool, flows ...Flow) []string {
+	held := p.Acquire(Flow{Tenant: "holder", Interactive: true})
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	ret := make([]string, 0, len(flows))
+	for i, flow := range flows {
+		wg.Add(1)
+		go func(flow Flow) {
+			defer wg.Done()
+			s := p.Acquire(flow)
+			lock.Lock()
+			ret = append(ret, flow.Tenant+"/"+flow.Function)
+			lock.Unlock()
+			p.Release(s)
+		}(flow)
+		waitFor(p, i+1)
+	}
+	p.Release(held)
+	wg.Wait()
+	return ret
+}
+
+// repeat returns n copies of flow.
+func repeat(flow Flow, n int) []Flow {
+	ret := make([]Flow, n)
+	for i := range ret {
+		ret[i] = flow
+	}
+	return ret
+}
+
+func count(grants []string, name string) int {
+	ret := 0
+	for _, g := range grants {
+		if g == name {
+			ret++
+		}
+	}
+	return ret
+}
+
+func TestPool(t *testing.T) {
+	Convey("Given a pool with one slot...", t, func() {
+		p := CreatePool(nil, 0)
+		So(p.Size(), ShouldEqual, 1)
+
+		Convey("Tenants should take turns, however much they've queued...", func() {
+			flows := append(repeat(Flow{Tenant: "batch", Function: "f"}, 4), repeat(Flow{Tenant: "other", Function: "f"}, 2)...)
+			So(grantOrder(p, flows...), ShouldResemble, []string{
+				"batch/f", "other/f", "batch/f", "other/f", "batch/f", "batch/f",
+			})
+		})
+
+		Convey("Tenants should get slots in proportion to their weights...", func() {
+			flows := append(repeat(Flow{Tenant: "heavy", Function: "f", TenantWeight: 2}, 6), repeat(Flow{Tenant: "light", Function: "f"}, 6)...)
+			grants := grantOrder(p, flows...)
+			So(count(grants[:6], "heavy/f"), ShouldEqual, 4)
+			So(count(grants[:6], "light/f"), ShouldEqual, 2)
+		})
+
+		Convey("A tenant's functions should share its slots by their weights...", func() {
+			flows := append(repeat(Flow{Tenant: "t", Function: "a", FunctionWeight: 3}, 6), repeat(Flow{Tenant: "t", Function: "b"}, 6)...)
+			grants := grantOrder(p, flows...)
+			So(count(grants[:8], "t/a"), ShouldEqual, 6)
+			So(count(grants[:8], "t/b"), ShouldEqual, 2)
+		})
+
+		Convey("Requests from one function should be granted in order...", func() {
+			flows := repeat(Flow{Tenant: "t", Function: "a"}, 3)
+			So(grantOrder(p, flows...), ShouldHaveLength, 3)
+		})
+
+		Convey("Only registered functions should be labelled by name...", func() {
+			adhoc := metrics.SlotsHeld.WithLabelValues("t", metrics.FunctionAdHoc, "interactive")
+			before := testutil.ToFloat64(adhoc)
+			s := p.Acquire(Flow{Tenant: "t", Function: "unregistered", Interactive: true})
+			So(testutil.ToFloat64(adhoc), ShouldEqual, before+1)
+			p.Release(s)
+			So(testutil.ToFloat64(adhoc), ShouldEqual, before)
+			So(metrics.SlotsHeld.DeleteLabelValues("t", "unregistered", "interactive"), ShouldBeFalse)
+
+			s = p.Acquire(Flow{Tenant: "t", Function: "registered", Interactive: true, Registered: true})
+			So(testutil.ToFloat64(metrics.SlotsHeld.WithLabelValues("t", "registered", "interactive")), ShouldEqual, 1)
+			p.Release(s)
+		})
+	})
+
+	Convey("Given a pool with a slot reserved for interactive requests...", t, func() {
+		p := CreatePool(make([]configuration.SlotConfig, 2), 1)
+		So(p.Reserved(), ShouldEqual, 1)
+
+		Convey("Background requests shouldn't be able to use it...", func() {
+			background := p.Acquire(Flow{Function: "job"})
+			granted := make(chan *Slot)
+			go func() {
+				granted <- p.Acquire(Flow{Function: "job"})
+			}()
+			waitFor(p, 1)
+
+			interactive := p.Acquire(Flow{Function: "exec", Interactive: true})
+			So(interactive, ShouldNotBeNil)
+			p.Release(interactive)
+			waitFor(p, 1)
+
+			p.Release(background)
+			p.Release(<-granted)
+		})
+
+		Convey("Every slot can't be reserved...", func() {
+			So(CreatePool(nil, 5).Reserved(), ShouldEqual, 0)
+		})
+	})
+}
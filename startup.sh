@@ -1,3 +1,3 @@
 #!/bin/sh
 echo "Starting functron..."
-go run /root/server.go
+cd /root && go run .
@@ -31,6 +31,9 @@ func GenerateSharedTemporaryDirectory() (string, error) {
 	// Retrieve the operating system's temporary directory
 	tmp := os.TempDir()
 	tmpPrefix := path.Join(tmp, "functron")
+	if err := os.MkdirAll(tmpPrefix, 0755); err != nil {
+		return "", err
+	}
 	return ioutil.TempDir(tmpPrefix, "functron-invocation")
 }
 
@@ -6,6 +6,8 @@ import (
 	"path/filepath"
 	"fmt"
 	"os"
+
+	"github.com/Sentimentron/functron/metrics"
 )
 
 func UnpackTarIntoDirectory(reader *tar.Reader, dir string) error {
@@ -24,7 +26,7 @@ func UnpackTarIntoDirectory(reader *tar.Reader, dir string) error {
 		target := filepath.Join(dir, header.Name)
 		absTarget, err := filepath.Abs(target)
 		if !filepath.HasPrefix(absTarget, dir) {
-			return fmt.Errorf("DirectoryUnpackSecurityError: expected prefix with '{}', have '{}'", dir, absTarget)
+			return fmt.Errorf("DirectoryUnpackSecurityError: expected prefix with '%s', have '%s'", dir, absTarget)
 		}
 		target = absTarget
 		// Do something
@@ -32,7 +34,7 @@ func UnpackTarIntoDirectory(reader *tar.Reader, dir string) error {
 		case tar.TypeDir:
 			permBits := header.FileInfo().Mode() & 0x1F
 			if err := os.MkdirAll(absTarget, permBits); err != nil {
-				return fmt.Errorf("UnpackError: could not create directory at '{}' (error was '{}')", absTarget, err)
+				return fmt.Errorf("UnpackError: could not create directory at '%s' (error was '%s')", absTarget, err)
 			}
 		case tar.TypeReg:
 			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
@@ -41,10 +43,11 @@ func UnpackTarIntoDirectory(reader *tar.Reader, dir string) error {
 			}
 			defer f.Close()
 
-			if _, err := io.Copy(f, reader); err != nil {
-				return fmt.Errorf("UnpackError: could not create file at '{}' (error was '{}')", absTarget, err)
+			written, err := io.Copy(f, reader)
+			metrics.BytesUnpacked.Add(float64(written))
+			if err != nil {
+				return fmt.Errorf("UnpackError: could not create file at '%s' (error was '%s')", absTarget, err)
 			}
 		}
 	}
-	return nil
 }
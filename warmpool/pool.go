@@ -0,0 +1,522 @@
+// Package warmpool keeps containers ready to run registered functions, so
+// that invoking one doesn't wait for a container to be created. Each
+// version of a function is built into an image once, and kept until the
+// function's replaced or deleted, or the image is evicted to save disk,
+// in which case it's built again on the next invocation. Every container
+// holds a reference to its image through the image library, so the image
+// can't be deleted from under it.
+package warmpool
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/configuration"
+	"github.com/Sentimentron/functron/executor"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/library"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/metrics"
+)
+
+// Function describes a version of a registered function.
+type Function struct {
+	Name         string
+	Dockerfile   string
+	BuildContext []byte
+	// Security confines the function's containers, and Network is the
+	// Docker network they join
+	Security interfaces.Security
+	Network  string
+	// Env is the environment the invocation will be run with. Ready
+	// containers' environment is fixed when they're created, so an
+	// invocation with one runs a new container from the function's image
+	// instead.
+	Env []string
+}
+
+// version names fn's image after the function, what it's built from, and
+// how its containers are confined, so that re-registering a function with
+// different code, or changing its security profile or network, replaces
+// the containers which are ready. Env isn't included, since it's given to
+// each invocation.
+func (fn Function) version() string {
+	h := sha256.New()
+	h.Write([]byte(fn.Dockerfile))
+	h.Write([]byte{0})
+	h.Write(fn.BuildContext)
+	h.Write([]byte{0})
+	// Maps are encoded in key order, so this is stable
+	security, _ := json.Marshal(fn.Security)
+	h.Write(security)
+	h.Write([]byte{0})
+	h.Write([]byte(fn.Network))
+	return fmt.Sprintf("%s-%x", fn.Name, h.Sum(nil)[:6])
+}
+
+// Pool keeps containers ready for each registered function which has been
+// invoked. The number kept follows how many invocations of the function
+// ran at once since the pool was last resized.
+type Pool struct {
+	executor *executor.Executor
+	library  interfaces.ImageLibrary
+	config   configuration.WarmPoolConfig
+
+	lock sync.Mutex
+	// functions holds the current version of each function, by name
+	functions map[string]*function
+}
+
+// function is the image and containers for one version of a function.
+type function struct {
+	name     string
+	version  string
+	security interfaces.Security
+	network  string
+	logger   *logging.Logger
+
+	// built is closed once the image has been built, or has failed to
+	built     chan struct{}
+	workspace *executor.Workspace
+	buildErr  *api.Error
+
+	ready []*container
+	// inUse counts invocations which have acquired, or are waiting for, a
+	// container; peak is the most there have been since the last resize
+	inUse    int
+	peak     int
+	lastUsed time.Time
+	filling  bool
+	// retired functions have been replaced or deleted: their image is
+	// deleted once nothing's using it
+	retired bool
+	removed bool
+	// evicted functions' images were removed by the image library's
+	// garbage collector, so have to be built again
+	evicted bool
+}
+
+// container is a pooled container, and its reference to its image. For
+// invocations which need an environment of their own, the container isn't
+// created until it's run, and Container is nil.
+type container struct {
+	*executor.Container
+	handle interfaces.OpaqueImageHandle
+}
+
+// CreatePool returns a Pool which builds and runs functions with e, and
+// holds references to their images in lib.
+func CreatePool(e *executor.Executor, lib interfaces.ImageLibrary, config configuration.WarmPoolConfig) *Pool {
+	return &Pool{
+		executor:  e,
+		library:   lib,
+		config:    config,
+		functions: make(map[string]*function),
+	}
+}
+
+// Container is a container which has been acquired to run a function
+// once.
+type Container struct {
+	pool      *Pool
+	function  *function
+	container *container
+}
+
+// Run starts the container, as executor.Workspace.Run would run a new one,
+// and gives it up. Containers acquired for an invocation with an
+// environment are run with req.Env.
+func (c *Container) Run(ctx context.Context, req executor.RunRequest) (*executor.RunResult, *api.Error) {
+	var result *executor.RunResult
+	var apiErr *api.Error
+	if c.container.Container != nil {
+		result, apiErr = c.container.Run(ctx, req)
+	} else {
+		req.Security, req.Network = c.function.security, c.function.network
+		result, apiErr = c.function.workspace.Run(ctx, req)
+	}
+	if err := c.pool.library.ReleaseImage(c.container.handle); err != nil {
+		c.function.logger.WithField("error", err).Warnf("Could not release image")
+	}
+	c.pool.finish(c.function)
+	return result, apiErr
+}
+
+// Acquire returns a container which is ready to run fn, and starts
+// replacing it in the background. If fn has an Env, the container is only
+// created when it's run, but fn's image is still kept ready. If fn's image
+// hadn't been built, it's built first, and the Workspace is returned so
+// that the build can be reported (even if it failed). The caller must Run
+// the container.
+func (p *Pool) Acquire(ctx context.Context, fn Function) (*Container, *executor.Workspace, *api.Error) {
+	f, builder := p.lookup(fn)
+	var built *executor.Workspace
+	if builder {
+		built = p.build(ctx, f, fn)
+	}
+	<-f.built
+	if f.buildErr != nil {
+		p.finish(f)
+		return nil, built, f.buildErr
+	}
+
+	var c *container
+	if len(fn.Env) == 0 {
+		p.lock.Lock()
+		if n := len(f.ready); n > 0 {
+			c = f.ready[n-1]
+			f.setReady(f.ready[:n-1])
+		}
+		p.lock.Unlock()
+	}
+
+	if c != nil {
+		metrics.WarmStarts.WithLabelValues(fn.Name, "hit").Inc()
+	} else {
+		metrics.WarmStarts.WithLabelValues(fn.Name, "miss").Inc()
+		var apiErr *api.Error
+		if c, apiErr = p.create(ctx, f, len(fn.Env) == 0); apiErr != nil {
+			p.finish(f)
+			if built == nil && p.wasEvicted(f) {
+				// Build the image again
+				return p.Acquire(ctx, fn)
+			}
+			return nil, built, apiErr
+		}
+	}
+
+	go p.fill(f)
+	return &Container{p, f, c}, built, nil
+}
+
+// lookup finds the pool for fn's current version, retiring any other, and
+// counts the caller as using it. If the caller's the first, it must build
+// the image.
+func (p *Pool) lookup(fn Function) (*function, bool) {
+	version := fn.version()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	f := p.functions[fn.Name]
+	builder := false
+	if f == nil || f.version != version {
+		if f != nil {
+			p.retire(f)
+		}
+		f = &function{
+			name:     fn.Name,
+			version:  version,
+			security: fn.Security,
+			network:  fn.Network,
+			logger:   logging.Default().WithFields(logging.Fields{"function": fn.Name, "image": version}),
+			built:    make(chan struct{}),
+		}
+		p.functions[fn.Name] = f
+		builder = true
+	}
+
+	f.inUse++
+	if f.inUse > f.peak {
+		f.peak = f.inUse
+	}
+	f.lastUsed = time.Now()
+	return f, builder
+}
+
+// build builds f's image, and lets everyone waiting for it know. If the
+// build fails, f is forgotten so that the next invocation tries again.
+func (p *Pool) build(ctx context.Context, f *function, fn Function) *executor.Workspace {
+	w, apiErr := p.executor.Build(ctx, executor.BuildRequest{
+		FunctionName: fn.Name,
+		RequestID:    f.version,
+		Dockerfile:   fn.Dockerfile,
+		BuildContext: bytes.NewReader(fn.BuildContext),
+		Image:        library.FormatToFunctronImageName(f.version),
+	})
+	if apiErr != nil && w != nil {
+		w.Close(ctx)
+	} else if apiErr == nil {
+		// If the previous version with this name was deleted while it
+		// was in use, its references now hold an untagged image
+		p.library.ImageRebuilt(f.version)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	f.workspace, f.buildErr = w, apiErr
+	if apiErr != nil && p.functions[f.name] == f {
+		delete(p.functions, f.name)
+	}
+	close(f.built)
+	return w
+}
+
+// create creates a container for f, holding a reference to its image. If
+// docker is false, only the reference is taken, and the container is
+// created when it's run. Containers can be kept ready indefinitely, so
+// their references aren't reported as leaks.
+func (p *Pool) create(ctx context.Context, f *function, docker bool) (*container, *api.Error) {
+	acquire := p.library.AcquireImage
+	if docker {
+		acquire = p.library.AcquireLongLivedImage
+	}
+	handle, err := acquire(f.version)
+	if err == interfaces.ImageNotBuilt || err == interfaces.ImageBeingRemoved {
+		p.evict(f)
+	}
+	if err != nil {
+		f.logger.WithField("error", err).Warnf("Could not acquire image")
+		return nil, api.NewError(api.ErrRunFailed, "could not acquire image %s: %s", f.version, err)
+	}
+	if !docker {
+		return &container{nil, handle}, nil
+	}
+	c, apiErr := f.workspace.Create(ctx, f.security, f.network)
+	if apiErr != nil {
+		p.library.ReleaseImage(handle)
+		return nil, apiErr
+	}
+	return &container{c, handle}, nil
+}
+
+// evict retires f, whose image was evicted while nothing was using it, or
+// deleted while its containers were ready, so that the next invocation
+// builds it again. Either way, nobody needs to delete it.
+func (p *Pool) evict(f *function) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	f.evicted = true
+	if p.functions[f.name] == f {
+		f.logger.Infof("Image was evicted or deleted")
+		p.retire(f)
+	}
+}
+
+// wasEvicted checks whether f's image was evicted.
+func (p *Pool) wasEvicted(f *function) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return f.evicted
+}
+
+// discard removes a container which won't be run, and gives up its image.
+func (p *Pool) discard(f *function, c *container) {
+	c.Remove(context.Background())
+	if err := p.library.ReleaseImage(c.handle); err != nil {
+		f.logger.WithField("error", err).Warnf("Could not release image")
+	}
+}
+
+// fill creates containers for f until it has as many ready as its target.
+// Only one fill runs for each function at a time, once it's been built.
+func (p *Pool) fill(f *function) {
+	select {
+	case <-f.built:
+	default:
+		return
+	}
+
+	p.lock.Lock()
+	if f.filling || f.retired || f.buildErr != nil {
+		p.lock.Unlock()
+		return
+	}
+	f.filling = true
+	p.lock.Unlock()
+
+	defer func() {
+		p.lock.Lock()
+		f.filling = false
+		unused := f.unused()
+		p.lock.Unlock()
+		if unused {
+			p.removeImage(f)
+		}
+	}()
+
+	for {
+		p.lock.Lock()
+		done := f.retired || len(f.ready) >= p.target(f)
+		p.lock.Unlock()
+		if done {
+			return
+		}
+
+		c, apiErr := p.create(context.Background(), f, true)
+		if apiErr != nil {
+			return
+		}
+
+		p.lock.Lock()
+		retired := f.retired
+		if !retired {
+			f.setReady(append(f.ready, c))
+		}
+		p.lock.Unlock()
+		if retired {
+			p.discard(f, c)
+		}
+	}
+}
+
+// finish records that an invocation of f is done with it.
+func (p *Pool) finish(f *function) {
+	p.lock.Lock()
+	f.inUse--
+	unused := f.unused()
+	p.lock.Unlock()
+	if unused {
+		p.removeImage(f)
+	}
+}
+
+// target returns how many containers f should have ready: as many as ran
+// at once since the last resize, unless it's been idle since then. It
+// must be called with the lock held.
+func (p *Pool) target(f *function) int {
+	target := f.peak
+	if time.Since(f.lastUsed) > time.Duration(p.config.IdleSeconds)*time.Second {
+		target = 0
+	}
+	if target < p.config.MinContainers {
+		target = p.config.MinContainers
+	}
+	if target > p.config.MaxContainers {
+		target = p.config.MaxContainers
+	}
+	return target
+}
+
+// resize removes containers which f's recent demand doesn't need, tops it
+// up if it needs more, and starts measuring its demand again.
+func (p *Pool) resize(f *function) {
+	p.lock.Lock()
+	var excess []*container
+	if target := p.target(f); len(f.ready) > target {
+		excess = append(excess, f.ready[target:]...)
+		f.setReady(f.ready[:target])
+		f.logger.WithField("containers", target).Infof("Shrinking warm pool")
+	}
+	f.peak = f.inUse
+	p.lock.Unlock()
+
+	for _, c := range excess {
+		p.discard(f, c)
+	}
+	go p.fill(f)
+}
+
+// Maintain resizes every function's pool every IdleSeconds, until ctx is
+// done, when it retires them all.
+func (p *Pool) Maintain(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(p.config.IdleSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			p.Close()
+			return
+		}
+
+		p.lock.Lock()
+		functions := make([]*function, 0, len(p.functions))
+		for _, f := range p.functions {
+			functions = append(functions, f)
+		}
+		p.lock.Unlock()
+
+		for _, f := range functions {
+			p.resize(f)
+		}
+	}
+}
+
+// Retire removes the containers and image for a function which has been
+// replaced or deleted. Invocations which are already running finish with
+// the old version, and its image is deleted once they're done.
+func (p *Pool) Retire(name string) {
+	p.lock.Lock()
+	f := p.functions[name]
+	if f != nil {
+		p.retire(f)
+	}
+	p.lock.Unlock()
+}
+
+// Close retires every function.
+func (p *Pool) Close() {
+	p.lock.Lock()
+	for _, f := range p.functions {
+		p.retire(f)
+	}
+	p.lock.Unlock()
+}
+
+// retire forgets f, and removes its containers and image in the background.
+// It must be called with the lock held.
+func (p *Pool) retire(f *function) {
+	delete(p.functions, f.name)
+	f.retired = true
+	ready := f.ready
+	f.setReady(nil)
+	unused := f.unused()
+	f.logger.Infof("Retiring warm pool")
+
+	go func() {
+		for _, c := range ready {
+			p.discard(f, c)
+		}
+		if unused {
+			p.removeImage(f)
+		}
+	}()
+}
+
+// removeImage deletes a retired function's image and workspace.
+func (p *Pool) removeImage(f *function) {
+	if p.wasEvicted(f) {
+		// There's nothing left to delete, and the eviction was recorded
+	} else if err := p.library.DeleteImage(f.version); err == nil || err == interfaces.ImageRemovalDeferred {
+		f.workspace.RecordRemoval("removed from the warm pool")
+	} else {
+		metrics.CleanupFailures.WithLabelValues("image").Inc()
+		f.logger.WithField("error", err).Warnf("Failed to remove image")
+	}
+	if err := os.RemoveAll(f.workspace.Dir); err != nil {
+		metrics.CleanupFailures.WithLabelValues("directory").Inc()
+		f.logger.WithFields(logging.Fields{"dir": f.workspace.Dir, "error": err}).Warnf("Failed to remove directory")
+	}
+}
+
+// unused checks whether f's image should be deleted now: it's retired,
+// built, nothing's using it, and nobody else has been told to delete it.
+// It must be called with the lock held.
+func (f *function) unused() bool {
+	select {
+	case <-f.built:
+	default:
+		return false
+	}
+	if !f.retired || f.removed || f.buildErr != nil || f.inUse > 0 || f.filling {
+		return false
+	}
+	f.removed = true
+	return true
+}
+
+// setReady replaces f's ready containers. It must be called with the lock
+// held.
+func (f *function) setReady(ready []*container) {
+	f.ready = ready
+	metrics.WarmContainers.WithLabelValues(f.name).Set(float64(len(ready)))
+}
@@ -0,0 +1,221 @@
+package warmpool
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/configuration"
+	"github.com/Sentimentron/functron/docker/dockertest"
+	"github.com/Sentimentron/functron/executor"
+	"github.com/Sentimentron/functron/interfaces"
+	"github.com/Sentimentron/functron/library"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// eventually waits up to a second for condition to become true, since
+// pools are filled and emptied in the background.
+func eventually(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+// imageNames lists the images which runtime has built, including untagged
+// ones, as "<none>".
+func imageNames(runtime *dockertest.FakeRuntime) []string {
+	ret := make([]string, 0)
+	images, _ := runtime.ListImages()
+	for _, line := range strings.Split(images, "\n") {
+		if line != "" {
+			ret = append(ret, strings.Split(line, "\t")[0])
+		}
+	}
+	return ret
+}
+
+func TestPool(t *testing.T) {
+	Convey("Given a warm pool with a fake runtime...", t, func() {
+		runtime := dockertest.CreateFakeRuntime()
+		lib := library.CreateDockerImageLibrary(runtime)
+		p := CreatePool(executor.CreateExecutor(runtime), lib, configuration.WarmPoolConfig{
+			MaxContainers: 2,
+			IdleSeconds:   60,
+		})
+		fn := Function{Name: "echo", Dockerfile: "FROM alpine\nCMD cat\n"}
+		ctx := context.Background()
+
+		invoke := func(fn Function, stdin string) (*executor.RunResult, *executor.Workspace) {
+			c, w, apiErr := p.Acquire(ctx, fn)
+			So(apiErr, ShouldBeNil)
+			result, apiErr := c.Run(ctx, executor.RunRequest{Stdin: strings.NewReader(stdin), Timeout: time.Second, Env: fn.Env})
+			So(apiErr, ShouldBeNil)
+			return result, w
+		}
+
+		Convey("The first invocation should build the image, and report the build...", func() {
+			result, w := invoke(fn, "hello")
+			So(string(result.Stdout), ShouldEqual, "hello")
+			So(w, ShouldNotBeNil)
+			So(w.Image, ShouldEqual, library.FormatToFunctronImageName(fn.version()))
+
+			Convey("Afterwards a container should be kept ready, holding the image...", func() {
+				So(eventually(func() bool { return runtime.ContainerCount() == 1 }), ShouldBeTrue)
+				So(lib.DeleteImage(fn.version()), ShouldEqual, interfaces.ImageRemovalDeferred)
+			})
+
+			Convey("The next invocation should use the ready container...", func() {
+				So(eventually(func() bool { return runtime.ContainerCount() == 1 }), ShouldBeTrue)
+				result, w := invoke(fn, "again")
+				So(string(result.Stdout), ShouldEqual, "again")
+				So(w, ShouldBeNil)
+				So(runtime.BuildCount(), ShouldEqual, 1)
+			})
+
+			Convey("Retiring the function should remove its containers and image...", func() {
+				So(eventually(func() bool { return runtime.ContainerCount() == 1 }), ShouldBeTrue)
+				p.Retire(fn.Name)
+				So(eventually(func() bool {
+					return runtime.ContainerCount() == 0 && len(imageNames(runtime)) == 0
+				}), ShouldBeTrue)
+			})
+
+			Convey("A new version should replace the old one...", func() {
+				So(eventually(func() bool { return runtime.ContainerCount() == 1 }), ShouldBeTrue)
+				old := fn.version()
+				fn.Dockerfile = "FROM alpine:3\nCMD cat\n"
+				_, w := invoke(fn, "new")
+				So(w, ShouldNotBeNil)
+				So(eventually(func() bool {
+					images := imageNames(runtime)
+					return len(images) == 1 && images[0] == library.FormatToFunctronImageName(fn.version())
+				}), ShouldBeTrue)
+				So(old, ShouldNotEqual, fn.version())
+			})
+
+			Convey("If its image is deleted while containers are ready, it should be built again...", func() {
+				So(eventually(func() bool { return runtime.ContainerCount() == 1 }), ShouldBeTrue)
+				So(lib.DeleteImage(fn.version()), ShouldEqual, interfaces.ImageRemovalDeferred)
+				So(lib.Leaks(0), ShouldBeEmpty)
+
+				// The ready container was taken before the image was deleted
+				result, w := invoke(fn, "first")
+				So(string(result.Stdout), ShouldEqual, "first")
+				So(w, ShouldBeNil)
+
+				result, w = invoke(fn, "rebuilt")
+				So(string(result.Stdout), ShouldEqual, "rebuilt")
+				So(w, ShouldNotBeNil)
+				So(runtime.BuildCount(), ShouldEqual, 2)
+				// The old image, which the first container held, is removed
+				// once it's released, rather than left untagged
+				So(eventually(func() bool {
+					return runtime.ContainerCount() == 1 && len(imageNames(runtime)) == 1
+				}), ShouldBeTrue)
+				So(imageNames(runtime), ShouldResemble, []string{library.FormatToFunctronImageName(fn.version())})
+			})
+
+			Convey("Changing its security settings or network should replace it...", func() {
+				So(eventually(func() bool { return runtime.ContainerCount() == 1 }), ShouldBeTrue)
+				confined := fn
+				confined.Security = interfaces.Security{ReadOnlyRootfs: true}
+				So(confined.version(), ShouldNotEqual, fn.version())
+				networked := fn
+				networked.Network = "bridge"
+				So(networked.version(), ShouldNotEqual, fn.version())
+
+				_, w := invoke(confined, "")
+				So(w, ShouldNotBeNil)
+				So(eventually(func() bool {
+					images := imageNames(runtime)
+					return runtime.ContainerCount() == 1 && len(images) == 1 &&
+						images[0] == library.FormatToFunctronImageName(confined.version())
+				}), ShouldBeTrue)
+			})
+
+			Convey("Once the function goes idle, its pool should shrink...", func() {
+				So(eventually(func() bool { return runtime.ContainerCount() == 1 }), ShouldBeTrue)
+				p.lock.Lock()
+				f := p.functions[fn.Name]
+				f.lastUsed = time.Now().Add(-time.Hour)
+				p.lock.Unlock()
+				p.resize(f)
+				So(eventually(func() bool { return runtime.ContainerCount() == 0 }), ShouldBeTrue)
+				So(lib.DeleteImage(fn.version()), ShouldBeNil)
+			})
+
+			Convey("If its idle image is evicted, the next invocation should build it again...", func() {
+				So(eventually(func() bool { return runtime.ContainerCount() == 1 }), ShouldBeTrue)
+				p.lock.Lock()
+				f := p.functions[fn.Name]
+				f.lastUsed = time.Now().Add(-time.Hour)
+				p.lock.Unlock()
+				p.resize(f)
+				So(eventually(func() bool { return runtime.ContainerCount() == 0 }), ShouldBeTrue)
+
+				runtime.ImageSizes[library.FormatToFunctronImageName(fn.version())] = 100
+				evictions, err := lib.CollectGarbage(ctx, library.GCPolicy{BudgetBytes: 10})
+				So(err, ShouldBeNil)
+				So(evictions, ShouldHaveLength, 1)
+
+				result, w := invoke(fn, "rebuilt")
+				So(string(result.Stdout), ShouldEqual, "rebuilt")
+				So(w, ShouldNotBeNil)
+				So(runtime.BuildCount(), ShouldEqual, 2)
+				So(eventually(func() bool { return runtime.ContainerCount() == 1 }), ShouldBeTrue)
+			})
+		})
+
+		Convey("Concurrent invocations should grow the pool, up to MaxContainers...", func() {
+			invoke(fn, "")
+			containers := make([]*Container, 0)
+			for i := 0; i < 3; i++ {
+				c, _, apiErr := p.Acquire(ctx, fn)
+				So(apiErr, ShouldBeNil)
+				containers = append(containers, c)
+			}
+			for _, c := range containers {
+				_, apiErr := c.Run(ctx, executor.RunRequest{Timeout: time.Second})
+				So(apiErr, ShouldBeNil)
+			}
+			p.lock.Lock()
+			peak := p.functions[fn.Name].peak
+			p.lock.Unlock()
+			So(peak, ShouldEqual, 3)
+			So(eventually(func() bool { return runtime.ContainerCount() == 2 }), ShouldBeTrue)
+		})
+
+		Convey("Invocations with an environment should run a new container with it...", func() {
+			invoke(fn, "")
+			So(eventually(func() bool { return runtime.ContainerCount() == 1 }), ShouldBeTrue)
+			runtime.RunFunc = func(ctx context.Context, spec interfaces.RunSpec) (int, error) {
+				_, err := spec.Stdout.Write([]byte(strings.Join(spec.Env, ",")))
+				return 0, err
+			}
+			withEnv := fn
+			withEnv.Env = []string{"GREETING=hello"}
+			result, w := invoke(withEnv, "")
+			So(string(result.Stdout), ShouldEqual, "GREETING=hello")
+			So(w, ShouldBeNil)
+			So(runtime.BuildCount(), ShouldEqual, 1)
+			So(runtime.ContainerCount(), ShouldEqual, 1)
+		})
+
+		Convey("A failed build should be reported, and tried again next time...", func() {
+			runtime.FailBuild = true
+			_, w, apiErr := p.Acquire(ctx, fn)
+			So(apiErr.Code, ShouldEqual, api.ErrBuildFailed)
+			So(string(w.BuildStderr), ShouldEqual, "build failed\n")
+
+			runtime.FailBuild = false
+			result, _ := invoke(fn, "hello")
+			So(string(result.Stdout), ShouldEqual, "hello")
+			So(runtime.BuildCount(), ShouldEqual, 2)
+		})
+	})
+}
@@ -0,0 +1,250 @@
+// Package webhook delivers job results to the callback URLs they were
+// submitted with. Each delivery is signed with a secret belonging to the
+// API key which submitted the job, and is retried with exponential backoff
+// until the receiver accepts it or it runs out of attempts. Deliveries and
+// every attempt at them are kept in the store, so pending deliveries carry
+// on after a restart.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/configuration"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/metrics"
+	"github.com/Sentimentron/functron/models"
+)
+
+// Store is where a Dispatcher keeps deliveries.
+type Store interface {
+	RetrieveWebhookSecret(apiKeyId int64) (*models.WebhookSecret, error)
+	CreateWebhookDelivery(delivery *models.WebhookDelivery) (*models.WebhookDelivery, error)
+	RecordWebhookAttempt(attempt *models.WebhookAttempt, status string, nextAttempt *time.Time) error
+	RetrievePendingWebhookDeliveries() ([]models.WebhookDelivery, error)
+}
+
+// GenerateSecret returns a new, random webhook secret.
+func GenerateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Dispatcher makes deliveries in the background.
+type Dispatcher struct {
+	store   Store
+	config  configuration.WebhookConfig
+	policy  *hostPolicy
+	client  *http.Client
+	running sync.WaitGroup
+	// ctx is cancelled by Stop, to interrupt deliveries waiting to retry
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+// CreateDispatcher returns a Dispatcher which keeps deliveries in store,
+// filling in any of config's fields which are zero.
+func CreateDispatcher(store Store, config configuration.WebhookConfig) *Dispatcher {
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = 8
+	}
+	if config.InitialDelaySeconds == 0 {
+		config.InitialDelaySeconds = 10
+	}
+	if config.MaxDelaySeconds == 0 {
+		config.MaxDelaySeconds = 3600
+	}
+	if config.TimeoutSeconds == 0 {
+		config.TimeoutSeconds = 10
+	}
+	policy := createHostPolicy(config)
+	ctx, stop := context.WithCancel(context.Background())
+	return &Dispatcher{
+		store:  store,
+		config: config,
+		policy: policy,
+		client: policy.client(seconds(config.TimeoutSeconds)),
+		ctx:    ctx,
+		stop:   stop,
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// CheckURL checks that deliveries can be made to callback's host. It's
+// checked again when each delivery is made, since the host's name could
+// point somewhere else by then.
+func (d *Dispatcher) CheckURL(callback string) error {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return err
+	}
+	return d.policy.checkURL(u)
+}
+
+// Send saves a delivery of payload to url, signed with the secret of the
+// key with apiKeyId, and starts making it.
+func (d *Dispatcher) Send(jobId string, apiKeyId int64, url string, payload []byte) (*models.WebhookDelivery, error) {
+	delivery, err := d.store.CreateWebhookDelivery(&models.WebhookDelivery{
+		JobId:    jobId,
+		APIKeyId: apiKeyId,
+		URL:      url,
+		Payload:  payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.start(delivery)
+	return delivery, nil
+}
+
+// Resume carries on with every delivery which was pending when the server
+// last stopped.
+func (d *Dispatcher) Resume() error {
+	deliveries, err := d.store.RetrievePendingWebhookDeliveries()
+	if err != nil {
+		return err
+	}
+	for i := range deliveries {
+		d.start(&deliveries[i])
+	}
+	return nil
+}
+
+// Wait blocks until every delivery the Dispatcher has started has been
+// delivered or has failed, or until Stop interrupts them.
+func (d *Dispatcher) Wait() {
+	d.running.Wait()
+}
+
+// Stop interrupts deliveries which are waiting to be retried, waits for
+// attempts which are under way, and stops new deliveries from starting.
+// Interrupted deliveries are still pending, so Resume carries on with them
+// when the server next starts.
+func (d *Dispatcher) Stop() {
+	d.stop()
+	d.running.Wait()
+}
+
+func (d *Dispatcher) start(delivery *models.WebhookDelivery) {
+	d.running.Add(1)
+	go func() {
+		defer d.running.Done()
+		d.deliver(d.ctx, delivery)
+	}()
+}
+
+// deliver attempts delivery until it succeeds, runs out of attempts or
+// ctx is done, waiting longer after each failure.
+func (d *Dispatcher) deliver(ctx context.Context, delivery *models.WebhookDelivery) {
+	logger := logging.Default().WithFields(logging.Fields{"job_id": delivery.JobId, "delivery": delivery.Id})
+	for attempt := delivery.Attempts + 1; ; attempt++ {
+		if delivery.NextAttempt != nil {
+			timer := time.NewTimer(time.Until(*delivery.NextAttempt))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				logger.Debugf("Interrupted webhook delivery")
+				return
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+
+		record := d.attempt(delivery, attempt)
+		status, result := models.WebhookPending, "retried"
+		var next *time.Time
+		switch {
+		case record.Error == "":
+			status, result = models.WebhookDelivered, "delivered"
+		case attempt >= d.config.MaxAttempts:
+			status, result = models.WebhookFailed, "failed"
+		default:
+			t := time.Now().Add(d.backoff(attempt))
+			next = &t
+		}
+		metrics.WebhookAttempts.WithLabelValues(result).Inc()
+
+		attemptLogger := logger.WithFields(logging.Fields{"attempt": attempt, "status": status})
+		if record.Error != "" {
+			attemptLogger = attemptLogger.WithField("error", record.Error)
+		}
+		attemptLogger.Infof("Attempted webhook delivery")
+
+		if err := d.store.RecordWebhookAttempt(record, status, next); err != nil {
+			// It'll be picked up again when the server restarts
+			logger.WithField("error", err).Errorf("Could not record webhook attempt")
+			return
+		}
+		if status != models.WebhookPending {
+			return
+		}
+		delivery.NextAttempt = next
+	}
+}
+
+// backoff returns how long to wait after a delivery's nth failed attempt.
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay := d.config.InitialDelaySeconds
+	for i := 1; i < attempt && delay < d.config.MaxDelaySeconds; i++ {
+		delay *= 2
+	}
+	if delay > d.config.MaxDelaySeconds {
+		delay = d.config.MaxDelaySeconds
+	}
+	return seconds(delay)
+}
+
+// attempt POSTs delivery once. It only succeeds if the receiver responds
+// with a 2xx status. The secret's looked up each time, so that rotating it
+// applies to retries.
+func (d *Dispatcher) attempt(delivery *models.WebhookDelivery, attempt int) *models.WebhookAttempt {
+	ret := &models.WebhookAttempt{DeliveryId: delivery.Id, Attempt: attempt, Started: time.Now()}
+	defer func() {
+		ret.DurationSeconds = time.Since(ret.Started).Seconds()
+	}()
+
+	secret, err := d.store.RetrieveWebhookSecret(delivery.APIKeyId)
+	if err != nil {
+		ret.Error = fmt.Sprintf("could not retrieve the webhook secret: %s", err)
+		return ret
+	}
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		ret.Error = err.Error()
+		return ret
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "functron-webhook")
+	req.Header.Set(api.WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(api.WebhookSignatureHeader, api.SignWebhook(secret.Secret, timestamp, delivery.Payload))
+	req.Header.Set(api.WebhookDeliveryHeader, strconv.FormatInt(delivery.Id, 10))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		ret.Error = err.Error()
+		return ret
+	}
+	resp.Body.Close()
+	ret.StatusCode = &resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		ret.Error = fmt.Sprintf("the receiver responded with %s", resp.Status)
+	}
+	return ret
+}
@@ -0,0 +1,164 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/configuration"
+	"github.com/Sentimentron/functron/database"
+	"github.com/Sentimentron/functron/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDispatcher(t *testing.T) {
+	Convey("Given a dispatcher and a receiver which fails at first...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "functronwebhooks")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		store, err := database.CreateStore(tmpFile.Name())
+		So(err, ShouldBeNil)
+		defer os.Remove(tmpFile.Name())
+
+		key, err := store.CreateAPIKey(&models.APIKey{Name: "hooks", Prefix: "fn_x", Hash: "x"})
+		So(err, ShouldBeNil)
+		secret, err := GenerateSecret()
+		So(err, ShouldBeNil)
+		_, err = store.SaveWebhookSecret(key.Id, secret)
+		So(err, ShouldBeNil)
+
+		var lock sync.Mutex
+		failures, received, verified := 2, 0, 0
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			lock.Lock()
+			defer lock.Unlock()
+			received++
+			if api.VerifyWebhook(secret, req.Header, body, time.Minute) == nil {
+				verified++
+			}
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer receiver.Close()
+
+		// The receiver's on the loopback interface
+		d := CreateDispatcher(store, configuration.WebhookConfig{MaxAttempts: 3, InitialDelaySeconds: 0.001, AllowPrivateAddresses: true})
+		attempts := func(id int64) []models.WebhookAttempt {
+			ret, err := store.RetrieveWebhookAttempts(id)
+			So(err, ShouldBeNil)
+			return ret
+		}
+
+		Convey("A delivery should be retried until it succeeds, and each attempt recorded...", func() {
+			delivery, err := d.Send("job", key.Id, receiver.URL, []byte(`{"event":"job.finished"}`))
+			So(err, ShouldBeNil)
+			d.Wait()
+
+			So(received, ShouldEqual, 3)
+			So(verified, ShouldEqual, 3)
+			recorded := attempts(delivery.Id)
+			So(recorded, ShouldHaveLength, 3)
+			So(*recorded[0].StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+			So(recorded[0].Error, ShouldContainSubstring, "503")
+			So(*recorded[2].StatusCode, ShouldEqual, http.StatusOK)
+
+			deliveries, err := store.RetrieveWebhookDeliveries("job")
+			So(err, ShouldBeNil)
+			So(deliveries[0].Status, ShouldEqual, models.WebhookDelivered)
+			So(deliveries[0].Attempts, ShouldEqual, 3)
+			So(deliveries[0].Finished, ShouldNotBeNil)
+		})
+
+		Convey("A delivery which runs out of attempts should fail...", func() {
+			failures = 10
+			delivery, err := d.Send("job", key.Id, receiver.URL, []byte("{}"))
+			So(err, ShouldBeNil)
+			d.Wait()
+
+			So(attempts(delivery.Id), ShouldHaveLength, 3)
+			pending, err := store.RetrievePendingWebhookDeliveries()
+			So(err, ShouldBeNil)
+			So(pending, ShouldBeEmpty)
+			deliveries, _ := store.RetrieveWebhookDeliveries("job")
+			So(deliveries[0].Status, ShouldEqual, models.WebhookFailed)
+		})
+
+		Convey("Pending deliveries should carry on after a restart...", func() {
+			failures = 0
+			delivery, err := store.CreateWebhookDelivery(&models.WebhookDelivery{
+				JobId: "job", APIKeyId: key.Id, URL: receiver.URL, Payload: []byte("{}"),
+			})
+			So(err, ShouldBeNil)
+			So(d.Resume(), ShouldBeNil)
+			d.Wait()
+			So(received, ShouldEqual, 1)
+			So(attempts(delivery.Id), ShouldHaveLength, 1)
+		})
+
+		Convey("Stopping should interrupt deliveries waiting to retry, and leave them pending...", func() {
+			failures = 1
+			d := CreateDispatcher(store, configuration.WebhookConfig{InitialDelaySeconds: 3600, AllowPrivateAddresses: true})
+			delivery, err := d.Send("job", key.Id, receiver.URL, []byte("{}"))
+			So(err, ShouldBeNil)
+			for len(attempts(delivery.Id)) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			stopped := make(chan struct{})
+			go func() {
+				d.Stop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Stop waited for the retry")
+			}
+			pending, err := store.RetrievePendingWebhookDeliveries()
+			So(err, ShouldBeNil)
+			So(pending, ShouldHaveLength, 1)
+		})
+
+		Convey("Private addresses should be refused unless they're allowed...", func() {
+			d := CreateDispatcher(store, configuration.WebhookConfig{MaxAttempts: 1})
+			So(d.CheckURL(receiver.URL), ShouldNotBeNil)
+			So(d.CheckURL("http://169.254.169.254/latest/meta-data"), ShouldNotBeNil)
+			So(d.CheckURL("https://hooks.example.com/x"), ShouldBeNil)
+
+			// Names are checked when they're connected to
+			delivery, err := d.Send("job", key.Id, strings.Replace(receiver.URL, "127.0.0.1", "localhost", 1), []byte("{}"))
+			So(err, ShouldBeNil)
+			d.Wait()
+			So(received, ShouldEqual, 0)
+			recorded := attempts(delivery.Id)
+			So(recorded, ShouldHaveLength, 1)
+			So(recorded[0].Error, ShouldContainSubstring, "public address")
+		})
+
+		Convey("Only allowed hosts should be accepted, and denied ones refused...", func() {
+			d := CreateDispatcher(store, configuration.WebhookConfig{
+				AllowedHosts: []string{"*.example.com"},
+				DeniedHosts:  []string{"internal.example.com"},
+			})
+			So(d.CheckURL("https://hooks.example.com/x"), ShouldBeNil)
+			So(d.CheckURL("https://internal.example.com/x"), ShouldEqual, ErrHostNotAllowed)
+			So(d.CheckURL("https://example.org/x"), ShouldEqual, ErrHostNotAllowed)
+		})
+
+		Convey("Backoff should double, up to the maximum...", func() {
+			d := CreateDispatcher(store, configuration.WebhookConfig{InitialDelaySeconds: 1, MaxDelaySeconds: 5})
+			So(d.backoff(1), ShouldEqual, time.Second)
+			So(d.backoff(3), ShouldEqual, 4*time.Second)
+			So(d.backoff(4), ShouldEqual, 5*time.Second)
+		})
+	})
+}
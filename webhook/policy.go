@@ -0,0 +1,113 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sentimentron/functron/configuration"
+)
+
+// ErrHostNotAllowed is returned for callback URLs whose host the
+// configuration doesn't allow deliveries to.
+var ErrHostNotAllowed = errors.New("webhook: callbacks can't be sent to this host")
+
+// hostPolicy decides which hosts deliveries can be made to, so that
+// callback URLs can't be used to reach services next to Functron.
+type hostPolicy struct {
+	allowed, denied []string
+	private         bool
+}
+
+func createHostPolicy(config configuration.WebhookConfig) *hostPolicy {
+	return &hostPolicy{allowed: config.AllowedHosts, denied: config.DeniedHosts, private: config.AllowPrivateAddresses}
+}
+
+// matchHost checks whether host is one of patterns, which are hostnames,
+// IP addresses, or "*.domain" for any of domain's subdomains.
+func matchHost(host string, patterns []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost checks host against the allowed and denied hosts, and, if it's
+// an IP address, that it's public.
+func (p *hostPolicy) checkHost(host string) error {
+	if matchHost(host, p.denied) || (len(p.allowed) > 0 && !matchHost(host, p.allowed)) {
+		return ErrHostNotAllowed
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(ip)
+	}
+	return nil
+}
+
+// checkIP checks that ip is public, unless private addresses are allowed.
+func (p *hostPolicy) checkIP(ip net.IP) error {
+	if p.private {
+		return nil
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("webhook: callbacks can't be sent to %s, which isn't a public address", ip)
+	}
+	return nil
+}
+
+// checkURL checks that a callback URL's host is allowed.
+func (p *hostPolicy) checkURL(u *url.URL) error {
+	return p.checkHost(u.Hostname())
+}
+
+// dialer returns a Dialer which refuses to connect to addresses the
+// policy doesn't allow. Names are resolved when they're dialled, so this
+// is checked every time, even if the name's been pointed elsewhere since
+// the callback was submitted.
+func (p *hostPolicy) dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("webhook: could not parse the address %s", host)
+			}
+			return p.checkIP(ip)
+		},
+	}
+}
+
+// client returns an HTTP client which only connects to allowed hosts,
+// including when it's redirected.
+func (p *hostPolicy) client(timeout time.Duration) *http.Client {
+	dialer := p.dialer(timeout)
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return p.checkURL(req.URL)
+		},
+	}
+}
@@ -0,0 +1,90 @@
+package workflow
+
+import (
+	"bytes"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/models"
+)
+
+// maxNodes is the most nodes a workflow can have.
+const maxNodes = 100
+
+// Validate checks that def's nodes have unique IDs, name valid functions,
+// only come after nodes which exist, and don't form a cycle.
+func Validate(def *api.WorkflowDefinition) *api.Error {
+	if len(def.Nodes) == 0 || len(def.Nodes) > maxNodes {
+		return api.NewError(api.ErrInvalidRequest, "a workflow needs between 1 and %d nodes, not %d", maxNodes, len(def.Nodes))
+	}
+
+	nodes := make(map[string]*api.WorkflowNode, len(def.Nodes))
+	for i := range def.Nodes {
+		n := &def.Nodes[i]
+		if n.ID == "" {
+			return api.NewError(api.ErrInvalidRequest, "node %d has no id", i)
+		}
+		if nodes[n.ID] != nil {
+			return api.NewError(api.ErrInvalidRequest, "there's more than one node with the id '%s'", n.ID)
+		}
+		if !models.ValidFunctionName(n.Function) {
+			return api.NewError(api.ErrInvalidRequest, "node '%s' has an invalid function name '%s'", n.ID, n.Function)
+		}
+		nodes[n.ID] = n
+	}
+	for _, n := range def.Nodes {
+		for _, dep := range n.After {
+			if nodes[dep] == nil {
+				return api.NewError(api.ErrInvalidRequest, "node '%s' comes after '%s', which doesn't exist", n.ID, dep)
+			}
+		}
+	}
+
+	// Depth-first search, looking for a node which is reached again while
+	// its own dependencies are still being visited
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(nodes))
+	var visit func(id string) *api.Error
+	visit = func(id string) *api.Error {
+		switch state[id] {
+		case visiting:
+			return api.NewError(api.ErrInvalidRequest, "node '%s' depends on itself", id)
+		case visited:
+			return nil
+		}
+		state[id] = visiting
+		for _, dep := range nodes[id].After {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[id] = visited
+		return nil
+	}
+	for _, n := range def.Nodes {
+		if err := visit(n.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitLines breaks a map node's input into one input per line, keeping
+// each line's newline and dropping blank lines.
+func splitLines(input []byte) [][]byte {
+	ret := make([][]byte, 0)
+	for len(input) > 0 {
+		line := input
+		if i := bytes.IndexByte(input, '\n'); i >= 0 {
+			line = input[:i+1]
+		}
+		input = input[len(line):]
+		if len(bytes.TrimSpace(line)) > 0 {
+			ret = append(ret, line)
+		}
+	}
+	return ret
+}
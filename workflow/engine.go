@@ -0,0 +1,376 @@
+// Package workflow runs workflows: directed acyclic graphs of registered
+// functions, where each node's input is the output of the nodes it comes
+// after. Every node's state, and the outcome of each of its tasks, is kept
+// in the store as it changes, so a workflow which was interrupted by a
+// restart carries on from where it was.
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/logging"
+	"github.com/Sentimentron/functron/models"
+)
+
+// Store is where an Engine keeps workflows.
+type Store interface {
+	CreateWorkflow(workflow *models.Workflow, nodeIds []string) (*models.Workflow, error)
+	RetrieveUnfinishedWorkflows() ([]models.Workflow, error)
+	FinishWorkflow(id string, status string) error
+	RetrieveWorkflowNodes(workflowId string) ([]models.WorkflowNode, error)
+	UpdateWorkflowNode(node *models.WorkflowNode) error
+	CreateWorkflowTasks(tasks []models.WorkflowTask) error
+	RetrieveWorkflowTasks(workflowId, nodeId string) ([]models.WorkflowTask, error)
+	UpdateWorkflowTask(task *models.WorkflowTask) error
+	CountWorkflowTasks(workflowId string) ([]models.WorkflowTaskCount, error)
+}
+
+// Result is the outcome of running a function once. Error is set if the
+// run failed, including if it exited with a non-zero status.
+type Result struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode *int
+	Error    *api.Error
+}
+
+// Invoker runs a registered function on behalf of a workflow.
+type Invoker func(ctx context.Context, workflow *models.Workflow, function string, stdin []byte) Result
+
+// Engine runs workflows in the background.
+type Engine struct {
+	store  Store
+	invoke Invoker
+	// parallelism is how many of a map node's tasks may run at once
+	parallelism int
+	running     sync.WaitGroup
+}
+
+// CreateEngine returns an Engine which keeps workflows in store, and runs
+// their functions with invoke, up to parallelism at a time for each node.
+func CreateEngine(store Store, invoke Invoker, parallelism int) *Engine {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	return &Engine{store: store, invoke: invoke, parallelism: parallelism}
+}
+
+// Submit saves a new workflow, which must be valid, and starts it.
+func (e *Engine) Submit(def api.WorkflowDefinition, stdin []byte, apiKeyId *int64) (*models.Workflow, error) {
+	definition, err := json.Marshal(def)
+	if err != nil {
+		return nil, err
+	}
+	nodeIds := make([]string, 0, len(def.Nodes))
+	for _, n := range def.Nodes {
+		nodeIds = append(nodeIds, n.ID)
+	}
+
+	wf, err := e.store.CreateWorkflow(&models.Workflow{
+		Id:         logging.NewRequestID(),
+		Definition: string(definition),
+		Stdin:      stdin,
+		Status:     models.WorkflowRunning,
+		APIKeyId:   apiKeyId,
+	}, nodeIds)
+	if err != nil {
+		return nil, err
+	}
+	e.start(wf)
+	return wf, nil
+}
+
+// Resume restarts every workflow which hadn't finished when the server
+// last stopped.
+func (e *Engine) Resume() error {
+	workflows, err := e.store.RetrieveUnfinishedWorkflows()
+	if err != nil {
+		return err
+	}
+	for i := range workflows {
+		logging.Default().WithField("workflow_id", workflows[i].Id).Infof("Resuming workflow")
+		e.start(&workflows[i])
+	}
+	return nil
+}
+
+// Wait blocks until every workflow the Engine has started has finished.
+func (e *Engine) Wait() {
+	e.running.Wait()
+}
+
+func (e *Engine) start(wf *models.Workflow) {
+	e.running.Add(1)
+	go func() {
+		defer e.running.Done()
+		e.run(wf)
+	}()
+}
+
+// run runs wf's nodes in waves: each wave runs, all at once, every node
+// whose dependencies have succeeded, and skips every node which comes
+// after one which didn't. Nodes left running by a restart run again, and
+// pick up their unfinished tasks.
+func (e *Engine) run(wf *models.Workflow) {
+	logger := logging.Default().WithField("workflow_id", wf.Id)
+	ctx := logging.NewContext(context.Background(), logger)
+
+	var def api.WorkflowDefinition
+	if err := json.Unmarshal([]byte(wf.Definition), &def); err != nil {
+		logger.WithField("error", err).Errorf("Could not decode workflow")
+		e.finish(logger, wf, models.WorkflowFailed)
+		return
+	}
+	nodes, err := e.retrieveNodes(wf.Id)
+	if err != nil {
+		logger.WithField("error", err).Errorf("Could not retrieve workflow nodes")
+		return
+	}
+
+	for {
+		ready := make([]api.WorkflowNode, 0)
+		for _, n := range def.Nodes {
+			state := nodes[n.ID]
+			if state.Status != models.WorkflowPending && state.Status != models.WorkflowRunning {
+				continue
+			}
+			switch dependencies(n, nodes) {
+			case models.WorkflowSucceeded:
+				ready = append(ready, n)
+			case models.WorkflowFailed:
+				now := time.Now()
+				state.Status, state.Finished = models.WorkflowSkipped, &now
+				if err := e.store.UpdateWorkflowNode(state); err != nil {
+					logger.WithField("error", err).Errorf("Could not skip workflow node")
+					return
+				}
+			}
+		}
+		if len(ready) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, len(ready))
+		for i, n := range ready {
+			wg.Add(1)
+			go func(i int, n api.WorkflowNode) {
+				defer wg.Done()
+				errs[i] = e.runNode(ctx, wf, n, nodes)
+			}(i, n)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				// The store's broken, so leave the workflow to be resumed
+				logger.WithField("error", err).Errorf("Could not save workflow node")
+				return
+			}
+		}
+	}
+
+	status := models.WorkflowSucceeded
+	for _, state := range nodes {
+		if state.Status != models.WorkflowSucceeded {
+			status = models.WorkflowFailed
+		}
+	}
+	e.finish(logger, wf, status)
+}
+
+func (e *Engine) finish(logger *logging.Logger, wf *models.Workflow, status string) {
+	if err := e.store.FinishWorkflow(wf.Id, status); err != nil {
+		logger.WithField("error", err).Errorf("Could not finish workflow")
+		return
+	}
+	logger.WithField("status", status).Infof("Workflow finished")
+}
+
+// retrieveNodes returns wf's nodes, by ID.
+func (e *Engine) retrieveNodes(workflowId string) (map[string]*models.WorkflowNode, error) {
+	nodes, err := e.store.RetrieveWorkflowNodes(workflowId)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]*models.WorkflowNode, len(nodes))
+	for i := range nodes {
+		ret[nodes[i].NodeId] = &nodes[i]
+	}
+	return ret, nil
+}
+
+// dependencies returns WorkflowSucceeded if every node n comes after has
+// succeeded, WorkflowFailed if any has failed or been skipped, and
+// WorkflowPending otherwise.
+func dependencies(n api.WorkflowNode, nodes map[string]*models.WorkflowNode) string {
+	ret := models.WorkflowSucceeded
+	for _, dep := range n.After {
+		switch nodes[dep].Status {
+		case models.WorkflowFailed, models.WorkflowSkipped:
+			return models.WorkflowFailed
+		case models.WorkflowSucceeded:
+		default:
+			ret = models.WorkflowPending
+		}
+	}
+	return ret
+}
+
+// runNode runs n's tasks, creating them first if it hasn't got any, and
+// records its outcome in nodes. Tasks which finished before a restart
+// aren't run again. It only returns an error if the store does.
+func (e *Engine) runNode(ctx context.Context, wf *models.Workflow, n api.WorkflowNode, nodes map[string]*models.WorkflowNode) error {
+	logger := logging.FromContext(ctx).WithFields(logging.Fields{"node": n.ID, "function": n.Function})
+	state := nodes[n.ID]
+	if state.Started == nil {
+		now := time.Now()
+		state.Started = &now
+	}
+	state.Status = models.WorkflowRunning
+	if err := e.store.UpdateWorkflowNode(state); err != nil {
+		return err
+	}
+
+	tasks, err := e.store.RetrieveWorkflowTasks(wf.Id, n.ID)
+	if err != nil {
+		return err
+	}
+	if len(tasks) == 0 {
+		tasks = createTasks(wf, n, nodes)
+		if err := e.store.CreateWorkflowTasks(tasks); err != nil {
+			return err
+		}
+	}
+	logger.WithField("tasks", len(tasks)).Infof("Running workflow node")
+
+	// Run the unfinished tasks, parallelism at a time
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var storeErr error
+	limit := make(chan struct{}, e.parallelism)
+	for i := range tasks {
+		task := &tasks[i]
+		if task.Status == models.WorkflowSucceeded || task.Status == models.WorkflowFailed {
+			continue
+		}
+		wg.Add(1)
+		limit <- struct{}{}
+		go func() {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+			result := e.invoke(ctx, wf, n.Function, task.Input)
+			task.Output, task.Stderr, task.ExitCode = result.Stdout, result.Stderr, result.ExitCode
+			task.Status = models.WorkflowSucceeded
+			if result.Error != nil {
+				task.Status = models.WorkflowFailed
+				task.Error = result.Error.Error()
+			}
+			if err := e.store.UpdateWorkflowTask(task); err != nil {
+				lock.Lock()
+				storeErr = err
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if storeErr != nil {
+		return storeErr
+	}
+
+	// The node's output is its tasks', in order
+	output := make([]byte, 0)
+	state.Status = models.WorkflowSucceeded
+	for _, task := range tasks {
+		if task.Status == models.WorkflowFailed {
+			state.Status = models.WorkflowFailed
+			state.Error = fmt.Sprintf("task %d: %s", task.Index, task.Error)
+			break
+		}
+		output = append(output, task.Output...)
+	}
+	if state.Status == models.WorkflowSucceeded {
+		state.Output = output
+	}
+	now := time.Now()
+	state.Finished = &now
+	logger.WithField("status", state.Status).Infof("Workflow node finished")
+	return e.store.UpdateWorkflowNode(state)
+}
+
+// createTasks works out n's input, and splits it into tasks: one for each
+// line if n's a map node, or just one.
+func createTasks(wf *models.Workflow, n api.WorkflowNode, nodes map[string]*models.WorkflowNode) []models.WorkflowTask {
+	input := wf.Stdin
+	if len(n.After) > 0 {
+		input = make([]byte, 0)
+		for _, dep := range n.After {
+			input = append(input, nodes[dep].Output...)
+		}
+	}
+
+	inputs := [][]byte{input}
+	if n.Map {
+		inputs = splitLines(input)
+	}
+	tasks := make([]models.WorkflowTask, 0, len(inputs))
+	for i, in := range inputs {
+		tasks = append(tasks, models.WorkflowTask{
+			WorkflowId: wf.Id,
+			NodeId:     n.ID,
+			Index:      i,
+			Input:      in,
+			Status:     models.WorkflowPending,
+		})
+	}
+	return tasks
+}
+
+// Describe returns wf's current state, including every node.
+func (e *Engine) Describe(wf *models.Workflow) (*api.Workflow, error) {
+	var def api.WorkflowDefinition
+	if err := json.Unmarshal([]byte(wf.Definition), &def); err != nil {
+		return nil, err
+	}
+	nodes, err := e.retrieveNodes(wf.Id)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := e.store.CountWorkflowTasks(wf.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &api.Workflow{
+		ID:       wf.Id,
+		Status:   api.WorkflowStatus(wf.Status),
+		Created:  wf.Created,
+		Finished: wf.Finished,
+		Nodes:    make([]api.NodeState, 0, len(def.Nodes)),
+	}
+	for _, n := range def.Nodes {
+		state := nodes[n.ID]
+		tasks := make(map[api.WorkflowStatus]int)
+		for _, c := range counts {
+			if c.NodeId == n.ID {
+				tasks[api.WorkflowStatus(c.Status)] = c.Count
+			}
+		}
+		ret.Nodes = append(ret.Nodes, api.NodeState{
+			WorkflowNode: n,
+			Status:       api.WorkflowStatus(state.Status),
+			Started:      state.Started,
+			Finished:     state.Finished,
+			Tasks:        tasks,
+			Output:       state.Output,
+			Error:        state.Error,
+		})
+	}
+	return ret, nil
+}
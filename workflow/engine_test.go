@@ -0,0 +1,167 @@
+package workflow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/Sentimentron/functron/api"
+	"github.com/Sentimentron/functron/database"
+	"github.com/Sentimentron/functron/models"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeFunctions runs a few functions in-process, and counts each run.
+type fakeFunctions struct {
+	lock  sync.Mutex
+	calls map[string]int
+}
+
+func (f *fakeFunctions) invoke(ctx context.Context, wf *models.Workflow, function string, stdin []byte) Result {
+	f.lock.Lock()
+	f.calls[function]++
+	f.lock.Unlock()
+
+	switch function {
+	case "split":
+		return Result{Stdout: bytes.Replace(stdin, []byte(" "), []byte("\n"), -1)}
+	case "upper":
+		return Result{Stdout: bytes.ToUpper(stdin)}
+	case "count":
+		return Result{Stdout: []byte(fmt.Sprintf("%d", bytes.Count(stdin, []byte("\n"))))}
+	}
+	return Result{Error: api.NewError(api.ErrNonZeroExit, "%s failed", function)}
+}
+
+func TestValidate(t *testing.T) {
+	Convey("Given workflow definitions...", t, func() {
+		node := func(id string, after ...string) api.WorkflowNode {
+			return api.WorkflowNode{ID: id, Function: "upper", After: after}
+		}
+		validate := func(nodes ...api.WorkflowNode) *api.Error {
+			return Validate(&api.WorkflowDefinition{Nodes: nodes})
+		}
+
+		Convey("A diamond should be valid...", func() {
+			So(validate(node("a"), node("b", "a"), node("c", "a"), node("d", "b", "c")), ShouldBeNil)
+		})
+		Convey("Empty workflows, duplicate IDs and unknown nodes should be refused...", func() {
+			So(validate(), ShouldNotBeNil)
+			So(validate(node("a"), node("a")), ShouldNotBeNil)
+			So(validate(node("a", "b")), ShouldNotBeNil)
+			So(validate(api.WorkflowNode{ID: "a", Function: "Not Valid"}), ShouldNotBeNil)
+		})
+		Convey("Cycles should be refused...", func() {
+			err := validate(node("a", "c"), node("b", "a"), node("c", "b"))
+			So(err, ShouldNotBeNil)
+			So(err.Code, ShouldEqual, api.ErrInvalidRequest)
+			So(validate(node("a", "a")), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestEngine(t *testing.T) {
+	Convey("Given an engine with a new store...", t, func() {
+		tmpFile, err := ioutil.TempFile("", "functronworkflows")
+		So(err, ShouldBeNil)
+		os.Remove(tmpFile.Name())
+		store, err := database.CreateStore(tmpFile.Name())
+		So(err, ShouldBeNil)
+		defer os.Remove(tmpFile.Name())
+
+		functions := &fakeFunctions{calls: make(map[string]int)}
+		engine := CreateEngine(store, functions.invoke, 2)
+
+		fanOut := api.WorkflowDefinition{Nodes: []api.WorkflowNode{
+			{ID: "split", Function: "split"},
+			{ID: "upper", Function: "upper", After: []string{"split"}, Map: true},
+			{ID: "count", Function: "count", After: []string{"upper"}},
+		}}
+
+		Convey("A fan-out/fan-in workflow should map over each line...", func() {
+			wf, err := engine.Submit(fanOut, []byte("a b c\n"), nil)
+			So(err, ShouldBeNil)
+			engine.Wait()
+
+			wf, err = store.RetrieveWorkflow(wf.Id)
+			So(err, ShouldBeNil)
+			described, err := engine.Describe(wf)
+			So(err, ShouldBeNil)
+			So(described.Status, ShouldEqual, api.WorkflowSucceeded)
+			So(described.Finished, ShouldNotBeNil)
+			So(described.Nodes, ShouldHaveLength, 3)
+			So(string(described.Nodes[1].Output), ShouldEqual, "A\nB\nC\n")
+			So(described.Nodes[1].Tasks[api.WorkflowSucceeded], ShouldEqual, 3)
+			So(string(described.Nodes[2].Output), ShouldEqual, "3")
+			So(functions.calls["upper"], ShouldEqual, 3)
+		})
+
+		Convey("Nodes after a failed node should be skipped...", func() {
+			def := api.WorkflowDefinition{Nodes: []api.WorkflowNode{
+				{ID: "first", Function: "fail"},
+				{ID: "second", Function: "upper", After: []string{"first"}},
+				{ID: "other", Function: "upper"},
+			}}
+			wf, err := engine.Submit(def, []byte("x"), nil)
+			So(err, ShouldBeNil)
+			engine.Wait()
+
+			wf, _ = store.RetrieveWorkflow(wf.Id)
+			described, err := engine.Describe(wf)
+			So(err, ShouldBeNil)
+			So(described.Status, ShouldEqual, api.WorkflowFailed)
+			So(described.Nodes[0].Status, ShouldEqual, api.WorkflowFailed)
+			So(described.Nodes[0].Error, ShouldContainSubstring, "fail failed")
+			So(described.Nodes[1].Status, ShouldEqual, api.WorkflowSkipped)
+			So(described.Nodes[2].Status, ShouldEqual, api.WorkflowSucceeded)
+			So(functions.calls["upper"], ShouldEqual, 1)
+		})
+
+		Convey("An interrupted workflow should resume where it left off...", func() {
+			// Set up the state a restart would leave behind: split has
+			// finished, and one of upper's tasks has too
+			definition, _ := json.Marshal(fanOut)
+			wf, err := store.CreateWorkflow(&models.Workflow{
+				Id:         "interrupted",
+				Definition: string(definition),
+				Stdin:      []byte("a b\n"),
+				Status:     models.WorkflowRunning,
+			}, []string{"split", "upper", "count"})
+			So(err, ShouldBeNil)
+			So(store.UpdateWorkflowNode(&models.WorkflowNode{
+				WorkflowId: wf.Id, NodeId: "split", Status: models.WorkflowSucceeded, Output: []byte("a\nb\n"),
+			}), ShouldBeNil)
+			So(store.UpdateWorkflowNode(&models.WorkflowNode{
+				WorkflowId: wf.Id, NodeId: "upper", Status: models.WorkflowRunning,
+			}), ShouldBeNil)
+			So(store.CreateWorkflowTasks([]models.WorkflowTask{
+				{WorkflowId: wf.Id, NodeId: "upper", Index: 0, Input: []byte("a\n"), Status: models.WorkflowPending},
+				{WorkflowId: wf.Id, NodeId: "upper", Index: 1, Input: []byte("b\n"), Status: models.WorkflowPending},
+			}), ShouldBeNil)
+			So(store.UpdateWorkflowTask(&models.WorkflowTask{
+				WorkflowId: wf.Id, NodeId: "upper", Index: 0, Status: models.WorkflowSucceeded, Output: []byte("A\n"),
+			}), ShouldBeNil)
+
+			So(engine.Resume(), ShouldBeNil)
+			engine.Wait()
+
+			So(functions.calls["split"], ShouldEqual, 0)
+			So(functions.calls["upper"], ShouldEqual, 1)
+			wf, _ = store.RetrieveWorkflow(wf.Id)
+			described, err := engine.Describe(wf)
+			So(err, ShouldBeNil)
+			So(described.Status, ShouldEqual, api.WorkflowSucceeded)
+			So(string(described.Nodes[1].Output), ShouldEqual, "A\nB\n")
+			So(string(described.Nodes[2].Output), ShouldEqual, "2")
+
+			unfinished, err := store.RetrieveUnfinishedWorkflows()
+			So(err, ShouldBeNil)
+			So(unfinished, ShouldBeEmpty)
+		})
+	})
+}